@@ -27,20 +27,30 @@ func initLogger(config *rtmp.Config) (*logrus.Logger, error) {
 }
 
 func main() {
+	config := &rtmp.Config{ChunkSize: rtmp.DefaultChunkSize} //TODO
+
+	logger, err := initLogger(config)
+	if err != nil {
+		panic(err)
+	}
+	config.Logger = logger
+	if err := config.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	server := rtmp.NewService(config)
+	health := server.HealthHandler()
+	http.Handle("/healthz", health)
+	http.Handle("/readyz", health)
+	http.Handle("/live/", server.WebSocketFLVHandler()) // ws://host:6060/live/{stream}.flv
+	http.Handle("/thumb/", http.StripPrefix("/thumb", server.ThumbnailHandler()))
+
 	go func() {
-		_ = http.ListenAndServe(":6060", nil) //pprof
+		_ = http.ListenAndServe(":6060", nil) //pprof, health probes
 	}()
 
 	go func() {
-		config := &rtmp.Config{} //TODO
-
-		logger, err := initLogger(config)
-		if err != nil {
-			panic(err)
-		}
-		config.Logger = logger
-
-		if err := rtmp.ListenAndServe("tcp", ":1935", config); err != nil {
+		if err := server.ListenAndServe("tcp", ":1935"); err != nil {
 			logrus.Fatal(err)
 		}
 	}()
@@ -0,0 +1,79 @@
+package gcdweightroundrobin
+
+import (
+	"errors"
+	"strconv"
+)
+
+// nginx classic weighted round robin, step current weight down by gcd of all weights
+type GcdWeightRoundRobinBalance struct {
+	allNodes []*WeightNode
+
+	curIdx    int // last selected node index
+	curWeight int // current weight threshold
+	maxWeight int // max weight of all nodes
+	gcdWeight int // gcd of all weights
+}
+
+type WeightNode struct {
+	node   string
+	weight int
+}
+
+// add node
+func (wrr *GcdWeightRoundRobinBalance) Add(params ...string) error {
+	if len(params) != 2 {
+		return errors.New("param len need 2")
+	}
+
+	parInt, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	if parInt <= 0 {
+		return errors.New("weight must > 0")
+	}
+
+	node := &WeightNode{node: params[0], weight: int(parInt)}
+	wrr.allNodes = append(wrr.allNodes, node)
+
+	if node.weight > wrr.maxWeight {
+		wrr.maxWeight = node.weight
+	}
+	wrr.gcdWeight = gcd(wrr.gcdWeight, node.weight)
+
+	// restart the round
+	wrr.curIdx = -1
+	wrr.curWeight = 0
+
+	return nil
+}
+
+// get node
+func (wrr *GcdWeightRoundRobinBalance) Get(...string) (string, error) {
+	lens := len(wrr.allNodes)
+	if lens == 0 {
+		return "", errors.New("list is empty")
+	}
+
+	for {
+		wrr.curIdx = (wrr.curIdx + 1) % lens
+		if wrr.curIdx == 0 {
+			wrr.curWeight -= wrr.gcdWeight
+			if wrr.curWeight <= 0 {
+				wrr.curWeight = wrr.maxWeight
+			}
+		}
+
+		if curNode := wrr.allNodes[wrr.curIdx]; curNode.weight >= wrr.curWeight {
+			return curNode.node, nil
+		}
+	}
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
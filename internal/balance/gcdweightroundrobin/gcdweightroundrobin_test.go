@@ -0,0 +1,49 @@
+package gcdweightroundrobin
+
+import "testing"
+
+func TestGcdWRR(t *testing.T) {
+	wrr := &GcdWeightRoundRobinBalance{}
+
+	_ = wrr.Add("a", "5")
+	_ = wrr.Add("b", "1")
+	_ = wrr.Add("c", "1")
+
+	expected := []string{"a", "a", "a", "a", "a", "b", "c"}
+	for round := 0; round < 2; round++ {
+		for i, want := range expected {
+			node, err := wrr.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node != want {
+				t.Fatalf("round %d pick %d: got %s; want %s", round, i, node, want)
+			}
+		}
+	}
+}
+
+func TestGcdWRRNormalize(t *testing.T) {
+	wrr := &GcdWeightRoundRobinBalance{}
+
+	_ = wrr.Add("a", "1000")
+	_ = wrr.Add("b", "500")
+
+	if wrr.gcdWeight != 500 {
+		t.Fatalf("got gcd %d; want 500", wrr.gcdWeight)
+	}
+
+	expected := []string{"a", "a", "b"}
+	for i, want := range expected {
+		if node, _ := wrr.Get(); node != want {
+			t.Fatalf("pick %d: got %s; want %s", i, node, want)
+		}
+	}
+}
+
+func TestGcdWRREmpty(t *testing.T) {
+	wrr := &GcdWeightRoundRobinBalance{}
+	if _, err := wrr.Get(); err == nil {
+		t.Fatal("expected error on empty list")
+	}
+}
@@ -2,6 +2,7 @@ package balance
 
 import (
 	"playground/internal/balance/consitenthash"
+	"playground/internal/balance/gcdweightroundrobin"
 	"playground/internal/balance/random"
 	"playground/internal/balance/roundrobin"
 	"playground/internal/balance/weightroundrobin"
@@ -17,6 +18,7 @@ const (
 	RoundRobin
 	WeightRoundRobin
 	ConsistentHash
+	GcdWeightRoundRobin
 )
 
 func NewLoadBalance(lbType int) LoadBalance {
@@ -29,6 +31,8 @@ func NewLoadBalance(lbType int) LoadBalance {
 		return new(weightroundrobin.WeightRoundRobinBalance)
 	case ConsistentHash:
 		return consitenthash.NewConsistentHash(nil)
+	case GcdWeightRoundRobin:
+		return new(gcdweightroundrobin.GcdWeightRoundRobinBalance)
 	default:
 		return new(roundrobin.RoundRobinBalance)
 	}
@@ -49,6 +49,19 @@ func TestWRR(t *testing.T) {
 	}
 }
 
+func TestGcdWRR(t *testing.T) {
+	lb := NewLoadBalance(GcdWeightRoundRobin)
+
+	_ = lb.Add("1.1.1.1", "5")
+	_ = lb.Add("2.2.2.2", "1")
+	_ = lb.Add("3.3.3.3", "1")
+
+	for i := 0; i < 7; i++ {
+		node, _ := lb.Get()
+		t.Log(node)
+	}
+}
+
 func TestCHash(t *testing.T) {
 	lb := NewLoadBalance(ConsistentHash)
 
@@ -0,0 +1,267 @@
+// Package websocket is a minimal server side RFC 6455 implementation, enough for pushing
+// binary media frames to browser players
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+const (
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	maxControlPayload = 125
+	maxMessageSize    = 64 << 10 // players send nothing but control frames, keep it small
+)
+
+var (
+	ErrBadHandshake    = errors.New("websocket: bad handshake")
+	ErrProtocol        = errors.New("websocket: protocol error")
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+)
+
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	writeMux     sync.Mutex    // read loop answers ping concurrently with data writes
+	writeTimeout time.Duration // of every frame written, 0: none
+	closeOnce    sync.Once
+}
+
+// AcceptKey computes Sec-WebSocket-Accept of the client's Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Upgrade hijacks the http connection and completes the opening handshake,
+// on failure an http error has been replied
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-Websocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-Websocket-Version") != "13" || key == "" {
+		http.Error(w, "bad websocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "websocket: hijack")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "websocket: write handshake")
+	}
+
+	return &Conn{conn: conn, br: brw.Reader}, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetWriteTimeout bounds every frame written from now on, a client not reading fails the write
+// instead of blocking it, 0 disables it
+func (c *Conn) SetWriteTimeout(d time.Duration) {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	c.writeTimeout = d
+}
+
+// Write sends p as one binary message, so Conn may be used as an io.Writer
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(OpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteMessage sends one unfragmented, unmasked (server to client) frame
+func (c *Conn) WriteMessage(opcode byte, payload []byte) error {
+	var hdr [10]byte
+	hdr[0] = 0x80 | opcode // FIN
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	if c.writeTimeout > 0 {
+		if err := c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	if _, err := c.conn.Write(hdr[:n]); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// ReadMessage returns the next data message. Ping is answered with pong, pong is ignored,
+// close is echoed and reported as io.EOF.
+func (c *Conn) ReadMessage() (opcode byte, payload []byte, err error) {
+	var msgOp byte
+	var msg []byte
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			if len(data) >= 2 { // echo status code
+				data = data[:2]
+			}
+			_ = c.WriteMessage(OpClose, data)
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if msgOp == 0 {
+				return 0, nil, ErrProtocol
+			}
+		case OpText, OpBinary:
+			if msgOp != 0 {
+				return 0, nil, ErrProtocol
+			}
+			msgOp = op
+		default:
+			return 0, nil, ErrProtocol
+		}
+
+		if len(msg)+len(data) > maxMessageSize {
+			return 0, nil, ErrMessageTooLarge
+		}
+		msg = append(msg, data...)
+		if fin {
+			return msgOp, msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.br, hdr[:]); err != nil {
+		return
+	}
+
+	fin = hdr[0]&0x80 != 0
+	opcode = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	length := uint64(hdr[1] & 0x7f)
+
+	if !masked || hdr[0]&0x70 != 0 { // client frames must be masked, no extension negotiated
+		err = ErrProtocol
+		return
+	}
+
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	if opcode >= OpClose && (length > maxControlPayload || !fin) {
+		err = ErrProtocol
+		return
+	}
+	if length > maxMessageSize {
+		err = ErrMessageTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
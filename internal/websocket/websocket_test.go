@@ -0,0 +1,183 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestConn returns a Conn over one end of a pipe and the client end
+func newTestConn(t *testing.T) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return &Conn{conn: server, br: bufio.NewReader(server)}, client
+}
+
+// maskedFrame encodes a client frame, masked as clients must
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	b := []byte{opcode, 0x80}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch l := len(payload); {
+	case l <= 125:
+		b[1] |= byte(l)
+	case l <= 0xffff:
+		b[1] |= 126
+		b = append(b, byte(l>>8), byte(l))
+	default:
+		b[1] |= 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(l))
+		b = append(b, ext[:]...)
+	}
+
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// readFrame reads one unmasked server frame
+func readFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0]&0x80 == 0 || hdr[1]&0x80 != 0 {
+		t.Fatalf("got header % x; want FIN set and no mask", hdr)
+	}
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0] & 0x0f, payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the sample of RFC 6455 1.3
+	if key := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s; want s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", key)
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} { // 7 bit, 16 bit and 64 bit lengths
+		c, client := newTestConn(t)
+		payload := bytes.Repeat([]byte{0xab}, size)
+		go func() { _, _ = c.Write(payload) }()
+
+		op, got := readFrame(t, client)
+		if op != OpBinary || !bytes.Equal(got, payload) {
+			t.Fatalf("size %d: got op %d %d bytes; want binary %d bytes", size, op, len(got), size)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	c, client := newTestConn(t)
+	go func() {
+		for _, b := range [][]byte{
+			maskedFrame(false, OpText, []byte("hel")),
+			maskedFrame(true, OpPing, []byte("ping")), // control frames may come between fragments
+			maskedFrame(true, OpContinuation, []byte("lo")),
+			maskedFrame(true, OpBinary, bytes.Repeat([]byte{0x01}, 300)),
+			maskedFrame(true, OpClose, []byte{0x03, 0xe8, 'b', 'y', 'e'}),
+		} {
+			if _, err := client.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	frames := make(chan []byte, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			op, payload := readFrame(t, client)
+			frames <- append([]byte{op}, payload...)
+		}
+	}()
+
+	if op, msg, err := c.ReadMessage(); err != nil || op != OpText || string(msg) != "hello" {
+		t.Fatalf("got %d %q %v; want text \"hello\" reassembled", op, msg, err)
+	}
+	if pong := <-frames; pong[0] != OpPong || string(pong[1:]) != "ping" {
+		t.Fatalf("got frame op %d %q; want pong \"ping\"", pong[0], pong[1:])
+	}
+	if op, msg, err := c.ReadMessage(); err != nil || op != OpBinary || len(msg) != 300 {
+		t.Fatalf("got %d %d bytes %v; want binary 300 bytes", op, len(msg), err)
+	}
+	if _, _, err := c.ReadMessage(); err != io.EOF {
+		t.Fatalf("got %v on close; want io.EOF", err)
+	}
+	if echo := <-frames; echo[0] != OpClose || !bytes.Equal(echo[1:], []byte{0x03, 0xe8}) {
+		t.Fatalf("got frame op %d % x; want close echoing status 1000", echo[0], echo[1:])
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	unmasked := maskedFrame(true, OpBinary, []byte("data"))
+	unmasked[1] &^= 0x80
+
+	var tests = []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"unmasked", unmasked, ErrProtocol},
+		{"continuation first", maskedFrame(true, OpContinuation, []byte("data")), ErrProtocol},
+		{"fragmented ping", maskedFrame(false, OpPing, nil), ErrProtocol},
+		{"long ping", maskedFrame(true, OpPing, make([]byte, 126)), ErrProtocol},
+		{"unknown opcode", maskedFrame(true, 0x3, nil), ErrProtocol},
+		{"too large", maskedFrame(true, OpBinary, make([]byte, maxMessageSize+1)), ErrMessageTooLarge},
+	}
+	for _, tt := range tests {
+		c, client := newTestConn(t)
+		go func(b []byte) { _, _ = client.Write(b) }(tt.frame)
+		if _, _, err := c.ReadMessage(); err != tt.err {
+			t.Fatalf("%s: got %v; want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	c, _ := newTestConn(t) // the client never reads
+	c.SetWriteTimeout(20 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- c.WriteMessage(OpBinary, []byte("stalled")) }()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("got %v; want a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write blocked on a client not reading")
+	}
+}
@@ -1,8 +1,13 @@
 package av
 
 const (
-	TagAudio = 0x08
-	TagVideo = 0x09
+	TagAudio          = 0x08
+	TagVideo          = 0x09
+	TagScriptDataAMF0 = 0x12
+)
+
+const (
+	VIDEO_H264 = 7
 )
 
 const (
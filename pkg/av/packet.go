@@ -20,10 +20,16 @@ type Packet struct {
 	Header PacketHeader
 	Data   []byte
 
-	TimeStamp uint32 // dts
-	StreamID  uint32
+	TimeStamp       uint32 // dts
+	CompositionTime int32  // pts - dts, video only
+	StreamID        uint32
 
 	IsAudio    bool
 	IsVideo    bool
 	IsMetaData bool
+
+	refs   int32 // atomic, references of a pooled packet, see NewPacket
+	pooled bool
+	body   []byte       // buffer Data is in, see PoolData
+	free   func([]byte) // gets body back with the last Release
 }
\ No newline at end of file
@@ -0,0 +1,77 @@
+package av
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var packetPool = sync.Pool{New: func() interface{} { return new(Packet) }}
+
+/*
+ * NewPacket returns a packet from the pool holding one reference, the caller's. Ownership contract:
+ *   1. every holder of a pooled packet beyond a function call (queue, cache) takes its own reference
+ *      with Retain before handing it on and drops it with Release once done.
+ *   2. the packet goes back to the pool when the last reference is released, it must not be touched
+ *      afterwards. Data is never reused, holders may keep referencing it, unless in a buffer of PoolData.
+ * Packets not from NewPacket, e.g. &Packet{}, are not reference counted: Retain and Release are no-ops.
+ */
+func NewPacket() *Packet {
+	p := packetPool.Get().(*Packet)
+	p.pooled = true
+	p.refs = 1
+	return p
+}
+
+func (p *Packet) Retain() {
+	if p.pooled {
+		atomic.AddInt32(&p.refs, 1)
+	}
+}
+
+func (p *Packet) Release() {
+	if !p.pooled {
+		return
+	}
+
+	switch refs := atomic.AddInt32(&p.refs, -1); {
+	case refs == 0:
+		if p.free != nil {
+			p.free(p.body)
+		}
+		*p = Packet{}
+		packetPool.Put(p)
+	case refs < 0:
+		panic("av: packet released more than retained")
+	}
+}
+
+// PoolData has body, the buffer Data is in, go back to free with the last Release of p, e.g. to a ring
+// buffer. Data may be rewritten meanwhile, body is what goes back. Holders of Data must hold a reference
+// of p as long as they read it, p must be from NewPacket.
+func (p *Packet) PoolData(body []byte, free func([]byte)) {
+	p.body, p.free = body, free
+}
+
+// HasPooledData reports Data in a buffer of PoolData, it's reused once p is released
+func (p *Packet) HasPooledData() bool {
+	return p.free != nil
+}
+
+// Copy returns a copy of p outside the pool, e.g. to restamp a cached packet. Data in a buffer of PoolData
+// is copied, the copy may outlive p.
+func (p *Packet) Copy() *Packet {
+	data := p.Data
+	if p.free != nil {
+		data = append([]byte(nil), p.Data...)
+	}
+	return &Packet{
+		Header:          p.Header,
+		Data:            data,
+		TimeStamp:       p.TimeStamp,
+		CompositionTime: p.CompositionTime,
+		StreamID:        p.StreamID,
+		IsAudio:         p.IsAudio,
+		IsVideo:         p.IsVideo,
+		IsMetaData:      p.IsMetaData,
+	}
+}
@@ -0,0 +1,101 @@
+package av
+
+import (
+	"testing"
+)
+
+func TestPacketRetainRelease(t *testing.T) {
+	p := NewPacket()
+	p.Data = []byte{1, 2, 3}
+	p.Retain()
+
+	p.Release()
+	if p.Data == nil {
+		t.Fatal("packet reset while still referenced")
+	}
+
+	p.Release()
+	if p.Data != nil || p.pooled || p.refs != 0 {
+		t.Fatalf("packet not reset on last release: %+v", p)
+	}
+}
+
+func TestPacketReleaseTooMany(t *testing.T) {
+	p := NewPacket()
+	p.Retain()
+	p.Release()
+	p.Release()
+
+	p.pooled = true // what a stale holder would see if the pool handed it out again
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on extra release")
+		}
+	}()
+	p.Release()
+}
+
+func TestUnpooledPacket(t *testing.T) {
+	p := &Packet{Data: []byte{1}}
+	p.Retain()
+	p.Release()
+	p.Release()
+	if p.Data == nil {
+		t.Fatal("unpooled packet must not be reset")
+	}
+
+	c := NewPacket()
+	c.TimeStamp = 40
+	cp := c.Copy()
+	c.Release()
+	if cp.pooled || cp.TimeStamp != 40 {
+		t.Fatalf("copy: %+v", cp)
+	}
+}
+
+var sinkPacket *Packet
+
+func BenchmarkPacketNew(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkPacket = new(Packet)
+		sinkPacket.TimeStamp = uint32(i)
+	}
+}
+
+func BenchmarkPacketPool(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := NewPacket()
+		p.TimeStamp = uint32(i)
+		p.Retain() // a subscriber queue
+		p.Release()
+		p.Release()
+	}
+}
+
+func TestPooledData(t *testing.T) {
+	var freed [][]byte
+	free := func(b []byte) { freed = append(freed, b) }
+
+	body := []byte{0, 1, 2, 3}
+	p := NewPacket()
+	p.Data = body[1:] // e.g. a format byte stripped
+	p.PoolData(body, free)
+	cp := p.Copy()
+	p.Retain()
+
+	p.Release()
+	if len(freed) != 0 {
+		t.Fatal("body freed while still referenced")
+	}
+	p.Release()
+	if len(freed) != 1 || &freed[0][0] != &body[0] || len(freed[0]) != len(body) {
+		t.Fatalf("got freed %v; want the whole body once", freed)
+	}
+
+	body[1] = 9 // reused by the pool
+	if cp.Data[0] != 1 || cp.HasPooledData() {
+		t.Fatalf("got copy %v; want its own data", cp.Data)
+	}
+}
@@ -0,0 +1,321 @@
+package dash
+
+import (
+	"encoding/binary"
+)
+
+// box builds an ISO BMFF box, size is patched on close
+type box struct {
+	b     []byte
+	stack []int // start offsets of open boxes
+}
+
+func (w *box) open(typ string) {
+	w.stack = append(w.stack, len(w.b))
+	w.u32(0)
+	w.b = append(w.b, typ...)
+}
+
+func (w *box) openFull(typ string, version uint8, flags uint32) {
+	w.open(typ)
+	w.u32(uint32(version)<<24 | flags)
+}
+
+func (w *box) close() {
+	start := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.b[start:], uint32(len(w.b)-start))
+}
+
+func (w *box) u8(v uint8) { w.b = append(w.b, v) }
+
+func (w *box) u16(v uint16) { w.b = append(w.b, byte(v>>8), byte(v)) }
+
+func (w *box) u24(v uint32) { w.b = append(w.b, byte(v>>16), byte(v>>8), byte(v)) }
+
+func (w *box) u32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *box) u64(v uint64) {
+	w.u32(uint32(v >> 32))
+	w.u32(uint32(v))
+}
+
+func (w *box) bytes(b []byte) { w.b = append(w.b, b...) }
+
+func (w *box) zeros(n int) { w.b = append(w.b, make([]byte, n)...) }
+
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func (w *box) matrix() {
+	for _, v := range unityMatrix {
+		w.u32(v)
+	}
+}
+
+// sample is one access unit of a track
+type sample struct {
+	dts      uint64 // in timescale
+	duration uint32
+	cts      int32 // pts - dts
+	sync     bool
+	data     []byte
+}
+
+const (
+	sampleFlagsSync    = 0x02000000 // sample_depends_on=2: I frame
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample
+)
+
+// initSegment builds ftyp + moov of tracks, every track at timescale
+func initSegment(tracks []*track) []byte {
+	w := &box{}
+
+	w.open("ftyp")
+	w.bytes([]byte("iso6"))
+	w.u32(0)
+	w.bytes([]byte("iso6dashmp41"))
+	w.close()
+
+	w.open("moov")
+
+	w.openFull("mvhd", 0, 0)
+	w.u32(0) // creation_time
+	w.u32(0) // modification_time
+	w.u32(timescale)
+	w.u32(0)          // duration, unknown for live
+	w.u32(0x00010000) // rate 1.0
+	w.u16(0x0100)     // volume 1.0
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24) // pre_defined
+	w.u32(uint32(len(tracks) + 1))
+	w.close()
+
+	for _, t := range tracks {
+		t.writeTrak(w)
+	}
+
+	w.open("mvex")
+	for _, t := range tracks {
+		w.openFull("trex", 0, 0)
+		w.u32(t.id)
+		w.u32(1) // default_sample_description_index
+		w.u32(0) // default_sample_duration
+		w.u32(0) // default_sample_size
+		w.u32(0) // default_sample_flags
+		w.close()
+	}
+	w.close()
+
+	w.close() // moov
+	return w.b
+}
+
+func (t *track) writeTrak(w *box) {
+	w.open("trak")
+
+	w.openFull("tkhd", 0, 0x3) // enabled, in movie
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.id)
+	w.u32(0)
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate_group
+	if t.kind == kindAudio {
+		w.u16(0x0100)
+	} else {
+		w.u16(0)
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(t.width) << 16)
+	w.u32(uint32(t.height) << 16)
+	w.close()
+
+	w.open("mdia")
+
+	w.openFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(timescale)
+	w.u32(0)
+	w.u16(0x55c4) // und
+	w.u16(0)
+	w.close()
+
+	w.openFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.kind == kindAudio {
+		w.bytes([]byte("soun"))
+	} else {
+		w.bytes([]byte("vide"))
+	}
+	w.zeros(12)
+	w.bytes([]byte(t.kind + "\x00"))
+	w.close()
+
+	w.open("minf")
+	if t.kind == kindAudio {
+		w.openFull("smhd", 0, 0)
+		w.u32(0)
+		w.close()
+	} else {
+		w.openFull("vmhd", 0, 1)
+		w.zeros(8)
+		w.close()
+	}
+
+	w.open("dinf")
+	w.openFull("dref", 0, 0)
+	w.u32(1)
+	w.openFull("url ", 0, 1) // self contained
+	w.close()
+	w.close()
+	w.close()
+
+	w.open("stbl")
+	w.openFull("stsd", 0, 0)
+	w.u32(1)
+	if t.kind == kindAudio {
+		t.writeMp4a(w)
+	} else {
+		t.writeAvc1(w)
+	}
+	w.close()
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		w.openFull(typ, 0, 0)
+		w.u32(0)
+		w.close()
+	}
+	w.openFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.close()
+	w.close() // stbl
+
+	w.close() // minf
+	w.close() // mdia
+	w.close() // trak
+}
+
+func (t *track) writeAvc1(w *box) {
+	w.open("avc1")
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(16)
+	w.u16(uint16(t.width))
+	w.u16(uint16(t.height))
+	w.u32(0x00480000) // 72 dpi
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1) // frame_count
+	w.zeros(32)
+	w.u16(0x0018) // depth
+	w.u16(0xffff) // pre_defined -1
+	w.open("avcC")
+	w.bytes(t.config)
+	w.close()
+	w.close()
+}
+
+func (t *track) writeMp4a(w *box) {
+	w.open("mp4a")
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(8)
+	w.u16(uint16(t.channels))
+	w.u16(16) // samplesize
+	w.u32(0)
+	w.u32(uint32(t.sampleRate) << 16)
+
+	w.openFull("esds", 0, 0)
+	asc := t.config
+	w.u8(0x03) // ES_Descriptor
+	w.u8(uint8(3 + 2 + 13 + 2 + len(asc) + 3))
+	w.u16(uint16(t.id))
+	w.u8(0)
+	w.u8(0x04) // DecoderConfigDescriptor
+	w.u8(uint8(13 + 2 + len(asc)))
+	w.u8(0x40) // Audio ISO/IEC 14496-3
+	w.u8(0x15) // AudioStream
+	w.u24(0)   // bufferSizeDB
+	w.u32(0)   // maxBitrate
+	w.u32(0)   // avgBitrate
+	w.u8(0x05) // DecoderSpecificInfo
+	w.u8(uint8(len(asc)))
+	w.bytes(asc)
+	w.u8(0x06) // SLConfigDescriptor
+	w.u8(1)
+	w.u8(2)
+	w.close()
+
+	w.close()
+}
+
+// mediaSegment builds styp + moof + mdat of samples of track t
+func mediaSegment(seq uint32, t *track, samples []sample) []byte {
+	w := &box{}
+
+	w.open("styp")
+	w.bytes([]byte("msdh"))
+	w.u32(0)
+	w.bytes([]byte("msdhmsix"))
+	w.close()
+
+	moofStart := len(w.b)
+	w.open("moof")
+
+	w.openFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.close()
+
+	w.open("traf")
+
+	w.openFull("tfhd", 0, 0x020000) // default-base-is-moof
+	w.u32(t.id)
+	w.close()
+
+	w.openFull("tfdt", 1, 0)
+	w.u64(samples[0].dts)
+	w.close()
+
+	flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400) // data offset, duration, size, flags
+	if t.kind == kindVideo {
+		flags |= 0x000800 // composition time offset
+	}
+	w.openFull("trun", 1, flags)
+	w.u32(uint32(len(samples)))
+	dataOffsetPos := len(w.b)
+	w.u32(0)
+	for _, s := range samples {
+		w.u32(s.duration)
+		w.u32(uint32(len(s.data)))
+		if s.sync {
+			w.u32(sampleFlagsSync)
+		} else {
+			w.u32(sampleFlagsNonSync)
+		}
+		if t.kind == kindVideo {
+			w.u32(uint32(s.cts))
+		}
+	}
+	w.close() // trun
+
+	w.close() // traf
+	w.close() // moof
+
+	// data offset from moof start to the first byte of mdat payload
+	binary.BigEndian.PutUint32(w.b[dataOffsetPos:], uint32(len(w.b)-moofStart+8))
+
+	w.open("mdat")
+	for _, s := range samples {
+		w.bytes(s.data)
+	}
+	w.close()
+
+	return w.b
+}
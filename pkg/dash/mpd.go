@@ -0,0 +1,120 @@
+package dash
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MPD returns the live manifest, false before the first segment is complete
+func (p *Packager) MPD() ([]byte, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	tracks := p.tracks()
+	if len(tracks) == 0 {
+		return nil, false
+	}
+
+	segDur := p.config.SegmentDuration
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`+
+		` availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s" timeShiftBufferDepth="%s" suggestedPresentationDelay="%s">`+"\n",
+		p.availabilityStart.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339),
+		isoDuration(segDur), isoDuration(segDur), isoDuration(segDur*time.Duration(p.config.Window)), isoDuration(2*segDur))
+	b.WriteString(`  <Period id="0" start="PT0S">` + "\n")
+
+	for i, t := range tracks {
+		fmt.Fprintf(&b, `    <AdaptationSet id="%d" contentType="%s" mimeType="%s/mp4" segmentAlignment="true" startWithSAP="1">`+"\n", i, t.kind, t.kind)
+		if t.kind == kindVideo {
+			fmt.Fprintf(&b, `      <Representation id="%s" codecs="%s" width="%d" height="%d" bandwidth="%d">`+"\n", t.kind, t.codecs, t.width, t.height, t.bandwidth())
+		} else {
+			fmt.Fprintf(&b, `      <Representation id="%s" codecs="%s" audioSamplingRate="%d" bandwidth="%d">`+"\n", t.kind, t.codecs, t.sampleRate, t.bandwidth())
+			fmt.Fprintf(&b, `        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n", t.channels)
+		}
+		fmt.Fprintf(&b, `        <SegmentTemplate timescale="%d" initialization="%s/init.mp4" media="%s/$Number$.m4s" startNumber="%d">`+"\n",
+			timescale, t.kind, t.kind, t.segments[0].number)
+		b.WriteString(`          <SegmentTimeline>` + "\n")
+		for _, seg := range t.segments {
+			fmt.Fprintf(&b, `            <S t="%d" d="%d"/>`+"\n", seg.start, seg.duration)
+		}
+		b.WriteString(`          </SegmentTimeline>` + "\n")
+		b.WriteString(`        </SegmentTemplate>` + "\n")
+		b.WriteString(`      </Representation>` + "\n")
+		b.WriteString(`    </AdaptationSet>` + "\n")
+	}
+
+	b.WriteString(`  </Period>` + "\n")
+	b.WriteString(`</MPD>` + "\n")
+
+	return []byte(b.String()), true
+}
+
+// isoDuration formats d as ISO 8601 duration in seconds, e.g. PT2S, PT0.5S
+func isoDuration(d time.Duration) string {
+	return "PT" + strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S"
+}
+
+// ServeFile serves name relative to the stream: manifest.mpd, {video,audio}/init.mp4, {video,audio}/{number}.m4s
+func (p *Packager) ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "manifest.mpd" {
+		mpd, ok := p.MPD()
+		if !ok {
+			http.Error(w, "stream not ready", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(mpd)
+		return
+	}
+
+	idx := strings.Index(name, "/")
+	if idx < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	kind, file := name[:idx], name[idx+1:]
+
+	data, ok := p.file(kind, file)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", kind+"/mp4")
+	_, _ = w.Write(data)
+}
+
+func (p *Packager) file(kind, file string) ([]byte, bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var t *track
+	switch kind {
+	case kindVideo:
+		t = p.video
+	case kindAudio:
+		t = p.audio
+	}
+	if t == nil {
+		return nil, false
+	}
+
+	if file == "init.mp4" {
+		return t.init, true
+	}
+
+	number, err := strconv.ParseUint(strings.TrimSuffix(file, ".m4s"), 10, 32)
+	if err != nil || !strings.HasSuffix(file, ".m4s") {
+		return nil, false
+	}
+	for _, seg := range t.segments {
+		if seg.number == uint32(number) {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,246 @@
+// Package dash packages av packets as fragmented MP4 segments and serves them with a live MPD manifest
+package dash
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+const timescale = 1000 // av packet timestamps are in ms
+
+const (
+	kindVideo = "video"
+	kindAudio = "audio"
+)
+
+const (
+	defaultSegmentDuration = 2 * time.Second
+	defaultWindow          = 6
+)
+
+type Config struct {
+	SegmentDuration time.Duration // segments are cut at the first video keyframe after it, default 2s
+	Window          int           // segments kept and listed in manifest, default 6
+}
+
+type segment struct {
+	number   uint32
+	start    uint64 // in timescale
+	duration uint64
+	data     []byte
+}
+
+type track struct {
+	id     uint32
+	kind   string
+	codecs string // RFC 6381, e.g. avc1.42c01f, mp4a.40.2
+	config []byte // AVCDecoderConfigurationRecord or AudioSpecificConfig
+	init   []byte // init segment of config
+
+	width, height        int
+	sampleRate, channels int
+
+	pending  []sample
+	segments []segment
+}
+
+// Packager is fed by one goroutine with WritePacket and read concurrently by http handlers
+type Packager struct {
+	config Config
+
+	mux          sync.Mutex
+	video, audio *track
+
+	started           bool
+	baseTimeStamp     uint32    // timestamp of the first sample, timeline starts at 0 from it
+	availabilityStart time.Time // wall time of the first sample
+	segStart          uint64    // start of the segment being built
+	number            uint32    // number of the segment being built
+}
+
+func NewPackager(config Config) *Packager {
+	if config.SegmentDuration <= 0 {
+		config.SegmentDuration = defaultSegmentDuration
+	}
+	if config.Window <= 0 {
+		config.Window = defaultWindow
+	}
+
+	return &Packager{config: config, number: 1}
+}
+
+// WritePacket takes sequence headers as codec config and media as samples, metadata is ignored
+func (p *Packager) WritePacket(pkt *av.Packet) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if !ok || vh.CodecID() != av.VIDEO_H264 {
+			return nil
+		}
+		if vh.IsSeq() {
+			return p.setVideoConfig(pkt.Data)
+		}
+		if p.video == nil || len(pkt.Data) <= 5 {
+			return nil
+		}
+		p.writeSample(p.video, pkt.TimeStamp, sample{cts: pkt.CompositionTime, sync: vh.IsKeyFrame(), data: pkt.Data[5:]})
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if !ok || ah.SoundFormat() != av.SOUND_AAC {
+			return nil
+		}
+		if ah.AACPacketType() == av.AAC_SEQHDR {
+			return p.setAudioConfig(pkt.Data)
+		}
+		if p.audio == nil || len(pkt.Data) <= 2 {
+			return nil
+		}
+		p.writeSample(p.audio, pkt.TimeStamp, sample{sync: true, data: pkt.Data[2:]})
+	}
+
+	return nil
+}
+
+func (p *Packager) setVideoConfig(data []byte) error {
+	cfg, err := flv.ParseAVCSequenceHeader(data)
+	if err != nil {
+		return err
+	}
+
+	rec := data[5:]
+	p.video = &track{
+		id:     1,
+		kind:   kindVideo,
+		codecs: fmt.Sprintf("avc1.%02x%02x%02x", rec[1], rec[2], rec[3]),
+		config: append([]byte(nil), rec...),
+		width:  cfg.Width,
+		height: cfg.Height,
+	}
+	p.video.init = initSegment([]*track{p.video})
+
+	return nil
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func (p *Packager) setAudioConfig(data []byte) error {
+	asc := data[2:]
+	if len(asc) < 2 {
+		return fmt.Errorf("invalid AudioSpecificConfig len=%d", len(asc))
+	}
+
+	objectType := asc[0] >> 3
+	freqIndex := (asc[0]&0x07)<<1 | asc[1]>>7
+	if int(freqIndex) >= len(aacSampleRates) {
+		return fmt.Errorf("unsupported AAC sampling frequency index %d", freqIndex)
+	}
+
+	p.audio = &track{
+		id:         2,
+		kind:       kindAudio,
+		codecs:     fmt.Sprintf("mp4a.40.%d", objectType),
+		config:     append([]byte(nil), asc...),
+		sampleRate: aacSampleRates[freqIndex],
+		channels:   int(asc[1] >> 3 & 0x0f),
+	}
+	p.audio.init = initSegment([]*track{p.audio})
+
+	return nil
+}
+
+// writeSample appends s at timeStamp, a segment is cut before a video keyframe once it is long enough,
+// or on duration if there is no video
+func (p *Packager) writeSample(t *track, timeStamp uint32, s sample) {
+	if !p.started {
+		if p.video != nil && !(t == p.video && s.sync) { // segments start with a keyframe
+			return
+		}
+		p.started = true
+		p.baseTimeStamp = timeStamp
+		p.availabilityStart = time.Now()
+	}
+
+	if timeStamp < p.baseTimeStamp {
+		timeStamp = p.baseTimeStamp
+	}
+	s.dts = uint64(timeStamp - p.baseTimeStamp)
+
+	long := s.dts-p.segStart >= uint64(p.config.SegmentDuration/time.Millisecond)
+	if long && ((t == p.video && s.sync) || (p.video == nil && t == p.audio)) {
+		p.cut(s.dts)
+	}
+
+	if n := len(t.pending); n > 0 && s.dts > t.pending[n-1].dts {
+		t.pending[n-1].duration = uint32(s.dts - t.pending[n-1].dts)
+	}
+	t.pending = append(t.pending, s)
+}
+
+// cut closes the segment being built of every track at end
+func (p *Packager) cut(end uint64) {
+	for _, t := range []*track{p.video, p.audio} {
+		if t == nil || len(t.pending) == 0 {
+			continue
+		}
+
+		last := &t.pending[len(t.pending)-1]
+		if end > last.dts {
+			last.duration = uint32(end - last.dts)
+		} else if last.duration == 0 {
+			last.duration = t.defaultDuration()
+		}
+
+		seg := segment{number: p.number, start: t.pending[0].dts}
+		for _, s := range t.pending {
+			seg.duration += uint64(s.duration)
+		}
+		seg.data = mediaSegment(p.number, t, t.pending)
+
+		t.segments = append(t.segments, seg)
+		if len(t.segments) > p.config.Window {
+			t.segments = t.segments[len(t.segments)-p.config.Window:]
+		}
+		t.pending = nil
+	}
+
+	p.segStart = end
+	p.number++
+}
+
+// duration of a sample whose successor is unknown, one AAC frame or one 25fps video frame
+func (t *track) defaultDuration() uint32 {
+	if t.kind == kindAudio && t.sampleRate > 0 {
+		return uint32(1024 * timescale / t.sampleRate)
+	}
+	return timescale / 25
+}
+
+// bandwidth in bits per second over the segments in window
+func (t *track) bandwidth() uint64 {
+	var bytes, duration uint64
+	for _, seg := range t.segments {
+		bytes += uint64(len(seg.data))
+		duration += seg.duration
+	}
+	if duration == 0 {
+		return 1
+	}
+	return bytes * 8 * timescale / duration
+}
+
+func (p *Packager) tracks() []*track {
+	var tracks []*track
+	for _, t := range []*track{p.video, p.audio} {
+		if t != nil && len(t.segments) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
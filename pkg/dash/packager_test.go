@@ -0,0 +1,128 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+var (
+	testAVCSeq720p = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x0a, 0x67, 0x42, 0x00, 0x28, 0xec, 0xa0, 0x28, 0x02, 0xdc, 0x80, 0x01, 0x00, 0x04, 0x68, 0xee, 0x3c, 0x80}
+	testVideoKey   = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x65}
+	testVideoInter = []byte{0x27, 0x01, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01, 0x41} // cts 40
+	testAudioSeq   = []byte{0xaf, 0x00, 0x12, 0x10}
+	testAudioRaw   = []byte{0xaf, 0x01, 0x21, 0x22}
+)
+
+func newTestPacket(t *testing.T, isVideo bool, data []byte, timeStamp uint32) *av.Packet {
+	t.Helper()
+
+	pkt := &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, Data: data, TimeStamp: timeStamp}
+	if err := flv.NewDemuxer().DemuxHdr(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+// writeTestGOPs writes n GOPs of 1s, 25fps video and ~43fps audio, starting at base
+func writeTestGOPs(t *testing.T, p *Packager, base uint32, n int) {
+	pkts := []*av.Packet{newTestPacket(t, true, testAVCSeq720p, 0), newTestPacket(t, false, testAudioSeq, 0)}
+	for ts := uint32(0); ts < uint32(n)*1000; ts += 40 {
+		data := testVideoInter
+		if ts%1000 == 0 {
+			data = testVideoKey
+		}
+		pkts = append(pkts, newTestPacket(t, true, data, base+ts))
+		if ts%80 == 0 {
+			pkts = append(pkts, newTestPacket(t, false, testAudioRaw, base+ts+3))
+		}
+	}
+	pkts = append(pkts, newTestPacket(t, true, testVideoKey, base+uint32(n)*1000)) // closes the last GOP
+
+	for _, pkt := range pkts {
+		if err := p.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// boxTypes lists the types of top level boxes in b
+func boxTypes(t *testing.T, b []byte) []string {
+	var types []string
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header % x", b)
+		}
+		size := binary.BigEndian.Uint32(b)
+		if size < 8 || int(size) > len(b) {
+			t.Fatalf("invalid box size %d of %d bytes", size, len(b))
+		}
+		types = append(types, string(b[4:8]))
+		b = b[size:]
+	}
+	return types
+}
+
+func TestPackagerSegments(t *testing.T) {
+	p := NewPackager(Config{SegmentDuration: time.Second, Window: 2})
+	if _, ok := p.MPD(); ok {
+		t.Fatal("got manifest before the first segment")
+	}
+
+	writeTestGOPs(t, p, 5000, 3)
+
+	// window keeps the last 2 of 3 segments
+	if n := len(p.video.segments); n != 2 {
+		t.Fatalf("got %d video segments; want 2", n)
+	}
+	for i, seg := range p.video.segments {
+		if seg.number != uint32(i+2) || seg.start != uint64(i+1)*1000 || seg.duration != 1000 {
+			t.Fatalf("video segment %d: got number %d start %d duration %d", i, seg.number, seg.start, seg.duration)
+		}
+	}
+
+	if got := boxTypes(t, p.video.init); len(got) != 2 || got[0] != "ftyp" || got[1] != "moov" {
+		t.Fatalf("got init boxes %v; want [ftyp moov]", got)
+	}
+	for _, tr := range []*track{p.video, p.audio} {
+		got := boxTypes(t, tr.segments[0].data)
+		if len(got) != 3 || got[0] != "styp" || got[1] != "moof" || got[2] != "mdat" {
+			t.Fatalf("%s: got segment boxes %v; want [styp moof mdat]", tr.kind, got)
+		}
+	}
+
+	// 25 frames of 5 bytes each (flv video header stripped)
+	data := p.video.segments[0].data
+	mdat := data[bytes.LastIndex(data, []byte("mdat"))-4:]
+	if size := binary.BigEndian.Uint32(mdat); size != 8+25*5 {
+		t.Fatalf("got video mdat size %d; want %d", size, 8+25*5)
+	}
+
+	if !bytes.Contains(p.video.init, testAVCSeq720p[5:]) {
+		t.Fatal("init segment should carry AVCDecoderConfigurationRecord")
+	}
+	if p.audio.codecs != "mp4a.40.2" || p.audio.sampleRate != 44100 || p.audio.channels != 2 {
+		t.Fatalf("got audio %s %d %d; want mp4a.40.2 44100 2", p.audio.codecs, p.audio.sampleRate, p.audio.channels)
+	}
+}
+
+func TestIsoDuration(t *testing.T) {
+	var tests = []struct {
+		d    time.Duration
+		want string
+	}{
+		{2 * time.Second, "PT2S"},
+		{500 * time.Millisecond, "PT0.5S"},
+		{12 * time.Second, "PT12S"},
+	}
+
+	for _, tt := range tests {
+		if got := isoDuration(tt.d); got != tt.want {
+			t.Fatalf("got %s; want %s", got, tt.want)
+		}
+	}
+}
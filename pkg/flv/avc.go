@@ -0,0 +1,198 @@
+package flv
+
+import (
+	"fmt"
+)
+
+// AVCConfig is what we need from an AVCDecoderConfigurationRecord
+type AVCConfig struct {
+	Profile uint8
+	Level   uint8
+	Width   int
+	Height  int
+}
+
+/*
+ * ParseAVCSequenceHeader parses the body of an AVC sequence header video tag:
+ *   FrameType|CodecID(1) AVCPacketType(1) CompositionTime(3) AVCDecoderConfigurationRecord
+ * the resolution comes from the first SPS.
+ */
+func ParseAVCSequenceHeader(b []byte) (*AVCConfig, error) {
+	if len(b) < 5+8 {
+		return nil, fmt.Errorf("invalid AVC sequence header len=%d", len(b))
+	}
+
+	rec := b[5:]
+	if rec[0] != 1 {
+		return nil, fmt.Errorf("invalid AVCDecoderConfigurationRecord version=%d", rec[0])
+	}
+
+	if numSPS := rec[5] & 0x1f; numSPS == 0 {
+		return nil, fmt.Errorf("no SPS in AVCDecoderConfigurationRecord")
+	}
+	spsLen := int(rec[6])<<8 | int(rec[7])
+	if len(rec) < 8+spsLen {
+		return nil, fmt.Errorf("invalid SPS len=%d", spsLen)
+	}
+
+	return ParseSPS(rec[8 : 8+spsLen])
+}
+
+// ParseSPS parses an H.264 sequence parameter set NAL unit, ISO/IEC 14496-10 7.3.2.1.1
+func ParseSPS(nalu []byte) (*AVCConfig, error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != 7 {
+		return nil, fmt.Errorf("not a SPS NAL unit")
+	}
+
+	cfg := &AVCConfig{Profile: nalu[1], Level: nalu[3]}
+	r := &bitReader{b: unescapeRBSP(nalu[4:])}
+
+	r.ue() // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	switch cfg.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.ue()
+		if chromaFormatIdc == 3 {
+			r.u(1) // separate_colour_plane_flag
+		}
+		r.ue()           // bit_depth_luma_minus8
+		r.ue()           // bit_depth_chroma_minus8
+		r.u(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.u(1) == 1 { // seq_scaling_matrix_present_flag
+			n := 8
+			if chromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if r.u(1) == 1 { // seq_scaling_list_present_flag
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					r.skipScalingList(size)
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.u(1) // delta_pic_order_always_zero_flag
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		for i := r.ue(); i > 0 && r.err == nil; i-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.u(1)
+	if frameMbsOnly == 0 {
+		r.u(1) // mb_adaptive_frame_field_flag
+	}
+	r.u(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.u(1) == 1 { // frame_cropping_flag
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("truncated SPS: %v", r.err)
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	switch chromaFormatIdc {
+	case 1: // 4:2:0
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2: // 4:2:2
+		cropUnitX = 2
+	}
+
+	cfg.Width = int(widthInMbs*16 - cropUnitX*(cropLeft+cropRight))
+	cfg.Height = int((2-frameMbsOnly)*heightInMapUnits*16 - cropUnitY*(cropTop+cropBottom))
+
+	return cfg, nil
+}
+
+// unescapeRBSP drops emulation prevention bytes, 00 00 03 => 00 00
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// bitReader reads exp-golomb coded fields, the first error sticks and later reads return 0
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err error
+}
+
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			if r.err == nil {
+				r.err = fmt.Errorf("read beyond %d bytes", len(r.b))
+			}
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil || zeros == 31 {
+			if r.err == nil {
+				r.err = fmt.Errorf("invalid exp-golomb code")
+			}
+			return 0
+		}
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.u(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	k := r.ue()
+	if k&1 == 1 {
+		return int32((k + 1) / 2)
+	}
+	return -int32(k / 2)
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
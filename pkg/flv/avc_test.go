@@ -0,0 +1,120 @@
+package flv
+
+import "testing"
+
+// bitWriter composes exp-golomb coded fields
+type bitWriter struct {
+	b   []byte
+	pos int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.pos%8))
+		w.pos++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// testSPS builds a progressive 4:2:0 SPS, cropping at the bottom only
+func testSPS(profile uint8, widthInMbs, heightInMbs, cropBottom uint32) []byte {
+	w := &bitWriter{}
+	w.ue(0) // sps id
+	if profile == 100 {
+		w.ue(1)   // chroma_format_idc 4:2:0
+		w.ue(0)   // bit_depth_luma_minus8
+		w.ue(0)   // bit_depth_chroma_minus8
+		w.u(1, 0) // qpprime
+		w.u(1, 0) // no scaling matrix
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(0) // pic_order_cnt_type
+	w.ue(2) // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(4) // max_num_ref_frames
+	w.u(1, 0)
+	w.ue(widthInMbs - 1)
+	w.ue(heightInMbs - 1)
+	w.u(1, 1) // frame_mbs_only
+	w.u(1, 1) // direct_8x8_inference
+	if cropBottom > 0 {
+		w.u(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0) // vui_parameters_present_flag
+	w.u(1, 1) // rbsp stop bit
+
+	return append([]byte{0x67, profile, 0x00, 0x28}, w.b...)
+}
+
+// testAVCSequenceHeader wraps sps as an AVC sequence header video tag body
+func testAVCSequenceHeader(sps []byte) []byte {
+	b := []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	b = append(b, sps...)
+	return append(b, 0x01, 0x00, 0x04, 0x68, 0xee, 0x3c, 0x80) // one PPS
+}
+
+func TestParseAVCSequenceHeader(t *testing.T) {
+	var tests = []struct {
+		name          string
+		sps           []byte
+		width, height int
+	}{
+		{"baseline 720p", testSPS(66, 80, 45, 0), 1280, 720},
+		{"high 1080p cropped", testSPS(100, 120, 68, 4), 1920, 1080},
+		{"main 480p", testSPS(77, 53, 30, 0), 848, 480},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ParseAVCSequenceHeader(testAVCSequenceHeader(tt.sps))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if cfg.Width != tt.width || cfg.Height != tt.height {
+			t.Fatalf("%s: got %dx%d; want %dx%d", tt.name, cfg.Width, cfg.Height, tt.width, tt.height)
+		}
+		if cfg.Profile != tt.sps[1] {
+			t.Fatalf("%s: got profile %d; want %d", tt.name, cfg.Profile, tt.sps[1])
+		}
+	}
+}
+
+func TestParseAVCSequenceHeaderInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+	}{
+		{"short", []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{"truncated sps", testAVCSequenceHeader(testSPS(66, 80, 45, 0)[:5])},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseAVCSequenceHeader(tt.data); err == nil {
+			t.Fatalf("%s: got nil err; want error", tt.name)
+		}
+	}
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+	got := unescapeRBSP([]byte{0x01, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x03})
+	want := []byte{0x01, 0x00, 0x00, 0x01, 0x00, 0x00}
+	if string(got) != string(want) {
+		t.Fatalf("got % x; want % x", got, want)
+	}
+}
@@ -22,5 +22,9 @@ func (dm *Demuxer) DemuxHdr(pkt *av.Packet) error {
 		pkt.Header = t
 	}
 
+	if pkt.IsVideo {
+		pkt.CompositionTime = t.CompositionTime()
+	}
+
 	return nil
 }
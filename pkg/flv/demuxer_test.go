@@ -0,0 +1,48 @@
+package flv
+
+import (
+	"testing"
+
+	"playground/pkg/av"
+)
+
+func TestDemuxHdrCompositionTime(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		cts  int32
+	}{
+		{"zero", []byte{0x27, 0x01, 0x00, 0x00, 0x00}, 0},
+		{"positive", []byte{0x27, 0x01, 0x00, 0x00, 0x50}, 80},
+		{"large", []byte{0x17, 0x01, 0x01, 0x02, 0x03}, 0x010203},
+		{"negative", []byte{0x27, 0x01, 0xff, 0xff, 0xd8}, -40},
+	}
+
+	dm := NewDemuxer()
+	for _, tt := range tests {
+		pkt := &av.Packet{IsVideo: true, Data: tt.data}
+		if err := dm.DemuxHdr(pkt); err != nil {
+			t.Fatalf("%s: demux error: %v", tt.name, err)
+		}
+
+		if pkt.CompositionTime != tt.cts {
+			t.Fatalf("%s: got cts %d; want %d", tt.name, pkt.CompositionTime, tt.cts)
+		}
+
+		vh := pkt.Header.(av.VideoPacketHeader)
+		if vh.CompositionTime() != tt.cts {
+			t.Fatalf("%s: got header cts %d; want %d", tt.name, vh.CompositionTime(), tt.cts)
+		}
+	}
+}
+
+func TestDemuxHdrAudioNoCompositionTime(t *testing.T) {
+	pkt := &av.Packet{IsAudio: true, Data: []byte{0xaf, 0x01, 0x21}}
+	if err := NewDemuxer().DemuxHdr(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	if pkt.CompositionTime != 0 {
+		t.Fatalf("got cts %d for audio; want 0", pkt.CompositionTime)
+	}
+}
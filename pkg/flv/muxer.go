@@ -0,0 +1,88 @@
+package flv
+
+import (
+	"io"
+
+	"playground/pkg/av"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+const (
+	headerLen    = 9
+	tagHeaderLen = 11
+)
+
+// Muxer writes av packets as an FLV stream, the header and every tag go out in a single Write,
+// so a message oriented writer (e.g. websocket) gets one frame per tag
+type Muxer struct {
+	w io.Writer
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w}
+}
+
+// WriteHeader writes the FLV header followed by PreviousTagSize0
+func (m *Muxer) WriteHeader(hasAudio, hasVideo bool) error {
+	b := make([]byte, headerLen+4)
+	copy(b, "FLV")
+	b[3] = 1 // version
+	if hasAudio {
+		b[4] |= 0x04
+	}
+	if hasVideo {
+		b[4] |= 0x01
+	}
+	b[8] = headerLen // data offset
+
+	_, err := m.w.Write(b)
+	return err
+}
+
+// WritePacket writes pkt as one tag at timeStamp followed by its PreviousTagSize,
+// "@setDataFrame" of metadata is stripped as FLV files carry onMetaData only
+func (m *Muxer) WritePacket(pkt *av.Packet, timeStamp uint32) error {
+	var tagType uint8
+	data := pkt.Data
+	switch {
+	case pkt.IsVideo:
+		tagType = av.TagVideo
+	case pkt.IsAudio:
+		tagType = av.TagAudio
+	case pkt.IsMetaData:
+		tagType = av.TagScriptDataAMF0
+		var err error
+		if data, err = amf.MetaDataReform(data, amf.DEL); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	dataSize := len(data)
+	b := make([]byte, tagHeaderLen+dataSize+4)
+	b[0] = tagType
+	putUint24(b[1:], uint32(dataSize))
+	putUint24(b[4:], timeStamp&0xffffff)
+	b[7] = byte(timeStamp >> 24) // TimeStampExtended
+	// StreamID, always 0
+	copy(b[tagHeaderLen:], data)
+	putUint32(b[tagHeaderLen+dataSize:], uint32(tagHeaderLen+dataSize))
+
+	_, err := m.w.Write(b)
+	return err
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+func putUint32(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
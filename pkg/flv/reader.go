@@ -0,0 +1,86 @@
+package flv
+
+import (
+	"io"
+	"io/ioutil"
+
+	"playground/pkg/av"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+)
+
+// Reader reads av packets from an FLV stream, the counterpart of Muxer
+type Reader struct {
+	r   io.Reader
+	hdr [tagHeaderLen]byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadHeader reads the FLV header up to PreviousTagSize0, it must come before ReadPacket
+func (r *Reader) ReadHeader() (hasAudio, hasVideo bool, err error) {
+	b := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return false, false, errors.Wrap(err, "read flv header")
+	}
+	if string(b[:3]) != "FLV" {
+		return false, false, errors.Errorf("not an flv header: % x", b[:3])
+	}
+
+	offset := int64(b[5])<<24 | int64(b[6])<<16 | int64(b[7])<<8 | int64(b[8])
+	if offset < headerLen {
+		return false, false, errors.Errorf("flv data offset %d within the header", offset)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r.r, offset-headerLen+4); err != nil { // PreviousTagSize0 follows
+		return false, false, errors.Wrap(err, "skip to the first tag")
+	}
+	return b[4]&0x04 != 0, b[4]&0x01 != 0, nil
+}
+
+/*
+ * ReadPacket returns the next audio, video or script tag as a packet from av.NewPacket, io.EOF at the end:
+ *   1. TimeStamp joins the 24 bit timestamp with TimeStampExtended, Data is the tag body.
+ *   2. metadata gets "@setDataFrame" back, as a publisher sends it, Muxer strips it.
+ *   3. tags of other types are skipped, the header is left to Demuxer.DemuxHdr.
+ */
+func (r *Reader) ReadPacket() (*av.Packet, error) {
+	for {
+		if _, err := io.ReadFull(r.r, r.hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, errors.Wrap(err, "read tag header")
+		}
+		size := int(r.hdr[1])<<16 | int(r.hdr[2])<<8 | int(r.hdr[3])
+		ts := uint32(r.hdr[7])<<24 | uint32(r.hdr[4])<<16 | uint32(r.hdr[5])<<8 | uint32(r.hdr[6])
+
+		data := make([]byte, size+4) // PreviousTagSize with it
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return nil, errors.Wrapf(err, "read %d bytes tag body", size)
+		}
+		data = data[:size]
+
+		pkt := av.NewPacket()
+		switch r.hdr[0] {
+		case av.TagAudio:
+			pkt.IsAudio = true
+		case av.TagVideo:
+			pkt.IsVideo = true
+		case av.TagScriptDataAMF0:
+			pkt.IsMetaData = true
+			var err error
+			if data, err = amf.MetaDataReform(data, amf.ADD); err != nil {
+				pkt.Release()
+				return nil, errors.Wrap(err, "script tag")
+			}
+		default:
+			pkt.Release()
+			continue
+		}
+		pkt.Data, pkt.TimeStamp = data, ts
+		return pkt, nil
+	}
+}
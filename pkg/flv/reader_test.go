@@ -0,0 +1,59 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"playground/pkg/av"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestReaderReadsMuxer(t *testing.T) {
+	meta := bytes.NewBuffer(nil)
+	if _, err := (&amf.Encoder{}).EncodeBatch(meta, amf.AMF0, "@setDataFrame", "onMetaData", amf.Object{"width": 1280.0}); err != nil {
+		t.Fatal(err)
+	}
+	pkts := []*av.Packet{
+		{IsMetaData: true, Data: meta.Bytes()},
+		{IsVideo: true, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+		{IsVideo: true, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}, TimeStamp: 40},
+		{IsVideo: true, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03}, TimeStamp: 0x01000020}, // extended
+	}
+
+	b := bytes.NewBuffer(nil)
+	m := NewMuxer(b)
+	if err := m.WriteHeader(true, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if err := m.WritePacket(pkt, pkt.TimeStamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReader(b)
+	if hasAudio, hasVideo, err := r.ReadHeader(); err != nil || !hasAudio || !hasVideo {
+		t.Fatalf("got audio %v video %v: %v; want both", hasAudio, hasVideo, err)
+	}
+	for i, want := range pkts {
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got.IsAudio != want.IsAudio || got.IsVideo != want.IsVideo || got.IsMetaData != want.IsMetaData ||
+			got.TimeStamp != want.TimeStamp || !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("packet %d: got %+v; want %+v", i, got, want)
+		}
+		got.Release()
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("got %v at the end; want EOF", err)
+	}
+
+	if _, _, err := NewReader(bytes.NewReader([]byte("GIF89a\x00\x00\x00"))).ReadHeader(); err == nil {
+		t.Fatal("read a header of no flv")
+	}
+}
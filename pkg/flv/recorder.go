@@ -0,0 +1,253 @@
+package flv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"playground/pkg/av"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+)
+
+const recordPartSuffix = ".part"
+
+// Recorder writes av packets to an FLV file whose onMetaData carries a keyframes index, times and
+// filepositions, for players to seek. Tags go to path.part while recording, Close writes path with
+// onMetaData first and removes path.part.
+type Recorder struct {
+	path   string
+	part   *os.File
+	w      *bufio.Writer
+	muxer  *Muxer
+	offset int64 // bytes of tags in part
+
+	meta               amf.Object // last onMetaData of the stream, nil if none
+	times, positions   []float64  // keyframes, positions relative to the first tag in part
+	hasAudio, hasVideo bool
+	lastTimeStamp      uint32
+	base               uint32 // added to timestamps written, continues the tags of an appended file
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	part, err := os.Create(path + recordPartSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{path: path, part: part, w: bufio.NewWriter(part)}
+	r.muxer = NewMuxer(writerFunc(func(b []byte) (int, error) {
+		n, err := r.w.Write(b)
+		r.offset += int64(n)
+		return n, err
+	}))
+	return r, nil
+}
+
+/*
+ * NewAppendRecorder continues the FLV file at path, a new one if it doesn't exist:
+ *   1. the tags of path are copied to path.part first, their keyframes start the index.
+ *   2. packets written then are stamped after the last tag of path.
+ * path itself is only replaced by Close, a failed append leaves it as it was. A tag cut short at the
+ * end of path, e.g. by a crash while recording, ends the copy.
+ */
+func NewAppendRecorder(path string) (*Recorder, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return NewRecorder(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fr := NewReader(bufio.NewReader(f))
+	hasAudio, hasVideo, err := fr.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRecorder(path)
+	if err != nil {
+		return nil, err
+	}
+	r.hasAudio, r.hasVideo = hasAudio, hasVideo
+	tags := 0
+	for {
+		pkt, err := fr.ReadPacket()
+		if err == io.EOF || errors.Cause(err) == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			r.abort()
+			return nil, err
+		}
+
+		if !pkt.IsMetaData {
+			tags++
+		}
+		err = r.WritePacket(pkt, pkt.TimeStamp)
+		pkt.Release()
+		if err != nil {
+			r.abort()
+			return nil, err
+		}
+	}
+
+	if tags > 0 {
+		r.base = r.lastTimeStamp + 1
+	}
+	return r, nil
+}
+
+// abort removes path.part, path is left untouched
+func (r *Recorder) abort() {
+	r.part.Close()
+	os.Remove(r.part.Name())
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// WritePacket appends pkt as one tag at timeStamp, metadata is kept for Close instead
+func (r *Recorder) WritePacket(pkt *av.Packet, timeStamp uint32) error {
+	timeStamp += r.base
+	switch {
+	case pkt.IsMetaData:
+		return r.setMetaData(pkt.Data)
+	case pkt.IsVideo:
+		r.hasVideo = true
+		if isKeyFrame(pkt) {
+			r.times = append(r.times, float64(timeStamp)/1000)
+			r.positions = append(r.positions, float64(r.offset))
+		}
+	case pkt.IsAudio:
+		r.hasAudio = true
+	default:
+		return nil
+	}
+
+	if timeStamp > r.lastTimeStamp {
+		r.lastTimeStamp = timeStamp
+	}
+	return r.muxer.WritePacket(pkt, timeStamp)
+}
+
+// isKeyFrame reports a video keyframe other than the AVC sequence header, from the tag body as the
+// header of a shared packet may not be demuxed
+func isKeyFrame(pkt *av.Packet) bool {
+	if len(pkt.Data) < 2 || pkt.Data[0]>>4 != av.KEY_FRAME {
+		return false
+	}
+	return pkt.Data[0]&0x0f != av.VIDEO_H264 || pkt.Data[1] != av.AVC_SEQHDR
+}
+
+func (r *Recorder) setMetaData(data []byte) error {
+	data, err := amf.MetaDataReform(data, amf.DEL)
+	if err != nil {
+		return err
+	}
+
+	vs, err := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(data), amf.AMF0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for _, v := range vs {
+		if obj, ok := v.(amf.Object); ok {
+			r.meta = obj
+		}
+	}
+	return nil
+}
+
+/*
+ * Close writes path as:
+ *   1. FLV header and PreviousTagSize0
+ *   2. onMetaData with duration and keyframes{times, filepositions}
+ *   3. the tags recorded in path.part
+ * AMF0 numbers are 8 bytes whatever the value, so the size of onMetaData is known before the final
+ * file positions it carries.
+ */
+func (r *Recorder) Close() error {
+	defer os.Remove(r.part.Name())
+	defer r.part.Close()
+
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+
+	meta, err := r.metaDataTag(0)
+	if err != nil {
+		return err
+	}
+	if meta, err = r.metaDataTag(int64(headerLen + 4 + len(meta))); err != nil {
+		return err
+	}
+
+	f, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := NewMuxer(w).WriteHeader(r.hasAudio, r.hasVideo); err != nil {
+		return err
+	}
+	if _, err := w.Write(meta); err != nil {
+		return err
+	}
+	if _, err := r.part.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r.part); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// metaDataTag encodes the onMetaData tag with keyframe positions shifted by base, the file offset of the first tag
+func (r *Recorder) metaDataTag(base int64) ([]byte, error) {
+	meta := make(amf.Object, len(r.meta)+3)
+	for k, v := range r.meta {
+		meta[k] = v
+	}
+
+	positions := make([]interface{}, len(r.positions))
+	for i, pos := range r.positions {
+		positions[i] = float64(base) + pos
+	}
+	times := make([]interface{}, len(r.times))
+	for i, t := range r.times {
+		times[i] = t
+	}
+	meta["duration"] = float64(r.lastTimeStamp) / 1000
+	meta["hasKeyframes"] = len(r.times) > 0
+	meta["keyframes"] = amf.Object{"times": times, "filepositions": positions}
+
+	body := bytes.NewBuffer(nil)
+	enc := &amf.Encoder{}
+	if _, err := enc.EncodeAmf0(body, "onMetaData"); err != nil {
+		return nil, err
+	}
+	if _, err := enc.EncodeAmf0EcmaArray(body, meta, true); err != nil {
+		return nil, fmt.Errorf("encode onMetaData: %v", err)
+	}
+
+	tag := bytes.NewBuffer(nil)
+	pkt := &av.Packet{IsMetaData: true, Data: body.Bytes()}
+	if err := NewMuxer(tag).WritePacket(pkt, 0); err != nil {
+		return nil, err
+	}
+	return tag.Bytes(), nil
+}
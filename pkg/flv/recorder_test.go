@@ -0,0 +1,176 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"playground/pkg/av"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestRecorderKeyframes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.flv")
+	r, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := bytes.NewBuffer(nil)
+	if _, err := (&amf.Encoder{}).EncodeBatch(meta, amf.AMF0, "@setDataFrame", "onMetaData", amf.Object{"width": 1280.0}); err != nil {
+		t.Fatal(err)
+	}
+	pkts := []*av.Packet{
+		{IsMetaData: true, Data: meta.Bytes()},
+		{IsVideo: true, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01}}, // sequence header
+		{IsAudio: true, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+		{IsVideo: true, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}, TimeStamp: 0},
+		{IsVideo: true, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03}, TimeStamp: 40},
+		{IsAudio: true, Data: []byte{0xaf, 0x01, 0x04}, TimeStamp: 46},
+		{IsVideo: true, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x04}, TimeStamp: 2000},
+		{IsVideo: true, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x05}, TimeStamp: 2040},
+		{IsVideo: true, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x06}, TimeStamp: 4000},
+	}
+	for _, pkt := range pkts {
+		if err := r.WritePacket(pkt, pkt.TimeStamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + recordPartSuffix); !os.IsNotExist(err) {
+		t.Fatalf("part file left: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("FLV")) || b[4] != 0x05 {
+		t.Fatalf("got header % x", b[:headerLen])
+	}
+
+	// the first tag is onMetaData
+	tag := func(pos int) (uint8, []byte) {
+		if pos+tagHeaderLen > len(b) {
+			t.Fatalf("tag at %d past end of file %d", pos, len(b))
+		}
+		size := int(b[pos+1])<<16 | int(b[pos+2])<<8 | int(b[pos+3])
+		return b[pos], b[pos+tagHeaderLen : pos+tagHeaderLen+size]
+	}
+	tagType, body := tag(headerLen + 4)
+	if tagType != av.TagScriptDataAMF0 {
+		t.Fatalf("got first tag type %d; want script data", tagType)
+	}
+	vs, err := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(body), amf.AMF0)
+	if len(vs) != 2 || vs[0] != "onMetaData" {
+		t.Fatalf("got onMetaData %v: %v", vs, err)
+	}
+	obj := vs[1].(amf.Object)
+	if obj["width"] != 1280.0 || obj["duration"] != 4.0 || obj["hasKeyframes"] != true {
+		t.Fatalf("got onMetaData %v", obj)
+	}
+
+	keyframes := obj["keyframes"].(amf.Object)
+	times, positions := keyframes["times"].(amf.Array), keyframes["filepositions"].(amf.Array)
+	wantTimes := []float64{0, 2, 4}
+	if len(times) != len(wantTimes) || len(positions) != len(wantTimes) {
+		t.Fatalf("got keyframes %v; want %d", keyframes, len(wantTimes))
+	}
+	for i, want := range wantTimes {
+		if times[i] != want {
+			t.Fatalf("got keyframe %d at %v; want %v", i, times[i], want)
+		}
+
+		tagType, body := tag(int(positions[i].(float64)))
+		if tagType != av.TagVideo || body[0]>>4 != av.KEY_FRAME || body[1] != av.AVC_NALU {
+			t.Fatalf("keyframe %d at %v: got tag %d % x", i, positions[i], tagType, body)
+		}
+	}
+}
+
+func TestAppendRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.flv")
+	record := func(newRecorder func(string) (*Recorder, error), stamps ...uint32) {
+		t.Helper()
+		r, err := newRecorder(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ts := range stamps {
+			for _, pkt := range []*av.Packet{
+				{IsVideo: true, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x02}},
+				{IsVideo: true, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x03}},
+			} {
+				if err := r.WritePacket(pkt, ts); err != nil {
+					t.Fatal(err)
+				}
+				ts += 40
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record(NewRecorder, 5000) // replaced by the first record
+	record(NewRecorder, 0, 2000)
+	record(NewAppendRecorder, 0, 1000)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fr := NewReader(f)
+	if _, _, err := fr.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := fr.ReadPacket()
+	if err != nil || !meta.IsMetaData {
+		t.Fatalf("got first tag %v: %v; want onMetaData", meta, err)
+	}
+	var stamps []uint32
+	for {
+		pkt, err := fr.ReadPacket()
+		if err != nil {
+			break
+		}
+		stamps = append(stamps, pkt.TimeStamp)
+	}
+	wantStamps := []uint32{0, 40, 2000, 2040, 2041, 2081, 3041, 3081} // the second record goes on after 2040
+	if fmt.Sprint(stamps) != fmt.Sprint(wantStamps) {
+		t.Fatalf("got timestamps %v; want %v", stamps, wantStamps)
+	}
+
+	vs, err := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(meta.Data), amf.AMF0)
+	if len(vs) < 3 {
+		t.Fatalf("got onMetaData %v: %v", vs, err)
+	}
+	obj := vs[2].(amf.Object)
+	times := obj["keyframes"].(amf.Object)["times"].(amf.Array)
+	if fmt.Sprint(times) != fmt.Sprint([]interface{}{0.0, 2.0, 2.041, 3.041}) || obj["duration"] != 3.081 {
+		t.Fatalf("got keyframe times %v duration %v", times, obj["duration"])
+	}
+}
+
+func TestAppendRecorderKeepsUnreadableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.flv")
+	if err := ioutil.WriteFile(path, []byte("not an flv file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAppendRecorder(path); err == nil {
+		t.Fatal("appended to a file which isn't FLV")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "not an flv file" {
+		t.Fatalf("got file %q: %v; want it untouched", b, err)
+	}
+	if _, err := os.Stat(path + recordPartSuffix); !os.IsNotExist(err) {
+		t.Fatalf("part file left: %v", err)
+	}
+}
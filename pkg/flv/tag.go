@@ -175,6 +175,7 @@ func (t *Tag) decodeVideoHeader(b []byte) (n int, err error) {
 		for i := 2; i < 5; i++ {
 			t.mediaTag.compositionTime = t.mediaTag.compositionTime<<8 + int32(b[i])
 		}
+		t.mediaTag.compositionTime = t.mediaTag.compositionTime << 8 >> 8 // SI24, sign extend
 		n += 4
 	}
 
@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rendition is one stream of an ABR group, e.g. stream_720p of stream
+type Rendition struct {
+	Name string // e.g. 720p
+	StreamInfo
+}
+
+func (mgr *streamSourceMgr) renditionSuffix() *regexp.Regexp {
+	if mgr.config != nil && mgr.config.RenditionSuffix != nil {
+		return mgr.config.RenditionSuffix
+	}
+	return defaultRenditionSuffix
+}
+
+// splitRendition splits vhost/app/stream_720p into vhost/app/stream and 720p
+func (mgr *streamSourceMgr) splitRendition(streamKey string) (baseKey, name string, ok bool) {
+	idx := strings.LastIndex(streamKey, "/")
+	stream := streamKey[idx+1:]
+
+	loc := mgr.renditionSuffix().FindStringSubmatchIndex(stream)
+	if loc == nil || loc[0] == 0 { // no suffix, or nothing left as base name
+		return "", "", false
+	}
+
+	name = stream[loc[0]:loc[1]]
+	if len(loc) >= 4 && loc[2] >= 0 {
+		name = stream[loc[2]:loc[3]]
+	}
+	name = strings.Trim(name, "_-.")
+
+	return streamKey[:idx+1] + stream[:loc[0]], name, true
+}
+
+// RenditionGroups groups the publishing streams by base stream key, for generating master playlists
+func (mgr *streamSourceMgr) RenditionGroups() map[string][]Rendition {
+	groups := make(map[string][]Rendition)
+	mgr.streamMap.Range(func(key, val interface{}) bool {
+		baseKey, name, ok := mgr.splitRendition(key.(string))
+		if !ok {
+			return true
+		}
+
+		info := val.(*streamSource).StreamInfo()
+		if info.Publishing {
+			groups[baseKey] = append(groups[baseKey], Rendition{Name: name, StreamInfo: info})
+		}
+		return true
+	})
+
+	for _, renditions := range groups {
+		sortRenditions(renditions)
+	}
+	return groups
+}
+
+// RenditionGroup returns the renditions of baseKey, highest resolution first
+func (mgr *streamSourceMgr) RenditionGroup(baseKey string) []Rendition {
+	return mgr.RenditionGroups()[baseKey]
+}
+
+func sortRenditions(renditions []Rendition) {
+	sort.Slice(renditions, func(i, j int) bool {
+		a, b := renditions[i], renditions[j]
+		if a.Height != b.Height {
+			return a.Height > b.Height
+		}
+		if a.Bitrate != b.Bitrate {
+			return a.Bitrate > b.Bitrate
+		}
+		return a.Name < b.Name
+	})
+}
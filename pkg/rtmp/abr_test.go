@@ -0,0 +1,84 @@
+package rtmp
+
+import (
+	"regexp"
+	"testing"
+)
+
+// AVC sequence headers of baseline 1280x720, main 848x480 and high 1920x1080 (cropped)
+var (
+	testAVCSeq720p  = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x42, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x0a, 0x67, 0x42, 0x00, 0x28, 0xec, 0xa0, 0x28, 0x02, 0xdc, 0x80, 0x01, 0x00, 0x04, 0x68, 0xee, 0x3c, 0x80}
+	testAVCSeq480p  = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x4d, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x09, 0x67, 0x4d, 0x00, 0x28, 0xec, 0xa0, 0x6a, 0x1e, 0xc8, 0x01, 0x00, 0x04, 0x68, 0xee, 0x3c, 0x80}
+	testAVCSeq1080p = []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64, 0x00, 0x28, 0xff, 0xe1, 0x00, 0x0c, 0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x40, 0x01, 0x00, 0x04, 0x68, 0xee, 0x3c, 0x80}
+)
+
+// publishTestStream attaches a publisher of streamKey and feeds it the sequence header
+func publishTestStream(t *testing.T, ssMgr *streamSourceMgr, config *Config, streamKey string, seq []byte) *streamSource {
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	ss, err := ssMgr.attachPublisher(newPublisher(c, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.updateStreamInfo(newTestAVPacket(t, true, seq, 0)); err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func TestRenditionGroups(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+
+	publishTestStream(t, ssMgr, config, "_defaultVhost_/live/stream_480p", testAVCSeq480p)
+	publishTestStream(t, ssMgr, config, "_defaultVhost_/live/stream_1080p", testAVCSeq1080p)
+	publishTestStream(t, ssMgr, config, "_defaultVhost_/live/stream_720p", testAVCSeq720p)
+	publishTestStream(t, ssMgr, config, "_defaultVhost_/live/other", testAVCSeq720p) // no rendition suffix
+	publishTestStream(t, ssMgr, config, "_defaultVhost_/live/_720p", testAVCSeq720p) // no base name
+
+	groups := ssMgr.RenditionGroups()
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups %+v; want 1", len(groups), groups)
+	}
+
+	renditions := ssMgr.RenditionGroup("_defaultVhost_/live/stream")
+	var want = []struct {
+		name          string
+		streamKey     string
+		width, height int
+	}{
+		{"1080p", "_defaultVhost_/live/stream_1080p", 1920, 1080},
+		{"720p", "_defaultVhost_/live/stream_720p", 1280, 720},
+		{"480p", "_defaultVhost_/live/stream_480p", 848, 480},
+	}
+	if len(renditions) != len(want) {
+		t.Fatalf("got %d renditions; want %d", len(renditions), len(want))
+	}
+	for i, w := range want {
+		r := renditions[i]
+		if r.Name != w.name || r.StreamKey != w.streamKey || r.Width != w.width || r.Height != w.height || !r.Publishing {
+			t.Fatalf("rendition %d: got %+v; want %s %s %dx%d publishing", i, r, w.name, w.streamKey, w.width, w.height)
+		}
+	}
+
+	// a rendition whose publisher left is not offered
+	val, _ := ssMgr.streamMap.Load("_defaultVhost_/live/stream_480p")
+	val.(*streamSource).delPublisher()
+	if n := len(ssMgr.RenditionGroup("_defaultVhost_/live/stream")); n != 2 {
+		t.Fatalf("got %d renditions after unpublish; want 2", n)
+	}
+}
+
+func TestRenditionSuffixConfig(t *testing.T) {
+	config := newTestConfig()
+	config.RenditionSuffix = regexp.MustCompile(`-(hd|sd)$`)
+	ssMgr := newStreamSourceMgr(config)
+
+	baseKey, name, ok := ssMgr.splitRendition("_defaultVhost_/live/stream-hd")
+	if !ok || baseKey != "_defaultVhost_/live/stream" || name != "hd" {
+		t.Fatalf("got %s %s %v; want _defaultVhost_/live/stream hd true", baseKey, name, ok)
+	}
+
+	if _, _, ok := ssMgr.splitRendition("_defaultVhost_/live/stream_720p"); ok {
+		t.Fatal("default suffix should not apply with custom RenditionSuffix")
+	}
+}
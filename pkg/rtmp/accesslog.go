@@ -0,0 +1,51 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionRecord is the access log record of a session, passed to Config.AccessLog once it ends
+type SessionRecord struct {
+	StreamKey string `json:"streamKey"`
+	Role      string `json:"role"` // publish or play, empty if the session ended in the command phase
+	Remote    string `json:"remote"`
+	FlashVer  string `json:"flashVer"`
+	TcUrl     string `json:"tcUrl"`
+
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"` // nanoseconds in JSON
+	BytesIn  int64         `json:"bytesIn"`  // raw bytes read and written, handshake and chunk headers included
+	BytesOut int64         `json:"bytesOut"`
+
+	Reason string `json:"reason"` // the error which ended the session
+}
+
+// logAccess passes the record of the session started at start to Config.AccessLog, probes closing
+// during the handshake have none
+func (c *Conn) logAccess(start time.Time, err error) {
+	if c.config.AccessLog == nil || !c.handshakeComplete() {
+		return
+	}
+
+	record := SessionRecord{
+		StreamKey: c.streamKey,
+		Remote:    c.RemoteAddr().String(),
+		FlashVer:  c.flashVer,
+		TcUrl:     c.tcUrl,
+		Start:     start,
+		Duration:  time.Since(start),
+		BytesIn:   atomic.LoadInt64(&c.bytesIn),
+		BytesOut:  atomic.LoadInt64(&c.bytesOut),
+	}
+	if c.handleCommandMessageDone {
+		record.Role = "play"
+		if c.isPublisher {
+			record.Role = "publish"
+		}
+	}
+	if err != nil {
+		record.Reason = err.Error()
+	}
+	c.config.AccessLog(record)
+}
@@ -0,0 +1,64 @@
+package rtmp
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestAccessLog(t *testing.T) {
+	config := newTestConfig()
+	records := make(chan SessionRecord, 1)
+	config.AccessLog = func(record SessionRecord) { records <- record }
+
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	go c.Serve()
+	if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+		t.Fatal("handshake failed")
+	}
+	read := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, peer)
+		read <- n
+	}()
+
+	written := int64(1 + 1536 + 1536) // C0 C1 C2
+	for _, b := range [][]byte{
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live", "flashVer": "FMLE/3.0"}).ChunkBody, 128),
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, newTestCommandMessage(t, "createStream", 2.0, nil).ChunkBody, 128),
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 1, newTestCommandMessage(t, "publish", 3.0, nil, "test", "live").ChunkBody, 128),
+		encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoKey, 128),
+	} {
+		if _, err := peer.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		written += int64(len(b))
+	}
+	time.Sleep(20 * time.Millisecond)
+	peer.Close()
+
+	var record SessionRecord
+	select {
+	case record = <-records:
+	case <-time.After(time.Second):
+		t.Fatal("no access log record after the session ended")
+	}
+	if record.StreamKey != "example.com/live/test" || record.Role != "publish" || record.FlashVer != "FMLE/3.0" || record.Remote != "127.0.0.1:10001" {
+		t.Fatalf("got %+v; want the publisher of example.com/live/test", record)
+	}
+	if record.BytesIn != written {
+		t.Fatalf("got %d bytes in; want %d", record.BytesIn, written)
+	}
+	if n := 1 + 1536*2 + <-read; record.BytesOut != n { // S0 S1 S2 read by simpleHandshakePeer
+		t.Fatalf("got %d bytes out; want %d", record.BytesOut, n)
+	}
+	if record.Duration < 20*time.Millisecond || record.Start.IsZero() {
+		t.Fatalf("got duration %v from %v; want at least 20ms", record.Duration, record.Start)
+	}
+	if record.Reason == "" {
+		t.Fatal("got no disconnect reason")
+	}
+}
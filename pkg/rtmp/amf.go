@@ -0,0 +1,58 @@
+package rtmp
+
+import (
+	"io"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// AMFCodec encodes and decodes the values of command and data messages, set by Config.AMFCodec.
+// One codec serves every conn of the config, it must be safe for concurrent use.
+type AMFCodec interface {
+	Encode(w io.Writer, v interface{}, ver amf.Version) (int, error)
+	Decode(r io.Reader, ver amf.Version) (interface{}, error) // io.EOF once r has no more value
+}
+
+// livegoAMFCodec is the default codec, livego's amf package, one per conn as the decoder keeps AMF3 references
+type livegoAMFCodec struct {
+	encoder amf.Encoder
+	decoder amf.Decoder
+}
+
+func (lc *livegoAMFCodec) Encode(w io.Writer, v interface{}, ver amf.Version) (int, error) {
+	return lc.encoder.Encode(w, v, ver)
+}
+
+func (lc *livegoAMFCodec) Decode(r io.Reader, ver amf.Version) (interface{}, error) {
+	return lc.decoder.Decode(r, ver)
+}
+
+// EncodeECMAArray encodes v as an AMF0 ECMA array, see ecmaArrayEncoder
+func (lc *livegoAMFCodec) EncodeECMAArray(w io.Writer, v amf.Object) (int, error) {
+	return lc.encoder.EncodeAmf0EcmaArray(w, v, true)
+}
+
+// ecmaArrayEncoder is implemented by codecs encoding an object as an ECMA array, the way publishers send
+// onMetaData. liveMetaData encodes it as any object with other codecs.
+type ecmaArrayEncoder interface {
+	EncodeECMAArray(w io.Writer, v amf.Object) (int, error)
+}
+
+func newAMFCodec(config *Config) AMFCodec {
+	if config != nil && config.AMFCodec != nil {
+		return config.AMFCodec
+	}
+	return &livegoAMFCodec{}
+}
+
+// decodeAMFBatch decodes values up to the first error, io.EOF at the end of r, like amf.Decoder.DecodeBatch
+func decodeAMFBatch(codec AMFCodec, r io.Reader, ver amf.Version) ([]interface{}, error) {
+	var vs []interface{}
+	for {
+		v, err := codec.Decode(r, ver)
+		if err != nil {
+			return vs, err
+		}
+		vs = append(vs, v)
+	}
+}
@@ -0,0 +1,58 @@
+package rtmp
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// mockAMFCodec records the values going through the default codec
+type mockAMFCodec struct {
+	livegoAMFCodec
+	mu      sync.Mutex
+	decoded []interface{}
+	encoded []interface{}
+}
+
+func (m *mockAMFCodec) Encode(w io.Writer, v interface{}, ver amf.Version) (int, error) {
+	m.mu.Lock()
+	m.encoded = append(m.encoded, v)
+	m.mu.Unlock()
+	return m.livegoAMFCodec.Encode(w, v, ver)
+}
+
+func (m *mockAMFCodec) Decode(r io.Reader, ver amf.Version) (interface{}, error) {
+	v, err := m.livegoAMFCodec.Decode(r, ver)
+	if err == nil {
+		m.mu.Lock()
+		m.decoded = append(m.decoded, v)
+		m.mu.Unlock()
+	}
+	return v, err
+}
+
+func TestAMFCodecConnect(t *testing.T) {
+	codec := &mockAMFCodec{}
+	config := newTestConfig()
+	config.AMFCodec = codec
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	drainPeer(peer)
+
+	if err := c.decodeCommandMessage(newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})); err != nil {
+		t.Fatal(err)
+	}
+	if c.appName != "live" {
+		t.Fatalf("got app %q; want live", c.appName)
+	}
+
+	codec.mu.Lock()
+	defer codec.mu.Unlock()
+	if len(codec.decoded) != 3 || codec.decoded[0] != cmdConnect {
+		t.Fatalf("got decoded %v; want the connect command", codec.decoded)
+	}
+	if len(codec.encoded) == 0 || codec.encoded[0] != "_result" {
+		t.Fatalf("got encoded %v; want the connect _result", codec.encoded)
+	}
+}
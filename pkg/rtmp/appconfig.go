@@ -0,0 +1,53 @@
+package rtmp
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// AppConfig overrides Config for the connections to one app, zero values keep the server's
+type AppConfig struct {
+	ChunkSize uint32 // announced with SetChunkSize in the connect response
+	RecordDir string
+
+	OnConnect func(c *Conn) error
+	OnPublish func(c *Conn, streamName string) error
+}
+
+// forApp returns the config of connections to app, c itself without an override
+func (c *Config) forApp(app string) *Config {
+	ac := c.AppConfigs[app]
+	if ac == nil {
+		return c
+	}
+
+	clone := *c // per connect, only read from, AppConfigs needn't be copied like Clone does
+	if ac.ChunkSize > 0 {
+		clone.ChunkSize = ac.ChunkSize
+	}
+	if ac.RecordDir != "" {
+		clone.RecordDir = ac.RecordDir
+	}
+	if ac.OnConnect != nil {
+		clone.OnConnect = ac.OnConnect
+	}
+	if ac.OnPublish != nil {
+		clone.OnPublish = ac.OnPublish
+	}
+	return &clone
+}
+
+// applyAppConfig switches to the config of the app once connect named it, before the connect response
+// and the hooks
+func (c *Conn) applyAppConfig() {
+	app, _ := c.appInstance()
+	config := c.config.forApp(app)
+	if config == c.config {
+		return
+	}
+
+	c.config = config
+	if config.ChunkSize > 0 {
+		c.localChunksize = config.ChunkSize
+	}
+	c.logger.WithFields(logrus.Fields{"event": "app config", "app": app, "chunkSize": c.localChunksize}).Debug("override server config")
+}
@@ -0,0 +1,112 @@
+package rtmp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultIngestBitrateWindow = 10 * time.Second
+
+/*
+ * guardIngestBitrate runs on the read loop with the bytes acked, like scaleAckWindow:
+ *   1. bytes are summed over IngestBitrateWindow, the average over a whole window is what counts,
+ *      so a keyframe burst alone doesn't trip it.
+ *   2. a publisher above MaxIngestBitrate gets NetStream.Publish.Rejected and is disconnected, the
+ *      next read fails and publishing ends.
+ */
+func (c *Conn) guardIngestBitrate(size uint32) {
+	max := c.config.MaxIngestBitrate
+	if max <= 0 || !c.isPublisher || c.ingestRejected {
+		return
+	}
+	window := c.config.IngestBitrateWindow
+	if window <= 0 {
+		window = defaultIngestBitrateWindow
+	}
+
+	now := timeNow()
+	if c.ingestStart.IsZero() {
+		c.ingestStart = now
+	}
+	c.ingestBytes += uint64(size)
+
+	elapsed := now.Sub(c.ingestStart)
+	if elapsed < window {
+		return
+	}
+	bitrate := int64(float64(c.ingestBytes*8) / elapsed.Seconds())
+	c.ingestStart, c.ingestBytes = now, 0
+	if bitrate <= max {
+		return
+	}
+
+	c.ingestRejected = true
+	c.logger.WithFields(logrus.Fields{"event": "ingest bitrate", "remote": c.RemoteAddr().String(), "streamKey": c.streamKey, "bitrate": bitrate, "window": window}).
+		Errorf("above %d bps, disconnect publisher", max)
+
+	streamID, _ := c.streamIDOf(streamRolePublish)
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second)) // a peer not reading mustn't hold the read loop
+	event := amf.Object{
+		"level":       "error",
+		"code":        "NetStream.Publish.Rejected",
+		"description": fmt.Sprintf("Ingest bitrate %d bps above the limit of %d bps.", bitrate, max),
+	}
+	_ = c.writeCommandMessage(3, streamID, "onStatus", 0, nil, event)
+	_ = c.Close()
+}
+
+/*
+ * reportIngestBitrate runs on the read loop with the bytes acked, like guardIngestBitrate:
+ *   1. bytes are summed over BitrateReportInterval, the publisher gets the average over it in bps.
+ *   2. the report adds what players of the stream dropped so far, by queue depth or latency budget,
+ *      and how many of them dropped any, a hint the publisher may lower its bitrate.
+ */
+func (c *Conn) reportIngestBitrate(size uint32) {
+	interval := c.config.BitrateReportInterval
+	if interval <= 0 || !c.isPublisher || c.ingestRejected || c.ssMgr == nil {
+		return
+	}
+
+	now := timeNow()
+	if c.reportStart.IsZero() {
+		c.reportStart = now
+	}
+	c.reportBytes += uint64(size)
+
+	elapsed := now.Sub(c.reportStart)
+	if elapsed < interval {
+		return
+	}
+	bitrate := int64(float64(c.reportBytes*8) / elapsed.Seconds())
+	c.reportStart, c.reportBytes = now, 0
+
+	var droppedAudio, droppedVideo uint64
+	dropping := 0
+	if val, ok := c.ssMgr.streamMap.Load(c.streamKey); ok {
+		for _, info := range val.(*streamSource).Subscribers() {
+			droppedAudio += info.DroppedAudio
+			droppedVideo += info.DroppedVideo
+			if info.DroppedAudio+info.DroppedVideo > 0 {
+				dropping++
+			}
+		}
+	}
+
+	streamID, _ := c.streamIDOf(streamRolePublish)
+	event := amf.Object{
+		"level":               "status",
+		"code":                "NetStream.Publish.BitrateReport",
+		"description":         fmt.Sprintf("Ingest bitrate %d bps.", bitrate),
+		"bitrate":             float64(bitrate),
+		"interval":            float64(elapsed / time.Millisecond),
+		"droppedAudio":        float64(droppedAudio),
+		"droppedVideo":        float64(droppedVideo),
+		"droppingSubscribers": float64(dropping),
+	}
+	if err := c.writeCommandMessage(3, streamID, "onStatus", 0, nil, event); err != nil {
+		c.logError(c.logger.WithFields(logrus.Fields{"event": "bitrate report", "streamKey": c.streamKey}), err)
+	}
+}
@@ -1,7 +1,9 @@
 package rtmp
 
 import (
+	"bytes"
 	"playground/pkg/av"
+	"time"
 )
 
 type SpecialCache struct {
@@ -13,16 +15,26 @@ func NewSpecialCache() *SpecialCache {
 	return &SpecialCache{}
 }
 
+// Write keeps a reference of pkt and releases the one it replaces
 func (c *SpecialCache) Write(pkt *av.Packet) {
+	pkt.Retain()
+	if c.pkt != nil {
+		c.pkt.Release()
+	}
 	c.pkt = pkt
 	c.full = true
 }
 
 type Cache struct {
-	//TODO:gop
 	videoSeq *SpecialCache
 	audioSeq *SpecialCache
 	metaData *SpecialCache
+
+	gopDuration time.Duration // media kept from a keyframe on, 0 disables the GOP cache
+	gop         []*av.Packet  // audio and video since the first cached keyframe
+	keyIdx      []int         // index in gop of every cached keyframe
+
+	keyFrameOnly bool // the GOP cache keeps the latest keyframe only, whatever gopDuration
 }
 
 func NewCache() *Cache {
@@ -44,14 +56,17 @@ func (c *Cache) Write(pkt *av.Packet) {
 				if ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR {
 					c.audioSeq.Write(pkt)
 					return
-				} else {
-					return
 				}
+			} else {
+				return
 			}
 		} else {
 			vh, ok := pkt.Header.(av.VideoPacketHeader)
 			if ok {
 				if vh.IsSeq() {
+					if old := c.videoSeq.pkt; old != nil && !bytes.Equal(old.Data, pkt.Data) {
+						c.resetGOP() // decodes with the old parameter sets only, e.g. a resolution change
+					}
 					c.videoSeq.Write(pkt)
 					return
 				}
@@ -61,5 +76,93 @@ func (c *Cache) Write(pkt *av.Packet) {
 		}
 	}
 
-	//TODO: GOP cache
+	c.writeGOP(pkt)
+}
+
+// reset releases every cached packet, the GOP cache keeps its duration
+func (c *Cache) reset() {
+	for _, sc := range []*SpecialCache{c.videoSeq, c.audioSeq, c.metaData} {
+		if sc.pkt != nil {
+			sc.pkt.Release()
+		}
+		sc.pkt, sc.full = nil, false
+	}
+	c.resetGOP()
+}
+
+// resetGOP releases the GOP cache, new players wait for the next keyframe
+func (c *Cache) resetGOP() {
+	for _, pkt := range c.gop {
+		pkt.Release()
+	}
+	c.gop, c.keyIdx = nil, nil
+}
+
+// writeGOP appends media from the first keyframe on, then drops the oldest GOPs as long as
+// what is left still spans gopDuration
+func (c *Cache) writeGOP(pkt *av.Packet) {
+	vh, ok := pkt.Header.(av.VideoPacketHeader)
+	isKeyFrame := ok && pkt.IsVideo && vh.IsKeyFrame()
+	if c.keyFrameOnly {
+		if isKeyFrame {
+			c.resetGOP()
+			pkt.Retain()
+			c.gop, c.keyIdx = append(c.gop, pkt), append(c.keyIdx, 0)
+		}
+		return
+	}
+	if c.gopDuration <= 0 {
+		return
+	}
+
+	if isKeyFrame {
+		c.keyIdx = append(c.keyIdx, len(c.gop))
+	} else if len(c.gop) == 0 {
+		return // wait for a keyframe
+	}
+	pkt.Retain()
+	c.gop = append(c.gop, pkt)
+
+	last := pkt.TimeStamp
+	limit := uint32(c.gopDuration / time.Millisecond)
+	n := 0
+	for n+1 < len(c.keyIdx) {
+		ts := c.gop[c.keyIdx[n+1]].TimeStamp
+		if ts > last || last-ts < limit {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		drop := c.keyIdx[n]
+		for _, old := range c.gop[:drop] {
+			old.Release()
+		}
+		c.gop = append(c.gop[:0:0], c.gop[drop:]...)
+		c.keyIdx = c.keyIdx[n:]
+		for i := range c.keyIdx {
+			c.keyIdx[i] -= drop
+		}
+	}
+}
+
+// gopFrom returns cached media from the oldest keyframe within depth of the last packet,
+// or from the last keyframe if no keyframe is that recent
+func (c *Cache) gopFrom(depth time.Duration) []*av.Packet {
+	if len(c.keyIdx) == 0 {
+		return nil
+	}
+
+	last := c.gop[len(c.gop)-1].TimeStamp
+	limit := uint32(depth / time.Millisecond)
+	start := c.keyIdx[len(c.keyIdx)-1]
+	for i := len(c.keyIdx) - 2; i >= 0; i-- {
+		ts := c.gop[c.keyIdx[i]].TimeStamp
+		if ts > last || last-ts > limit {
+			break
+		}
+		start = c.keyIdx[i]
+	}
+
+	return c.gop[start:]
 }
@@ -3,6 +3,9 @@ package rtmp
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -30,6 +33,10 @@ type ChunkStream struct {
 	ChunkHeader
 	ChunkBody []byte
 
+	// ExplicitCsid writes on Csid as set, e.g. a relay keeping the csids of its source or a custom
+	// message stream of Conn.AllocCSID, otherwise audio goes on csid 4, video and data on 6
+	ExplicitCsid bool
+
 	msgHdrSize int
 	msgHdrBuf  []byte // At most 11bytes
 
@@ -37,6 +44,7 @@ type ChunkStream struct {
 	gotBodyFull  bool
 	bodyIndex    uint32
 	bodyRemain   uint32
+	assembling   uint32 // body bytes reserved against Config.MaxConnMemory, see assembleBody
 }
 
 func newChunkBasicHeader(fmt uint8, csid uint32) ChunkBasicHeader {
@@ -81,19 +89,34 @@ func (cs *ChunkStream) setMessageHeaderBuffer(size int) *ChunkStream {
 
 func NewProtolControlMessage(typeID RtmpMsgTypeID, length uint32, value uint32) *ChunkStream {
 	cs := newChunkStream()
-	cs = cs.setBasicHeader(0, 2)
+	cs = cs.setBasicHeader(0, csidProtocolControl)
 	cs = cs.setMessageHeader(0, length, typeID, 0)
 	cs = cs.setChunkBodyBuffer(length) // length must >= 4
 
-	uintAsbyteSlice(value, cs.ChunkBody[:4], true) // fill chunk body
+	binary.BigEndian.PutUint32(cs.ChunkBody[:4], value) // fill chunk body
+
+	return cs
+}
+
+// limit types of SetPeerBandwidth
+const (
+	PeerBandwidthHard    byte = 0 // limit output to the window size
+	PeerBandwidthSoft    byte = 1 // limit to the window size or the limit in effect, whichever is smaller
+	PeerBandwidthDynamic byte = 2 // hard if the previous limit was hard, ignored otherwise
+)
 
+// NewSetPeerBandwidthMessage asks the peer to limit its output to windowSize unacknowledged bytes, body is
+// the 4 byte window size and the 1 byte limit type
+func NewSetPeerBandwidthMessage(windowSize uint32, limitType byte) *ChunkStream {
+	cs := NewProtolControlMessage(MsgSetPeerBandwidth, 5, windowSize)
+	cs.ChunkBody[4] = limitType
 	return cs
 }
 
 func NewUserControlMessage(eventType, buflen uint32) *ChunkStream {
 	buflen += 2
 	cs := newChunkStream()
-	cs = cs.setBasicHeader(0, 2)
+	cs = cs.setBasicHeader(0, csidProtocolControl)
 	cs = cs.setMessageHeader(0, buflen, MsgUserControlMessage, 1)
 	cs = cs.setChunkBodyBuffer(buflen)
 
@@ -112,19 +135,39 @@ func newChunkStreamForRead(fmt uint8, csid uint32) *ChunkStream {
 
 //read one chunk stream fully
 func (c *Conn) readChunkStream(basicHdrBuf []byte) (*ChunkStream, error) {
+	hdrBuf := basicHdrBuf
+	pooled, err := c.getHeaderBuf()
+	if err != nil {
+		return nil, errors.Wrap(err, "read chunk basic header")
+	}
+	if pooled != nil {
+		hdrBuf = pooled[:]
+		defer c.putHeaderBuf(pooled)
+	}
+
 	for {
-		fmt, csid, err := c.readChunkBasicHeader(basicHdrBuf)
+		fmt, csid, err := c.readChunkBasicHeader(hdrBuf)
 		if err != nil {
 			return nil, errors.Wrap(err, "read chunk basic header")
 		}
 
 		cs, ok := c.chunks[csid]
 		if !ok {
-			cs = newChunkStreamForRead(fmt, csid)
+			if max := c.maxChunkStreams(); len(c.chunks) >= max {
+				return nil, errors.Wrapf(errTooManyChunkStreams, "csid %d beyond %d chunk streams", csid, max)
+			}
+			if err := c.reserveReadMemory(chunkStreamMemory); err != nil {
+				return nil, errors.Wrapf(err, "csid %d", csid)
+			}
+			if c.headerBufPool() != nil { // headers are read into hdrBuf
+				cs = newChunkStream().setBasicHeader(fmt, csid)
+			} else {
+				cs = newChunkStreamForRead(fmt, csid)
+			}
 			c.chunks[cs.Csid] = cs
 		}
 
-		if err := c.readChunkMessageHeader(cs, fmt); err != nil {
+		if err := c.readChunkMessageHeader(cs, fmt, hdrBuf); err != nil {
 			return nil, errors.Wrap(err, "read chunk message header")
 		}
 
@@ -133,7 +176,10 @@ func (c *Conn) readChunkStream(basicHdrBuf []byte) (*ChunkStream, error) {
 		}
 
 		if cs.gotBodyFull {
-			c.onReadChunkStreamSucc(cs)
+			c.bodyDone(cs)
+			if err := c.onReadChunkStreamSucc(cs); err != nil {
+				return nil, err
+			}
 			return cs, nil
 		}
 	}
@@ -168,7 +214,13 @@ func (c *Conn) readChunkBasicHeader(basicHdrBuf []byte) (uint8, uint32, error) {
 	return fmt, csid, nil
 }
 
-func (c *Conn) readChunkMessageHeader(cs *ChunkStream, fmt uint8) error {
+// readChunkMessageHeader reads into the header buffer of cs, or hdrBuf for a chunk stream without one
+func (c *Conn) readChunkMessageHeader(cs *ChunkStream, fmt uint8, hdrBuf []byte) error {
+	msgHdrBuf := cs.msgHdrBuf
+	if msgHdrBuf == nil {
+		msgHdrBuf = hdrBuf
+	}
+
 	switch fmt {
 	case 0:
 		cs.msgHdrSize = 11
@@ -182,7 +234,7 @@ func (c *Conn) readChunkMessageHeader(cs *ChunkStream, fmt uint8) error {
 
 	var buf []byte
 	if cs.msgHdrSize > 0 {
-		buf = cs.msgHdrBuf[0:cs.msgHdrSize]
+		buf = msgHdrBuf[0:cs.msgHdrSize]
 		if nr, err := c.Read(buf); err != nil || nr != cs.msgHdrSize {
 			return errors.Wrapf(err, "read %d bytes message header", cs.msgHdrSize)
 		}
@@ -196,7 +248,14 @@ func (c *Conn) readChunkMessageHeader(cs *ChunkStream, fmt uint8) error {
 	 *   4bytes: stream id,          fmt=0
 	 */
 	if fmt <= 2 {
-		cs.ExtendedTimeStamp = byteSliceAsUint(buf[0:3], true) // timestamp (delta)
+		if cs.bodyRemain > 0 { // messages on one chunk stream never interleave, the peer gave up the partial one
+			c.logger.WithFields(logrus.Fields{"event": "readChunkMessageHeader", "csid": cs.Csid, "fmt": fmt}).
+				Warnf("new message header with %d bytes of message stream %d pending, discard it", cs.bodyRemain, cs.MsgStreamID)
+			c.putBody(cs, cs.ChunkBody) // replaced by the body of the new message below
+		}
+
+		cs.Fmt = fmt // a fmt 3 chunk starting a new message repeats the delta of the last header
+		cs.ExtendedTimeStamp = getUint24BE(buf[0:3]) // timestamp (delta)
 		cs.timeExtended = cs.ExtendedTimeStamp >= 0xffffff
 
 		if !cs.timeExtended {
@@ -209,48 +268,80 @@ func (c *Conn) readChunkMessageHeader(cs *ChunkStream, fmt uint8) error {
 		}
 
 		if fmt <= 1 {
-			payloadLength := byteSliceAsUint(buf[3:6], true) // payload length
+			payloadLength := getUint24BE(buf[3:6]) // payload length
 			cs.MsgLength = payloadLength
 
-			msgTypeID := byteSliceAsUint(buf[6:7], true) // message type
+			msgTypeID := uint32(buf[6]) // message type
 			cs.MsgTypeID = RtmpMsgTypeID(msgTypeID)
 
+			if max := c.maxCommandMessageSize(); isCommandMessage(cs.MsgTypeID) && cs.MsgLength > max {
+				return errors.Wrapf(errCommandMessageTooLarge, "%d bytes message type %d, max %d", cs.MsgLength, cs.MsgTypeID, max)
+			}
+
 			if fmt == 0 {
-				msgStreamID := byteSliceAsUint(buf[7:11], false) // stream id
+				msgStreamID := binary.LittleEndian.Uint32(buf[7:11]) // stream id
 				cs.MsgStreamID = msgStreamID
 			}
 		}
 
+		if cs.timeExtended { // the 4 byte timestamp (delta) follows the header
+			ts, err := c.readUint(msgHdrBuf[0:4], true)
+			if err != nil {
+				return errors.Wrap(err, "read extended timestamp")
+			}
+			if cs.Fmt == 0 {
+				cs.TimeStamp = ts
+			} else {
+				cs.TimeStamp += ts
+			}
+		}
+
+		if err := c.assembleBody(cs); err != nil {
+			return err
+		}
 		cs.gotBodyFull = false
 		cs.bodyIndex = 0
 		cs.bodyRemain = cs.MsgLength
-		cs.ChunkBody = make([]byte, int(cs.MsgLength))
+		cs.ChunkBody = c.getBody(int(cs.MsgLength))
 	} else {
 		if cs.bodyRemain == 0 {
 			switch cs.Fmt {
 			case 0:
 				if cs.timeExtended {
 					b := make([]byte, 4)
-					cs.TimeStamp, _ = c.readUint(b, true)
+					ts, err := c.readUint(b, true)
+					if err != nil {
+						return errors.Wrap(err, "read extended timestamp")
+					}
+					cs.TimeStamp = ts
 				}
 			case 1, 2:
 				timedelta := cs.ExtendedTimeStamp
 				if cs.timeExtended {
 					b := make([]byte, 4)
-					timedelta, _ = c.readUint(b, true)
+					var err error
+					if timedelta, err = c.readUint(b, true); err != nil {
+						return errors.Wrap(err, "read extended timestamp delta")
+					}
 				}
 				cs.TimeStamp += timedelta
 			}
 
+			if err := c.assembleBody(cs); err != nil {
+				return err
+			}
 			cs.gotBodyFull = false
 			cs.bodyIndex = 0
 			cs.bodyRemain = cs.MsgLength
-			cs.ChunkBody = make([]byte, int(cs.MsgLength))
+			cs.ChunkBody = c.getBody(int(cs.MsgLength))
 		} else {
-			if cs.timeExtended {
+			if cs.timeExtended { // some peers repeat the extended timestamp on every chunk, others don't
 				b, err := c.reader.Peek(4)
-				if err != nil {
-					return errors.Wrap(err, "peek 4 bytes")
+				if err != nil { // the conn is done, don't leave a message half assembled
+					c.putBody(cs, cs.ChunkBody)
+					c.bodyDone(cs)
+					cs.discardPartial()
+					return errors.Wrap(err, "peek extended timestamp")
 				}
 
 				tmpTimeStamp := binary.BigEndian.Uint32(b)
@@ -264,12 +355,39 @@ func (c *Conn) readChunkMessageHeader(cs *ChunkStream, fmt uint8) error {
 	return nil
 }
 
+// discardPartial drops the message being assembled, the next chunk must start a new one
+func (cs *ChunkStream) discardPartial() {
+	cs.ChunkBody = nil
+	cs.gotBodyFull = false
+	cs.bodyIndex = 0
+	cs.bodyRemain = 0
+}
+
+// resetChunkStreams discards the chunk streams read so far with a message being assembled, e.g. once a
+// publisher stops: bodies go back to the pool, their memory is released and the next message read on
+// the conn must come with a full header
+func (c *Conn) resetChunkStreams() {
+	for _, cs := range c.chunks {
+		if cs.bodyRemain > 0 { // a body read in full is owned by whom it was handed over to
+			c.putBody(cs, cs.ChunkBody)
+		}
+		c.bodyDone(cs)
+		cs.discardPartial()
+	}
+	_ = c.reserveReadMemory(-int64(len(c.chunks)) * chunkStreamMemory)
+	c.chunks = make(map[uint32]*ChunkStream)
+}
+
 func (c *Conn) readChunkMessageBody(cs *ChunkStream) error {
 	size := cs.bodyRemain
 	if size > c.remoteChunkSize {
 		size = c.remoteChunkSize //important: read chunk from peer accord to min(remoteChunkSize, cs.remain)
 	}
 
+	if end := uint64(cs.bodyIndex) + uint64(size); end > uint64(len(cs.ChunkBody)) { // inconsistent assembly state
+		return errors.Errorf("chunk of csid %d overflows body: %d bytes at %d, body %d bytes", cs.Csid, size, cs.bodyIndex, len(cs.ChunkBody))
+	}
+
 	buf := cs.ChunkBody[cs.bodyIndex : cs.bodyIndex+size]
 	if nr, err := c.Read(buf); err != nil || nr != int(size) {
 		return errors.Wrapf(err, "read %d bytes, autual: %d", size, nr)
@@ -287,11 +405,44 @@ func (c *Conn) readChunkMessageBody(cs *ChunkStream) error {
 
 // write one chunk stream fully
 func (c *Conn) writeChunkStream(cs *ChunkStream) error {
-	switch cs.MsgTypeID {
-	case MsgAudioMessage:
-		cs.Csid = 4
-	case MsgVideoMessage, MsgAMF3DataMessage, MSGAMF0DataMessage:
-		cs.Csid = 6
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	return c.writeChunkStreamLocked(cs)
+}
+
+/*
+ * setLocalChunkSize announces size with SetChunkSize and chunks every later message by it, e.g. a
+ * relay client towards its upstream. Chunk sizes are per direction: what the peer announced only
+ * affects reading, see onReadChunkStreamSucc. The switch happens under writeMux right after the
+ * SetChunkSize message, so no message of another writer is chunked by a size the peer doesn't know yet.
+ */
+func (c *Conn) setLocalChunkSize(size uint32) error {
+	if size == 0 || size > maxChunkSize {
+		return errors.Errorf("chunk size %d out of range [1, %d]", size, maxChunkSize)
+	}
+
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	if err := c.writeChunkStreamLocked(NewProtolControlMessage(MsgSetChunkSize, 4, size)); err != nil {
+		return errors.Wrap(err, "send SetChunkSize")
+	}
+	c.localChunksize = size
+	return nil
+}
+
+// must hold writeMux
+func (c *Conn) writeChunkStreamLocked(cs *ChunkStream) error {
+	switch {
+	case cs.ExplicitCsid:
+		if err := checkExplicitCSID(cs); err != nil {
+			return err
+		}
+	case cs.MsgTypeID == MsgAudioMessage:
+		cs.Csid = csidAudio
+	case cs.MsgTypeID == MsgVideoMessage, cs.MsgTypeID == MsgAMF3DataMessage, cs.MsgTypeID == MSGAMF0DataMessage:
+		cs.Csid = csidVideo
 	}
 
 	totalLen := uint32(0)
@@ -329,6 +480,9 @@ func (c *Conn) writeChunkStream(cs *ChunkStream) error {
 		}
 	}
 
+	if c.batching || (c.deferringFlush > 0 && c.writeBufferLen < maxDeferredWriteSize) {
+		return nil
+	}
 	if err := c.Flush(); err != nil {
 		return errors.Wrap(err, "flush chunk stream")
 	}
@@ -336,18 +490,121 @@ func (c *Conn) writeChunkStream(cs *ChunkStream) error {
 	return nil
 }
 
-func (c *Conn) onReadChunkStreamSucc(cs *ChunkStream) {
+// onReadChunkStreamSucc handles protocol control messages, an error fails the conn
+func (c *Conn) onReadChunkStreamSucc(cs *ChunkStream) error {
 	switch cs.MsgTypeID {
 	case MsgSetChunkSize:
-		c.remoteChunkSize = binary.BigEndian.Uint32(cs.ChunkBody)
+		if len(cs.ChunkBody) < 4 {
+			return errors.Wrapf(errInvalidChunkSize, "%d bytes body", len(cs.ChunkBody))
+		}
+		size := binary.BigEndian.Uint32(cs.ChunkBody)
+		if size == 0 || size > maxRecvChunkSize { // the first bit must be 0
+			return errors.Wrapf(errInvalidChunkSize, "%#x out of range [1, %#x]", size, maxRecvChunkSize)
+		}
+		c.remoteChunkSize = size
 		c.logger.WithFields(logrus.Fields{"event": "save remoteChunkSize", "data": c.remoteChunkSize}).Trace("")
+	case MsgAcknowledgement:
+		c.onAcknowledgement(cs)
 	case MsgWindowAcknowledgementSize:
 		c.remoteWindowAckSize = binary.BigEndian.Uint32(cs.ChunkBody)
 		c.logger.WithFields(logrus.Fields{"event": "save remoteWindowAckSize", "data": c.remoteWindowAckSize}).Trace("")
+	case MsgUserControlMessage:
+		c.onUserControlMessage(cs)
 	default:
 	}
 
 	c.ack(cs.MsgLength)
+	return nil
+}
+
+// onAcknowledgement saves the bytes the peer received so far, see Conn.peerAcked
+func (c *Conn) onAcknowledgement(cs *ChunkStream) {
+	if len(cs.ChunkBody) < 4 {
+		c.logger.WithField("event", "recv ACK").Errorf("invalid body len=%d", len(cs.ChunkBody))
+		return
+	}
+
+	seq := binary.BigEndian.Uint32(cs.ChunkBody)
+	atomic.StoreUint32(&c.peerAcked, seq)
+	c.logger.WithFields(logrus.Fields{"event": "recv ACK", "data": seq}).Trace("")
+
+	c.peerAckMux.Lock()
+	if c.peerAckWake != nil {
+		close(c.peerAckWake)
+		c.peerAckWake = nil
+	}
+	c.peerAckMux.Unlock()
+}
+
+// unacked is what was written to the peer beyond its last Acknowledgement, 0 before the first one: a peer
+// never acknowledging is never waited for
+func (c *Conn) unacked() uint32 {
+	acked := atomic.LoadUint32(&c.peerAcked)
+	if acked == 0 {
+		return 0
+	}
+	return uint32(atomic.LoadInt64(&c.bytesOut)) - acked // sequence numbers wrap at 4GB
+}
+
+// peerAckWaiter returns a channel closed by the next Acknowledgement
+func (c *Conn) peerAckWaiter() <-chan struct{} {
+	c.peerAckMux.Lock()
+	defer c.peerAckMux.Unlock()
+
+	if c.peerAckWake == nil {
+		c.peerAckWake = make(chan struct{})
+	}
+	return c.peerAckWake
+}
+
+/*
+ * user control message body:
+ *   2bytes: event type
+ *   4bytes: stream id,        SetBufferLength
+ *   4bytes: buffer length,    SetBufferLength
+ *   4bytes: timestamp,        PingRequest/PingResponse
+ */
+func (c *Conn) onUserControlMessage(cs *ChunkStream) {
+	logger := c.logger.WithFields(logrus.Fields{"event": "recv user control message"})
+	if len(cs.ChunkBody) < 2 {
+		logger.Errorf("invalid body len=%d", len(cs.ChunkBody))
+		return
+	}
+
+	eventType := uint32(binary.BigEndian.Uint16(cs.ChunkBody[0:2]))
+	switch eventType {
+	case setBufferLen:
+		if len(cs.ChunkBody) < 10 {
+			logger.Errorf("invalid SetBufferLength body len=%d", len(cs.ChunkBody))
+			return
+		}
+
+		streamID := binary.BigEndian.Uint32(cs.ChunkBody[2:6])
+		bufLen := binary.BigEndian.Uint32(cs.ChunkBody[6:10])
+
+		c.userCtrlMux.Lock()
+		if c.bufferLengths == nil {
+			c.bufferLengths = make(map[uint32]uint32)
+		}
+		c.bufferLengths[streamID] = bufLen
+		c.userCtrlMux.Unlock()
+		logger.WithFields(logrus.Fields{"streamID": streamID, "bufferLength": bufLen}).Trace("SetBufferLength")
+	case pingRequest:
+		if len(cs.ChunkBody) < 6 {
+			logger.Errorf("invalid PingRequest body len=%d", len(cs.ChunkBody))
+			return
+		}
+
+		respCs := NewUserControlMessage(pingResponse, 4)
+		copy(respCs.ChunkBody[2:6], cs.ChunkBody[2:6])
+		c.runOffReadLoop(func() {
+			if err := c.writeChunkStream(respCs); err != nil {
+				c.logError(logger.WithField("action", "send PingResponse"), err)
+			}
+		})
+	default:
+		logger.Tracef("ignore event type %d", eventType)
+	}
 }
 
 func (c *Conn) ack(size uint32) {
@@ -358,41 +615,86 @@ func (c *Conn) ack(size uint32) {
 	}
 
 	c.ackSeqNumber += size
-	if c.ackSeqNumber >= c.remoteWindowAckSize { //超过窗口通告大小，回复ACK
+	if c.config.AckInterval > 0 {
+		c.scaleAckWindow(size)
+	}
+	c.guardIngestBitrate(size)
+	c.reportIngestBitrate(size)
+
+	if c.ackSeqNumber >= c.ackWindowSize() { //超过窗口通告大小，回复ACK
 		cs := NewProtolControlMessage(MsgAcknowledgement, 4, c.ackSeqNumber)
-		if err := c.writeChunkStream(cs); err != nil {
-			c.logger.WithFields(logrus.Fields{"event": "send ACK"}).Error(err)
+		if c.playsInBand() {
+			if !c.writeAckAsync(cs) {
+				return // one in flight, the count goes on to the next ACK
+			}
+		} else if err := c.writeChunkStream(cs); err != nil {
+			c.logError(c.logger.WithFields(logrus.Fields{"event": "send ACK"}), err)
 		}
 
 		c.ackSeqNumber = 0
 	}
 }
 
+// scaleAckWindow measures ingest bitrate every second and sizes the ack window to AckInterval worth of bytes
+func (c *Conn) scaleAckWindow(size uint32) {
+	now := timeNow()
+	if c.ackRateStart.IsZero() {
+		c.ackRateStart = now
+	}
+	c.ackRateBytes += size
+
+	if elapsed := now.Sub(c.ackRateStart); elapsed >= time.Second {
+		bytesPerSec := float64(c.ackRateBytes) / elapsed.Seconds()
+		c.ackWindow = uint32(bytesPerSec * c.config.AckInterval.Seconds())
+		c.logger.WithFields(logrus.Fields{"event": "scale ack window", "bytesPerSec": uint64(bytesPerSec), "data": c.ackWindow}).Trace("")
+
+		c.ackRateStart = now
+		c.ackRateBytes = 0
+	}
+}
+
+// ackWindowSize is the scaled window once measured, never beyond the window peer announced or
+// Config.MaxAckWindowSize if above it
+func (c *Conn) ackWindowSize() uint32 {
+	if c.ackWindow == 0 {
+		return c.remoteWindowAckSize
+	}
+
+	max := c.remoteWindowAckSize
+	if c.config.MaxAckWindowSize > max {
+		max = c.config.MaxAckWindowSize
+	}
+	if c.ackWindow > max {
+		return max
+	}
+	return c.ackWindow
+}
+
 func (c *Conn) writeChunkBasicHeader(fmt uint8, csid uint32) error {
 	h := uint32(fmt) << 6
 
 	switch {
 	case csid < 64:
 		h |= csid
-		if err := c.writeUint(h, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(h, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 	case csid-64 < 256:
 		h |= 0
-		if err := c.writeUint(h, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(h, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 
-		if err := c.writeUint(csid-64, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(csid-64, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 	case csid-64 < 65536:
 		h |= 1
-		if err := c.writeUint(h, c.basicHdrBuf[0:1], false); err != nil {
+		if err := c.writeUint(h, c.writeHdrBuf[0:1], false); err != nil {
 			return err
 		}
 
-		if err := c.writeUint(csid-64, c.basicHdrBuf[0:2], false); err != nil {
+		if err := c.writeUint(csid-64, c.writeHdrBuf[0:2], false); err != nil {
 			return err
 		}
 	}
@@ -400,19 +702,23 @@ func (c *Conn) writeChunkBasicHeader(fmt uint8, csid uint32) error {
 	return nil
 }
 
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func (c *Conn) writeChunkMessageHeader(cs *ChunkStream) error {
 	if cs.msgHdrBuf == nil {
 		cs.msgHdrBuf = make([]byte, 11)
 	}
-	ts := cs.TimeStamp
+	extended := cs.TimeStamp >= 0xffffff // the 4 byte timestamp follows the header, on fmt 3 chunks as well
 	if cs.Fmt == 3 {
 		goto END
 	}
 
-	if cs.TimeStamp > 0xffffff {
-		ts = 0xffffff
-	}
-	if err := c.writeUint(ts, cs.msgHdrBuf[0:3], true); err != nil {
+	if err := c.writeUint(minUint32(cs.TimeStamp, 0xffffff), cs.msgHdrBuf[0:3], true); err != nil {
 		return err
 	}
 
@@ -438,7 +744,7 @@ func (c *Conn) writeChunkMessageHeader(cs *ChunkStream) error {
 	}
 
 END:
-	if ts > 0xffffff {
+	if extended {
 		if err := c.writeUint(cs.TimeStamp, cs.msgHdrBuf[0:4], true); err != nil {
 			return err
 		}
@@ -448,61 +754,39 @@ END:
 }
 
 func (c *Conn) writeChunkMessageBody(cs *ChunkStream, start, chunkSize uint32) error {
-	buf := cs.ChunkBody[start : start+chunkSize]
-	if _, err := c.Write(buf); err != nil {
-		return err
+	if c.deferringFlush > 0 && c.config != nil && c.config.BufferPool != nil { // the body may be reused before the flush
+		_, _ = c.Write(cs.ChunkBody[start : start+chunkSize])
+		return nil
 	}
+	c.writeNoCopy(cs.ChunkBody[start : start+chunkSize])
 
 	return nil
 }
 
 func (c *Conn) readUint(b []byte, bigEndian bool) (uint32, error) {
 	if nr, err := c.Read(b); err != nil {
-		c.logger.WithFields(logrus.Fields{"event": fmt.Sprintf("read %d byte, actual: %d", len(b), nr)}).Error(err)
+		logger := c.logger.WithFields(logrus.Fields{"event": fmt.Sprintf("read %d byte, actual: %d", len(b), nr)})
+		if err == io.EOF { // peer closed between reads, callers tell whether it's expected
+			logger.Debug(err)
+		} else {
+			c.logError(logger, err)
+		}
 		return 0, err
 	}
 
-	return byteSliceAsUint(b, bigEndian), nil
+	return getUint(b, bigEndian), nil
 }
 
 func (c *Conn) writeUint(val uint32, buf []byte, bigEndian bool) error {
-	uintAsbyteSlice(val, buf, bigEndian)
+	putUint(buf, val, bigEndian)
 	if nw, err := c.Write(buf); err != nil {
-		c.logger.WithFields(logrus.Fields{"event": fmt.Sprintf("write %d byte, actual: %d", len(buf), nw)}).Error(err)
+		c.logError(c.logger.WithFields(logrus.Fields{"event": fmt.Sprintf("write %d byte, actual: %d", len(buf), nw)}), err)
 		return err
 	}
 
 	return nil
 }
 
-func uintAsbyteSlice(val uint32, b []byte, bigEndian bool) {
-	nbytes := len(b)
-	for i := 0; i < nbytes; i++ {
-		if bigEndian {
-			v := val >> ((nbytes - i - 1) << 3)
-			b[i] = byte(v) & 0xff
-		} else {
-			b[i] = byte(val) & 0xff
-			val = val >> 8
-		}
-	}
-}
-
-func byteSliceAsUint(b []byte, bigEndian bool) uint32 {
-	ret := uint32(0)
-
-	n := len(b)
-	for i := 0; i < n; i++ {
-		if bigEndian { // big endian
-			ret = ret<<8 + uint32(b[i])
-		} else { // little endian
-			ret += uint32(b[i]) << uint32(i*8)
-		}
-	}
-
-	return ret
-}
-
 type RtmpMsgTypeID uint32
 
 const (
@@ -524,3 +808,8 @@ const (
 	MsgAMF0CommandMessage                                  //0x14
 	MsgAggregateMessage           RtmpMsgTypeID = 22       //0x16
 )
+
+// isCommandMessage reports whether typeID is an AMF command, bounded by Config.MaxCommandMessageSize
+func isCommandMessage(typeID RtmpMsgTypeID) bool {
+	return typeID == MsgAMF0CommandMessage || typeID == MsgAMF3CommandMessage
+}
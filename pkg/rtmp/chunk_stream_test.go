@@ -0,0 +1,532 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadUserControlSetBufferLength(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+
+	body := []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0xb8} // stream 1, 3000ms
+	feedPeer(peer, encodeTestMessage(2, 0, MsgUserControlMessage, 0, body, 128))
+
+	if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	if bufLen := c.bufferLength(1); bufLen != 3000 {
+		t.Fatalf("got buffer length %d; want 3000", bufLen)
+	}
+	if bufLen := c.bufferLength(2); bufLen != 0 {
+		t.Fatalf("got buffer length %d for unknown stream; want 0", bufLen)
+	}
+}
+
+// countPeerAcks counts the 16 bytes ACK messages written to peer until it's closed
+func countPeerAcks(peer net.Conn) <-chan int {
+	count := make(chan int, 1)
+	go func() {
+		n := 0
+		b := make([]byte, 16)
+		for {
+			if _, err := io.ReadFull(peer, b); err != nil {
+				count <- n
+				return
+			}
+			if RtmpMsgTypeID(b[7]) == MsgAcknowledgement {
+				n++
+			}
+		}
+	}()
+	return count
+}
+
+func TestAckWindowScale(t *testing.T) {
+	var tests = []struct {
+		name        string
+		ackInterval time.Duration
+		maxWindow   uint32
+		minAcks     int
+		maxAcks     int
+		window      uint32 // once scaled
+	}{
+		// 1MB/s for 3s, 10000 bytes a message every 10ms, peer announced a 1MB window
+		{"fixed", 0, 0, 3, 3, 1000000},
+		{"scaled", 100 * time.Millisecond, 0, 1 + 18, 1 + 22, 100000},        // first second unscaled, then about 10 acks a second
+		{"never widened", 10 * time.Second, 0, 3, 3, 1000000},                // 10MB scaled window is capped at the announced one
+		{"widened", 1500 * time.Millisecond, 4000000, 1 + 1, 1 + 1, 1500000}, // 1.5MB, above the announced window and the default
+		{"widened to max", 10 * time.Second, 2000000, 1 + 1, 1 + 1, 2000000}, // capped at MaxAckWindowSize
+	}
+
+	defer func() { timeNow = time.Now }()
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.WindowAckSize = 1000000
+		config.AckInterval = tt.ackInterval
+		config.MaxAckWindowSize = tt.maxWindow
+
+		c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), config, "127.0.0.1:10001")
+		count := countPeerAcks(peer)
+
+		now := time.Unix(1600000000, 0)
+		timeNow = func() time.Time { return now }
+		for i := 0; i < 300; i++ {
+			c.ack(10000)
+			now = now.Add(10 * time.Millisecond)
+		}
+		c.Close()
+
+		if n := <-count; n < tt.minAcks || n > tt.maxAcks {
+			t.Fatalf("%s: got %d acks; want [%d, %d]", tt.name, n, tt.minAcks, tt.maxAcks)
+		}
+		if window := c.ackWindowSize(); window != tt.window {
+			t.Fatalf("%s: got window %d; want %d", tt.name, window, tt.window)
+		}
+	}
+}
+
+// chunksOf splits an encoded message of encodeTestMessage into its chunks
+func chunksOf(msg []byte, bodyLen, chunkSize int) [][]byte {
+	var chunks [][]byte
+	for n := 0; n == 0 || n < bodyLen; n += chunkSize {
+		size := chunkSize
+		if bodyLen-n < size {
+			size = bodyLen - n
+		}
+		if n == 0 {
+			size += 12
+		} else {
+			size++
+		}
+		chunks = append(chunks, msg[:size])
+		msg = msg[size:]
+	}
+	return chunks
+}
+
+func TestReadInterleavedMessageStreams(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+
+	body1 := make([]byte, 300)
+	body2 := make([]byte, 300)
+	for i := range body1 {
+		body1[i], body2[i] = 1, 2
+	}
+
+	// stream 1 on csid 4 and stream 2 on csid 5, chunk by chunk
+	var b []byte
+	chunks1 := chunksOf(encodeTestMessage(4, 40, MsgVideoMessage, 1, body1, 128), len(body1), 128)
+	chunks2 := chunksOf(encodeTestMessage(5, 80, MsgVideoMessage, 2, body2, 128), len(body2), 128)
+	for i := range chunks1 {
+		b = append(b, chunks1[i]...)
+		b = append(b, chunks2[i]...)
+	}
+	// csid 4 reused by stream 2 with a fmt 0 header, then a fmt 1 message inherits stream 2
+	b = append(b, encodeTestMessage(4, 120, MsgVideoMessage, 2, body2, 128)...)
+	fmt1 := encodeTestMessage(4, 0, MsgVideoMessage, 0, body2[:100], 128)
+	fmt1 = append([]byte{1<<6 | 4, 0, 0, 40}, fmt1[4:8]...) // timestamp delta 40, length, type
+	b = append(b, append(fmt1, body2[:100]...)...)
+	// partial message on csid 7 given up for a new one
+	b = append(b, chunksOf(encodeTestMessage(7, 200, MsgVideoMessage, 1, body2, 128), len(body2), 128)[0]...)
+	b = append(b, encodeTestMessage(7, 240, MsgVideoMessage, 1, body1, 128)...)
+	feedPeer(peer, b)
+
+	var tests = []struct {
+		csid      uint32
+		streamID  uint32
+		timeStamp uint32
+		body      []byte
+	}{
+		{4, 1, 40, body1},
+		{5, 2, 80, body2},
+		{4, 2, 120, body2},
+		{4, 2, 160, body2[:100]},
+		{7, 1, 240, body1},
+	}
+	for i, tt := range tests {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs.Csid != tt.csid || cs.MsgStreamID != tt.streamID || cs.TimeStamp != tt.timeStamp {
+			t.Fatalf("message %d: got csid %d stream %d timestamp %d; want %d %d %d",
+				i, cs.Csid, cs.MsgStreamID, cs.TimeStamp, tt.csid, tt.streamID, tt.timeStamp)
+		}
+		if string(cs.ChunkBody) != string(tt.body) {
+			t.Fatalf("message %d: got corrupted body of %d bytes", i, len(cs.ChunkBody))
+		}
+	}
+}
+
+func TestDiscardedBodyPooled(t *testing.T) {
+	pool := &testBufferPool{got: make(map[*byte]bool)}
+	config := newTestConfig()
+	config.BufferPool = pool
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+
+	body := make([]byte, 300)
+	b := chunksOf(encodeTestMessage(7, 200, MsgVideoMessage, 1, body, 128), len(body), 128)[0]
+	b = append(b, encodeTestMessage(7, 240, MsgVideoMessage, 1, body, 128)...)
+	feedPeer(peer, b)
+
+	cs, err := c.readChunkStream(c.basicHdrBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, put := pool.state(cs.ChunkBody); !got || put {
+		t.Fatalf("got pooled %v put %v for the body read; want pooled, not put", got, put)
+	}
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	if len(pool.got) != 2 || pool.puts != 1 {
+		t.Fatalf("got %d bodies, %d put; want the partial body put back", len(pool.got), pool.puts)
+	}
+}
+
+func TestMaxChunkStreams(t *testing.T) {
+	config := newTestConfig()
+	config.MaxChunkStreams = 100
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+
+	// distinct csids with 2 bytes basic header, 64-319
+	var b []byte
+	for csid := 64; csid < 64+101; csid++ {
+		msg := encodeTestMessage(0, 0, MsgVideoMessage, 1, testVideoInter, 128)
+		b = append(b, msg[0], byte(csid-64))
+		b = append(b, msg[1:]...)
+	}
+	feedPeer(peer, b)
+
+	for i := 0; i < 100; i++ {
+		if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+			t.Fatalf("csid %d within limit: %v", 64+i, err)
+		}
+	}
+	if _, err := c.readChunkStream(c.basicHdrBuf); errors.Cause(err) != errTooManyChunkStreams {
+		t.Fatalf("got err %v; want %v", err, errTooManyChunkStreams)
+	}
+	if len(c.chunks) != 100 {
+		t.Fatalf("got %d chunk streams; want 100", len(c.chunks))
+	}
+}
+
+func TestMaxCommandMessageSize(t *testing.T) {
+	config := newTestConfig()
+	config.MaxCommandMessageSize = 4096
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+
+	// header of a 1MB connect only, the body is never sent: rejected before read and decode
+	hdr := encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, make([]byte, 1<<20), 128)[:12]
+	feedPeer(peer, hdr)
+	if _, err := c.readChunkStream(c.basicHdrBuf); errors.Cause(err) != errCommandMessageTooLarge {
+		t.Fatalf("got err %v; want %v", err, errCommandMessageTooLarge)
+	}
+	if cs := c.chunks[3]; cs != nil && len(cs.ChunkBody) != 0 {
+		t.Fatalf("got %d bytes body buffer; want none allocated", len(cs.ChunkBody))
+	}
+
+	// media is not limited
+	c, peer = newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10002")
+	feedPeer(peer, encodeTestMessage(6, 0, MsgVideoMessage, 1, make([]byte, 8192), 128))
+	if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+		t.Fatalf("8KB video message: %v", err)
+	}
+}
+
+func TestReadChunkBodyOverflow(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+
+	// partial message whose body is smaller than what is still expected
+	cs := newChunkStreamForRead(0, 4)
+	cs.MsgLength = 300
+	cs.ChunkBody = make([]byte, 100)
+	cs.bodyIndex = 80
+	cs.bodyRemain = 220
+	c.chunks[4] = cs
+
+	feedPeer(peer, append([]byte{3<<6 | 4}, make([]byte, 128)...)) // fmt 3 continuation
+	_, err := c.readChunkStream(c.basicHdrBuf)
+	if err == nil || !strings.Contains(err.Error(), "overflows body") {
+		t.Fatalf("got err %v; want body overflow", err)
+	}
+}
+
+func TestWriteExplicitCsid(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	msgs := make(chan []*ChunkStream, 1)
+	go func() { msgs <- readTestMessages(t, newTestPeer(peer), 3) }()
+
+	for _, tt := range []struct {
+		typeID   RtmpMsgTypeID
+		csid     uint32
+		explicit bool
+	}{
+		{MsgVideoMessage, 7, true},
+		{MsgVideoMessage, 7, false},
+		{MsgAudioMessage, 7, true},
+	} {
+		cs := newChunkStream()
+		cs.Csid, cs.ExplicitCsid = tt.csid, tt.explicit
+		cs.MsgTypeID, cs.MsgStreamID = tt.typeID, 1
+		cs.ChunkBody = []byte{0x17, 0x01, 0x00, 0x00, 0x00}
+		cs.MsgLength = uint32(len(cs.ChunkBody))
+		if err := c.writeChunkStream(cs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := <-msgs
+	if len(got) != 3 {
+		t.Fatalf("got %d messages; want 3", len(got))
+	}
+	for i, want := range []uint32{7, 6, 7} {
+		if got[i].Csid != want {
+			t.Fatalf("message %d: got csid %d; want %d", i, got[i].Csid, want)
+		}
+		if got[i].MsgLength != 5 {
+			t.Fatalf("message %d: got length %d; want 5", i, got[i].MsgLength)
+		}
+	}
+}
+
+func TestSetLocalChunkSizePerDirection(t *testing.T) {
+	relayConfig := newTestConfig()
+	relayConfig.ChunkSize = 60000 // the local server's, not for the upstream
+	upstreamConfig := newTestConfig()
+	upstreamConfig.ChunkSize = 1000
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	relay := newTestClient(local, relayConfig)
+	upstream := Server(&testNetConn{Conn: remote, local: testAddr("127.0.0.1:1935"), remote: testAddr("127.0.0.1:10001")}, newStreamSourceMgr(upstreamConfig), upstreamConfig)
+	upstream.basicHdrBuf = make([]byte, 3)
+
+	// write body on conn, announcing size first unless 0, and read it intact on peer, of many chunks
+	transfer := func(conn, peer *Conn, size uint32, body []byte) {
+		t.Helper()
+		errc := make(chan error, 1)
+		go func() {
+			if size > 0 {
+				if err := conn.setLocalChunkSize(size); err != nil {
+					errc <- err
+					return
+				}
+			}
+			cs := newChunkStream()
+			cs.Csid, cs.ExplicitCsid = 6, true
+			cs.MsgTypeID, cs.MsgLength, cs.MsgStreamID, cs.ChunkBody = MsgVideoMessage, uint32(len(body)), 1, body
+			errc <- conn.writeChunkStream(cs)
+		}()
+		for {
+			cs, err := peer.readChunkStream(peer.basicHdrBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cs.MsgTypeID != MsgVideoMessage {
+				continue
+			}
+			if !bytes.Equal(cs.ChunkBody, body) {
+				t.Fatalf("got %d bytes; want %d intact", len(cs.ChunkBody), len(body))
+			}
+			break
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// relay to upstream on 300, independent of the chunk size of the local server
+	transfer(relay, upstream, 300, bytes.Repeat([]byte{0x01}, 5777))
+	if upstream.remoteChunkSize != 300 {
+		t.Fatalf("upstream reads by %d; want the relay's 300", upstream.remoteChunkSize)
+	}
+
+	// upstream to relay on 1000, the relay keeps writing by 300
+	transfer(upstream, relay, upstreamConfig.ChunkSize, bytes.Repeat([]byte{0xab}, 2500))
+	transfer(relay, upstream, 0, bytes.Repeat([]byte{0x02}, 3333))
+	if relay.remoteChunkSize != 1000 || relay.localChunksize != 300 {
+		t.Fatalf("relay reads by %d writes by %d; want 1000 300", relay.remoteChunkSize, relay.localChunksize)
+	}
+}
+
+func TestSetPeerBandwidthMessage(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	got := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 17)
+		_, _ = io.ReadFull(peer, b)
+		got <- b
+	}()
+	if err := c.writeChunkStream(NewSetPeerBandwidthMessage(2500000, PeerBandwidthSoft)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0x02,             // fmt 0, csid 2 of protocol control
+		0x00, 0x00, 0x00, // timestamp
+		0x00, 0x00, 0x05, // message length
+		0x06,                   // SetPeerBandwidth
+		0x00, 0x00, 0x00, 0x00, // message stream 0, little endian
+		0x00, 0x26, 0x25, 0xa0, // window size 2500000, big endian
+		0x01, // limit type soft
+	}
+	if b := <-got; !bytes.Equal(b, want) {
+		t.Fatalf("got % x; want % x", b, want)
+	}
+
+	// sent to a publisher with Config.PublisherBandwidth, ahead of NetStream.Publish.Start
+	config := newTestConfig()
+	config.PublisherBandwidth = 1000000
+	c, peer = newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10002")
+	msgs := make(chan []*ChunkStream, 1)
+	go func() { msgs <- readTestMessages(t, newTestPeer(peer), 2) }()
+	if err := c.respPulishCmdMessage(&ChunkStream{ChunkHeader: ChunkHeader{ChunkBasicHeader: newChunkBasicHeader(0, 5)}}); err != nil {
+		t.Fatal(err)
+	}
+	ms := <-msgs
+	if len(ms) != 2 || ms[0].MsgTypeID != MsgSetPeerBandwidth || ms[1].MsgTypeID != MsgAMF0CommandMessage {
+		t.Fatalf("got %d messages; want SetPeerBandwidth then onStatus", len(ms))
+	}
+	if !bytes.Equal(ms[0].ChunkBody, []byte{0x00, 0x0f, 0x42, 0x40, PeerBandwidthHard}) {
+		t.Fatalf("got body % x; want 1000000 hard", ms[0].ChunkBody)
+	}
+}
+
+func TestReadExtendedTimeStampSmallBuffer(t *testing.T) {
+	const ts = 0x01000000
+	body := bytes.Repeat([]byte{0xaa}, 300)
+	extended := []byte{0x01, 0x00, 0x00, 0x00}
+
+	// fmt 0 with extended timestamp, then fmt 3 continuations repeating it or not
+	encode := func(repeat bool) []byte {
+		b := []byte{4, 0xff, 0xff, 0xff, 0x00, 0x01, 0x2c, byte(MsgVideoMessage), 1, 0, 0, 0}
+		b = append(b, extended...)
+		for i := 0; i < len(body); i += 128 {
+			if i > 0 {
+				b = append(b, 3<<6|4)
+				if repeat {
+					b = append(b, extended...)
+				}
+			}
+			end := i + 128
+			if end > len(body) {
+				end = len(body)
+			}
+			b = append(b, body[i:end]...)
+		}
+		return b
+	}
+
+	for _, repeat := range []bool{true, false} {
+		c, _ := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+		c.reader = newConnReader(iotest.OneByteReader(bytes.NewReader(encode(repeat))), 4) // peeks span reads
+		if size := c.reader.Size(); size != minConnReadBufSize {
+			t.Fatalf("got reader size %d; want at least %d", size, minConnReadBufSize)
+		}
+
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			t.Fatalf("repeat %v: %v", repeat, err)
+		}
+		if cs.TimeStamp != ts || !bytes.Equal(cs.ChunkBody, body) {
+			t.Fatalf("repeat %v: got ts %#x %d bytes; want %#x %d bytes intact", repeat, cs.TimeStamp, len(cs.ChunkBody), ts, len(body))
+		}
+	}
+
+	// what the conn writes with an extended timestamp reads back
+	w, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	w.localChunksize = 128
+	msgs := make(chan []*ChunkStream, 1)
+	go func() {
+		pc := newTestPeer(peer)
+		pc.remoteChunkSize = 128
+		msgs <- readTestMessages(t, pc, 1)
+	}()
+	out := newChunkStream()
+	out.MsgTypeID, out.MsgStreamID, out.TimeStamp = MsgVideoMessage, 1, ts
+	out.ChunkBody, out.MsgLength = body, uint32(len(body))
+	if err := w.writeChunkStream(out); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-msgs; len(got) != 1 || got[0].TimeStamp != ts || !bytes.Equal(got[0].ChunkBody, body) {
+		t.Fatalf("got %d messages back; want ts %#x %d bytes intact", len(got), ts, len(body))
+	}
+
+	// the peer goes away within the extended timestamp of a continuation
+	b := encode(true)
+	b = b[:bytes.IndexByte(b[16:], 3<<6|4)+16+3]
+	c, _ := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	c.reader = newConnReader(iotest.OneByteReader(bytes.NewReader(b)), 4)
+	if _, err := c.readChunkStream(c.basicHdrBuf); err == nil || !strings.Contains(err.Error(), "peek extended timestamp") {
+		t.Fatalf("got err %v; want peek failure", err)
+	}
+	if cs := c.chunks[4]; cs.bodyRemain != 0 || cs.ChunkBody != nil {
+		t.Fatalf("got %d bytes pending; want the partial message dropped", cs.bodyRemain)
+	}
+}
+
+func TestReadSetChunkSizeRange(t *testing.T) {
+	var tests = []struct {
+		body []byte
+		ok   bool
+	}{
+		{[]byte{0, 0, 0x10, 0}, true},
+		{[]byte{0x7f, 0xff, 0xff, 0xff}, true}, // larger than any message, legal
+		{[]byte{0, 0, 0, 0}, false},
+		{[]byte{0x80, 0, 0x10, 0}, false}, // first bit set
+		{[]byte{0, 0x10}, false},
+	}
+	for _, tt := range tests {
+		c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+		drainPeer(peer)
+		feedPeer(peer, encodeTestMessage(2, 0, MsgSetChunkSize, 0, tt.body, 128))
+
+		_, err := c.readChunkStream(c.basicHdrBuf)
+		if !tt.ok {
+			if errors.Cause(err) != errInvalidChunkSize {
+				t.Fatalf("% x: got err %v; want %v", tt.body, err, errInvalidChunkSize)
+			}
+			if c.remoteChunkSize != 128 {
+				t.Fatalf("% x: got remote chunk size %d; want 128 kept", tt.body, c.remoteChunkSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("% x: %v", tt.body, err)
+		}
+		if want := binary.BigEndian.Uint32(tt.body); c.remoteChunkSize != want {
+			t.Fatalf("% x: got remote chunk size %d; want %d", tt.body, c.remoteChunkSize, want)
+		}
+	}
+}
+
+func TestReadAcknowledgement(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	drainPeer(peer)
+
+	for _, seq := range []uint32{4096, 1 << 20} {
+		body := make([]byte, 4)
+		binary.BigEndian.PutUint32(body, seq)
+		feedPeer(peer, encodeTestMessage(2, 0, MsgAcknowledgement, 0, body, 128))
+
+		if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+			t.Fatal(err)
+		}
+		if got := atomic.LoadUint32(&c.peerAcked); got != seq {
+			t.Fatalf("got peer acked %d; want %d", got, seq)
+		}
+	}
+}
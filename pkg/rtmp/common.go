@@ -1,19 +1,309 @@
 package rtmp
 
 import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
 	Logger *logrus.Logger
+
+	LogLevel          string        // filters what the server logs on Logger, e.g. "info", empty keeps Logger's level. It can only be quieter than Logger. Per-packet logs are Debug or Trace
+	LogSampleInterval time.Duration // per-packet logs of a subscriber, e.g. drops, at most one an interval, default 1s
+
+	TCPKeepAlive time.Duration // os tcp keepalive period of accepted conns, 0 means keep system default
+
+	ChunkSize        uint32        // announced to peers with SetChunkSize, 1 to 0xffffff, 0 falls back to DefaultChunkSize but fails Validate
+	WindowAckSize    uint32        // bytes received before sending ACK until peer set its own, default 250000
+	AckInterval      time.Duration // if > 0, scale ack window to measured ingest bitrate so ACK fires about once an interval
+	MaxAckWindowSize uint32        // the scaled ack window goes up to it for high bitrate ingest, 0 caps it at the window peer announced.
+	// A publisher honouring its window waits for the ACK, above the window it announced it would stall
+
+	PublisherBandwidth uint32 // window size a publisher is hard limited to with SetPeerBandwidth on publish, 0 sends none
+
+	MaxChunkStreams int // distinct csids a peer may use, reading one more fails the conn, default 1024
+
+	BufferPool BufferPool // message bodies come from it if set
+
+	HeaderBufPool *sync.Pool // chunk header read buffers shared by all conns, made by NewHeaderBufPool, nil: per conn
+
+	AMFCodec AMFCodec // encodes and decodes command and data messages, default livego's amf package
+
+	MaxCommandMessageSize uint32 // AMF command message bodies beyond it fail the conn before read, media is not limited, default 64KB
+
+	MaxConnMemory int64 // bytes of chunk streams, messages being assembled and queued media a conn may hold,
+	// beyond it the conn is closed, 0 means unlimited. One knob on top of MaxChunkStreams and MaxCommandMessageSize
+
+	StrictHandshakeVersion bool // true: reject C0 version other than 3, false: accept it and answer S0 version 3
+
+	ConnectTimeout time.Duration // a peer sending no connect command that long after the handshake is disconnected, 0 disables
+
+	ShutdownTimeout time.Duration // Service.Shutdown waits that long for players to flush their queues, then closes them, default 10s
+
+	PublishReconnectGrace time.Duration // keep stream source after publisher left so it may reconnect, default 1min
+	PlayWaitsForReconnect bool          // a play within the grace period attaches and waits for the publisher, false answers StreamNotFound
+
+	AcceptRateLimit int // max conns accepted per second, excess ones wait in listen backlog, 0 means unlimited
+
+	MinPublishThroughput    int           // bytes per ThroughputCheckInterval, a publisher below is disconnected, 0 disables
+	ThroughputCheckInterval time.Duration // default 10s
+
+	MaxIngestBitrate    int64         // bits per second, a publisher above it on average over IngestBitrateWindow is disconnected, 0 disables
+	IngestBitrateWindow time.Duration // default 10s
+
+	BitrateReportInterval time.Duration // a publisher gets onStatus NetStream.Publish.BitrateReport every interval with the
+	// ingest bitrate measured over it and the media its players dropped, 0 disables
+
+	MaxConnections     int // publishers + players, new connect is rejected at it, 0 means unlimited
+	SoftMaxConnections int // new play is rejected with a retriable status at it, below MaxConnections, 0 means unlimited
+
+	DASH                bool          // package every stream as DASH, served by Service.DASHHandler
+	DASHSegmentDuration time.Duration // cut at the first keyframe after it, default 2s
+	DASHWindow          int           // segments kept and listed in manifest, default 6
+
+	ThumbnailDecoder  ThumbnailDecoder // decodes the latest keyframe for Service.ThumbnailHandler, nil disables thumbnails
+	ThumbnailInterval time.Duration    // a thumbnail is decoded at most once an interval, default 5s
+
+	AppConfigs map[string]*AppConfig // overrides by connect app without instance, e.g. "vod", resolved on connect
+
+	RecordDir string // publish type record or append is recorded to {RecordDir}/{app}/{stream}.flv, default ./record
+
+	DispatchShards int // dispatch workers per stream, each queueing packets to a share of the subscribers, 0 or 1 means none
+
+	MetaDataRefreshInterval time.Duration // resend the cached onMetaData to subscribers every interval, 0 disables
+
+	RequestKeyFrame bool // a subscriber joining without keyframe in the GOP cache asks the publisher for one, best-effort
+
+	GOPCacheDuration time.Duration // media cached from a keyframe on for new players, 0 disables the GOP cache
+	PlayBufferDepth  time.Duration // GOP cache replayed to a new player from the keyframe within it, 0 means the last GOP only,
+	// a player may override it with tcUrl parameter buffer in seconds, e.g. buffer=2, or else with SetBufferLength
+
+	KeyFrameOnlyCache bool // cache the latest keyframe only besides sequence headers and metadata, for low memory, e.g.
+	// thumbnails only, new players start at it, GOPCacheDuration is ignored
+
+	AudioFirst bool // cache replay to a new player sends the audio sequence header first, then the video one and the GOP
+
+	RebaseTimeStamps bool // the first media of every publish goes at 0 whatever the encoder starts at, for consumers of
+	// publisher timestamps such as DASH, relays and monitors, players and recordings start at 0 anyway
+
+	NonIncreasingTimeStamps TimeStampPolicy // media not later than the previous one of its track, from a buggy encoder or
+	// a looped source, is passed, logged, clamped or rejected, default TimeStampPass doesn't check
+
+	// hooks run on the conn goroutine, an error rejects the command, values for later hooks go to Conn.SetContext
+	OnHandshakeComplete func(c *Conn) // after handshake, before the connect command
+	OnConnect           func(c *Conn) error
+	OnPublish           func(c *Conn, streamName string) error
+
+	OnStreamEvent func(ev StreamEvent) // changes of a published stream, e.g. ResolutionChange, run on the publishing goroutine
+
+	AccessLog func(record SessionRecord) // one record per session on teardown, e.g. marshaled to a JSON line
+
+	SessionIDFunc func() string // generates session id of stream sources, default uuid v4
+
+	DomainFunc func(c *Conn) string // domain of the stream keys of a conn once tcUrl is known, e.g. a tenant from Conn.TcUrl,
+	// empty or nil keeps the default: the tcUrl host, or the vhost parameter if the host is the server ip, else _defaultVhost_
+
+	TrackDetectTimeout time.Duration // a track missing that long after publish start makes the stream audio or video only, default 5s
+
+	SessionResumeWindow time.Duration // a player reconnecting with the same tcUrl parameter session within it resumes from the GOP cache
+	// where it left off instead of live, 0 disables
+
+	SubscriberFlushInterval time.Duration // media to a subscriber is coalesced and flushed every interval, e.g. 20ms,
+	// fewer syscalls for some latency, 0 flushes every message
+
+	StreamDryTimeout time.Duration // players get StreamDry after no media that long and StreamBegin once it flows again, 0 disables
+
+	IdleSubscriberTimeout time.Duration // a player with media pending and no write progress that long is idle, default 30s
+
+	IngestSleepWhenIdle time.Duration // a stream the server pulls itself, e.g. PublishFile, stops reading its source
+	// after no subscriber that long and resumes on the next play, 0 never sleeps
+
+	LatencyBudget time.Duration // players more behind the publisher drop media and skip to a keyframe, e.g. 3s, 0 disables
+
+	AVDriftThreshold time.Duration // warn when audio - video timestamp of a subscriber exceeds it, default 500ms
+
+	RenditionSuffix *regexp.Regexp // rendition suffix of stream name for ABR grouping, submatch 1 names it, default _(\d+p)$
+}
+
+// Clone returns a copy to derive another config from, Logger, BufferPool and hooks are shared.
+// AppConfigs is copied with its values, changing an app of the clone leaves c as is.
+func (c *Config) Clone() *Config {
+	clone := *c
+	if c.AppConfigs != nil {
+		clone.AppConfigs = make(map[string]*AppConfig, len(c.AppConfigs))
+		for app, ac := range c.AppConfigs {
+			if ac != nil {
+				copied := *ac
+				ac = &copied
+			}
+			clone.AppConfigs[app] = ac
+		}
+	}
+	return &clone
 }
 
+// Validate reports the first invalid value, zero values stand for defaults except ChunkSize
+func (c *Config) Validate() error {
+	if c.Logger == nil {
+		return errors.New("rtmp: config Logger is nil")
+	}
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			return errors.Wrap(err, "rtmp: config LogLevel")
+		}
+	}
+	if c.ChunkSize == 0 || c.ChunkSize > maxChunkSize {
+		return errors.Errorf("rtmp: config ChunkSize %d out of range [1, %d]", c.ChunkSize, maxChunkSize)
+	}
+
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"TCPKeepAlive", c.TCPKeepAlive},
+		{"LogSampleInterval", c.LogSampleInterval},
+		{"ConnectTimeout", c.ConnectTimeout},
+		{"ShutdownTimeout", c.ShutdownTimeout},
+		{"AckInterval", c.AckInterval},
+		{"PublishReconnectGrace", c.PublishReconnectGrace},
+		{"ThroughputCheckInterval", c.ThroughputCheckInterval},
+		{"IngestBitrateWindow", c.IngestBitrateWindow},
+		{"BitrateReportInterval", c.BitrateReportInterval},
+		{"DASHSegmentDuration", c.DASHSegmentDuration},
+		{"MetaDataRefreshInterval", c.MetaDataRefreshInterval},
+		{"GOPCacheDuration", c.GOPCacheDuration},
+		{"PlayBufferDepth", c.PlayBufferDepth},
+		{"TrackDetectTimeout", c.TrackDetectTimeout},
+		{"AVDriftThreshold", c.AVDriftThreshold},
+		{"LatencyBudget", c.LatencyBudget},
+		{"IdleSubscriberTimeout", c.IdleSubscriberTimeout},
+		{"IngestSleepWhenIdle", c.IngestSleepWhenIdle},
+		{"StreamDryTimeout", c.StreamDryTimeout},
+		{"SubscriberFlushInterval", c.SubscriberFlushInterval},
+		{"ThumbnailInterval", c.ThumbnailInterval},
+		{"SessionResumeWindow", c.SessionResumeWindow},
+	} {
+		if d.d < 0 {
+			return errors.Errorf("rtmp: config %s %v is negative", d.name, d.d)
+		}
+	}
+
+	for _, n := range []struct {
+		name string
+		n    int
+	}{
+		{"MaxChunkStreams", c.MaxChunkStreams},
+		{"AcceptRateLimit", c.AcceptRateLimit},
+		{"MinPublishThroughput", c.MinPublishThroughput},
+		{"MaxConnections", c.MaxConnections},
+		{"SoftMaxConnections", c.SoftMaxConnections},
+		{"DASHWindow", c.DASHWindow},
+		{"DispatchShards", c.DispatchShards},
+	} {
+		if n.n < 0 {
+			return errors.Errorf("rtmp: config %s %d is negative", n.name, n.n)
+		}
+	}
+
+	for app, ac := range c.AppConfigs {
+		if ac != nil && ac.ChunkSize > maxChunkSize {
+			return errors.Errorf("rtmp: config AppConfigs[%q] ChunkSize %d out of range [1, %d]", app, ac.ChunkSize, maxChunkSize)
+		}
+	}
+
+	if c.MaxConnMemory < 0 {
+		return errors.Errorf("rtmp: config MaxConnMemory %d is negative", c.MaxConnMemory)
+	}
+	if c.MaxIngestBitrate < 0 {
+		return errors.Errorf("rtmp: config MaxIngestBitrate %d is negative", c.MaxIngestBitrate)
+	}
+	if c.MaxConnections > 0 && c.SoftMaxConnections > c.MaxConnections {
+		return errors.Errorf("rtmp: config SoftMaxConnections %d above MaxConnections %d", c.SoftMaxConnections, c.MaxConnections)
+	}
+
+	return nil
+}
+
+// BufferPool supplies message bodies instead of allocating per message, e.g. from a ring buffer. Bodies of
+// messages the conn consumes itself, commands and protocol control, are Put back once handled; media bodies
+// are handed over in av packets and Put back with their last Release, once every player sent them and the
+// cache dropped them. Get and Put are called from many goroutines.
+type BufferPool interface {
+	Get(size int) []byte // len must be size
+	Put(b []byte)
+}
+
+// DefaultChunkSize is the chunk size of servers whose config leaves it 0
+const DefaultChunkSize = 60000
+
+const (
+	maxChunkSize     = 0xffffff   // message length is 3 bytes, a larger chunk never fills
+	maxRecvChunkSize = 0x7fffffff // SetChunkSize from a peer, the first bit must be 0, a chunk larger than any message is legal
+
+	defaultWindowAckSize         = 250000
+	defaultPublishReconnectGrace = time.Minute
+	defaultAVDriftThreshold      = 500 * time.Millisecond
+	defaultTrackDetectTimeout    = 5 * time.Second
+
+	defaultThroughputCheckInterval = 10 * time.Second
+
+	defaultMaxChunkStreams       = 1024
+	defaultMaxCommandMessageSize = 64 * 1024
+
+	coalesceWriteSize    = 4096       // flush at most this many bytes with one copy and write instead of writev
+	maxDeferredWriteSize = 256 * 1024 // flushed before SubscriberFlushInterval, e.g. a keyframe burst
+
+	minAcceptDelay = 5 * time.Millisecond // backoff of temporary accept error, doubled each retry
+	maxAcceptDelay = time.Second
+)
+
+// ErrHandshakeEOF is returned when the peer closes during the handshake, e.g. a port scan or
+// a load balancer probe, rather than breaking the protocol
+var ErrHandshakeEOF = errors.New("rtmp: peer closed during handshake")
+
+// ErrShutdownTimeout is returned by Service.Shutdown when players were closed before flushing their queues
+var ErrShutdownTimeout = errors.New("rtmp: shutdown timeout, connections force closed")
+
+var (
+	errServerDraining         = errors.New("rtmp: server is draining")
+	errServerBusy             = errors.New("rtmp: server is busy")
+	errStreamBusy             = errors.New("rtmp: stream is busy")
+	errStreamBanned           = errors.New("rtmp: stream is banned")
+	errNoPublisher            = errors.New("rtmp: stream has no publisher")
+	errTooManyChunkStreams    = errors.New("rtmp: too many chunk streams")
+	errCommandMessageTooLarge = errors.New("rtmp: command message too large")
+	errStreamSourceDeleted    = errors.New("rtmp: stream source deleted")
+	errStreamNotFound         = errors.New("rtmp: stream not found")
+	errAlreadySubscribed      = errors.New("rtmp: stream already subscribed")
+	errStreamReconnecting     = errors.New("rtmp: stream publisher is reconnecting")
+	errMemoryBudgetExceeded   = errors.New("rtmp: connection memory budget exceeded")
+	errInvalidChunkSize       = errors.New("rtmp: invalid chunk size")
+	errReservedCSID           = errors.New("rtmp: message on a reserved chunk stream id")
+	errCSIDExhausted          = errors.New("rtmp: chunk stream ids exhausted")
+	errReadLoopWritesFull     = errors.New("rtmp: too many writes waiting off the read loop")
+	errUpstreamRejected       = errors.New("rtmp: upstream rejected the relay")
+	errPlayerClosedStream     = errors.New("rtmp: player closed the stream")
+)
+
+var defaultRenditionSuffix = regexp.MustCompile(`_(\d+p)$`) // stream_720p
+
+var timeNow = time.Now // for tests
+
 type ConnectionState struct {
 	HandshakeComplete bool
 	Vhost             string
 }
 
+const (
+	defaultVhost    = "_defaultVhost_"
+	defaultInstance = "_definst_"
+)
+
 func genStreamKey(domain, app, stream string) string {
 	return domain + "/" + app + "/" + stream
 }
@@ -30,15 +320,39 @@ const (
 	cmdPublish       = "publish"
 	cmdFCUnpublish   = "FCUnpublish"
 	cmdDeleteStream  = "deleteStream"
+	cmdCloseStream   = "closeStream"
 	cmdPlay          = "play"
+	cmdPlay2         = "play2"
+
+	// non-standard, sent to publishers with Config.RequestKeyFrame
+	cmdRequestKeyFrame = "requestKeyFrame"
+
+	// bandwidth check of FMLE and librtmp, answered with onBWDone only
+	cmdCheckBandwidth = "checkBandwidth"
+	cmdCheckBw        = "_checkbw"
+)
+
+// play start and len arguments, start -2 is the default. No recorded stream is served, any other start
+// plays live like it.
+const (
+	playStartLive     = -2 // live, or recorded if not live
+	playStartLiveOnly = -1 // live only, not found without a publisher
+	playLenAll        = -1 // len >= 0 caps the GOP cache replay, see Conn.playBufferDepth
+)
+
+// publishing type carried by publish command
+const (
+	publishTypeLive   = "live"
+	publishTypeRecord = "record"
+	publishTypeAppend = "append"
 )
 
 const (
 	streamBegin uint32 = 0
 	//streamEOF        uint32 = 1
-	//streamDry        uint32 = 2
-	//setBufferLen     uint32 = 3
+	streamDry        uint32 = 2
+	setBufferLen     uint32 = 3
 	streamIsRecorded uint32 = 4
-	//pingRequest      uint32 = 6
-	//pingResponse     uint32 = 7
+	pingRequest      uint32 = 6
+	pingResponse     uint32 = 7
 )
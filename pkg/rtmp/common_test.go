@@ -0,0 +1,64 @@
+package rtmp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string // substring of the error, empty: valid
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"max chunk size", func(c *Config) { c.ChunkSize = 0xffffff }, ""},
+		{"zero chunk size", func(c *Config) { c.ChunkSize = 0 }, "ChunkSize"},
+		{"chunk size too large", func(c *Config) { c.ChunkSize = 0xffffff + 1 }, "ChunkSize"},
+		{"nil logger", func(c *Config) { c.Logger = nil }, "Logger"},
+		{"negative duration", func(c *Config) { c.PublishReconnectGrace = -time.Second }, "PublishReconnectGrace"},
+		{"negative count", func(c *Config) { c.MaxConnections = -1 }, "MaxConnections"},
+		{"soft max above max", func(c *Config) { c.MaxConnections, c.SoftMaxConnections = 10, 20 }, "SoftMaxConnections"},
+	}
+
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.ChunkSize = DefaultChunkSize
+		tt.modify(config)
+
+		err := config.Validate()
+		if tt.err == "" && err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Fatalf("%s: got %v; want error of %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestConfigClone(t *testing.T) {
+	base := newTestConfig()
+	base.ChunkSize = DefaultChunkSize
+	base.MaxConnections = 10
+	base.AppConfigs = map[string]*AppConfig{"vod": {ChunkSize: 1024}}
+
+	clone := base.Clone()
+	clone.MaxConnections = 20
+	clone.ChunkSize = 4096
+	clone.AppConfigs["vod"].ChunkSize = 8192
+	clone.AppConfigs["live"] = &AppConfig{RecordDir: "/tmp"}
+
+	if base.MaxConnections != 10 || base.ChunkSize != DefaultChunkSize {
+		t.Fatalf("base changed by clone: %+v", base)
+	}
+	if len(base.AppConfigs) != 1 || base.AppConfigs["vod"].ChunkSize != 1024 {
+		t.Fatalf("base AppConfigs changed by clone: %+v", base.AppConfigs)
+	}
+	if clone.Logger != base.Logger {
+		t.Fatal("logger not shared")
+	}
+	if err := clone.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@ package rtmp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +14,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"playground/pkg/av"
+
 	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -23,8 +26,13 @@ type Conn struct {
 	conn     net.Conn
 	isClient bool
 
-	reader      *bufio.Reader
-	writeBuffer net.Buffers
+	reader         *bufio.Reader
+	writeBuffer    net.Buffers
+	writeScratch   []byte // copies of small writes referenced by writeBuffer
+	writeBufferLen int
+	batching       bool       // true: writeChunkStream doesn't flush, see batch
+	deferringFlush int        // > 0: writeChunkStream flushes past maxDeferredWriteSize only, see deferFlush
+	writeMux       sync.Mutex // guard the write buffer, in-band players write next to the publishing cycle
 
 	// config and logger pointer
 	config *Config
@@ -38,9 +46,9 @@ type Conn struct {
 
 	// handle command message
 	transactionID            int
-	amfDecoder               *amf.Decoder
-	amfEncoder               *amf.Encoder
+	amfCodec                 AMFCodec
 	handleCommandMessageDone bool
+	fcPublishName            string // of releaseStream or FCPublish, for a publish without stream name
 
 	// client connect info
 	appName        string
@@ -50,6 +58,7 @@ type Conn struct {
 	objectEncoding int
 
 	// parse tcUrl result
+	tcPath    string // /app/instance
 	host      string
 	port      int
 	vhost     string
@@ -59,20 +68,92 @@ type Conn struct {
 	// client role and associate with stream source manager
 	isPublisher bool             // true: publish  false: play
 	streamName  string           // set while publish/play command
+	playStart   float64          // start of play/play2 in ms, -2: live or recorded, -1: live only
+	playLen     float64          // duration of play/play2 in ms, -1: until the end, caps the GOP cache replay
+	publishType string           // live, record or append, set while publish command
 	ssMgr       *streamSourceMgr // stream source manager pointer
 	streamKey   string           // generate by func genStreamKey
+	server      *Service         // nil if not served by Service
+
+	// <MsgStreamID, netStream> of createStream, publish and play. One conn may publish a stream and play
+	// others, each on its own message stream
+	streamsMux   sync.Mutex
+	streams      map[uint32]*netStream
+	lastStreamID uint32
 
-	basicHdrBuf []byte                  //rtmp chunk basic header, at most 3 bytes
-	chunks      map[uint32]*ChunkStream //<CSID, ChunkStream>
+	basicHdrBuf []byte  //rtmp chunk basic header, at most 3 bytes
+	writeHdrBuf [3]byte // basic header being written, apart from basicHdrBuf as writes may come from players
+	// <CSID, ChunkStream>, partial assembly per chunk stream. A chunk stream carries one message at a time,
+	// messages of different message streams interleave on distinct csids, a csid is reused by another
+	// message stream only with a new fmt 0 header after the previous message completes.
+	chunks map[uint32]*ChunkStream
+
+	customCSIDs uint32 // atomic, csids handed out by AllocCSID
 
 	localChunksize      uint32 // local chunk size
 	localWindowAckSize  uint32 // local window ack size
 	remoteChunkSize     uint32 // peer chunk size
 	remoteWindowAckSize uint32 // peer window ack size
 	ackSeqNumber        uint32 // window ack sequence number
+	ackWriting          int32  // atomic, 1: an ACK is written off the read loop, see writeAckAsync
+	readLoopWrites      readLoopWriter
+
+	// ingest bitrate measurement for ack window scaling
+	ackRateStart time.Time
+	ackRateBytes uint32
+	ackWindow    uint32 // scaled ack window, 0 before first measurement
+
+	// Acknowledgement from peer, sends to it pause once too far ahead, see subscriber.waitPeerAck
+	peerAcked   uint32        // atomic, sequence number of the last Acknowledgement, bytes the peer received
+	peerAckMux  sync.Mutex    // guard peerAckWake
+	peerAckWake chan struct{} // closed and replaced on every Acknowledgement, wakes the paused sends
+
+	// ingest bitrate measurement for Config.MaxIngestBitrate
+	ingestStart    time.Time
+	ingestBytes    uint64
+	ingestRejected bool
+
+	// ingest bitrate measurement for Config.BitrateReportInterval
+	reportStart time.Time
+	reportBytes uint64
 
 	bytesRecv      uint32
 	bytesRecvReset uint32
+	bytesIn        int64 // atomic, raw bytes read from conn
+	bytesOut       int64 // atomic, raw bytes written to conn
+
+	timings connTimings // see Timings
+	mem     connMemory  // see MemoryUsage
+	errLog  errLogDedup // see logError
+
+	// user control message from peer
+	userCtrlMux   sync.Mutex
+	bufferLengths map[uint32]uint32 //<MsgStreamID, SetBufferLength in ms>
+
+	ctxMux sync.Mutex
+	ctx    context.Context // request-scoped values set by hooks
+}
+
+// SetContext attaches request-scoped values, e.g. the auth principal from OnConnect, for later hooks
+func (c *Conn) SetContext(ctx context.Context) {
+	c.ctxMux.Lock()
+	defer c.ctxMux.Unlock()
+	c.ctx = ctx
+}
+
+// Context returns the context set by SetContext, context.Background if none
+func (c *Conn) Context() context.Context {
+	c.ctxMux.Lock()
+	defer c.ctxMux.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// TcUrl returns tcUrl of the connect command
+func (c *Conn) TcUrl() string {
+	return c.tcUrl
 }
 
 func (c *Conn) LocalAddr() net.Addr {
@@ -104,27 +185,100 @@ func (c *Conn) Read(b []byte) (int, error) {
 	//return c.conn.Read(b)
 }
 
+// Write buffers b until Flush, b is copied as callers reuse their header buffers
 func (c *Conn) Write(b []byte) (int, error) {
+	start := len(c.writeScratch)
+	c.writeScratch = append(c.writeScratch, b...)
+	c.writeBuffer = append(c.writeBuffer, c.writeScratch[start:len(c.writeScratch):len(c.writeScratch)])
+	c.writeBufferLen += len(b)
+	return len(b), nil
+}
+
+// writeNoCopy buffers b until Flush, b must not be modified before that, e.g. a chunk body
+func (c *Conn) writeNoCopy(b []byte) {
 	c.writeBuffer = append(c.writeBuffer, b)
-	if len(c.writeBuffer) > 0 {
-		if nw, err := c.writeBuffer.WriteTo(c.conn); err != nil {
-			return int(nw), err
-		}
-	}
-	return 0, nil
+	c.writeBufferLen += len(b)
 }
 
+// Flush writes the buffered bytes, small ones (control messages) are coalesced into a single write
 func (c *Conn) Flush() error {
 	//logrus.Errorf("buff size: %d", len(c.writeBuffer))
-	if _, err := c.writeBuffer.WriteTo(c.conn); err != nil {
+	defer func() {
+		c.writeBuffer = c.writeBuffer[:0]
+		c.writeScratch = c.writeScratch[:0]
+		c.writeBufferLen = 0
+	}()
+
+	if c.writeBufferLen == 0 {
+		return nil
+	}
+
+	if c.writeBufferLen <= coalesceWriteSize {
+		b := c.writeScratch[len(c.writeScratch):]
+		for _, buf := range c.writeBuffer {
+			b = append(b, buf...)
+		}
+		n, err := c.conn.Write(b)
+		atomic.AddInt64(&c.bytesOut, int64(n))
 		return err
 	}
-	return nil
+
+	bufs := c.writeBuffer // WriteTo consumes it
+	n, err := bufs.WriteTo(c.conn)
+	atomic.AddInt64(&c.bytesOut, n)
+	return err
+}
+
+// batch defers the flush of every chunk stream written in fn to its end, so messages generated
+// together (e.g. connect and play responses) go out in one write
+func (c *Conn) batch(fn func() error) error {
+	c.writeMux.Lock()
+	c.batching = true
+	c.writeMux.Unlock()
+
+	err := fn()
+
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	c.batching = false
+	if ferr := c.Flush(); err == nil && ferr != nil {
+		err = errors.Wrap(ferr, "flush batch")
+	}
+	return err
+}
+
+// deferFlush leaves flushing to flushDeferred, a subscriber flushes every Config.SubscriberFlushInterval
+// instead of every message. Calls nest, in-band players share the conn; the last off flushes what is pending.
+func (c *Conn) deferFlush(on bool) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	if on {
+		c.deferringFlush++
+		return nil
+	}
+	if c.deferringFlush--; c.deferringFlush > 0 {
+		return nil
+	}
+	return c.Flush()
+}
+
+func (c *Conn) flushDeferred() error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	return c.Flush()
 }
 
 func (c *Conn) Serve() {
-	defer c.Close()
+	start := time.Now()
+	err := c.serve()
+	_ = c.Close()
+	c.logAccess(start, err)
+}
 
+// serve runs the session, the error ending it is the disconnect reason of the access log
+func (c *Conn) serve() error {
 	logger := c.logger.WithFields(logrus.Fields{"event": "Serve Rtmp Conn"})
 	logger.Tracef("local: %s, remote: %s, network: %s", c.LocalAddr().String(), c.RemoteAddr().String(), c.LocalAddr().Network())
 
@@ -136,89 +290,127 @@ func (c *Conn) Serve() {
 
 	logger = c.logger.WithFields(logrus.Fields{"event": "serverHandshake"})
 	if err := c.Handshake(); err != nil {
+		if errors.Cause(err) == ErrHandshakeEOF { // probes and port scans, not worth an error
+			logger.WithField("remote", c.RemoteAddr().String()).Debug(err)
+			return err
+		}
 		logger.Error(err)
-		return
+		return err
 	}
 	logger.Trace("success")
 
+	if d := c.config.ConnectTimeout; d > 0 { // the connect command clears it
+		_ = c.SetReadDeadline(time.Now().Add(d))
+	}
+
 	logger = c.logger.WithFields(logrus.Fields{"event": "handleCommandMessage"})
 	c.basicHdrBuf = make([]byte, 3)
 	if err := c.handleCommandMessage(); err != nil {
+		if ne, ok := errors.Cause(err).(net.Error); ok && ne.Timeout() && atomic.LoadInt64(&c.timings.connect) == 0 {
+			logger.WithField("remote", c.RemoteAddr().String()).Infof("no connect command within %v, disconnect", c.config.ConnectTimeout)
+			return err
+		}
 		logger.Error(err)
-		return
+		return err
 	}
 	logger.Trace("success")
 
 	logger = c.logger.WithFields(logrus.Fields{"event": "discover tcUrl"})
 	if err := c.discoverTcUrl(); err != nil {
 		logger.Error(err)
-		return
+		return err
 	}
-	c.streamKey = genStreamKey(c.vhost, c.appName, c.streamName)
-	logger.WithFields(logrus.Fields{"vhost": c.vhost, "app": c.appName, "stream": c.streamName, "rawQuery": c.rawQuery, "streamKey": c.streamKey}).Trace("")
+	c.streamKey = genStreamKey(c.vhost, c.appKey(), c.streamName)
+	logger.WithFields(logrus.Fields{"vhost": c.vhost, "app": c.appName, "tcPath": c.tcPath, "stream": c.streamName, "rawQuery": c.rawQuery, "streamKey": c.streamKey}).Trace("")
 
+	clientFields := logrus.Fields{"streamKey": c.streamKey, "flashVer": c.flashVer, "tcUrl": c.tcUrl, "remote": c.RemoteAddr().String()}
 	if c.isPublisher { // publish
-		logger = c.logger.WithFields(logrus.Fields{"event": "publish"})
-
-		var ss *streamSource
-		val, ok := c.ssMgr.streamMap.Load(c.streamKey)
-		if !ok { //stream source not exists
-			pub := newPublisher(c, c.streamKey)
-			ss = newStreamSource(pub, c.streamKey, c.ssMgr)
+		logger = c.logger.WithFields(logrus.Fields{"event": "publish"}).WithFields(clientFields)
+		logger.Info("start publishing")
 
-			c.ssMgr.streamMap.Store(c.streamKey, ss) // save <streamKey, streamSource> pair
-		} else {
-			ss = val.(*streamSource)
-			if ss.publisher != nil { // stream exists and is publishing
-				logger.Error("stream is busy")
-				return
-			} else {
-				ss.setPublisher(newPublisher(c, c.streamKey))
-			}
+		pub := newPublisher(c, c.streamKey)
+		ss, err := c.ssMgr.attachPublisher(pub)
+		if err != nil { // stream exists and is publishing
+			logger.Error(err)
+			return err
 		}
 
 		defer ss.delPublisher()
-		if err := ss.doPublishing(); err != nil {
-			return
+		defer c.resetChunkStreams() // the read loop is done, don't keep a message it stopped in
+		if pub.needRecord() {
+			if stop, err := ss.startRecording(recordPath(c.recordDir(), c.appKey(), c.streamName), pub.publishType == publishTypeAppend, c.logger); err != nil {
+				logger.Error(err)
+			} else {
+				defer stop()
+			}
 		}
+		defer c.closeStreams()
+		defer c.watchPublishThroughput()()
+		return ss.doPublishing()
 	} else { //play
-		logger = c.logger.WithFields(logrus.Fields{"event": "play"})
+		logger = c.logger.WithFields(logrus.Fields{"event": "play"}).WithFields(clientFields)
+		logger.Info("start playing")
 
 		val, ok := c.ssMgr.streamMap.Load(c.streamKey)
 		if !ok {
 			logger.Error("stream not exists")
-			return
+			return errStreamNotFound
 		}
 
 		sub := newSubscriber(c, 1024) //TODO: avQueueSize use config's value
+		sub.streamID, _ = c.streamIDOf(streamRolePlay)
+		sub.quit = make(chan struct{})
 		ss := val.(*streamSource)
 		if !ss.addSubscriber(sub) {
 			logger.Error("already subscribe")
-			return
+			return errAlreadySubscribed
 		}
 
-		defer ss.delSubscriber(sub)
+		defer ss.delPlayer(sub)
+		var readErr error
+		go func() {
+			readErr = c.readWhilePlaying(sub.streamID)
+			close(sub.quit) // stops the playing cycle
+		}()
 		if err := ss.doPlaying(sub); err != nil {
-			return
+			select {
+			case <-sub.quit:
+				return readErr // the player left or closed its stream
+			default:
+				return err
+			}
 		}
+		return nil
 	}
 }
 
+// Handshake runs the handshake once, Config.OnHandshakeComplete fires after it succeeds, before any command
 func (c *Conn) Handshake() error {
 	c.handshakeMutex.Lock()
-	defer c.handshakeMutex.Unlock()
+	completed, err := c.handshakeLocked()
+	c.handshakeMutex.Unlock()
 
+	if completed && c.config.OnHandshakeComplete != nil { // unlocked, the hook may call ConnectionState
+		c.config.OnHandshakeComplete(c)
+	}
+	return err
+}
+
+// handshakeLocked returns completed true only for the call which completed the handshake
+func (c *Conn) handshakeLocked() (completed bool, err error) {
 	if err := c.handshakeErr; err != nil {
-		return err
+		return false, err
 	}
 
 	if c.handshakeComplete() {
-		return nil
+		return false, nil
 	}
 
+	markTime(&c.timings.handshakeStart)
 	c.handshakeErr = c.handshakeFn()
 	if c.handshakeErr == nil {
 		c.HandshakeStatus++
+		markTime(&c.timings.handshakeEnd)
 	} else {
 		c.Flush()
 	}
@@ -227,7 +419,7 @@ func (c *Conn) Handshake() error {
 		c.handshakeErr = errors.New("rtmp: internal error: handshake should be have had a result")
 	}
 
-	return c.handshakeErr
+	return c.handshakeErr == nil, c.handshakeErr
 }
 
 func (c *Conn) handleCommandMessage() error {
@@ -239,8 +431,11 @@ func (c *Conn) handleCommandMessage() error {
 			logger.Error(err)
 			return errors.Wrap(err, "read chunk stream")
 		}
-		logger.WithField("data", fmt.Sprintf("%#v", cs)).Trace("")
+		if logger.Logger.IsLevelEnabled(logrus.TraceLevel) { // formatting every message costs even when not logged
+			logger.WithField("data", fmt.Sprintf("%#v", cs)).Trace("")
+		}
 
+		body := cs.ChunkBody // decodeCommandMessage may reslice it
 		switch cs.MsgTypeID {
 		case MsgAMF0CommandMessage, MsgAMF3CommandMessage:
 			if err := c.decodeCommandMessage(cs); err != nil {
@@ -248,6 +443,7 @@ func (c *Conn) handleCommandMessage() error {
 				return errors.Wrap(err, "decode command message")
 			}
 		}
+		c.putBody(cs, body)
 
 		if c.handleCommandMessageDone {
 			break
@@ -268,6 +464,7 @@ func (c *Conn) discoverTcUrl() error {
 		return errors.Errorf("not rtmp scheme: %s", u.Scheme)
 	}
 
+	c.tcPath = u.Path
 	c.rawQuery = u.RawQuery // vhost=...&token=...
 	c.urlValues, _ = url.ParseQuery(c.rawQuery)
 
@@ -305,7 +502,12 @@ func (c *Conn) discoverTcUrl() error {
 	}
 
 	if c.vhost == "" {
-		c.vhost = "_defaultVhost_"
+		c.vhost = defaultVhost
+	}
+	if c.config.DomainFunc != nil {
+		if domain := c.config.DomainFunc(c); domain != "" {
+			c.vhost = domain
+		}
 	}
 
 	if idx := strings.Index(c.appName, "?"); idx > 0 {
@@ -316,61 +518,277 @@ func (c *Conn) discoverTcUrl() error {
 	return nil
 }
 
+// isBannedPublish checks the stream key to publish against bans, it's known once tcUrl is discovered
+func (c *Conn) isBannedPublish() bool {
+	if !c.ssMgr.hasBans() {
+		return false
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		return false // Serve fails on it after the command phase
+	}
+	return c.ssMgr.IsBanned(genStreamKey(c.vhost, c.appKey(), c.streamName))
+}
+
+// isGracePlay checks the stream key to play like isBannedPublish, see rejectGracePlay
+func (c *Conn) isGracePlay() bool {
+	if c.config.PlayWaitsForReconnect {
+		return false
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		return false // Serve fails on it after the command phase
+	}
+	val, ok := c.ssMgr.streamMap.Load(genStreamKey(c.vhost, c.appKey(), c.streamName))
+	return ok && c.rejectGracePlay(val.(*streamSource))
+}
+
+// isLiveOnlyMiss checks a play with start -1, live only, like isGracePlay: without a live publisher
+// it's answered with StreamNotFound instead of Play.Start
+func (c *Conn) isLiveOnlyMiss() bool {
+	if c.playStart != playStartLiveOnly {
+		return false
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		return false // Serve fails on it after the command phase
+	}
+	val, ok := c.ssMgr.streamMap.Load(genStreamKey(c.vhost, c.appKey(), c.streamName))
+	return !ok || val.(*streamSource).getPublisher() == nil
+}
+
+// rejectGracePlay reports a play of ss to answer with StreamNotFound: its publisher left and it lingers
+// in the reconnect grace period, unless Config.PlayWaitsForReconnect
+func (c *Conn) rejectGracePlay(ss *streamSource) bool {
+	return !c.config.PlayWaitsForReconnect && ss.getPublisher() == nil
+}
+
+// appInstance splits the connect app FMS style, rtmp://host/app/instance: the instance comes from
+// tcUrl path if app carries none, the default instance _definst_ is returned as ""
+func (c *Conn) appInstance() (app, instance string) {
+	app = strings.Trim(c.appName, "/")
+	path := strings.Trim(c.tcPath, "/")
+	if app == "" {
+		app = path
+	}
+
+	if idx := strings.Index(app, "/"); idx >= 0 {
+		app, instance = app[:idx], app[idx+1:]
+	} else if strings.HasPrefix(path, app+"/") {
+		instance = path[len(app)+1:]
+	}
+
+	if instance == defaultInstance {
+		instance = ""
+	}
+	return app, instance
+}
+
+// appKey is the app of stream key, app/instance but for the default instance
+func (c *Conn) appKey() string {
+	app, instance := c.appInstance()
+	if instance == "" {
+		return app
+	}
+	return app + "/" + instance
+}
+
+func (c *Conn) maxChunkStreams() int {
+	if c.config != nil && c.config.MaxChunkStreams > 0 {
+		return c.config.MaxChunkStreams
+	}
+	return defaultMaxChunkStreams
+}
+
+func (c *Conn) maxCommandMessageSize() uint32 {
+	if c.config != nil && c.config.MaxCommandMessageSize > 0 {
+		return c.config.MaxCommandMessageSize
+	}
+	return defaultMaxCommandMessageSize
+}
+
+// getBody returns a message body of size from Config.BufferPool, or allocated without it
+func (c *Conn) getBody(size int) []byte {
+	if c.config != nil && c.config.BufferPool != nil {
+		if b := c.config.BufferPool.Get(size); len(b) == size {
+			return b
+		}
+	}
+	return make([]byte, size)
+}
+
+// putBody returns the body of a message the conn is done with, cs must not be read after
+func (c *Conn) putBody(cs *ChunkStream, body []byte) {
+	if c.config != nil && c.config.BufferPool != nil && body != nil {
+		cs.ChunkBody = nil
+		c.config.BufferPool.Put(body)
+	}
+}
+
+// poolBody hands the body of cs over to pkt, it goes back to Config.BufferPool with the last Release of pkt
+func (c *Conn) poolBody(pkt *av.Packet, cs *ChunkStream) {
+	if c.config != nil && c.config.BufferPool != nil && cs.ChunkBody != nil {
+		pkt.PoolData(cs.ChunkBody, c.config.BufferPool.Put)
+		cs.ChunkBody = nil
+	}
+}
+
+// playBufferDepth takes tcUrl parameter buffer in seconds, Config.PlayBufferDepth without it, capped
+// by the len of play/play2 if any. Unless the parameter or len pinned it, the buffer the player
+// announces with SetBufferLength replaces it, see subscriber.replayDepth.
+func (c *Conn) playBufferDepth() (depth time.Duration, pinned bool) {
+	depth = c.config.PlayBufferDepth
+	if v := c.urlValues.Get("buffer"); v != "" {
+		if sec, err := strconv.ParseFloat(v, 64); err == nil && sec >= 0 {
+			depth, pinned = time.Duration(sec*float64(time.Second)), true
+		} else {
+			c.logger.WithFields(logrus.Fields{"event": "playBufferDepth", "buffer": v}).Warn("invalid buffer parameter, use default")
+		}
+	}
+	if c.playLen >= 0 {
+		if l := time.Duration(c.playLen * float64(time.Millisecond)); l < depth {
+			depth = l
+		}
+		pinned = true
+	}
+	return depth, pinned
+}
+
 func (c *Conn) decodeCommandMessage(cs *ChunkStream) error {
 	if cs.MsgTypeID == MsgAMF3CommandMessage {
 		cs.ChunkBody = cs.ChunkBody[1:]
 	}
 
 	r := bytes.NewReader(cs.ChunkBody)
-	vs, err := c.amfDecoder.DecodeBatch(r, amf.Version(amf.AMF0))
+	vs, err := decodeAMFBatch(c.amfCodec, r, amf.AMF0)
 	if err != nil && err != io.EOF {
-		c.logger.WithField("event", "amf decode chunk body").Error(err)
+		c.logError(c.logger.WithField("event", "amf decode chunk body"), err)
 		return err
 	}
-	c.logger.WithField("event", "amf decode chunk body").WithField("data", fmt.Sprintf("%#v", vs)).Trace("")
+	if c.logger.IsLevelEnabled(logrus.TraceLevel) {
+		c.logger.WithField("event", "amf decode chunk body").WithField("data", fmt.Sprintf("%#v", vs)).Trace("")
+	}
 
+	if len(vs) == 0 {
+		return errors.New("empty command message")
+	}
 	if cmdStr, ok := vs[0].(string); ok {
 		switch cmdStr {
 		case cmdConnect: // "connect"
+			markTime(&c.timings.connect)
+			if c.config.ConnectTimeout > 0 {
+				_ = c.SetReadDeadline(time.Time{}) // in time, see Serve
+			}
 			if err := c.decodeConnectCmdMessage(vs[1:]); err != nil {
 				return err
 			}
-			if err := c.respConnectCmdMessage(cs); err != nil {
+			c.applyAppConfig()
+			if c.isDraining() {
+				event := make(amf.Object)
+				event["level"] = "error"
+				event["code"] = "NetConnection.Connect.Rejected"
+				event["description"] = "Server is draining, please retry later."
+				_ = c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_error", c.transactionID, nil, event)
+				return errServerDraining
+			}
+			if max := c.config.MaxConnections; max > 0 && c.ssMgr.ConnectionCount() >= max {
+				event := make(amf.Object)
+				event["level"] = "error"
+				event["code"] = "NetConnection.Connect.Rejected"
+				event["description"] = "Too many connections."
+				_ = c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_error", c.transactionID, nil, event)
+				return errServerBusy
+			}
+			if hook := c.config.OnConnect; hook != nil {
+				if err := hook(c); err != nil {
+					event := make(amf.Object)
+					event["level"] = "error"
+					event["code"] = "NetConnection.Connect.Rejected"
+					event["description"] = err.Error()
+					_ = c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_error", c.transactionID, nil, event)
+					return errors.Wrap(err, "OnConnect")
+				}
+			}
+			if err := c.batch(func() error { return c.respConnectCmdMessage(cs) }); err != nil {
 				return err
 			}
 		case cmdReleaseStream: // "releaseStream"
-			_ = c.decodeReleaseStreamCmdMessage(vs[1:]) //do nothing
+			_ = c.decodeReleaseStreamCmdMessage(vs[1:])
+			if err := c.respReleaseStreamCmdMessage(cs); err != nil {
+				return err
+			}
 		case cmdFcpublish: // "FCPublish"
-			_ = c.decodeFcPublishCmdMessage(vs[1:]) //do nothing
+			_ = c.decodeFcPublishCmdMessage(vs[1:])
+			if err := c.respFcPublishCmdMessage(cs); err != nil {
+				return err
+			}
 		case cmdCreateStream: // "createStream"
 			if err := c.decodeCreateStreamCmdMessage(vs[1:]); err != nil {
 				return err
 			}
-			if err := c.respCreateStreamCmdMessage(cs); err != nil {
+			if err := c.respCreateStreamCmdMessage(cs, c.createStream()); err != nil {
 				return err
 			}
 		case cmdPublish: // "publish"
 			if err := c.decodePulishCmdMessage(vs[1:]); err != nil {
 				return err
 			}
+			if c.isDraining() {
+				_ = c.writeStatusMessage(cs, "error", "NetStream.Publish.Rejected", "Server is draining, please retry later.")
+				return errServerDraining
+			}
+			if c.isBannedPublish() {
+				_ = c.writeStatusMessage(cs, "error", "NetStream.Publish.BadName", "Stream is banned.")
+				return errStreamBanned
+			}
+			if hook := c.config.OnPublish; hook != nil {
+				if err := hook(c, c.streamName); err != nil {
+					_ = c.writeStatusMessage(cs, "error", "NetStream.Publish.Rejected", err.Error())
+					return errors.Wrap(err, "OnPublish")
+				}
+			}
 			if err := c.respPulishCmdMessage(cs); err != nil {
 				return err
 			}
+			markTime(&c.timings.publish)
 
 			c.handleCommandMessageDone = true
 			c.isPublisher = true
+			c.setStreamRole(cs.MsgStreamID, streamRolePublish, c.streamName)
 			c.logger.WithField("event", "decode Publish Msg").Trace("success")
-		case cmdPlay:
-			if err := c.decodePlayCmdMessage(vs[1:]); err != nil {
+		case cmdPlay, cmdPlay2:
+			decode := c.decodePlayCmdMessage
+			if cmdStr == cmdPlay2 {
+				decode = c.decodePlay2CmdMessage
+			}
+			if err := decode(vs[1:]); err != nil {
 				return err
 			}
-			if err := c.respPlayCmdMessage(cs); err != nil {
+			if c.isDraining() {
+				_ = c.writeStatusMessage(cs, "error", "NetStream.Play.Failed", "Server is draining, please retry later.")
+				return errServerDraining
+			}
+			if soft := c.config.SoftMaxConnections; soft > 0 && c.ssMgr.ConnectionCount() >= soft {
+				_ = c.writeStatusMessage(cs, "error", "NetStream.Play.Failed", "Server is busy, please retry later.")
+				return errServerBusy
+			}
+			if c.isGracePlay() {
+				_ = c.writeStatusMessage(cs, "error", "NetStream.Play.StreamNotFound", "Stream not found.")
+				return errStreamReconnecting
+			}
+			if c.isLiveOnlyMiss() {
+				_ = c.writeStatusMessage(cs, "error", "NetStream.Play.StreamNotFound", "Stream not found.")
+				return errStreamNotFound
+			}
+			if err := c.batch(func() error { return c.respPlayCmdMessage(cs) }); err != nil {
 				return err
 			}
 
 			c.handleCommandMessageDone = true
 			c.isPublisher = false
+			c.setStreamRole(cs.MsgStreamID, streamRolePlay, c.streamName)
 			c.logger.WithField("event", "decode Play Msg").Trace("success")
+		case cmdCheckBandwidth, cmdCheckBw:
+			if err := c.respCheckBandwidthCmdMessage(cs); err != nil {
+				return err
+			}
 		case cmdFCUnpublish, cmdDeleteStream:
 		default:
 			//err := fmt.Errorf("unsupport command=%s", cmdStr)
@@ -433,8 +851,7 @@ func (c *Conn) respConnectCmdMessage(cs *ChunkStream) error {
 	c.logger.WithField("event", "Set WindowAckSize Message").Trace("success")
 
 	// Set Peer Bandwidth
-	respCs = NewProtolControlMessage(MsgSetPeerBandwidth, 5, 2500000)
-	respCs.ChunkBody[4] = 2
+	respCs = NewSetPeerBandwidthMessage(2500000, PeerBandwidthDynamic)
 	if err := c.writeChunkStream(respCs); err != nil {
 		c.logger.WithField("event", "Set Peer Bandwidth").Error(err)
 		return err
@@ -468,6 +885,14 @@ func (c *Conn) respConnectCmdMessage(cs *ChunkStream) error {
 	return nil
 }
 
+// respCheckBandwidthCmdMessage skips the measurement, clients only wait for onBWDone to go on
+func (c *Conn) respCheckBandwidthCmdMessage(cs *ChunkStream) error {
+	if err := c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "onBWDone", 0, nil); err != nil {
+		return errors.Wrap(err, "send onBWDone message")
+	}
+	return nil
+}
+
 func (c *Conn) decodeCreateStreamCmdMessage(vs []interface{}) error {
 	for _, v := range vs {
 		switch v := v.(type) {
@@ -480,15 +905,42 @@ func (c *Conn) decodeCreateStreamCmdMessage(vs []interface{}) error {
 	return nil
 }
 
-func (c *Conn) respCreateStreamCmdMessage(cs *ChunkStream) error {
-	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_result", c.transactionID, nil, 1 /*streamID*/)
+func (c *Conn) respCreateStreamCmdMessage(cs *ChunkStream, streamID uint32) error {
+	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_result", c.transactionID, nil, streamID)
 }
 
 func (c *Conn) decodePulishCmdMessage(vs []interface{}) error {
-	return c.publishOrPlay(vs)
+	if err := c.publishOrPlay(vs); err != nil {
+		return err
+	}
+
+	// transactionID, null, streamName, publishType
+	if c.streamName == "" {
+		c.streamName = c.fcPublishName
+	}
+	c.publishType = publishTypeLive
+	if len(vs) > 3 {
+		if typ, ok := vs[3].(string); ok {
+			switch typ {
+			case publishTypeLive, publishTypeRecord, publishTypeAppend:
+				c.publishType = typ
+			default:
+				c.logger.WithField("event", "decode Publish Msg").Infof("unknown publishing type '%s', use live", typ)
+			}
+		}
+	}
+
+	return nil
 }
 
 func (c *Conn) respPulishCmdMessage(cs *ChunkStream) error {
+	if size := c.config.PublisherBandwidth; size > 0 { // before any media is sent
+		if err := c.writeChunkStream(NewSetPeerBandwidthMessage(size, PeerBandwidthHard)); err != nil {
+			c.logger.WithField("event", "Set Peer Bandwidth").Error(err)
+			return err
+		}
+	}
+
 	event := make(amf.Object)
 	event["level"] = "status"
 	event["code"] = "NetStream.Publish.Start"
@@ -497,26 +949,63 @@ func (c *Conn) respPulishCmdMessage(cs *ChunkStream) error {
 	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "onStatus", 0, nil, event)
 }
 
+// decodePlayCmdMessage takes transactionID, null, streamName, start, duration
 func (c *Conn) decodePlayCmdMessage(vs []interface{}) error {
+	c.playStart, c.playLen = playStartLive, playLenAll
+	if len(vs) > 3 {
+		if start, ok := vs[3].(float64); ok {
+			c.playStart = start
+		}
+	}
+	if len(vs) > 4 {
+		if l, ok := vs[4].(float64); ok {
+			c.playLen = l
+		}
+	}
+
 	return c.publishOrPlay(vs)
 }
 
-func (c *Conn) respPlayCmdMessage(cs *ChunkStream) error {
-	// set recorded
-	cs1 := NewUserControlMessage(streamIsRecorded, 4)
-	for i := 0; i < 4; i++ {
-		cs1.ChunkBody[i+2] = byte(1 >> uint32((3-i)*8) & 0xff)
+// decodePlay2CmdMessage takes transactionID, null, NetStreamPlayOptions{streamName, start, len, transition...},
+// a transition switching renditions plays the new stream name like a fresh play
+func (c *Conn) decodePlay2CmdMessage(vs []interface{}) error {
+	c.playStart, c.playLen = playStartLive, playLenAll
+	for _, v := range vs {
+		switch v := v.(type) {
+		case float64:
+			c.transactionID = int(v)
+		case amf.Object:
+			name, ok := v["streamName"].(string)
+			if !ok || name == "" {
+				return errors.New("play2 options without streamName")
+			}
+			c.streamName = name
+			if start, ok := v["start"].(float64); ok {
+				c.playStart = start
+			}
+			if l, ok := v["len"].(float64); ok {
+				c.playLen = l
+			}
+		}
 	}
-	if err := c.writeChunkStream(cs1); err != nil {
-		return errors.Wrap(err, "send user control message streamIsRecorded")
+
+	if c.streamName == "" {
+		return errors.New("play2 without options")
 	}
+	return nil
+}
 
+/*
+ * respPlayCmdMessage sends the play start sequence, in order:
+ *   1. user control StreamBegin
+ *   2. onStatus NetStream.Play.Reset, player clears its buffer
+ *   3. onStatus NetStream.Play.Start
+ *   4. data message |RtmpSampleAccess, allow player to access audio and video data
+ *   5. data message onStatus NetStream.Data.Start, some flash derived players wait for it
+ */
+func (c *Conn) respPlayCmdMessage(cs *ChunkStream) error {
 	// set begin
-	cs2 := NewUserControlMessage(streamBegin, 4)
-	for i := 0; i < 4; i++ {
-		cs2.ChunkBody[i+2] = byte(1 >> uint32((3-i)*8) & 0xff)
-	}
-	if err := c.writeChunkStream(cs2); err != nil {
+	if err := c.writeChunkStream(newStreamEvent(streamBegin, cs.MsgStreamID)); err != nil {
 		return errors.Wrap(err, "send user control message streamBegin")
 	}
 
@@ -537,44 +1026,63 @@ func (c *Conn) respPlayCmdMessage(cs *ChunkStream) error {
 		return errors.Wrap(err, "send NetStream.Play.Start message")
 	}
 
+	// |RtmpSampleAccess
+	if err := c.writeDataMessage(cs.Csid, cs.MsgStreamID, "|RtmpSampleAccess", true, true); err != nil {
+		return errors.Wrap(err, "send |RtmpSampleAccess message")
+	}
+
 	// NetStream.Data.Start
-	event["level"] = "status"
+	event = make(amf.Object)
 	event["code"] = "NetStream.Data.Start"
-	event["description"] = "Started playing stream."
-	if err := c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "onStatus", 0, nil, event); err != nil {
+	if err := c.writeDataMessage(cs.Csid, cs.MsgStreamID, "onStatus", event); err != nil {
 		return errors.Wrap(err, "send NetStream.Data.Start message")
 	}
 
-	// NetStream.Play.PublishNotify
-	event["level"] = "status"
-	event["code"] = "NetStream.Play.PublishNotify"
-	event["description"] = "Started playing notify."
-	if err := c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "onStatus", 0, nil, event); err != nil {
-		return errors.Wrap(err, "send NetStream.Play.PublishNotify message")
-	}
-
 	return nil
 }
 
-func (c *Conn) decodeFcPublishCmdMessage(vs interface{}) error {
+/*
+ * encoders send releaseStream and FCPublish ahead of createStream and publish, in varying order:
+ *   1. ffmpeg and OBS don't wait for the answers, FMLE and some hardware encoders wait for _result,
+ *      so each is answered if its transaction id asks for it, FCPublish with onFCPublish as well.
+ *   2. they take transactionID, null, streamName. The name is kept for a publish without one.
+ *   3. publish may come on a message stream never created, see setStreamRole and createStream.
+ */
+func (c *Conn) decodeFcPublishCmdMessage(vs []interface{}) error {
+	for k, v := range vs {
+		switch v := v.(type) {
+		case float64:
+			c.transactionID = int(v)
+		case string:
+			if k == 2 && v != "" {
+				c.fcPublishName = v
+			}
+		}
+	}
 	return nil
 }
 
-/*
 func (c *Conn) respFcPublishCmdMessage(cs *ChunkStream) error {
-	return nil
+	if err := c.respReleaseStreamCmdMessage(cs); err != nil {
+		return err
+	}
+
+	event := make(amf.Object)
+	event["code"] = "NetStream.Publish.Start"
+	event["description"] = c.fcPublishName
+	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "onFCPublish", 0, nil, event)
 }
-*/
 
-func (c *Conn) decodeReleaseStreamCmdMessage(vs interface{}) error {
-	return nil
+func (c *Conn) decodeReleaseStreamCmdMessage(vs []interface{}) error {
+	return c.decodeFcPublishCmdMessage(vs)
 }
 
-/*
 func (c *Conn) respReleaseStreamCmdMessage(cs *ChunkStream) error {
-	return nil
+	if c.transactionID == 0 { // no answer expected
+		return nil
+	}
+	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "_result", c.transactionID, nil, nil)
 }
-*/
 
 func (c *Conn) publishOrPlay(vs []interface{}) error {
 	for k, v := range vs {
@@ -600,7 +1108,7 @@ func (c *Conn) publishOrPlay(vs []interface{}) error {
 func (c *Conn) writeCommandMessage(csid, streamID uint32, args ...interface{}) error {
 	buffer := bytes.NewBuffer([]byte{})
 	for _, v := range args {
-		if _, err := c.amfEncoder.Encode(buffer, v, amf.AMF0); err != nil {
+		if _, err := c.amfCodec.Encode(buffer, v, amf.AMF0); err != nil {
 			c.logger.WithField("event", "amf encode").Error(err)
 			return err
 		}
@@ -620,6 +1128,78 @@ func (c *Conn) writeCommandMessage(csid, streamID uint32, args ...interface{}) e
 	return nil
 }
 
+// send onStatus command message with a NetStream status event
+func (c *Conn) writeStatusMessage(cs *ChunkStream, level, code, description string) error {
+	event := make(amf.Object)
+	event["level"] = level
+	event["code"] = code
+	event["description"] = description
+
+	return c.writeCommandMessage(cs.Csid, cs.MsgStreamID, "onStatus", 0, nil, event)
+}
+
+// watchPublishThroughput closes the conn once a publisher sends less than MinPublishThroughput bytes
+// within an interval, a peer trickling bytes would otherwise hold the conn forever. Returns the stop func.
+func (c *Conn) watchPublishThroughput() func() {
+	min := c.config.MinPublishThroughput
+	if min <= 0 {
+		return func() {}
+	}
+	interval := c.config.ThroughputCheckInterval
+	if interval <= 0 {
+		interval = defaultThroughputCheckInterval
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := atomic.LoadInt64(&c.bytesIn)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			n := atomic.LoadInt64(&c.bytesIn)
+			if n-last < int64(min) {
+				c.logger.WithFields(logrus.Fields{"event": "low publish throughput", "remote": c.RemoteAddr().String(), "bytes": n - last, "interval": interval}).Error("disconnect publisher")
+				_ = c.Close()
+				return
+			}
+			last = n
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func (c *Conn) isDraining() bool {
+	return c.server != nil && c.server.IsDraining()
+}
+
+// send MSGAMF0DataMessage msg
+func (c *Conn) writeDataMessage(csid, streamID uint32, args ...interface{}) error {
+	buffer := bytes.NewBuffer([]byte{})
+	for _, v := range args {
+		if _, err := c.amfCodec.Encode(buffer, v, amf.AMF0); err != nil {
+			c.logger.WithField("event", "amf encode").Error(err)
+			return err
+		}
+	}
+	dataMsgBody := buffer.Bytes()
+
+	cs := newChunkStream()
+	cs = cs.setBasicHeader(0, csid)
+	cs = cs.setMessageHeader(0, uint32(len(dataMsgBody)), MSGAMF0DataMessage, streamID)
+	cs.ChunkBody = dataMsgBody
+	cs = cs.setMessageHeaderBuffer(11)
+
+	return c.writeChunkStream(cs)
+}
+
 func (c *Conn) ConnectionState() ConnectionState {
 	c.handshakeMutex.Lock()
 	defer c.handshakeMutex.Unlock()
@@ -633,6 +1213,13 @@ func (c *Conn) conncetionStateLocked() ConnectionState {
 	return state
 }
 
+// bufferLength returns the client buffer length(ms) of stream announced by SetBufferLength, 0 if unknown
+func (c *Conn) bufferLength(streamID uint32) uint32 {
+	c.userCtrlMux.Lock()
+	defer c.userCtrlMux.Unlock()
+	return c.bufferLengths[streamID]
+}
+
 func (c *Conn) handshakeComplete() bool {
 	return atomic.LoadUint32(&c.HandshakeStatus) == 1
 }
@@ -0,0 +1,896 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+)
+
+func TestDecodePublishType(t *testing.T) {
+	var tests = []struct {
+		name        string
+		args        []interface{}
+		publishType string
+		needRecord  bool
+	}{
+		{"record", []interface{}{"publish", 5.0, nil, "test", "record"}, publishTypeRecord, true},
+		{"append", []interface{}{"publish", 5.0, nil, "test", "append"}, publishTypeAppend, true},
+		{"live", []interface{}{"publish", 5.0, nil, "test", "live"}, publishTypeLive, false},
+		{"absent", []interface{}{"publish", 5.0, nil, "test"}, publishTypeLive, false},
+		{"unknown", []interface{}{"publish", 5.0, nil, "test", "foo"}, publishTypeLive, false},
+	}
+
+	for _, tt := range tests {
+		c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+		drainPeer(peer)
+
+		if err := c.decodeCommandMessage(newTestCommandMessage(t, tt.args...)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if !c.isPublisher || c.streamName != "test" {
+			t.Fatalf("%s: got isPublisher %v stream '%s'; want publisher of 'test'", tt.name, c.isPublisher, c.streamName)
+		}
+
+		pub := newPublisher(c, "_defaultVhost_/live/test")
+		if pub.publishType != tt.publishType || pub.needRecord() != tt.needRecord {
+			t.Fatalf("%s: got type '%s' record %v; want '%s' %v", tt.name, pub.publishType, pub.needRecord(), tt.publishType, tt.needRecord)
+		}
+	}
+}
+
+func TestPlayStartSequence(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	msgsCh := make(chan []*ChunkStream, 1)
+	go func() { msgsCh <- readTestMessages(t, newTestPeer(peer), 5) }()
+
+	if err := c.respPlayCmdMessage(newTestCommandMessage(t, "play", 4.0, nil, "test")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	var expected = []struct {
+		typeID RtmpMsgTypeID
+		name   string // event type for user control, first AMF value otherwise
+		code   string
+	}{
+		{MsgUserControlMessage, "StreamBegin", ""},
+		{MsgAMF0CommandMessage, "onStatus", "NetStream.Play.Reset"},
+		{MsgAMF0CommandMessage, "onStatus", "NetStream.Play.Start"},
+		{MSGAMF0DataMessage, "|RtmpSampleAccess", ""},
+		{MSGAMF0DataMessage, "onStatus", "NetStream.Data.Start"},
+	}
+
+	msgs := <-msgsCh
+	if len(msgs) != len(expected) {
+		t.Fatalf("got %d messages; want %d", len(msgs), len(expected))
+	}
+
+	for i, want := range expected {
+		msg := msgs[i]
+		if msg.MsgTypeID != want.typeID {
+			t.Fatalf("msg %d: got type %d; want %d", i, msg.MsgTypeID, want.typeID)
+		}
+
+		if msg.MsgTypeID == MsgUserControlMessage {
+			if uint32(msg.ChunkBody[0])<<8|uint32(msg.ChunkBody[1]) != streamBegin {
+				t.Fatalf("msg %d: got user control % x; want StreamBegin", i, msg.ChunkBody)
+			}
+			continue
+		}
+
+		vs := decodeTestAMF(t, msg.ChunkBody)
+		if vs[0] != want.name || statusCode(vs) != want.code {
+			t.Fatalf("msg %d: got %v; want %s %s", i, vs, want.name, want.code)
+		}
+		if want.name == "|RtmpSampleAccess" && (len(vs) != 3 || vs[1] != true || vs[2] != true) {
+			t.Fatalf("msg %d: got %v; want |RtmpSampleAccess true true", i, vs)
+		}
+	}
+}
+
+func TestPublishLowThroughputDisconnect(t *testing.T) {
+	config := newTestConfig()
+	config.MinPublishThroughput = 100
+	config.ThroughputCheckInterval = 50 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// trickle a video message one byte every 5ms, about 10 bytes per interval
+	go func() {
+		for _, b := range encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoKey, 128) {
+			if _, err := peer.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	stop := c.watchPublishThroughput()
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() { done <- ss.doPublishing() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("got nil err; want read error after disconnect")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("trickling publisher not disconnected")
+	}
+}
+
+func TestPublishThroughputAboveFloor(t *testing.T) {
+	config := newTestConfig()
+	config.MinPublishThroughput = 10
+	config.ThroughputCheckInterval = 20 * time.Millisecond
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	go func() { _, _ = ioutil.ReadAll(peer) }()
+
+	// about 80 bytes per interval
+	stop := c.watchPublishThroughput()
+	for i := 0; i < 30; i++ {
+		atomic.AddInt64(&c.bytesIn, 20)
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+
+	if _, err := c.conn.Write([]byte{0}); err != nil {
+		t.Fatalf("publisher above floor disconnected: %v", err)
+	}
+}
+
+func TestPublishAboveMaxIngestBitrate(t *testing.T) {
+	config := newTestConfig()
+	config.MaxIngestBitrate = 80000 // 10KB/s
+	config.IngestBitrateWindow = 100 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	c.isPublisher = true
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1KB video messages every ms, about 100 times the limit
+	frame := append(append([]byte(nil), testVideoInter...), make([]byte, 1024)...)
+	go func() {
+		for ts := uint32(0); ; ts++ {
+			if _, err := peer.Write(encodeTestMessage(6, ts, MsgVideoMessage, 1, frame, 128)); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	status := make(chan string, 1)
+	go func() { status <- statusCode(readTestCommand(t, newTestPeer(peer))) }()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- ss.doPublishing() }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("got nil err; want read error after disconnect")
+		}
+		if elapsed := time.Since(start); elapsed < config.IngestBitrateWindow {
+			t.Fatalf("disconnected after %v; want a whole window of %v first", elapsed, config.IngestBitrateWindow)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publisher above max bitrate not disconnected")
+	}
+	select {
+	case code := <-status:
+		if code != "NetStream.Publish.Rejected" {
+			t.Fatalf("got status %q; want NetStream.Publish.Rejected", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no status before disconnect")
+	}
+}
+
+func TestPublishBitrateReport(t *testing.T) {
+	config := newTestConfig()
+	config.BitrateReportInterval = 50 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	c.isPublisher = true
+	c.streamKey = "_defaultVhost_/live/test"
+	ss, err := ssMgr.attachPublisher(newPublisher(c, c.streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+	atomic.StoreUint64(&sub.droppedVideo, 3)
+
+	frame := append(append([]byte(nil), testVideoInter...), make([]byte, 1024)...)
+	go func() {
+		for ts := uint32(0); ; ts++ {
+			if _, err := peer.Write(encodeTestMessage(6, ts, MsgVideoMessage, 1, frame, 128)); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	report := make(chan []interface{}, 1)
+	go func() { report <- readTestCommand(t, newTestPeer(peer)) }()
+	go func() { _ = ss.doPublishing() }()
+
+	select {
+	case vs := <-report:
+		if statusCode(vs) != "NetStream.Publish.BitrateReport" {
+			t.Fatalf("got %v; want NetStream.Publish.BitrateReport", vs)
+		}
+		event := vs[len(vs)-1].(amf.Object)
+		if bitrate, _ := event["bitrate"].(float64); bitrate <= 0 {
+			t.Fatalf("got bitrate %v; want the measured one", event["bitrate"])
+		}
+		if event["droppedVideo"] != 3.0 || event["droppingSubscribers"] != 1.0 {
+			t.Fatalf("got dropped video %v by %v subscribers; want 3 by 1", event["droppedVideo"], event["droppingSubscribers"])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no bitrate report to the publisher")
+	}
+	_ = c.Close()
+}
+
+// writeCountConn counts writes reaching the socket
+type writeCountConn struct {
+	net.Conn
+	writes int32
+}
+
+func (wc *writeCountConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&wc.writes, 1)
+	return wc.Conn.Write(b)
+}
+
+func TestConnectResponseCoalesced(t *testing.T) {
+	config := newTestConfig()
+	local, peer := net.Pipe()
+	wc := &writeCountConn{Conn: local}
+	c := Server(wc, newStreamSourceMgr(config), config)
+	c.basicHdrBuf = make([]byte, 3)
+
+	msgs := make(chan []*ChunkStream, 1)
+	go func() { msgs <- readTestMessages(t, newTestPeer(peer), 4) }()
+
+	connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://127.0.0.1/live"})
+	if err := c.decodeCommandMessage(connect); err != nil {
+		t.Fatal(err)
+	}
+
+	// WindowAckSize, SetPeerBandwidth, SetChunkSize and _result in one write, was one write per header and body
+	got := <-msgs
+	want := []RtmpMsgTypeID{MsgWindowAcknowledgementSize, MsgSetPeerBandwidth, MsgSetChunkSize, MsgAMF0CommandMessage}
+	for i, cs := range got {
+		if cs.MsgTypeID != want[i] {
+			t.Fatalf("msg %d: got type %d; want %d", i, cs.MsgTypeID, want[i])
+		}
+	}
+	if n := atomic.LoadInt32(&wc.writes); n != 1 {
+		t.Fatalf("got %d writes for connect response; want 1", n)
+	}
+}
+
+func TestAppConfigChunkSize(t *testing.T) {
+	config := newTestConfig()
+	config.AppConfigs = map[string]*AppConfig{"vod": {ChunkSize: 4096}}
+
+	for _, tt := range []struct {
+		app  string
+		want uint32
+	}{
+		{"vod", 4096},
+		{"vod/room1", 4096}, // instance doesn't matter
+		{"live", DefaultChunkSize},
+	} {
+		c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+		msgs := make(chan []*ChunkStream, 1)
+		go func() { msgs <- readTestMessages(t, newTestPeer(peer), 4) }()
+
+		connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": tt.app, "tcUrl": "rtmp://127.0.0.1/" + tt.app})
+		if err := c.decodeCommandMessage(connect); err != nil {
+			t.Fatalf("%s: %v", tt.app, err)
+		}
+
+		got := <-msgs
+		if len(got) < 3 || got[2].MsgTypeID != MsgSetChunkSize {
+			t.Fatalf("%s: no SetChunkSize in connect response", tt.app)
+		}
+		if size := binary.BigEndian.Uint32(got[2].ChunkBody); size != tt.want || c.localChunksize != tt.want {
+			t.Fatalf("%s: got announced chunk size %d local %d; want %d", tt.app, size, c.localChunksize, tt.want)
+		}
+	}
+	if config.AppConfigs["vod"].ChunkSize != 4096 || config.ChunkSize == 4096 {
+		t.Fatal("override changed the server config")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	var log bytes.Buffer
+	config := newTestConfig()
+	config.Logger.SetOutput(&log)
+	config.ConnectTimeout = 50 * time.Millisecond
+
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	done := make(chan struct{})
+	go func() {
+		c.Serve()
+		close(done)
+	}()
+	if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+		t.Fatal("handshake failed")
+	}
+	start := time.Now()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("conn without connect command still served")
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("disconnected after %v; want the timeout of 50ms", d)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v; want the conn closed", err)
+	}
+	if !strings.Contains(log.String(), "no connect command within 50ms") {
+		t.Fatalf("got log %q; want the timeout logged", log.String())
+	}
+}
+
+func TestPlayerReadLoop(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+	pubConn, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10000")
+	ss, err := ssMgr.attachPublisher(newPublisher(pubConn, "example.com/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	served := make(chan error, 1)
+	go func() { served <- c.serve() }()
+	if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+		t.Fatal("handshake failed")
+	}
+	drainPeer(peer)
+	for _, args := range [][]interface{}{
+		{"connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"}},
+		{"createStream", 2.0, nil},
+		{"play", 3.0, nil, "test"},
+	} {
+		streamID := uint32(0)
+		if args[0] == "play" {
+			streamID = 1
+		}
+		if _, err := peer.Write(encodeTestMessage(3, 0, MsgAMF0CommandMessage, streamID, newTestCommandMessage(t, args...).ChunkBody, 128)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100 && len(ss.Subscribers()) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// players announce their buffer once playing, it sets the GOP cache replay
+	body := []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0xb8} // stream 1, 3000ms
+	if _, err := peer.Write(encodeTestMessage(2, 0, MsgUserControlMessage, 0, body, 128)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && c.bufferLength(1) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	ss.addSubMux.Lock()
+	sub := ss.subscribers["127.0.0.1:10001"]
+	ss.addSubMux.Unlock()
+	if sub == nil || sub.replayDepth() != 3*time.Second {
+		t.Fatalf("got player %v; want a replay depth of the announced 3s", sub)
+	}
+
+	if _, err := peer.Write(encodeTestMessage(3, 0, MsgAMF0CommandMessage, 1, newTestCommandMessage(t, "closeStream", 0.0, nil).ChunkBody, 128)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != errPlayerClosedStream {
+			t.Fatalf("got %v; want %v", err, errPlayerClosedStream)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("player still playing after closeStream")
+	}
+}
+
+func TestPublisherStopMidMessage(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	done := make(chan struct{})
+	go func() {
+		c.Serve()
+		close(done)
+	}()
+	if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+		t.Fatal("handshake failed")
+	}
+	drainPeer(peer)
+
+	video := append(append([]byte(nil), testVideoKey...), make([]byte, 300-len(testVideoKey))...)
+	for _, b := range [][]byte{
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"}).ChunkBody, 128),
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, newTestCommandMessage(t, "createStream", 2.0, nil).ChunkBody, 128),
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 1, newTestCommandMessage(t, "publish", 3.0, nil, "test", "live").ChunkBody, 128),
+		encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoKey, 128),
+		encodeTestMessage(6, 40, MsgVideoMessage, 1, video, 128)[:12+128], // then the publisher stops
+	} {
+		if _, err := peer.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; c.MemoryUsage() < 300; i++ {
+		if i == 100 {
+			t.Fatal("partial message not being assembled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	peer.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher conn still served after close")
+	}
+	if n := len(c.chunks); n != 0 {
+		t.Fatalf("got %d chunk streams after teardown; want none", n)
+	}
+	if n := c.MemoryUsage(); n != 0 {
+		t.Fatalf("got %d bytes accounted after teardown; want 0", n)
+	}
+}
+
+func TestCheckBandwidth(t *testing.T) {
+	for _, cmd := range []string{"checkBandwidth", "_checkbw"} {
+		c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+		cmdResp := make(chan []interface{}, 1)
+		go func() { cmdResp <- readTestCommand(t, newTestPeer(peer)) }()
+
+		if err := c.decodeCommandMessage(newTestCommandMessage(t, cmd, 0.0, nil)); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		if vs := <-cmdResp; len(vs) < 2 || vs[0] != "onBWDone" || vs[1] != 0.0 {
+			t.Fatalf("%s: got %v; want onBWDone 0", cmd, vs)
+		}
+		if c.handleCommandMessageDone {
+			t.Fatalf("%s: command phase should go on until publish or play", cmd)
+		}
+	}
+}
+
+func TestConnectAppInstance(t *testing.T) {
+	var tests = []struct {
+		app       string
+		tcUrl     string
+		streamKey string
+	}{
+		{"live", "rtmp://example.com/live", "example.com/live/test"},
+		{"live/inst1", "rtmp://example.com/live/inst1", "example.com/live/inst1/test"},
+		{"live", "rtmp://example.com/live/inst1", "example.com/live/inst1/test"}, // instance from tcUrl
+		{"", "rtmp://example.com/live/inst1", "example.com/live/inst1/test"},
+		{"live/_definst_", "rtmp://example.com/live/_definst_", "example.com/live/test"},
+		{"live", "rtmp://example.com/live/_definst_", "example.com/live/test"},
+		{"live?token=x", "rtmp://example.com/live?token=x", "example.com/live/test"},
+	}
+
+	for _, tt := range tests {
+		c, _ := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+		connect := amf.Object{"tcUrl": tt.tcUrl}
+		if tt.app != "" {
+			connect["app"] = tt.app
+		}
+		if err := c.decodeConnectCmdMessage([]interface{}{1.0, connect}); err != nil {
+			t.Fatal(err)
+		}
+		c.streamName = "test"
+
+		if err := c.discoverTcUrl(); err != nil {
+			t.Fatalf("app '%s' tcUrl %s: %v", tt.app, tt.tcUrl, err)
+		}
+		if key := genStreamKey(c.vhost, c.appKey(), c.streamName); key != tt.streamKey {
+			t.Fatalf("app '%s' tcUrl %s: got stream key %s; want %s", tt.app, tt.tcUrl, key, tt.streamKey)
+		}
+	}
+}
+
+func TestDomainFunc(t *testing.T) {
+	config := newTestConfig()
+	config.DomainFunc = func(c *Conn) string {
+		u, err := url.Parse(c.TcUrl())
+		if err != nil {
+			return ""
+		}
+		if tenant := u.Query().Get("tenant"); tenant != "" {
+			return tenant + ".example.com"
+		}
+		return ""
+	}
+
+	var tests = []struct {
+		tcUrl     string
+		streamKey string
+	}{
+		{"rtmp://example.com/live?tenant=alice", "alice.example.com/live/test"},
+		{"rtmp://127.0.0.1:10001/live?tenant=bob&vhost=example.com", "bob.example.com/live/test"},
+		{"rtmp://example.com/live", "example.com/live/test"}, // empty keeps the default
+	}
+	for _, tt := range tests {
+		c, _ := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+		if err := c.decodeConnectCmdMessage([]interface{}{1.0, amf.Object{"app": "live", "tcUrl": tt.tcUrl}}); err != nil {
+			t.Fatal(err)
+		}
+		c.streamName = "test"
+
+		if err := c.discoverTcUrl(); err != nil {
+			t.Fatalf("tcUrl %s: %v", tt.tcUrl, err)
+		}
+		if key := genStreamKey(c.vhost, c.appKey(), c.streamName); key != tt.streamKey {
+			t.Fatalf("tcUrl %s: got stream key %s; want %s", tt.tcUrl, key, tt.streamKey)
+		}
+	}
+}
+
+type testCtxKey struct{}
+
+func TestConnContextThroughHooks(t *testing.T) {
+	config := newTestConfig()
+	config.OnConnect = func(c *Conn) error {
+		if !strings.Contains(c.TcUrl(), "token=alice") {
+			return errors.New("unauthorized")
+		}
+		c.SetContext(context.WithValue(c.Context(), testCtxKey{}, "alice"))
+		return nil
+	}
+	principal := make(chan interface{}, 1)
+	config.OnPublish = func(c *Conn, streamName string) error {
+		principal <- c.Context().Value(testCtxKey{})
+		return nil
+	}
+
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	drainPeer(peer)
+	if c.Context() == nil {
+		t.Fatal("got nil context before SetContext")
+	}
+
+	connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live?token=alice"})
+	if err := c.decodeCommandMessage(connect); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.decodeCommandMessage(newTestCommandMessage(t, "publish", 5.0, nil, "test", "live")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-principal; got != "alice" {
+		t.Fatalf("got principal %v in OnPublish; want alice", got)
+	}
+
+	// rejected by OnConnect
+	c, peer = newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10002")
+	cmdResp := make(chan []interface{}, 1)
+	go func() { cmdResp <- readTestCommand(t, newTestPeer(peer)) }()
+	connect = newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})
+	if err := c.decodeCommandMessage(connect); err == nil {
+		t.Fatal("got nil err; want rejected by OnConnect")
+	}
+	if vs := <-cmdResp; len(vs) == 0 || vs[0] != "_error" || statusCode(vs) != "NetConnection.Connect.Rejected" {
+		t.Fatalf("got %v; want _error NetConnection.Connect.Rejected", vs)
+	}
+}
+
+func TestDecodePlay2(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	pc := newTestPeer(peer)
+	cmdResp := make(chan []interface{}, 2)
+	go func() {
+		cmdResp <- readTestCommand(t, pc)
+		cmdResp <- readTestCommand(t, pc)
+	}()
+
+	c.tcUrl = "rtmp://example.com/live"
+	options := amf.Object{"streamName": "stream_720p", "oldStreamName": "stream_480p", "start": 0.0, "len": -1.0, "transition": "switch"}
+	if err := c.decodeCommandMessage(newTestCommandMessage(t, "play2", 0.0, nil, options)); err != nil {
+		t.Fatal(err)
+	}
+	if codes := statusCode(<-cmdResp) + " " + statusCode(<-cmdResp); codes != "NetStream.Play.Reset NetStream.Play.Start" {
+		t.Fatalf("got status %s; want NetStream.Play.Reset NetStream.Play.Start", codes)
+	}
+
+	if !c.handleCommandMessageDone || c.isPublisher {
+		t.Fatal("play2 should end the command phase as a player")
+	}
+	if c.playStart != 0 || c.playLen != -1 {
+		t.Fatalf("got start %v len %v; want 0 -1", c.playStart, c.playLen)
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		t.Fatal(err)
+	}
+	if key := genStreamKey(c.vhost, c.appKey(), c.streamName); key != "example.com/live/stream_720p" {
+		t.Fatalf("got stream key %s; want example.com/live/stream_720p", key)
+	}
+
+	// options without stream name
+	c, peer = newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10002")
+	drainPeer(peer)
+	if err := c.decodeCommandMessage(newTestCommandMessage(t, "play2", 0.0, nil, amf.Object{"start": 0.0})); err == nil {
+		t.Fatal("got nil err for play2 without streamName")
+	}
+}
+
+func TestPlayLiveOnly(t *testing.T) {
+	config := newTestConfig()
+	config.PlayWaitsForReconnect = true // a play with the default start waits for the publisher
+	ssMgr := newStreamSourceMgr(config)
+	pubConn, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10000")
+	ss, err := ssMgr.attachPublisher(newPublisher(pubConn, "example.com/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	play := func(start float64) string {
+		c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		cmdResp := make(chan []interface{}, 1)
+		go func() { cmdResp <- readTestCommand(t, newTestPeer(peer)) }()
+		c.tcUrl = "rtmp://example.com/live"
+		_ = c.decodeCommandMessage(newTestCommandMessage(t, "play", 0.0, nil, "test", start))
+		return statusCode(<-cmdResp)
+	}
+	if code := play(playStartLiveOnly); code != "NetStream.Play.Reset" {
+		t.Fatalf("live only while publishing: got %s; want NetStream.Play.Reset", code)
+	}
+
+	ss.delPublisher() // in the reconnect grace period
+	defer ss.Close()
+	if code := play(playStartLive); code != "NetStream.Play.Reset" {
+		t.Fatalf("live or recorded without publisher: got %s; want NetStream.Play.Reset", code)
+	}
+	if code := play(playStartLiveOnly); code != "NetStream.Play.StreamNotFound" {
+		t.Fatalf("live only without publisher: got %s; want NetStream.Play.StreamNotFound", code)
+	}
+}
+
+// testBufferPool hands out buffers it records, safe for concurrent use
+type testBufferPool struct {
+	mux  sync.Mutex
+	got  map[*byte]bool // first byte of every buffer handed out, true once put back
+	puts int
+}
+
+func (p *testBufferPool) Get(size int) []byte {
+	b := make([]byte, size, size+1) // cap > 0 so &b[:1][0] identifies it
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.got[&b[:1][0]] = false
+	return b
+}
+
+func (p *testBufferPool) Put(b []byte) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if _, ok := p.got[&b[:1][0]]; ok {
+		p.got[&b[:1][0]] = true
+	}
+	p.puts++
+}
+
+func (p *testBufferPool) state(b []byte) (got, put bool) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	put, got = p.got[&b[:1][0]]
+	return got, put
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := &testBufferPool{got: make(map[*byte]bool)}
+	config := newTestConfig()
+	config.BufferPool = pool
+	ssMgr := newStreamSourceMgr(config)
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	drainPeer(peer)
+
+	// command phase: every body goes back to the pool once handled
+	var cmds []byte
+	for _, args := range [][]interface{}{
+		{"connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"}},
+		{"createStream", 2.0, nil},
+		{"publish", 3.0, nil, "test", "live"},
+	} {
+		cs := newTestCommandMessage(t, args...)
+		cmds = append(cmds, encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, cs.ChunkBody, 128)...)
+	}
+	feedPeer(peer, cmds)
+	if err := c.handleCommandMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.got) != 3 || pool.puts != 3 {
+		t.Fatalf("got %d buffers, %d put back; want 3 3", len(pool.got), pool.puts)
+	}
+	for _, put := range pool.got {
+		if !put {
+			t.Fatal("command body not put back")
+		}
+	}
+
+	// publishing: media is handed over in packets, protocol control goes back
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "example.com/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+	go func() { _ = ss.doPublishing() }()
+
+	setBufLen := []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0xb8}
+	feedPeer(peer, append(encodeTestMessage(2, 0, MsgUserControlMessage, 0, setBufLen, 128),
+		encodeTestMessage(6, 40, MsgVideoMessage, 1, testVideoKey, 128)...))
+
+	var video []byte
+	select {
+	case pkt := <-sub.avPktQueue:
+		video = pkt.Data
+		if got, put := pool.state(video); !got || put {
+			t.Fatalf("got pooled %v put back %v for video body; want pooled, not put back", got, put)
+		}
+		pkt.Release()
+	case <-time.After(time.Second):
+		t.Fatal("video not dispatched")
+	}
+
+	// the body comes back with the last reference, once the cache dropped the packet too
+	ss.Close()
+	for i := 0; ; i++ {
+		if _, put := pool.state(video); put {
+			break
+		}
+		if i == 100 {
+			t.Fatal("video body not put back once released")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	if len(pool.got) != 5 || pool.puts != 5 {
+		t.Fatalf("got %d buffers, %d put back; want 5 5", len(pool.got), pool.puts)
+	}
+}
+
+func TestPublishCommandOrderings(t *testing.T) {
+	connect := []interface{}{"connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"}}
+	tests := []struct {
+		name      string
+		cmds      [][]interface{} // on message stream 0 but the last, publish on message stream 1
+		results   []float64       // transaction ids answered with _result, after connect
+		fcPublish bool            // onFCPublish sent
+	}{
+		{
+			"ffmpeg", // capture of ffmpeg -f flv rtmp://...
+			[][]interface{}{
+				connect,
+				{"releaseStream", 2.0, nil, "test"},
+				{"FCPublish", 3.0, nil, "test"},
+				{"createStream", 4.0, nil},
+				{"publish", 5.0, nil, "test", "live"},
+			},
+			[]float64{2, 3, 4}, true,
+		},
+		{
+			"createStream first",
+			[][]interface{}{connect, {"createStream", 2.0, nil}, {"releaseStream", 3.0, nil, "test"}, {"FCPublish", 4.0, nil, "test"}, {"publish", 5.0, nil, "test", "live"}},
+			[]float64{2, 3, 4}, true,
+		},
+		{
+			"FCPublish only names the stream",
+			[][]interface{}{connect, {"FCPublish", 2.0, nil, "test"}, {"createStream", 3.0, nil}, {"publish", 4.0, nil, "", "live"}},
+			[]float64{2, 3}, true,
+		},
+		{
+			"no createStream",
+			[][]interface{}{connect, {"releaseStream", 0.0, nil, "test"}, {"FCPublish", 0.0, nil, "test"}, {"publish", 0.0, nil, "test", "live"}},
+			nil, true,
+		},
+		{
+			"publish right after connect",
+			[][]interface{}{connect, {"publish", 2.0, nil, "test", "live"}},
+			nil, false,
+		},
+	}
+
+	for _, tt := range tests {
+		c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+
+		type reply struct {
+			results   []float64
+			fcPublish bool
+			started   bool
+		}
+		replies := make(chan reply, 1)
+		go func() {
+			var r reply
+			pc := newTestPeer(peer)
+			readTestCommand(t, pc) // connect _result
+			for !r.started {
+				vs := readTestCommand(t, pc)
+				if len(vs) < 2 {
+					break
+				}
+				switch vs[0] {
+				case "_result":
+					r.results = append(r.results, vs[1].(float64))
+				case "onFCPublish":
+					r.fcPublish = true
+				case "onStatus":
+					r.started = statusCode(vs) == "NetStream.Publish.Start"
+				}
+			}
+			replies <- r
+		}()
+
+		var b []byte
+		for i, args := range tt.cmds {
+			streamID := uint32(0)
+			if i == len(tt.cmds)-1 {
+				streamID = 1
+			}
+			b = append(b, encodeTestMessage(3, 0, MsgAMF0CommandMessage, streamID, newTestCommandMessage(t, args...).ChunkBody, 128)...)
+		}
+		feedPeer(peer, b)
+		if err := c.handleCommandMessage(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var r reply
+		select {
+		case r = <-replies:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no NetStream.Publish.Start", tt.name)
+		}
+		if !r.started || !c.isPublisher || c.streamName != "test" {
+			t.Fatalf("%s: got started %v publisher %v stream '%s'; want test published", tt.name, r.started, c.isPublisher, c.streamName)
+		}
+		if id, ok := c.streamIDOf(streamRolePublish); !ok || id != 1 {
+			t.Fatalf("%s: got publish stream id %d %v; want 1", tt.name, id, ok)
+		}
+		if len(r.results) != len(tt.results) || r.fcPublish != tt.fcPublish {
+			t.Fatalf("%s: got _result of %v onFCPublish %v; want %v %v", tt.name, r.results, r.fcPublish, tt.results, tt.fcPublish)
+		}
+		for i := range tt.results {
+			if r.results[i] != tt.results[i] {
+				t.Fatalf("%s: got _result of %v; want %v", tt.name, r.results, tt.results)
+			}
+		}
+
+		// a createStream coming late doesn't hand out the published stream id
+		if id := c.createStream(); id == 1 {
+			t.Fatalf("%s: createStream got the published stream id", tt.name)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package rtmp
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ * Chunk stream ids written by the conn:
+ *   1. 0 and 1 select the 2 and 3 byte basic header, they never name a chunk stream.
+ *   2. 2 carries protocol and user control messages, 3 is the command csid by convention, 4 audio and
+ *      6 video and data. They are reserved, a custom message written with ExplicitCsid on one of them
+ *      fails, media may keep them, e.g. a relay keeping the csids of its source.
+ *   3. custom message streams take csids from AllocCSID, 7 on.
+ */
+const (
+	csidProtocolControl = 2
+	csidCommand         = 3
+	csidAudio           = 4
+	csidVideo           = 6 // video and data messages
+
+	firstCustomCSID = 7
+	maxCSID         = 65599 // 3 byte basic header
+)
+
+// AllocCSID hands out a csid for a custom message stream, none of the reserved ones, each once per conn
+func (c *Conn) AllocCSID() (uint32, error) {
+	n := atomic.AddUint32(&c.customCSIDs, 1)
+	if n > maxCSID-firstCustomCSID+1 {
+		return 0, errors.Wrapf(errCSIDExhausted, "%d csids allocated", n-1)
+	}
+	return firstCustomCSID + n - 1, nil
+}
+
+// checkExplicitCSID reports cs written on a csid it must not use, see the csid reservation above
+func checkExplicitCSID(cs *ChunkStream) error {
+	switch cs.Csid {
+	case 0, 1:
+		return errors.Wrapf(errReservedCSID, "csid %d", cs.Csid)
+	case csidProtocolControl:
+		if !isControlMessage(cs.MsgTypeID) {
+			return errors.Wrapf(errReservedCSID, "message type %d on protocol control csid %d", cs.MsgTypeID, cs.Csid)
+		}
+	case csidCommand:
+		if !isCommandMessage(cs.MsgTypeID) {
+			return errors.Wrapf(errReservedCSID, "message type %d on command csid %d", cs.MsgTypeID, cs.Csid)
+		}
+	case csidAudio, csidVideo:
+		if !isMediaMessage(cs.MsgTypeID) {
+			return errors.Wrapf(errReservedCSID, "message type %d on media csid %d", cs.MsgTypeID, cs.Csid)
+		}
+	}
+	if cs.Csid > maxCSID {
+		return errors.Errorf("rtmp: csid %d beyond %d", cs.Csid, maxCSID)
+	}
+	return nil
+}
+
+// protocol control messages 1 to 6, user control included
+func isControlMessage(typeID RtmpMsgTypeID) bool {
+	return typeID >= MsgSetChunkSize && typeID <= MsgSetPeerBandwidth
+}
+
+func isMediaMessage(typeID RtmpMsgTypeID) bool {
+	switch typeID {
+	case MsgAudioMessage, MsgVideoMessage, MSGAMF0DataMessage, MsgAMF3DataMessage, MsgAggregateMessage:
+		return true
+	}
+	return false
+}
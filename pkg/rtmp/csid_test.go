@@ -0,0 +1,75 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestAllocCSID(t *testing.T) {
+	c, _ := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+
+	seen := make(map[uint32]bool)
+	for {
+		csid, err := c.AllocCSID()
+		if err != nil {
+			if errors.Cause(err) != errCSIDExhausted {
+				t.Fatalf("got err %v; want %v", err, errCSIDExhausted)
+			}
+			break
+		}
+		switch {
+		case csid <= csidVideo:
+			t.Fatalf("got reserved csid %d", csid)
+		case csid > maxCSID:
+			t.Fatalf("got csid %d beyond %d", csid, maxCSID)
+		case seen[csid]:
+			t.Fatalf("got csid %d twice", csid)
+		}
+		seen[csid] = true
+	}
+	if n := len(seen); n != maxCSID-firstCustomCSID+1 {
+		t.Fatalf("allocated %d csids; want %d", n, maxCSID-firstCustomCSID+1)
+	}
+}
+
+func TestWriteReservedCSID(t *testing.T) {
+	c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	drainPeer(peer)
+	custom, err := c.AllocCSID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const msgCustom RtmpMsgTypeID = 0x30
+	var tests = []struct {
+		csid   uint32
+		typeID RtmpMsgTypeID
+		ok     bool
+	}{
+		{1, MsgVideoMessage, false},
+		{csidProtocolControl, MsgSetChunkSize, true},
+		{csidProtocolControl, MsgVideoMessage, false},
+		{csidCommand, MsgAMF0CommandMessage, true},
+		{csidCommand, msgCustom, false},
+		{csidAudio, MsgAudioMessage, true},
+		{csidVideo, MsgAudioMessage, true}, // media may keep the csids of its source
+		{csidVideo, msgCustom, false},
+		{5, msgCustom, true},
+		{custom, msgCustom, true},
+	}
+	for _, tt := range tests {
+		cs := newChunkStream()
+		cs.Csid, cs.ExplicitCsid = tt.csid, true
+		cs.MsgTypeID = tt.typeID
+		cs.ChunkBody = []byte{0, 0, 0, 128}
+		cs.MsgLength = uint32(len(cs.ChunkBody))
+		err := c.writeChunkStream(cs)
+		if tt.ok && err != nil {
+			t.Fatalf("csid %d type %d: %v", tt.csid, tt.typeID, err)
+		}
+		if !tt.ok && errors.Cause(err) != errReservedCSID {
+			t.Fatalf("csid %d type %d: got err %v; want %v", tt.csid, tt.typeID, err, errReservedCSID)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package rtmp
+
+import (
+	"net/http"
+	"strings"
+
+	"playground/pkg/av"
+	"playground/pkg/dash"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startDASH packages the stream through a pseudo subscriber until the stream source is deleted
+func (ss *streamSource) startDASH(config *Config) {
+	ss.dash = dash.NewPackager(dash.Config{
+		SegmentDuration: config.DASHSegmentDuration,
+		Window:          config.DASHWindow,
+	})
+
+	sub := newPseudoSubscriber(subTypeDASH, subTypeDASH, config.Logger, 1024)
+	ss.putSubscriberLocked(sub)
+	ss.subscriberCount++
+	ss.addShardLocked(sub)
+
+	go ss.dashPackagingCycle(sub)
+}
+
+func (ss *streamSource) dashPackagingCycle(sub *subscriber) {
+	defer ss.delPseudoSubscriber(sub, (*av.Packet).Release)
+	defer sub.stop()
+
+	logger := sub.logger.WithFields(logrus.Fields{"event": "dash packaging", "streamKey": ss.streamKey})
+	for {
+		select {
+		case <-ss.done:
+			return
+		case pkt := <-sub.avPktQueue:
+			out := pkt.Copy()
+			out.TimeStamp = sub.nextTimeStamp(pkt)
+			if err := ss.dash.WritePacket(out); err != nil {
+				logger.Error(err)
+			}
+			pkt.Release()
+		}
+	}
+}
+
+// DASHHandler serves streams packaged with Config.DASH, e.g. http://host/live/test/manifest.mpd?vhost=...,
+// segments are relative to the manifest: {video,audio}/init.mp4 and {video,audio}/{number}.m4s
+func (s *Service) DASHHandler() http.Handler {
+	return http.HandlerFunc(s.serveDASH)
+}
+
+func (s *Service) serveDASH(w http.ResponseWriter, r *http.Request) {
+	streamKey, name, ok := parseDASHPath(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	val, ok := s.ssMgr.streamMap.Load(streamKey)
+	if !ok || val.(*streamSource).dash == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	val.(*streamSource).dash.ServeFile(w, r, name)
+}
+
+// parseDASHPath maps /{app}/{stream}/{name} to stream key and the file name relative to the manifest
+func parseDASHPath(r *http.Request) (streamKey, name string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	n := len(parts)
+	switch {
+	case n >= 3 && parts[n-1] == "manifest.mpd":
+		name = parts[n-1]
+		parts = parts[:n-1]
+	case n >= 4 && (parts[n-2] == "video" || parts[n-2] == "audio"):
+		name = parts[n-2] + "/" + parts[n-1]
+		parts = parts[:n-2]
+	default:
+		return "", "", false
+	}
+
+	app, stream := strings.Join(parts[:len(parts)-1], "/"), parts[len(parts)-1]
+	if app == "" || stream == "" {
+		return "", "", false
+	}
+
+	return genStreamKey(httpVhost(r), app, stream), name, true
+}
@@ -0,0 +1,98 @@
+package rtmp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// video frames with one length prefixed NALU, the packager drops empty ones
+var (
+	testDASHVideoKey   = []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x65}
+	testDASHVideoInter = []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x41}
+)
+
+func TestDASHManifest(t *testing.T) {
+	config := newTestConfig()
+	config.DASH = true
+	config.DASHSegmentDuration = time.Second
+	server := NewService(config)
+
+	streamKey := "_defaultVhost_/live/test"
+	c, _ := newTestConn(t, server.ssMgr, config, "127.0.0.1:10001")
+	ss, err := server.ssMgr.attachPublisher(newPublisher(c, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one GOP of 1s, closed by the next keyframe
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testAVCSeq720p, 0))
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, false, testAudioSeq, 0))
+	for ts := uint32(0); ts < 1000; ts += 40 {
+		data := testDASHVideoInter
+		if ts == 0 {
+			data = testDASHVideoKey
+		}
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, data, 1000+ts))
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, false, []byte{0xaf, 0x01, 0x21, 0x22}, 1000+ts+5))
+	}
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testDASHVideoKey, 2000))
+
+	srv := httptest.NewServer(server.DASHHandler())
+	defer srv.Close()
+
+	var mpd string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) { // packaging is asynchronous
+		resp, err := http.Get(srv.URL + "/live/test/manifest.mpd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			mpd = string(body)
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if mpd == "" {
+		t.Fatal("manifest not ready")
+	}
+
+	for _, want := range []string{
+		`type="dynamic"`,
+		`<Representation id="video" codecs="avc1.420028" width="1280" height="720"`,
+		`<Representation id="audio" codecs="mp4a.40.2" audioSamplingRate="44100"`,
+		`initialization="video/init.mp4" media="video/$Number$.m4s" startNumber="1"`,
+		`initialization="audio/init.mp4" media="audio/$Number$.m4s" startNumber="1"`,
+		`<S t="0" d="1000"/>`,
+	} {
+		if !strings.Contains(mpd, want) {
+			t.Fatalf("manifest missing %s:\n%s", want, mpd)
+		}
+	}
+
+	for _, path := range []string{"/live/test/video/init.mp4", "/live/test/video/1.m4s", "/live/test/audio/1.m4s"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d; want %d", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/live/other/manifest.mpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown stream: got status %d; want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
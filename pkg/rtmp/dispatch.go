@@ -0,0 +1,96 @@
+package rtmp
+
+import (
+	"playground/pkg/av"
+)
+
+// dispatchShard fans packets out to its share of the subscribers of a stream on its own goroutine
+type dispatchShard struct {
+	jobs chan *av.Packet
+	subs []*subscriber // guarded by addSubMux of the stream source
+}
+
+// startShards starts n dispatch workers, they exit once the stream source is deleted
+func (ss *streamSource) startShards(n int) {
+	ss.shards = make([]*dispatchShard, n)
+	for i := range ss.shards {
+		sh := &dispatchShard{jobs: make(chan *av.Packet)}
+		ss.shards[i] = sh
+		go ss.shardCycle(sh)
+	}
+}
+
+func (ss *streamSource) shardCycle(sh *dispatchShard) {
+	for {
+		select {
+		case pkt := <-sh.jobs:
+			for _, sub := range sh.subs {
+				if sub.isStopped() {
+					continue
+				}
+
+				sub.sendCachePacket(ss.cache)
+				sub.writeAVPacket(pkt)
+			}
+			ss.shardWG.Done()
+		case <-ss.done:
+			return
+		}
+	}
+}
+
+// must hold addSubMux, puts sub on the shard with the fewest subscribers
+func (ss *streamSource) addShardLocked(sub *subscriber) {
+	if len(ss.shards) == 0 {
+		return
+	}
+
+	min := ss.shards[0]
+	for _, sh := range ss.shards[1:] {
+		if len(sh.subs) < len(min.subs) {
+			min = sh
+		}
+	}
+	min.subs = append(min.subs, sub)
+	sub.shard = min
+}
+
+// must hold addSubMux
+func (ss *streamSource) delShardLocked(sub *subscriber) {
+	sh := sub.shard
+	if sh == nil {
+		return
+	}
+
+	for i, s := range sh.subs {
+		if s == sub {
+			sh.subs = append(sh.subs[:i], sh.subs[i+1:]...)
+			break
+		}
+	}
+	sub.shard = nil
+}
+
+/*
+ * dispatchShardsLocked hands pkt to every shard and waits for all of them:
+ *   1. shards queue pkt to their subscribers in parallel, the cache and the subscriber sets don't
+ *      change meanwhile as addSubMux is held throughout.
+ *   2. the next packet is handed over only after pkt is queued everywhere, so each subscriber still
+ *      gets packets in dispatch order.
+ * A deleted stream source has no workers left, its shards are skipped.
+ */
+func (ss *streamSource) dispatchShardsLocked(pkt *av.Packet) {
+	for _, sh := range ss.shards {
+		if len(sh.subs) == 0 {
+			continue
+		}
+
+		ss.shardWG.Add(1)
+		select {
+		case sh.jobs <- pkt: // unbuffered, a worker which took it always calls Done
+		case <-ss.done:
+			ss.shardWG.Done()
+		}
+	}
+	ss.shardWG.Wait()
+}
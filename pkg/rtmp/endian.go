@@ -0,0 +1,85 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// rtmp headers are big endian but message stream id of the message header and csid of the basic
+// header, little endian. encoding/binary has no 24 bit order, these cover timestamps and lengths.
+
+func getUint24BE(b []byte) uint32 {
+	_ = b[2] // bounds check hint to compiler
+	return uint32(b[2]) | uint32(b[1])<<8 | uint32(b[0])<<16
+}
+
+func putUint24BE(b []byte, v uint32) {
+	_ = b[2]
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+func getUint24LE(b []byte) uint32 {
+	_ = b[2]
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24LE(b []byte, v uint32) {
+	_ = b[2]
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// getUint decodes a 1 to 4 bytes unsigned integer
+func getUint(b []byte, bigEndian bool) uint32 {
+	switch len(b) {
+	case 1:
+		return uint32(b[0])
+	case 2:
+		if bigEndian {
+			return uint32(binary.BigEndian.Uint16(b))
+		}
+		return uint32(binary.LittleEndian.Uint16(b))
+	case 3:
+		if bigEndian {
+			return getUint24BE(b)
+		}
+		return getUint24LE(b)
+	case 4:
+		if bigEndian {
+			return binary.BigEndian.Uint32(b)
+		}
+		return binary.LittleEndian.Uint32(b)
+	}
+	panic(fmt.Sprintf("rtmp: %d bytes unsigned integer", len(b)))
+}
+
+// putUint encodes v into len(b) bytes, 1 to 4, higher bytes of v beyond them are cut off
+func putUint(b []byte, v uint32, bigEndian bool) {
+	switch len(b) {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		if bigEndian {
+			binary.BigEndian.PutUint16(b, uint16(v))
+		} else {
+			binary.LittleEndian.PutUint16(b, uint16(v))
+		}
+	case 3:
+		if bigEndian {
+			putUint24BE(b, v)
+		} else {
+			putUint24LE(b, v)
+		}
+	case 4:
+		if bigEndian {
+			binary.BigEndian.PutUint32(b, v)
+		} else {
+			binary.LittleEndian.PutUint32(b, v)
+		}
+	default:
+		panic(fmt.Sprintf("rtmp: %d bytes unsigned integer", len(b)))
+	}
+}
@@ -0,0 +1,49 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUintRoundTrip(t *testing.T) {
+	var tests = []struct {
+		v         uint32
+		bigEndian bool
+		b         []byte
+	}{
+		{0xab, true, []byte{0xab}},
+		{0xab, false, []byte{0xab}},
+		{0x0102, true, []byte{0x01, 0x02}},
+		{0x0102, false, []byte{0x02, 0x01}},
+		{0x010203, true, []byte{0x01, 0x02, 0x03}},
+		{0x010203, false, []byte{0x03, 0x02, 0x01}},
+		{0xffffff, true, []byte{0xff, 0xff, 0xff}},
+		{0x01020304, true, []byte{0x01, 0x02, 0x03, 0x04}},
+		{0x01020304, false, []byte{0x04, 0x03, 0x02, 0x01}},
+		{0xffffffff, false, []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		b := make([]byte, len(tt.b))
+		putUint(b, tt.v, tt.bigEndian)
+		if !bytes.Equal(b, tt.b) {
+			t.Fatalf("putUint(%#x, bigEndian %v): got % x; want % x", tt.v, tt.bigEndian, b, tt.b)
+		}
+		if v := getUint(b, tt.bigEndian); v != tt.v {
+			t.Fatalf("getUint(% x, bigEndian %v): got %#x; want %#x", b, tt.bigEndian, v, tt.v)
+		}
+	}
+}
+
+func TestUint24(t *testing.T) {
+	b := make([]byte, 3)
+	putUint24BE(b, 0x12345678) // the top byte doesn't fit
+	if !bytes.Equal(b, []byte{0x34, 0x56, 0x78}) || getUint24BE(b) != 0x345678 {
+		t.Fatalf("big endian: got % x", b)
+	}
+
+	putUint24LE(b, 0x345678)
+	if !bytes.Equal(b, []byte{0x78, 0x56, 0x34}) || getUint24LE(b) != 0x345678 {
+		t.Fatalf("little endian: got % x", b)
+	}
+}
@@ -0,0 +1,163 @@
+package rtmp
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const fileLoopGap = 40 * time.Millisecond // between the last tag of a pass and the first of the next
+
+// PublishFile publishes an FLV file as streamKey, e.g. _defaultVhost_/live/test, paced by the tag
+// timestamps. It returns at the end of the file, or with an error once the stream source is closed.
+// With Config.IngestSleepWhenIdle, reading pauses while the stream has no subscriber.
+func (s *Service) PublishFile(streamKey, flvPath string) error {
+	return s.publishFile(streamKey, flvPath, false)
+}
+
+// PublishFileLoop is PublishFile starting over at the end of the file, timestamps go on across passes,
+// it returns once the stream source is closed or on a read error
+func (s *Service) PublishFileLoop(streamKey, flvPath string) error {
+	return s.publishFile(streamKey, flvPath, true)
+}
+
+func (s *Service) publishFile(streamKey, flvPath string, loop bool) error {
+	f, err := os.Open(flvPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pub := &publisher{streamKey: streamKey, publishType: publishTypeLive, demuxer: flv.NewDemuxer(), amfCodec: newAMFCodec(s.config), logger: s.config.Logger,
+		rebase: s.config.RebaseTimeStamps, tsPolicy: s.config.NonIncreasingTimeStamps}
+	ss, err := s.ssMgr.attachPublisher(pub)
+	if err != nil {
+		return err
+	}
+	defer ss.delPublisher()
+
+	logger := s.config.Logger.WithFields(logrus.Fields{"event": "publish file", "streamKey": streamKey, "path": flvPath})
+	logger.Info("start publishing")
+
+	fp := &filePacer{ss: ss, logger: logger, sleepWhenIdle: s.config.IngestSleepWhenIdle}
+	for {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := fp.publish(pub, flv.NewReader(bufio.NewReader(f))); err != nil {
+			logger.Error(err)
+			return err
+		}
+		if !loop {
+			logger.Info("end of file")
+			return nil
+		}
+		fp.nextPass()
+	}
+}
+
+/*
+ * filePacer feeds the tags of a file at real-time pace:
+ *   1. a tag is due at start + (timestamp - first timestamp), timestamps out of order don't wait.
+ *   2. a next pass goes on from the last timestamp plus fileLoopGap, subscribers see one timeline.
+ *   3. with sleepWhenIdle, reading stops after no subscriber that long, the next play resumes at the
+ *      tag it stopped at, paced from then on.
+ */
+type filePacer struct {
+	ss     *streamSource
+	logger *logrus.Entry
+
+	sleepWhenIdle time.Duration
+
+	started bool
+	start   time.Time
+	first   uint32 // timestamp due at start
+	offset  uint32 // added to the timestamps of this pass
+	last    uint32 // last timestamp published
+}
+
+func (fp *filePacer) publish(pub *publisher, r *flv.Reader) error {
+	if _, _, err := r.ReadHeader(); err != nil {
+		return err
+	}
+
+	passStart := true
+	for {
+		pkt, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if passStart {
+			fp.offset -= pkt.TimeStamp // the pass starts right at offset, whatever the file's first timestamp
+			passStart = false
+		}
+		pkt.TimeStamp += fp.offset
+		if err := fp.sleepWhileIdle(); err != nil {
+			pkt.Release()
+			return err
+		}
+		if err := fp.wait(pkt); err != nil {
+			pkt.Release()
+			return err
+		}
+		if pkt.IsAudio || pkt.IsVideo {
+			fp.last = pkt.TimeStamp
+		}
+		pub.publishPacket(fp.ss, nil, pkt)
+	}
+}
+
+func (fp *filePacer) wait(pkt *av.Packet) error {
+	if !fp.started {
+		fp.started, fp.start, fp.first = true, time.Now(), pkt.TimeStamp
+	}
+
+	select {
+	case <-fp.ss.done:
+		return errStreamSourceDeleted
+	default:
+	}
+
+	lag := int32(pkt.TimeStamp - fp.first)
+	due := time.Duration(lag)*time.Millisecond - time.Since(fp.start)
+	if due <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(due)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-fp.ss.done:
+		return errStreamSourceDeleted
+	}
+}
+
+func (fp *filePacer) sleepWhileIdle() error {
+	if fp.sleepWhenIdle <= 0 || fp.ss.idleFor() < fp.sleepWhenIdle {
+		return nil
+	}
+
+	fp.logger.Infof("no subscriber for %v, sleep", fp.sleepWhenIdle)
+	if err := fp.ss.sleepWhileIdle(fp.sleepWhenIdle); err != nil {
+		return err
+	}
+	fp.logger.Info("subscriber joined, resume")
+	fp.started = false // paced from the resumed tag, not a burst to catch up
+	return nil
+}
+
+func (fp *filePacer) nextPass() {
+	fp.offset = fp.last + uint32(fileLoopGap/time.Millisecond)
+}
@@ -0,0 +1,200 @@
+package rtmp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+
+	"github.com/pkg/errors"
+)
+
+// writeTestFLV writes pkts as an FLV file
+func writeTestFLV(t *testing.T, pkts []*av.Packet) string {
+	t.Helper()
+
+	b := bytes.NewBuffer(nil)
+	m := flv.NewMuxer(b)
+	if err := m.WriteHeader(false, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range pkts {
+		if err := m.WritePacket(pkt, pkt.TimeStamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "test.flv")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type receivedTag struct {
+	timeStamp uint32
+	data      []byte
+	at        time.Duration // since the first tag
+}
+
+func TestPublishFile(t *testing.T) {
+	pkts := []*av.Packet{
+		{IsVideo: true, Data: testVideoSeq},
+		{IsVideo: true, Data: testVideoKey},
+		{IsVideo: true, Data: testVideoInter, TimeStamp: 100},
+		{IsVideo: true, Data: testVideoInter, TimeStamp: 200},
+		{IsVideo: true, Data: testVideoKey, TimeStamp: 300},
+	}
+	path := writeTestFLV(t, pkts)
+
+	config := newTestConfig()
+	server := NewService(config)
+	const streamKey = "_defaultVhost_/live/test"
+
+	// a monitor on the stream source before publishing sees every tag
+	newMonitor := func() (*streamSource, func() []receivedTag) {
+		ss := newStreamSource(nil, streamKey, server.ssMgr)
+		server.ssMgr.streamMap.Store(streamKey, ss)
+
+		var mu sync.Mutex
+		var tags []receivedTag
+		var first time.Time
+		ss.AddMonitor(func(pkt *av.Packet) {
+			mu.Lock()
+			defer mu.Unlock()
+			if first.IsZero() {
+				first = time.Now()
+			}
+			tags = append(tags, receivedTag{pkt.TimeStamp, append([]byte(nil), pkt.Data...), time.Since(first)})
+		})
+		return ss, func() []receivedTag {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]receivedTag(nil), tags...)
+		}
+	}
+
+	ss, received := newMonitor()
+	if err := server.PublishFile(streamKey, path); err != nil {
+		t.Fatal(err)
+	}
+	if ss.getPublisher() != nil {
+		t.Fatal("file publisher still attached at the end")
+	}
+
+	var tags []receivedTag
+	for i := 0; i < 100 && len(tags) < len(pkts); i++ { // the monitor is asynchronous
+		time.Sleep(5 * time.Millisecond)
+		tags = received()
+	}
+	if len(tags) != len(pkts) {
+		t.Fatalf("got %d tags; want %d", len(tags), len(pkts))
+	}
+	for i, pkt := range pkts {
+		tag := tags[i]
+		if tag.timeStamp != pkt.TimeStamp || !bytes.Equal(tag.data, pkt.Data) {
+			t.Fatalf("tag %d: got timestamp %d % x; want %d % x", i, tag.timeStamp, tag.data, pkt.TimeStamp, pkt.Data)
+		}
+		due := time.Duration(pkt.TimeStamp) * time.Millisecond
+		if tag.at < due-5*time.Millisecond || tag.at > due+80*time.Millisecond {
+			t.Fatalf("tag %d: got at %v; want paced at %v", i, tag.at, due)
+		}
+	}
+
+	// looping goes on with the timeline until the stream source is closed
+	ss.Close()
+	ss, received = newMonitor()
+	done := make(chan error, 1)
+	go func() { done <- server.PublishFileLoop(streamKey, path) }()
+	for i := 0; i < 200 && len(tags) <= len(pkts); i++ {
+		time.Sleep(5 * time.Millisecond)
+		tags = received()
+	}
+	ss.Close()
+	select {
+	case err := <-done:
+		if errors.Cause(err) != errStreamSourceDeleted {
+			t.Fatalf("got %v; want stream source deleted", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("loop not stopped by Close")
+	}
+	if len(tags) <= len(pkts) || tags[len(pkts)].timeStamp != 300+40 {
+		t.Fatalf("got %d tags; want the second pass at 340ms", len(tags))
+	}
+}
+
+func TestPublishFileSleepWhenIdle(t *testing.T) {
+	pkts := []*av.Packet{
+		{IsVideo: true, Data: testVideoSeq},
+		{IsVideo: true, Data: testVideoKey},
+	}
+	for ts := uint32(20); ts <= 1000; ts += 20 { // PublishFile is still on the first pass once resumed
+		pkts = append(pkts, &av.Packet{IsVideo: true, Data: testVideoInter, TimeStamp: ts})
+	}
+	path := writeTestFLV(t, pkts)
+
+	for _, loop := range []bool{false, true} {
+		testPublishFileSleepWhenIdle(t, path, loop)
+	}
+}
+
+func testPublishFileSleepWhenIdle(t *testing.T, path string, loop bool) {
+	config := newTestConfig()
+	config.IngestSleepWhenIdle = 50 * time.Millisecond
+	server := NewService(config)
+	const streamKey = "_defaultVhost_/live/test"
+
+	ss := newStreamSource(nil, streamKey, server.ssMgr)
+	server.ssMgr.streamMap.Store(streamKey, ss)
+	var mu sync.Mutex
+	n := 0
+	ss.AddMonitor(func(pkt *av.Packet) { // a monitor isn't a subscriber, it doesn't keep the ingest awake
+		mu.Lock()
+		n++
+		mu.Unlock()
+	})
+	received := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- server.publishFile(streamKey, path, loop) }()
+
+	// no subscriber: the pull pauses after the grace period
+	time.Sleep(150 * time.Millisecond)
+	paused := received()
+	if paused == 0 {
+		t.Fatalf("loop %v: got no tag before sleeping", loop)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := received(); got != paused {
+		t.Fatalf("loop %v: got %d tags while idle; want the pull paused at %d", loop, got, paused)
+	}
+
+	// a play resumes it
+	newTestSubscriber(t, ss, "127.0.0.1:10001")
+	for i := 0; i < 100 && received() == paused; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if received() == paused {
+		t.Fatalf("loop %v: pull not resumed on play", loop)
+	}
+
+	ss.Close()
+	select {
+	case err := <-done:
+		if errors.Cause(err) != errStreamSourceDeleted {
+			t.Fatalf("loop %v: got %v; want stream source deleted", loop, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("loop %v: publish not stopped by Close", loop)
+	}
+}
@@ -0,0 +1,101 @@
+package rtmp
+
+import (
+	"io"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// flvSink writes the packets of a pseudo subscriber to an io.Writer as FLV, the cached metadata and
+// sequence headers come first like for any subscriber, every tag is a single Write
+type flvSink struct {
+	ss    *streamSource
+	sub   *subscriber
+	muxer *flv.Muxer
+}
+
+// newFLVSink subscribes sub to ss and writes the FLV header, sub must not be subscribed yet
+func (ss *streamSource) newFLVSink(w io.Writer, sub *subscriber) (*flvSink, error) {
+	if !ss.addSubscriber(sub) {
+		return nil, errors.New("already subscribe")
+	}
+
+	fs := &flvSink{ss: ss, sub: sub, muxer: flv.NewMuxer(w)}
+	if err := fs.muxer.WriteHeader(ss.StreamInfo().flvTracks()); err != nil {
+		fs.close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// write sends a packet taken from the queue, and releases it
+func (fs *flvSink) write(pkt *av.Packet) error {
+	fs.sub.beginWrite()
+	err := fs.muxer.WritePacket(pkt, fs.sub.nextTimeStamp(pkt))
+	fs.sub.endWrite()
+	pkt.Release()
+	return err
+}
+
+func (fs *flvSink) close() {
+	fs.sub.stop()
+	fs.ss.delSubscriber(fs.sub)
+	for {
+		pkt, ok := fs.sub.tryDequeue()
+		if !ok {
+			return
+		}
+		pkt.Release()
+	}
+}
+
+/*
+ * AttachFLVSink writes the stream to w as FLV until detach, e.g. to a file or an http response:
+ *   1. the FLV header, then the cached metadata, sequence headers and GOP with the next packet
+ *      dispatched, then every tag as it comes; timestamps start from 0.
+ *   2. the sink is a player: a w falling behind has packets dropped, it never holds the publisher back.
+ *   3. a write error or the stream source being deleted ends it, detach is still to be called, it
+ *      waits for the last write.
+ */
+func (ss *streamSource) AttachFLVSink(w io.Writer) (detach func(), err error) {
+	logger := ss.ssMgr.logger()
+	sub := newPseudoSubscriber(subTypeFLVSink, genUuid(), logger, 1024)
+	sub.policy = dropPolicyDrop
+	if ss.ssMgr != nil && ss.ssMgr.config != nil {
+		sub.latencyBudget = ss.ssMgr.config.LatencyBudget
+	}
+	sub.quit = make(chan struct{})
+
+	fs, err := ss.newFLVSink(w, sub)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer fs.close()
+		for {
+			select {
+			case <-sub.quit:
+				return
+			case <-ss.done:
+				return
+			case pkt := <-sub.avPktQueue:
+				if err := fs.write(pkt); err != nil {
+					logger.WithFields(logrus.Fields{"event": "flv sink", "streamKey": ss.streamKey, "subscriber": sub.id}).Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(sub.quit)
+		<-done
+	}, nil
+}
@@ -0,0 +1,102 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// syncBuffer is a bytes.Buffer written by a sink goroutine and read by the test
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.b.Write(p)
+}
+
+func (sb *syncBuffer) Len() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.b.Len()
+}
+
+func TestAttachFLVSink(t *testing.T) {
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(newTestConfig()))
+
+	meta := bytes.NewBuffer(nil)
+	if _, err := (&amf.Encoder{}).EncodeBatch(meta, amf.AMF0, "@setDataFrame", "onMetaData", amf.Object{"width": 1280.0}); err != nil {
+		t.Fatal(err)
+	}
+	publish := func(pkt *av.Packet) {
+		ss.dispatchAVPacket(nil, pkt)
+		ss.cacheAVMetaPacket(pkt)
+	}
+	publish(&av.Packet{IsMetaData: true, Data: meta.Bytes()})
+	publish(newTestAVPacket(t, true, testVideoSeq, 1000))
+
+	var sink syncBuffer
+	detach, err := ss.AttachFLVSink(&sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss.Subscribers()) != 1 || ss.Subscribers()[0].Type != subTypeFLVSink {
+		t.Fatalf("got %+v; want the sink subscribed", ss.Subscribers())
+	}
+
+	publish(newTestAVPacket(t, true, testVideoKey, 1000))
+	publish(newTestAVPacket(t, true, testVideoInter, 1040))
+	// header and PreviousTagSize0, then tags with their PreviousTagSize, metadata without "@setDataFrame"
+	want := 9 + 4 + 4*(11+4) + len(meta.Bytes()) - 16 + len(testVideoSeq) + len(testVideoKey) + len(testVideoInter)
+	for i := 0; i < 100 && sink.Len() < want; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	detach()
+	if len(ss.Subscribers()) != 0 {
+		t.Fatal("sink still subscribed after detach")
+	}
+
+	b := sink.b.Bytes()
+	if len(b) != want {
+		t.Fatalf("got %d bytes; want %d", len(b), want)
+	}
+	if !bytes.HasPrefix(b, []byte{'F', 'L', 'V', 0x01, 0x05}) {
+		t.Fatalf("got header % x; want FLV version 1 with audio and video", b[:5])
+	}
+	r := flv.NewReader(bytes.NewReader(b))
+	if _, _, err := r.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		metaData  bool
+		data      []byte
+		timeStamp uint32
+	}{
+		{true, meta.Bytes(), 0},
+		{false, testVideoSeq, 0},
+		{false, testVideoKey, 0},
+		{false, testVideoInter, 40},
+	} {
+		pkt, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("tag %d: %v", i, err)
+		}
+		if pkt.IsMetaData != tt.metaData || !bytes.Equal(pkt.Data, tt.data) || pkt.TimeStamp != tt.timeStamp {
+			t.Fatalf("tag %d: got %+v; want % x at %d", i, pkt, tt.data, tt.timeStamp)
+		}
+		pkt.Release()
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("got %v after the last tag; want EOF", err)
+	}
+}
@@ -1,6 +1,47 @@
 package rtmp
 
+import (
+	"fmt"
+	"math/rand"
+)
+
+// clientHandshake runs the simple handshake: C1 has a zero version so servers answer with the simple
+// scheme as well, S2 echoing C1 is not verified, C2 echoes S1.
 func (c *Conn) clientHandshake() error {
-	//TODO
-	return nil
+	var random [(1 + 1536*2) * 2]byte
+
+	c0c1c2 := random[:1536*2+1]
+	c0 := c0c1c2[:1]
+	c1 := c0c1c2[1 : 1536+1]
+	c0c1 := c0c1c2[:1536+1]
+	c2 := c0c1c2[1536+1:]
+
+	s0s1s2 := random[1536*2+1:]
+	s0 := s0s1s2[:1]
+	s1 := s0s1s2[1 : 1536+1]
+
+	// write C0C1, time and version 0
+	c0[0] = 3
+	rand.Read(c1[8:])
+	if _, err := c.Write(c0c1); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	// read S0S1S2
+	if err := c.readHandshake(s0s1s2); err != nil {
+		return err
+	}
+	if s0[0] != 3 && c.config.StrictHandshakeVersion {
+		return fmt.Errorf("rtmp: handshake version=%d invalid", s0[0])
+	}
+
+	// write C2
+	copy(c2, s1)
+	if _, err := c.Write(c2); err != nil {
+		return err
+	}
+	return c.Flush()
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
 )
 
@@ -28,17 +30,20 @@ func (c *Conn) serverHandshake() error {
 	s2 := s0s1s2[1536+1:]
 
 	// read C0C1
-	if _, err := c.Read(c0c1); err != nil {
+	if err := c.readHandshake(c0c1); err != nil {
 		return err
 	}
 
 	if c0[0] != 3 {
-		return fmt.Errorf("rtmp: handshake version=%d invalid", c0[0])
+		if c.config.StrictHandshakeVersion {
+			return fmt.Errorf("rtmp: handshake version=%d invalid", c0[0])
+		}
+		c.logger.WithField("event", "serverHandshake").Debugf("tolerate handshake version=%d", c0[0])
 	}
 	s0[0] = 3
 
-	cliTime := byteSliceAsUint(c1[0:4], true)
-	cliVer := byteSliceAsUint(c1[4:8], true)
+	cliTime := binary.BigEndian.Uint32(c1[0:4])
+	cliVer := binary.BigEndian.Uint32(c1[4:8])
 	if cliVer != 0 {
 		var ok bool
 		var digest []byte
@@ -64,13 +69,24 @@ func (c *Conn) serverHandshake() error {
 	}
 
 	// read C2
-	if _, err := c.Read(c2); err != nil {
+	if err := c.readHandshake(c2); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// readHandshake reads b fully, the peer closing before or in the middle of it is ErrHandshakeEOF
+func (c *Conn) readHandshake(b []byte) error {
+	if _, err := c.Read(b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrHandshakeEOF
+		}
+		return err
+	}
+	return nil
+}
+
 func complexHandshakeParseC1(p []byte, peerkey []byte, key []byte) (ok bool, digest []byte) {
 	var pos int
 	if pos = complexHandshakeFindDigest(p, peerkey, 772); pos == -1 {
@@ -116,8 +132,8 @@ func complexHandshakeCreateS0S1(p []byte, time uint32, ver uint32, key []byte) {
 	p1 := p[1:]
 	rand.Read(p1[8:])
 
-	uintAsbyteSlice(time, p1[0:4], true)
-	uintAsbyteSlice(ver, p1[4:8], true)
+	binary.BigEndian.PutUint32(p1[0:4], time)
+	binary.BigEndian.PutUint32(p1[4:8], ver)
 
 	gap := complexHandshakeCalcDigestPos(p1, 8)
 	digest := complexHandshakeMakeDigest(key, p1, gap)
@@ -0,0 +1,196 @@
+package rtmp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/sirupsen/logrus"
+)
+
+// simpleHandshakePeer plays the client side of a simple handshake, returns S0S1S2
+func simpleHandshakePeer(peer net.Conn, version byte) <-chan []byte {
+	s0s1s2Ch := make(chan []byte, 1)
+	go func() {
+		c0c1 := make([]byte, 1+1536) // c1 time and zero version: simple handshake
+		c0c1[0] = version
+		if _, err := peer.Write(c0c1); err != nil {
+			s0s1s2Ch <- nil
+			return
+		}
+
+		s0s1s2 := make([]byte, 1+1536*2)
+		if _, err := io.ReadFull(peer, s0s1s2); err != nil {
+			s0s1s2Ch <- nil
+			return
+		}
+
+		if _, err := peer.Write(make([]byte, 1536)); err != nil {
+			s0s1s2Ch <- nil
+			return
+		}
+		s0s1s2Ch <- s0s1s2
+	}()
+	return s0s1s2Ch
+}
+
+func TestServerHandshakeVersion(t *testing.T) {
+	var tests = []struct {
+		name      string
+		version   byte
+		strict    bool
+		expectErr bool
+	}{
+		{"v3 strict", 3, true, false},
+		{"v6 strict", 6, true, true},
+		{"v6 tolerant", 6, false, false},
+	}
+
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.StrictHandshakeVersion = tt.strict
+		c, peer := newTestConn(t, newStreamSourceMgr(newTestConfig()), config, "127.0.0.1:10001")
+		s0s1s2Ch := simpleHandshakePeer(peer, tt.version)
+
+		err := c.Handshake()
+		if (err != nil) != tt.expectErr {
+			t.Fatalf("%s: got err %v; want err %v", tt.name, err, tt.expectErr)
+		}
+		if tt.expectErr {
+			continue
+		}
+
+		if s0s1s2 := <-s0s1s2Ch; s0s1s2 == nil || s0s1s2[0] != 3 {
+			t.Fatalf("%s: got S0 %v; want version 3", tt.name, s0s1s2)
+		}
+		if !c.ConnectionState().HandshakeComplete {
+			t.Fatalf("%s: handshake should be complete", tt.name)
+		}
+	}
+}
+
+func TestOnHandshakeComplete(t *testing.T) {
+	config := newTestConfig()
+	var fired int32
+	appAtHandshake := make(chan string, 2)
+	config.OnHandshakeComplete = func(c *Conn) {
+		atomic.AddInt32(&fired, 1)
+		if !c.ConnectionState().HandshakeComplete {
+			t.Error("hook fired before handshake complete")
+		}
+		appAtHandshake <- c.appName // set by connect once commands are processed
+	}
+
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	served := make(chan struct{})
+	go func() {
+		c.Serve()
+		close(served)
+	}()
+
+	if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+		t.Fatal("handshake failed")
+	}
+	connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})
+	go func() {
+		_, _ = peer.Write(encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, connect.ChunkBody, 128))
+		_, _ = io.Copy(ioutil.Discard, peer)
+	}()
+
+	if app := <-appAtHandshake; app != "" {
+		t.Fatalf("got app '%s' at handshake; want hook before connect", app)
+	}
+	peer.Close()
+	<-served
+
+	if err := c.Handshake(); err != nil { // already complete
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Fatalf("got hook fired %d times; want 1", n)
+	}
+}
+
+// testLogHook records the level of every entry logged
+type testLogHook struct {
+	mux    sync.Mutex
+	levels []logrus.Level
+}
+
+func (h *testLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *testLogHook) Fire(e *logrus.Entry) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.levels = append(h.levels, e.Level)
+	return nil
+}
+
+// worst returns the most severe level logged, TraceLevel if none
+func (h *testLogHook) worst() logrus.Level {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	worst := logrus.TraceLevel
+	for _, l := range h.levels {
+		if l < worst {
+			worst = l
+		}
+	}
+	return worst
+}
+
+func TestHandshakeEOF(t *testing.T) {
+	tests := []struct {
+		name string
+		peer func(peer net.Conn)
+	}{
+		{"probe", func(peer net.Conn) {}},
+		{"after C0", func(peer net.Conn) {
+			_, _ = peer.Write([]byte{3})
+		}},
+		{"after C0C1", func(peer net.Conn) {
+			_, _ = peer.Write(make([]byte, 1+1536))
+			_, _ = io.ReadFull(peer, make([]byte, 1+1536*2))
+		}},
+	}
+
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.Logger.SetLevel(logrus.TraceLevel)
+		hook := &testLogHook{}
+		config.Logger.AddHook(hook)
+
+		c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+		served := make(chan struct{})
+		go func() {
+			c.Serve()
+			close(served)
+		}()
+
+		tt.peer(peer)
+		peer.Close()
+		<-served
+
+		if err := c.Handshake(); err != ErrHandshakeEOF {
+			t.Fatalf("%s: got err %v; want %v", tt.name, err, ErrHandshakeEOF)
+		}
+		if worst := hook.worst(); worst < logrus.DebugLevel {
+			t.Fatalf("%s: got %s log; want debug at most", tt.name, worst)
+		}
+	}
+
+	// a protocol error is still one
+	config := newTestConfig()
+	config.StrictHandshakeVersion = true
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	go func() { _, _ = peer.Write(make([]byte, 1+1536)) }()
+	if err := c.Handshake(); err == nil || err == ErrHandshakeEOF {
+		t.Fatalf("got err %v; want version error", err)
+	}
+}
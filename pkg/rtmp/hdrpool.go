@@ -0,0 +1,47 @@
+package rtmp
+
+import (
+	"sync"
+)
+
+// chunkHeaderBufSize fits the largest header of a chunk read at once, the basic header, the message
+// header and the extended timestamp are read one after the other into the same buffer
+const chunkHeaderBufSize = 11
+
+// NewHeaderBufPool returns a pool of chunk header read buffers for Config.HeaderBufPool, one pool for
+// all conns of a server
+func NewHeaderBufPool() *sync.Pool {
+	return &sync.Pool{New: func() interface{} { return new([chunkHeaderBufSize]byte) }}
+}
+
+func (c *Conn) headerBufPool() *sync.Pool {
+	if c.config == nil {
+		return nil
+	}
+	return c.config.HeaderBufPool
+}
+
+// getHeaderBuf takes the buffer to read the chunk headers of a message into from Config.HeaderBufPool
+// once the first byte arrives, so an idle conn holds none. Without the pool it returns nil, headers are
+// read into basicHdrBuf and the buffers of the chunk streams. putHeaderBuf puts it back.
+func (c *Conn) getHeaderBuf() (*[chunkHeaderBufSize]byte, error) {
+	pool := c.headerBufPool()
+	if pool == nil {
+		return nil, nil
+	}
+
+	if _, err := c.reader.Peek(1); err != nil {
+		return nil, err
+	}
+	b, ok := pool.Get().(*[chunkHeaderBufSize]byte)
+	if !ok { // a pool not made by NewHeaderBufPool
+		b = new([chunkHeaderBufSize]byte)
+	}
+	return b, nil
+}
+
+func (c *Conn) putHeaderBuf(b *[chunkHeaderBufSize]byte) {
+	if pool := c.headerBufPool(); pool != nil && b != nil {
+		pool.Put(b)
+	}
+}
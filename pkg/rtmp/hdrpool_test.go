@@ -0,0 +1,121 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestHeaderBufPool(t *testing.T) {
+	config := newTestConfig()
+	config.HeaderBufPool = NewHeaderBufPool()
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	c.basicHdrBuf = nil // not needed with the pool
+
+	audio := bytes.Repeat([]byte{0xaf, 0x01}, 150) // 300 bytes, 3 chunks
+	video := append([]byte(nil), testVideoKey...)
+	go func() {
+		_, _ = peer.Write(encodeTestMessage(4, 100, MsgAudioMessage, 1, audio, 128))
+		_, _ = peer.Write(encodeTestMessage(6, 140, MsgVideoMessage, 1, video, 128))
+	}()
+
+	for _, want := range []struct {
+		csid      uint32
+		timeStamp uint32
+		body      []byte
+	}{
+		{4, 100, audio},
+		{6, 140, video},
+	} {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs.Csid != want.csid || cs.TimeStamp != want.timeStamp || !bytes.Equal(cs.ChunkBody, want.body) {
+			t.Fatalf("got csid %d timestamp %d %d bytes; want csid %d timestamp %d %d bytes",
+				cs.Csid, cs.TimeStamp, len(cs.ChunkBody), want.csid, want.timeStamp, len(want.body))
+		}
+		if cs.msgHdrBuf != nil {
+			t.Fatalf("csid %d: got own header buffer with the pool", cs.Csid)
+		}
+	}
+}
+
+func TestHeaderBufNoAlloc(t *testing.T) {
+	config := newTestConfig()
+	config.HeaderBufPool = NewHeaderBufPool()
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	go func() { _, _ = peer.Write([]byte{0x04}) }() // a first byte to peek
+
+	if allocs := testing.AllocsPerRun(100, func() {
+		b, err := c.getHeaderBuf()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.putHeaderBuf(b)
+	}); allocs != 0 {
+		t.Fatalf("got %v allocs taking and putting back a header buffer; want 0", allocs)
+	}
+}
+
+// idleTestConn reads a few messages then nothing, as a conn idle after publishing started
+type idleTestConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *idleTestConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// BenchmarkIdleConns reports the heap held by 1000 idle conns, each having read on 3 chunk streams
+func BenchmarkIdleConns(b *testing.B) {
+	var msgs []byte
+	for _, csid := range []uint32{3, 4, 6} {
+		msgs = append(msgs, encodeTestMessage(csid, 0, MsgAudioMessage, 1, testAudioRaw, 128)...)
+	}
+
+	for _, bc := range []struct {
+		name string
+		pool bool
+	}{
+		{"per conn", false},
+		{"pool", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			config := newTestConfig()
+			if bc.pool {
+				config.HeaderBufPool = NewHeaderBufPool()
+			}
+
+			const n = 1000
+			var held uint64
+			var ms runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				before := ms.HeapAlloc
+
+				conns := make([]*Conn, n)
+				for j := range conns {
+					c := Server(&idleTestConn{r: bytes.NewReader(msgs)}, nil, config)
+					if !bc.pool {
+						c.basicHdrBuf = make([]byte, 3)
+					}
+					for k := 0; k < 3; k++ {
+						if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+							b.Fatal(err)
+						}
+					}
+					conns[j] = c
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				held += ms.HeapAlloc - before
+				runtime.KeepAlive(conns)
+			}
+			b.ReportMetric(float64(held)/float64(b.N*n), "B/conn")
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package rtmp
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthHandler serves /healthz (process alive) and /readyz (accepting connections and not draining)
+// for container orchestration probes
+func (s *Service) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.IsReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// IsReady reports whether at least one listener is accepting connections and the server is not draining
+func (s *Service) IsReady() bool {
+	return atomic.LoadInt32(&s.serving) > 0 && !s.IsDraining()
+}
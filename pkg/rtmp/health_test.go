@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, h http.Handler, path string) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := NewService(newTestConfig())
+	h := server.HealthHandler()
+
+	if code := probe(t, h, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz got %d; want %d", code, http.StatusOK)
+	}
+	if code := probe(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz before serving got %d; want %d", code, http.StatusServiceUnavailable)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = server.Serve(l) }()
+
+	deadline := time.Now().Add(time.Second)
+	for !server.IsReady() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if code := probe(t, h, "/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz while serving got %d; want %d", code, http.StatusOK)
+	}
+
+	server.Drain()
+	if code := probe(t, h, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz while draining got %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := probe(t, h, "/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz while draining got %d; want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,103 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultIdleSubscriberTimeout = 30 * time.Second
+
+// beginWrite marks a send in progress, endWrite its completion, a write blocked on a full TCP window
+// never ends
+func (s *subscriber) beginWrite() {
+	atomic.StoreInt32(&s.writing, 1)
+}
+
+func (s *subscriber) endWrite() {
+	atomic.StoreInt64(&s.progressAt, timeNow().UnixNano())
+	atomic.StoreInt32(&s.writing, 0)
+}
+
+// pending reports media queued or a send in progress
+func (s *subscriber) pending() bool {
+	return atomic.LoadInt32(&s.writing) == 1 || len(s.avPktQueue) > 0
+}
+
+// isIdle reports a player with media to send which made no write progress within timeout, a player
+// of a quiet stream isn't idle
+func (s *subscriber) isIdle(timeout time.Duration) bool {
+	if !s.isPlayer() || s.isStopped() {
+		return false
+	}
+
+	return s.pending() && timeNow().Sub(time.Unix(0, atomic.LoadInt64(&s.progressAt))) > timeout
+}
+
+func (ss *streamSource) idleTimeout() time.Duration {
+	if ss.ssMgr != nil && ss.ssMgr.config != nil && ss.ssMgr.config.IdleSubscriberTimeout > 0 {
+		return ss.ssMgr.config.IdleSubscriberTimeout
+	}
+	return defaultIdleSubscriberTimeout
+}
+
+// disconnectIdle closes the connection of every idle player, their playing cycles fail and delete them
+func (ss *streamSource) disconnectIdle() int {
+	timeout := ss.idleTimeout()
+
+	var idle []*subscriber
+	ss.addSubMux.Lock()
+	for _, sub := range ss.subscribers {
+		if sub.closeConn != nil && sub.isIdle(timeout) {
+			idle = append(idle, sub)
+		}
+	}
+	ss.addSubMux.Unlock()
+
+	for _, sub := range idle { // unlocked, a close may wait for a writer
+		logger := sub.logger.WithFields(logrus.Fields{"event": "disconnect idle subscriber", "streamKey": ss.streamKey, "subscriber": sub.id})
+		if err := sub.closeConn(); err != nil {
+			logger.Error(err)
+			continue
+		}
+		logger.Infof("no write progress for %v", timeout)
+	}
+
+	return len(idle)
+}
+
+// DisconnectIdleSubscribers closes the connections of players idle for Config.IdleSubscriberTimeout,
+// see SubscriberStats.Idle, and returns how many
+func (s *Service) DisconnectIdleSubscribers() int {
+	n := 0
+	s.ssMgr.streamMap.Range(func(_, val interface{}) bool {
+		n += val.(*streamSource).disconnectIdle()
+		return true
+	})
+	return n
+}
+
+// idleFor is how long ss has had no player, 0 while any. Pseudo subscribers such as DASH or a
+// recording don't count, they'd keep the ingest awake for nobody.
+func (ss *streamSource) idleFor() time.Duration {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+	if ss.idleSince.IsZero() {
+		return 0
+	}
+	return timeNow().Sub(ss.idleSince)
+}
+
+// sleepWhileIdle blocks an ingest pulled by the server while ss has had no subscriber for grace, until
+// one joins or ss is deleted
+func (ss *streamSource) sleepWhileIdle(grace time.Duration) error {
+	for ss.idleFor() >= grace {
+		select {
+		case <-ss.subJoined: // may be stale, idleFor tells
+		case <-ss.done:
+			return errStreamSourceDeleted
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleSubscriber(t *testing.T) {
+	config := newTestConfig()
+	config.IdleSubscriberTimeout = 50 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+	server := &Service{ssMgr: ssMgr}
+	ssMgr.streamMap.Store(ss.streamKey, ss)
+
+	// blocked never reads its socket, the first write blocks for good
+	blocked := newTestSubscriber(t, ss, "127.0.0.1:10001")
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10002")
+	drainPeer(peer)
+	healthy := newSubscriber(c, 1024)
+	ss.addSubscriber(healthy)
+
+	done := make(chan error, 2)
+	for _, sub := range []*subscriber{blocked, healthy} {
+		sub := sub
+		go func() { done <- ss.doPlaying(sub) }()
+	}
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 0))
+
+	idle := func() map[string]bool {
+		m := make(map[string]bool)
+		for _, st := range ss.Stats().SubscriberStats {
+			m[st.ID] = st.Idle
+		}
+		return m
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := idle(); !got[blocked.id] || got[healthy.id] {
+		t.Fatalf("got idle %v; want %s only", got, blocked.id)
+	}
+
+	if n := server.DisconnectIdleSubscribers(); n != 1 {
+		t.Fatalf("disconnected %d; want 1", n)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("playing cycle of the disconnected player returned no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnected player still playing")
+	}
+	if !blocked.isStopped() || healthy.isStopped() {
+		t.Fatalf("got stopped blocked %v healthy %v; want blocked only", blocked.isStopped(), healthy.isStopped())
+	}
+}
+
+func TestIdleSubscriberClock(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(1600000000, 0)
+	timeNow = func() time.Time { return now }
+
+	config := newTestConfig()
+	c, _ := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	sub := newSubscriber(c, 4)
+	sub.beginWrite()
+	if now = now.Add(time.Second); sub.isIdle(time.Second) {
+		t.Fatal("idle within the timeout")
+	}
+	if now = now.Add(time.Millisecond); !sub.isIdle(time.Second) {
+		t.Fatal("not idle past the timeout")
+	}
+
+	sub.endWrite()
+	sub.beginWrite()
+	if now = now.Add(time.Second); sub.isIdle(time.Second) {
+		t.Fatal("idle within the timeout of the last send")
+	}
+}
+
+func TestIdleForPlayersOnly(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(1600000000, 0)
+	timeNow = func() time.Time { return now }
+
+	config := newTestConfig()
+	config.DASH = true // packages through a pseudo subscriber from the start
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(config))
+	defer ss.Close()
+
+	now = now.Add(10 * time.Second)
+	if idle := ss.idleFor(); idle != 10*time.Second {
+		t.Fatalf("got idle for %v with DASH only; want 10s", idle)
+	}
+
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10001")
+	if idle := ss.idleFor(); idle != 0 {
+		t.Fatalf("got idle for %v with a player; want 0", idle)
+	}
+
+	ss.delSubscriber(sub)
+	now = now.Add(5 * time.Second)
+	if idle := ss.idleFor(); idle != 5*time.Second {
+		t.Fatalf("got idle for %v since the player left; want 5s", idle)
+	}
+}
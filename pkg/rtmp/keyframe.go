@@ -0,0 +1,52 @@
+package rtmp
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const keyFrameRequestInterval = time.Second // per stream, joins in a burst ask once
+
+/*
+ * Keyframe request with Config.RequestKeyFrame, best-effort:
+ *   1. a subscriber joining while the GOP cache holds no keyframe makes the stream source send
+ *      command requestKeyFrame(0, null, streamName) to its publisher, at most once an interval.
+ *   2. nothing waits for an answer, the subscriber starts at whatever keyframe comes next. Encoders
+ *      and servers not knowing the command ignore it, a relay upstream may force an IDR.
+ */
+func (ss *streamSource) keyFrameRequestDueLocked() bool {
+	if ss.ssMgr == nil || ss.ssMgr.config == nil || !ss.ssMgr.config.RequestKeyFrame {
+		return false
+	}
+	if len(ss.cache.keyIdx) > 0 {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(ss.keyFrameRequestAt) < keyFrameRequestInterval {
+		return false
+	}
+	ss.keyFrameRequestAt = now
+	return true
+}
+
+// requestKeyFrame asks the publisher for a keyframe, the write is asynchronous so a join never waits
+// for the publisher conn
+func (ss *streamSource) requestKeyFrame() {
+	pub := ss.getPublisher()
+	if pub == nil || pub.rtmpConn == nil {
+		return // a publisher to come starts with a keyframe anyway
+	}
+
+	c := pub.rtmpConn
+	go func() {
+		logger := c.logger.WithFields(logrus.Fields{"event": "request keyframe", "streamKey": ss.streamKey})
+		streamID, streamName, _ := c.streamOf(streamRolePublish)
+		if err := c.writeCommandMessage(csidCommand, streamID, cmdRequestKeyFrame, 0, nil, streamName); err != nil {
+			logger.Error(err)
+			return
+		}
+		logger.Debug("sent to publisher")
+	}()
+}
@@ -0,0 +1,52 @@
+package rtmp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRequestKeyFrame(t *testing.T) {
+	config := newTestConfig()
+	config.RequestKeyFrame = true
+	config.GOPCacheDuration = 2 * time.Second
+	ssMgr := newStreamSourceMgr(config)
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	c.setStreamRole(1, streamRolePublish, "test")
+	c.streamName = "other" // decoded by an in-band play on another message stream
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := newTestPeer(peer)
+
+	// noCommand fails on any message to the publisher within 50ms
+	noCommand := func(step string) {
+		t.Helper()
+		_ = peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if cs, err := pc.readChunkStream(pc.basicHdrBuf); err == nil {
+			t.Fatalf("%s: got a message %d %q; want none", step, cs.MsgTypeID, cs.ChunkBody)
+		}
+		_ = peer.SetReadDeadline(time.Time{})
+	}
+
+	newTestSubscriber(t, ss, "127.0.0.1:10002")
+	vs := readTestCommand(t, pc)
+	if len(vs) != 4 || vs[0] != cmdRequestKeyFrame || vs[3] != "test" {
+		t.Fatalf("got %v; want requestKeyFrame of stream test", vs)
+	}
+
+	newTestSubscriber(t, ss, "127.0.0.1:10003")
+	noCommand("join within the interval")
+
+	// a cached keyframe serves the join, no request even after the interval
+	ss.cacheAVMetaPacket(newTestAVPacket(t, true, testVideoKey, 0))
+	ss.addSubMux.Lock()
+	ss.keyFrameRequestAt = time.Time{}
+	ss.addSubMux.Unlock()
+	for i := 0; i < 2; i++ {
+		newTestSubscriber(t, ss, fmt.Sprintf("127.0.0.1:%d", 10004+i))
+	}
+	noCommand("join with a keyframe cached")
+}
@@ -0,0 +1,108 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"playground/pkg/av"
+)
+
+// markSent records the publisher timestamp of the media just sent, the reference of latency
+func (s *subscriber) markSent(pkt *av.Packet) {
+	if (!pkt.IsAudio && !pkt.IsVideo) || isSeqHeader(pkt) {
+		return
+	}
+
+	atomic.StoreUint32(&s.sentTimeStamp, pkt.TimeStamp)
+	atomic.StoreInt32(&s.sentMedia, 1)
+}
+
+// lastSent returns the publisher timestamp of the last media sent, false before any was sent
+func (s *subscriber) lastSent() (uint32, bool) {
+	if atomic.LoadInt32(&s.sentMedia) == 0 {
+		return 0, false
+	}
+	return atomic.LoadUint32(&s.sentTimeStamp), true
+}
+
+// latency is how far pkt, about to be queued, is ahead of the last media sent, 0 before any was sent
+func (s *subscriber) latency(pkt *av.Packet) time.Duration {
+	sent, ok := s.lastSent()
+	if !ok {
+		return 0
+	}
+
+	lag := int32(pkt.TimeStamp - sent) // survives the 32 bit wrap
+	if lag < 0 {
+		return 0
+	}
+	return time.Duration(lag) * time.Millisecond
+}
+
+/*
+ * withinLatencyBudget reports whether pkt is to be queued, keeping a player within its latency budget:
+ *   1. metadata and sequence headers always go, the decoder needs them whatever is dropped.
+ *   2. over budget, audio and inter frames are dropped, an inter frame also drops the ones after it
+ *      up to the next keyframe as they don't decode without it.
+ *   3. a keyframe over budget skips the player forward: media still queued is dropped and playing
+ *      resumes from the keyframe.
+ * The queue depth based drop still applies below it, for a player too slow to catch up even so.
+ */
+func (s *subscriber) withinLatencyBudget(pkt *av.Packet) bool {
+	if (!pkt.IsAudio && !pkt.IsVideo) || isSeqHeader(pkt) {
+		return true
+	}
+
+	keyFrame := isKeyFrame(pkt)
+	if s.waitKeyFrame && pkt.IsVideo && !keyFrame {
+		return false
+	}
+
+	lag := s.latency(pkt)
+	if lag <= s.latencyBudget {
+		if keyFrame {
+			s.waitKeyFrame = false
+		}
+		return true
+	}
+
+	logger := s.logger.WithField("event", "latency drop")
+	switch {
+	case keyFrame:
+		s.waitKeyFrame = false
+		n := s.skipQueuedMedia()
+		logger.Debugf("subscriber %s %v behind, skip %d queued packets to keyframe", s.id, lag, n)
+		return true
+	case pkt.IsVideo:
+		s.waitKeyFrame = true
+	}
+	logger.Tracef("subscriber %s %v behind, drop pkt", s.id, lag)
+	return false
+}
+
+// skipQueuedMedia drops queued audio and video but sequence headers, returns the number dropped
+func (s *subscriber) skipQueuedMedia() int {
+	dropped := 0
+	for i, n := 0, len(s.avPktQueue); i < n; i++ {
+		pkt, ok := s.tryDequeue()
+		if !ok {
+			break // drained by playing cycle meanwhile
+		}
+
+		if (pkt.IsAudio || pkt.IsVideo) && !isSeqHeader(pkt) {
+			s.countDrop(pkt)
+			pkt.Release()
+			dropped++
+			continue
+		}
+		s.requeue(pkt)
+	}
+
+	return dropped
+}
+
+// video keyframe but sequence header
+func isKeyFrame(pkt *av.Packet) bool {
+	vh, ok := pkt.Header.(av.VideoPacketHeader)
+	return pkt.IsVideo && ok && vh.IsKeyFrame() && !vh.IsSeq()
+}
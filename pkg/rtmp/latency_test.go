@@ -0,0 +1,67 @@
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+// playSlowly publishes 20s of 25fps video with a keyframe every second and audio, the sender takes one
+// packet for every two published. Returns the worst latency of a packet sent.
+func playSlowly(t *testing.T, budget time.Duration) time.Duration {
+	config := newTestConfig()
+	config.LatencyBudget = budget
+	c, _ := newTestConn(t, nil, config, "127.0.0.1:10001")
+	sub := newSubscriber(c, 1024)
+
+	var newest uint32
+	var worst time.Duration
+	lastVideo, gotVideo := uint32(0), false
+	send := func() {
+		pkt, ok := sub.tryDequeue()
+		if !ok {
+			return
+		}
+		defer pkt.Release()
+
+		sub.nextTimeStamp(pkt)
+		if pkt.IsVideo && !isSeqHeader(pkt) {
+			// nothing undecodable goes out: an inter frame follows the frame before it
+			if !isKeyFrame(pkt) && (!gotVideo || pkt.TimeStamp != lastVideo+40) {
+				t.Fatalf("inter frame at %d sent after video at %d", pkt.TimeStamp, lastVideo)
+			}
+			lastVideo, gotVideo = pkt.TimeStamp, true
+		}
+		if lag := time.Duration(newest-pkt.TimeStamp) * time.Millisecond; lag > worst {
+			worst = lag
+		}
+	}
+
+	sub.writeAVPacket(newTestAVPacket(t, true, testVideoSeq, 0))
+	sub.writeAVPacket(newTestAVPacket(t, false, testAudioSeq, 0))
+	for i := 0; i < 500; i++ {
+		ts := uint32(i * 40)
+		video := testVideoInter
+		if i%25 == 0 {
+			video = testVideoKey
+		}
+		newest = ts
+		sub.writeAVPacket(newTestAVPacket(t, true, video, ts))
+		sub.writeAVPacket(newTestAVPacket(t, false, testAudioRaw, ts))
+
+		send()
+	}
+
+	return worst
+}
+
+func TestLatencyBudget(t *testing.T) {
+	if worst := playSlowly(t, 0); worst < 5*time.Second {
+		t.Fatalf("got latency %v without budget; want the slow sender to fall behind", worst)
+	}
+
+	// over budget it takes up to a GOP to reach the next keyframe to skip to
+	budget := 3 * time.Second
+	if worst := playSlowly(t, budget); worst > budget+time.Second {
+		t.Fatalf("got latency %v; want within %v and a GOP", worst, budget)
+	}
+}
@@ -0,0 +1,53 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// liveMetaData adds duration 0 and filesize 0 to an onMetaData body missing them, some players misbehave
+// without and take 0 for live. Other data messages and bodies failing to decode come back as they are.
+func liveMetaData(codec AMFCodec, body []byte) []byte {
+	vs, err := decodeAMFBatch(codec, bytes.NewReader(body), amf.AMF0)
+	if err != io.EOF {
+		return body
+	}
+
+	i := 0
+	if len(vs) > 0 && vs[0] == amf.SetDataFrame {
+		i = 1
+	}
+	if len(vs) < i+2 || vs[i] != "onMetaData" {
+		return body
+	}
+	meta, ok := vs[i+1].(amf.Object)
+	if !ok {
+		return body
+	}
+	_, hasDuration := meta["duration"]
+	_, hasFileSize := meta["filesize"]
+	if hasDuration && hasFileSize {
+		return body
+	}
+	if !hasDuration {
+		meta["duration"] = 0.0
+	}
+	if !hasFileSize {
+		meta["filesize"] = 0.0
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, len(body)+32))
+	for j, v := range vs {
+		if ec, ok := codec.(ecmaArrayEncoder); ok && j == i+1 {
+			_, err = ec.EncodeECMAArray(b, meta) // as publishers send it
+		} else {
+			_, err = codec.Encode(b, v, amf.AMF0)
+		}
+		if err != nil {
+			return body
+		}
+	}
+	return b.Bytes()
+}
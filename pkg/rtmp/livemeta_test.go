@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"playground/pkg/av"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func decodeTestMetaData(t *testing.T, body []byte) amf.Object {
+	t.Helper()
+
+	vs, err := decodeAMFBatch(&livegoAMFCodec{}, bytes.NewReader(body), amf.AMF0)
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if len(vs) != 3 || vs[0] != amf.SetDataFrame || vs[1] != "onMetaData" {
+		t.Fatalf("got %v; want @setDataFrame onMetaData {...}", vs)
+	}
+	return vs[2].(amf.Object)
+}
+
+func TestLiveMetaData(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	c, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	pub := newPublisher(c, "_defaultVhost_/live/test")
+	ss, err := ssMgr.attachPublisher(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+
+	pub.publishPacket(ss, nil, &av.Packet{IsMetaData: true, Data: newTestMetaData(t)}) // no duration
+	pkt := <-sub.avPktQueue
+	meta := decodeTestMetaData(t, pkt.Data)
+	if meta["duration"] != 0.0 || meta["filesize"] != 0.0 || meta["width"] != 1280.0 {
+		t.Fatalf("got dispatched metadata %v; want duration 0 and filesize 0 added", meta)
+	}
+	if cached := decodeTestMetaData(t, ss.cache.metaData.pkt.Data); cached["duration"] != 0.0 {
+		t.Fatalf("got cached metadata %v; want duration 0", cached)
+	}
+
+	// set by the publisher, kept
+	b := bytes.NewBuffer(nil)
+	for _, v := range []interface{}{amf.SetDataFrame, "onMetaData", amf.Object{"duration": 60.0, "filesize": 1024.0}} {
+		if _, err := (&amf.Encoder{}).Encode(b, v, amf.AMF0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := liveMetaData(&livegoAMFCodec{}, b.Bytes()); !bytes.Equal(got, b.Bytes()) {
+		t.Fatalf("got % x; want the body untouched", got)
+	}
+	if text := []byte{0x02, 0x00, 0x03, 'a', 'b', 'c'}; !bytes.Equal(liveMetaData(&livegoAMFCodec{}, text), text) {
+		t.Fatal("got a data message other than onMetaData changed")
+	}
+}
+
+func TestLiveMetaDataCodec(t *testing.T) {
+	codec := &mockAMFCodec{}
+	config := newTestConfig()
+	config.AMFCodec = codec
+	ssMgr := newStreamSourceMgr(config)
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	pub := newPublisher(c, "_defaultVhost_/live/test")
+	ss, err := ssMgr.attachPublisher(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub.publishPacket(ss, nil, &av.Packet{IsMetaData: true, Data: newTestMetaData(t)})
+	codec.mu.Lock()
+	defer codec.mu.Unlock()
+	if len(codec.decoded) != 3 || codec.decoded[1] != "onMetaData" || len(codec.encoded) != 2 {
+		t.Fatalf("got decoded %v encoded %v; want onMetaData rewritten by the config codec", codec.decoded, codec.encoded)
+	}
+}
@@ -0,0 +1,135 @@
+package rtmp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLogSampleInterval = time.Second
+	maxDedupErrors           = 64 // distinct errors held back per conn, beyond it they are all forgotten
+)
+
+// logSampler lets one log through an interval and counts the ones held back, for logs which would
+// come per packet
+type logSampler struct {
+	interval   time.Duration // 0: defaultLogSampleInterval
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether to log now, with the number suppressed since the last one logged
+func (ls *logSampler) allow(now time.Time) (bool, int) {
+	interval := ls.interval
+	if interval <= 0 {
+		interval = defaultLogSampleInterval
+	}
+	if !ls.last.IsZero() && now.Sub(ls.last) < interval {
+		ls.suppressed++
+		return false, 0
+	}
+
+	n := ls.suppressed
+	ls.last, ls.suppressed = now, 0
+	return true, n
+}
+
+// levelLogger returns a logger letting through to l what is enabled at level, l is left as is. It
+// writes nothing itself: the entries are logged again on l, so they go through l's lock, hooks and
+// Out like any other. l's level still applies, level can only make l quieter.
+func levelLogger(l *logrus.Logger, level logrus.Level) *logrus.Logger {
+	hooks := make(logrus.LevelHooks)
+	hooks.Add(forwardHook{to: l})
+	return &logrus.Logger{
+		Out:       ioutil.Discard,
+		Hooks:     hooks,
+		Formatter: discardFormatter{},
+		Level:     level,
+		ExitFunc:  l.ExitFunc,
+	}
+}
+
+// forwardHook logs the entries fired on another logger
+type forwardHook struct {
+	to *logrus.Logger
+}
+
+func (forwardHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h forwardHook) Fire(e *logrus.Entry) error {
+	if h.to.IsLevelEnabled(e.Level) {
+		h.to.WithFields(e.Data).WithTime(e.Time).Log(e.Level, e.Message)
+	}
+	return nil
+}
+
+// discardFormatter formats nothing for a logger whose entries are written by its hooks
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// logDrop logs a dropped packet at Debug level, sampled by Config.LogSampleInterval. It runs on the
+// dispatch goroutine like the drops do.
+func (s *subscriber) logDrop(msg string) {
+	if !s.logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	ok, suppressed := s.dropLog.allow(timeNow())
+	if !ok {
+		return
+	}
+	s.logger.WithFields(logrus.Fields{"event": "dropAvPkt", "subscriber": s.id, "suppressed": suppressed}).Debug(msg)
+}
+
+// errLogDedup holds back repeats of the errors logged on a conn, e.g. a flapping peer failing every
+// message the same way, see Conn.logError
+type errLogDedup struct {
+	mux      sync.Mutex
+	samplers map[string]*logSampler
+}
+
+func (d *errLogDedup) allow(key string, interval time.Duration, now time.Time) (bool, int) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	ls, ok := d.samplers[key]
+	if !ok {
+		if d.samplers == nil || len(d.samplers) >= maxDedupErrors {
+			d.samplers = make(map[string]*logSampler)
+		}
+		ls = &logSampler{interval: interval}
+		d.samplers[key] = ls
+	}
+	return ls.allow(now)
+}
+
+// logError logs err on entry at most once per Config.LogSampleInterval for the same event and error
+// text, a logged one counts the repeats held back before it. Logs may come from any goroutine of the conn.
+func (c *Conn) logError(entry *logrus.Entry, err error) {
+	key := fmt.Sprint(entry.Data["event"]) + ": " + err.Error()
+	ok, suppressed := c.errLog.allow(key, c.config.LogSampleInterval, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Error(err)
+}
+
+// logError logs through the conn of p, a file publisher has none to dedup on
+func (p *publisher) logError(entry *logrus.Entry, err error) {
+	if p.rtmpConn == nil {
+		entry.Error(err)
+		return
+	}
+	p.rtmpConn.logError(entry, err)
+}
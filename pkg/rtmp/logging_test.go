@@ -0,0 +1,113 @@
+package rtmp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDropLogLevelAndSampling(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(1600000000, 0)
+	timeNow = func() time.Time { return now }
+
+	for _, tt := range []struct {
+		level string
+		logs  int
+	}{
+		{"info", 0},  // per-packet logs are Debug
+		{"debug", 2}, // one an interval, the 50 drops of two intervals
+	} {
+		var log bytes.Buffer
+		config := newTestConfig()
+		config.Logger.SetOutput(&log)
+		config.Logger.SetLevel(logrus.DebugLevel) // LogLevel can only be quieter
+		config.LogLevel = tt.level
+		config.LogSampleInterval = time.Second
+		level := config.Logger.GetLevel()
+		server := NewService(config)
+		if config.Logger.GetLevel() != level {
+			t.Fatalf("%s: the caller's logger went to %v; want it left at %v", tt.level, config.Logger.GetLevel(), level)
+		}
+
+		c, _ := newTestConn(t, server.ssMgr, server.config, "127.0.0.1:10001")
+		sub := newSubscriber(c, 4) // nobody dequeues, every packet past 4 is dropped
+		for i := uint32(0); i < 54; i++ {
+			if i == 30 {
+				now = now.Add(time.Second)
+			}
+			sub.writeAVPacket(newTestAVPacket(t, true, testVideoInter, i*40))
+		}
+
+		if n := strings.Count(log.String(), "dropAvPkt"); n != tt.logs {
+			t.Fatalf("%s: got %d drop logs; want %d\n%s", tt.level, n, tt.logs, log.String())
+		}
+		if tt.logs > 0 && !strings.Contains(log.String(), "suppressed=25") {
+			t.Fatalf("%s: got %q; want the 25 suppressed drops of the first interval counted", tt.level, log.String())
+		}
+	}
+
+	config := newTestConfig()
+	config.ChunkSize = DefaultChunkSize
+	config.LogLevel = "loud"
+	if err := config.Validate(); err == nil {
+		t.Fatal("validated an unknown log level")
+	}
+}
+
+func TestLogLevelWithoutLogger(t *testing.T) {
+	std := logrus.StandardLogger()
+	var log bytes.Buffer
+	out, level := std.Out, std.GetLevel()
+	defer func() {
+		std.SetOutput(out)
+		std.SetLevel(level)
+	}()
+	std.SetOutput(&log)
+	std.SetLevel(logrus.DebugLevel)
+
+	config := newTestConfig()
+	config.Logger = nil
+	config.LogLevel = "info"
+	server := NewService(config) // panicked wrapping a nil Logger
+	server.config.Logger.Debug("quiet")
+	server.config.Logger.Info("forwarded")
+	if got := log.String(); strings.Contains(got, "quiet") || !strings.Contains(got, "forwarded") {
+		t.Fatalf("got %q; want info logs forwarded to the standard logger", got)
+	}
+}
+
+func TestConnErrorLogDedup(t *testing.T) {
+	var log bytes.Buffer
+	config := newTestConfig()
+	config.Logger.SetOutput(&log)
+	config.LogSampleInterval = 50 * time.Millisecond
+	c, _ := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+
+	entry := c.logger.WithField("event", "flv Demux Hdr")
+	for i := 0; i < 100; i++ {
+		c.logError(entry, errors.New("invalid video tag"))
+	}
+	c.logError(entry, errors.New("invalid audio tag"))                                   // another error
+	c.logError(c.logger.WithField("event", "send ACK"), errors.New("invalid video tag")) // another event
+	if n := strings.Count(log.String(), "level=error"); n != 3 {
+		t.Fatalf("got %d error logs; want 3, one per event and error\n%s", n, log.String())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.logError(entry, errors.New("invalid video tag"))
+	if n := strings.Count(log.String(), "level=error"); n != 4 || !strings.Contains(log.String(), "suppressed=99") {
+		t.Fatalf("got %d error logs; want the repeat logged after the interval with 99 suppressed\n%s", n, log.String())
+	}
+
+	// another conn logs its own
+	other, _ := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10002")
+	other.logError(entry, errors.New("invalid audio tag"))
+	if n := strings.Count(log.String(), "level=error"); n != 5 {
+		t.Fatalf("got %d error logs; want the error of another conn logged", n)
+	}
+}
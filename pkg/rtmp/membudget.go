@@ -0,0 +1,88 @@
+package rtmp
+
+import (
+	"sync/atomic"
+
+	"playground/pkg/av"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const chunkStreamMemory = 128 // estimated state of one chunk stream, header buffers and bookkeeping
+
+/*
+ * connMemory accounts what a conn holds against Config.MaxConnMemory:
+ *   1. read: chunk streams and the bodies of messages being assembled, reserved before a body is
+ *      allocated so a peer announcing huge messages fails before memory is spent. A message read in
+ *      full is handed over and no longer counts.
+ *   2. queued: media queued to the conn as a player, from enqueue to dequeue or the player leaving, see
+ *      streamSource.delPlayer. A packet beyond the budget is dropped and the conn is closed, its playing
+ *      cycle fails.
+ */
+type connMemory struct {
+	read     int64 // atomic, written on the read loop
+	queued   int64 // atomic, written by dispatch and the playing cycle
+	exceeded int32 // atomic, 1: closed over budget
+}
+
+// MemoryUsage returns the bytes accounted against Config.MaxConnMemory
+func (c *Conn) MemoryUsage() int64 {
+	return atomic.LoadInt64(&c.mem.read) + atomic.LoadInt64(&c.mem.queued)
+}
+
+func (c *Conn) withinMemory(delta int64) bool {
+	max := c.config.MaxConnMemory
+	return max <= 0 || c.MemoryUsage()+delta <= max
+}
+
+// reserveReadMemory accounts delta bytes of the read side, an error leaves the usage unchanged
+func (c *Conn) reserveReadMemory(delta int64) error {
+	if delta > 0 && !c.withinMemory(delta) {
+		return errors.Wrapf(errMemoryBudgetExceeded, "%d bytes more on %d in use, max %d", delta, c.MemoryUsage(), c.config.MaxConnMemory)
+	}
+	atomic.AddInt64(&c.mem.read, delta)
+	return nil
+}
+
+// assembleBody reserves the body of the message cs starts, a partial message it replaces is released
+func (c *Conn) assembleBody(cs *ChunkStream) error {
+	if err := c.reserveReadMemory(int64(cs.MsgLength) - int64(cs.assembling)); err != nil {
+		return err
+	}
+	cs.assembling = cs.MsgLength
+	return nil
+}
+
+// bodyDone releases the body of cs, handed over or discarded
+func (c *Conn) bodyDone(cs *ChunkStream) {
+	atomic.AddInt64(&c.mem.read, -int64(cs.assembling))
+	cs.assembling = 0
+}
+
+// queueMemory accounts pkt queued to a player, false if it's over budget and the conn is being closed.
+// A subscriber with dropPolicyBlock, a relay, only counts, it's at the pace of the publisher.
+func (s *subscriber) queueMemory(pkt *av.Packet) bool {
+	c := s.rtmpConn
+	if c == nil {
+		return true
+	}
+
+	size := int64(len(pkt.Data))
+	if s.policy != dropPolicyBlock && !c.withinMemory(size) {
+		if atomic.CompareAndSwapInt32(&c.mem.exceeded, 0, 1) {
+			s.logger.WithFields(logrus.Fields{"event": "memory budget", "subscriber": s.id, "usage": c.MemoryUsage()}).
+				Errorf("above %d bytes, disconnect", c.config.MaxConnMemory)
+			_ = c.Close()
+		}
+		return false
+	}
+	atomic.AddInt64(&c.mem.queued, size)
+	return true
+}
+
+func (s *subscriber) dequeueMemory(pkt *av.Packet) {
+	if s.rtmpConn != nil {
+		atomic.AddInt64(&s.rtmpConn.mem.queued, -int64(len(pkt.Data)))
+	}
+}
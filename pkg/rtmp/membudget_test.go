@@ -0,0 +1,98 @@
+package rtmp
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestConnMemoryBudget(t *testing.T) {
+	config := newTestConfig()
+	config.MaxConnMemory = 64 * 1024
+	ssMgr := newStreamSourceMgr(config)
+
+	// read side: a message body beyond the budget fails the read before it's allocated
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	b := encodeTestMessage(6, 0, MsgVideoMessage, 1, make([]byte, 1000), 128)
+	b = append(b, encodeTestMessage(6, 40, MsgVideoMessage, 1, make([]byte, 100000), 128)...)
+	feedPeer(peer, b)
+	if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.MemoryUsage(); n != chunkStreamMemory {
+		t.Fatalf("got %d bytes in use after a message read in full; want the chunk stream only", n)
+	}
+	if _, err := c.readChunkStream(c.basicHdrBuf); errors.Cause(err) != errMemoryBudgetExceeded {
+		t.Fatalf("got %v; want memory budget exceeded", err)
+	}
+
+	// queue side: the player is disconnected once queued media crosses the budget
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+	ssMgr.streamMap.Store(ss.streamKey, ss)
+	c, peer = newTestConn(t, ssMgr, config, "127.0.0.1:10002")
+	sub := newSubscriber(c, 1024)
+	ss.addSubscriber(sub)
+
+	frame := append(append([]byte(nil), testVideoInter...), make([]byte, 10000-len(testVideoInter))...)
+	for i := uint32(0); i < 7; i++ {
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, frame, i*40))
+	}
+
+	stats := ss.Stats()
+	if len(stats.SubscriberStats) != 1 || stats.SubscriberStats[0].Memory != 6*10000 {
+		t.Fatalf("got %+v; want 6 frames of queued memory", stats.SubscriberStats)
+	}
+	if infos := ss.Subscribers(); infos[0].QueueDepth != 6 || infos[0].DroppedVideo != 1 {
+		t.Fatalf("got %+v; want 6 queued and the 7th dropped", infos[0])
+	}
+
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v; want the player conn closed", err)
+	}
+
+	// dequeued media no longer counts
+	for {
+		pkt, ok := sub.tryDequeue()
+		if !ok {
+			break
+		}
+		pkt.Release()
+	}
+	if n := c.MemoryUsage(); n != 0 {
+		t.Fatalf("got %d bytes in use with the queue drained; want 0", n)
+	}
+}
+
+func TestStoppedPlayerQueueNotAccounted(t *testing.T) {
+	config := newTestConfig()
+	config.MaxConnMemory = 64 * 1024
+	ssMgr := newStreamSourceMgr(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+	ssMgr.streamMap.Store(ss.streamKey, ss)
+
+	// an in-band player stopped with media still queued, its conn publishes on
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	frame := append(append([]byte(nil), testVideoInter...), make([]byte, 10000-len(testVideoInter))...)
+	for round := 0; round < 3; round++ {
+		sub := newSubscriber(c, 1024)
+		ss.addSubscriber(sub)
+		for i := uint32(0); i < 3; i++ {
+			ss.dispatchAVPacket(nil, newTestAVPacket(t, true, frame, i*40))
+		}
+		if n := c.MemoryUsage(); n != 3*10000 {
+			t.Fatalf("round %d: got %d bytes in use; want 3 frames queued", round, n)
+		}
+
+		sub.stop()
+		ss.delPlayer(sub)
+		if n := c.MemoryUsage(); n != 0 || len(sub.avPktQueue) != 0 {
+			t.Fatalf("round %d: got %d bytes in use, %d queued after the player left; want none", round, n, len(sub.avPktQueue))
+		}
+	}
+	if err := c.reserveReadMemory(50000); err != nil {
+		t.Fatalf("read side short of the budget left by players: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package rtmp
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// msgSizeBounds are the upper bounds of the message size buckets, from the default chunk size up
+var msgSizeBounds = [...]uint32{128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+// MsgSizeBucket counts the messages of a length within the bucket, see StreamStats.PublisherMsgSizes
+type MsgSizeBucket struct {
+	Max   uint32 // message length up to, inclusive, 0 for the last bucket taking the longer ones
+	Count uint64
+}
+
+// msgSizeHistogram counts published messages by length, the last bucket is above all bounds
+type msgSizeHistogram [len(msgSizeBounds) + 1]uint64
+
+func (h *msgSizeHistogram) add(size uint32) {
+	i := sort.Search(len(msgSizeBounds), func(i int) bool { return msgSizeBounds[i] >= size })
+	atomic.AddUint64(&h[i], 1)
+}
+
+func (h *msgSizeHistogram) buckets() []MsgSizeBucket {
+	buckets := make([]MsgSizeBucket, len(h))
+	for i := range h {
+		if i < len(msgSizeBounds) {
+			buckets[i].Max = msgSizeBounds[i]
+		}
+		buckets[i].Count = atomic.LoadUint64(&h[i])
+	}
+	return buckets
+}
@@ -0,0 +1,36 @@
+package rtmp
+
+import (
+	"testing"
+)
+
+func TestPublisherMsgSizes(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	pub := newPublisher(c, "_defaultVhost_/live/test")
+	ss, err := ssMgr.attachPublisher(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes := ss.Stats().PublisherMsgSizes; len(sizes) != len(msgSizeBounds)+1 {
+		t.Fatalf("got %d buckets; want %d", len(sizes), len(msgSizeBounds)+1)
+	}
+
+	for i, size := range []int{100, 128, 129, 1000, 5000, 70000} {
+		frame := append(append([]byte(nil), testVideoInter...), make([]byte, size-len(testVideoInter))...)
+		pub.publishPacket(ss, nil, newTestAVPacket(t, true, frame, uint32(i*40)))
+	}
+
+	want := map[uint32]uint64{128: 2, 256: 1, 1024: 1, 8192: 1, 0: 1} // by Max
+	for _, b := range ss.Stats().PublisherMsgSizes {
+		if b.Count != want[b.Max] {
+			t.Errorf("bucket up to %d: got %d messages; want %d", b.Max, b.Count, want[b.Max])
+		}
+	}
+
+	ss.delPublisher()
+	if sizes := ss.Stats().PublisherMsgSizes; sizes != nil {
+		t.Fatalf("got %v without publisher; want nil", sizes)
+	}
+}
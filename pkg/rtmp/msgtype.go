@@ -0,0 +1,49 @@
+package rtmp
+
+import (
+	"playground/pkg/av"
+)
+
+/*
+ * The one mapping between rtmp message types and av packets:
+ *   1. audio(8) and video(9) map to IsAudio and IsVideo, AMF0(18) and AMF3(15) data to IsMetaData.
+ *   2. an AMF3 data message is an AMF0 payload behind a format byte, packets keep the AMF0
+ *      payload only, so metadata always goes out as AMF0 data whatever the publisher sent.
+ */
+
+// msgTypeToPacket flags pkt with the media carried by a typeID message and sets its data to body,
+// false for a message carrying no media, leaving pkt untouched
+func msgTypeToPacket(typeID RtmpMsgTypeID, body []byte, pkt *av.Packet) bool {
+	switch typeID {
+	case MsgAudioMessage:
+		pkt.IsAudio = true
+	case MsgVideoMessage:
+		pkt.IsVideo = true
+	case MSGAMF0DataMessage:
+		pkt.IsMetaData = true
+	case MsgAMF3DataMessage:
+		pkt.IsMetaData = true
+		if len(body) > 0 && body[0] == 0 { // AMF0 format
+			body = body[1:]
+		}
+	default:
+		return false
+	}
+
+	pkt.Data = body
+	return true
+}
+
+// packetToMsgType is the message type carrying pkt, 0 for a packet carrying no media
+func packetToMsgType(pkt *av.Packet) RtmpMsgTypeID {
+	switch {
+	case pkt.IsVideo:
+		return MsgVideoMessage
+	case pkt.IsAudio:
+		return MsgAudioMessage
+	case pkt.IsMetaData:
+		return MSGAMF0DataMessage
+	}
+
+	return 0
+}
@@ -0,0 +1,54 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+
+	"playground/pkg/av"
+)
+
+func TestMsgTypePacketRoundTrip(t *testing.T) {
+	amf0 := []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a'}
+	tests := []struct {
+		typeID   RtmpMsgTypeID
+		body     []byte
+		media    bool
+		wantType RtmpMsgTypeID
+		wantData []byte
+	}{
+		{MsgAudioMessage, testAudioRaw, true, MsgAudioMessage, testAudioRaw},
+		{MsgVideoMessage, testVideoKey, true, MsgVideoMessage, testVideoKey},
+		{MSGAMF0DataMessage, amf0, true, MSGAMF0DataMessage, amf0},
+		{MsgAMF3DataMessage, append([]byte{0}, amf0...), true, MSGAMF0DataMessage, amf0},
+		{MsgAMF0CommandMessage, amf0, false, 0, nil},
+		{MsgAMF3CommandMessage, amf0, false, 0, nil},
+		{MsgSetChunkSize, []byte{0, 0, 0x10, 0}, false, 0, nil},
+	}
+
+	for _, tt := range tests {
+		pkt := av.NewPacket()
+		if got := msgTypeToPacket(tt.typeID, tt.body, pkt); got != tt.media {
+			t.Errorf("msgTypeToPacket(%d) = %v, want %v", tt.typeID, got, tt.media)
+		}
+		if got := packetToMsgType(pkt); got != tt.wantType {
+			t.Errorf("packetToMsgType(msgTypeToPacket(%d)) = %d, want %d", tt.typeID, got, tt.wantType)
+		}
+		if !bytes.Equal(pkt.Data, tt.wantData) {
+			t.Errorf("type %d data = %x, want %x", tt.typeID, pkt.Data, tt.wantData)
+		}
+		if n := countTrue(pkt.IsAudio, pkt.IsVideo, pkt.IsMetaData); n > 1 {
+			t.Errorf("type %d flags %d media kinds", tt.typeID, n)
+		}
+		pkt.Release()
+	}
+}
+
+func countTrue(bs ...bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
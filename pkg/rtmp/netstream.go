@@ -0,0 +1,380 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// role of a message stream
+type streamRole int
+
+const (
+	streamRoleNone    streamRole = iota // created, neither published nor played yet
+	streamRolePublish                   // publish target
+	streamRolePlay                      // play target
+)
+
+// netStream is a message stream of the conn, what the client sees as a NetStream
+type netStream struct {
+	role       streamRole
+	streamName string
+	sub        *subscriber   // in-band player, see playStream
+	quit       chan struct{} // closed to stop sub
+}
+
+// createStream allocates the next free message stream id, 0 is the NetConnection itself
+func (c *Conn) createStream() uint32 {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	if c.streams == nil {
+		c.streams = make(map[uint32]*netStream)
+	}
+	c.lastStreamID++
+	for c.streams[c.lastStreamID] != nil { // taken by a publish or play which came first
+		c.lastStreamID++
+	}
+	c.streams[c.lastStreamID] = &netStream{}
+	return c.lastStreamID
+}
+
+// setStreamRole records the publish or play target of a message stream, a stream id never created
+// is added as some clients publish on it anyway
+func (c *Conn) setStreamRole(streamID uint32, role streamRole, streamName string) *netStream {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	if c.streams == nil {
+		c.streams = make(map[uint32]*netStream)
+	}
+	ns, ok := c.streams[streamID]
+	if !ok {
+		ns = &netStream{}
+		c.streams[streamID] = ns
+	}
+	ns.role, ns.streamName = role, streamName
+	return ns
+}
+
+// streamIDOf returns the lowest message stream id of role, false if there is none
+func (c *Conn) streamIDOf(role streamRole) (uint32, bool) {
+	id, _, found := c.streamOf(role)
+	return id, found
+}
+
+// streamOf is streamIDOf with the stream name of its publish or play command, c.streamName is the name
+// of the last command decoded, an in-band play may be decoding another meanwhile
+func (c *Conn) streamOf(role streamRole) (uint32, string, bool) {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	var id uint32
+	var name string
+	found := false
+	for streamID, ns := range c.streams {
+		if ns.role == role && (!found || streamID < id) {
+			id, name, found = streamID, ns.streamName, true
+		}
+	}
+	return id, name, found
+}
+
+/*
+ * handleStreamCommand handles commands arriving while publishing, so that one conn publishes a stream
+ * and plays others:
+ *   1. createStream allocates one more message stream.
+ *   2. play/play2 on a message stream other than the published one starts an in-band player on it.
+ *   3. closeStream/deleteStream of a played message stream stops its player.
+ * A player conn is read by readWhilePlaying, which only stops the play, publishing has to come first.
+ */
+func (c *Conn) handleStreamCommand(cs *ChunkStream) error {
+	body := cs.ChunkBody
+	if cs.MsgTypeID == MsgAMF3CommandMessage && len(body) > 0 {
+		body = body[1:]
+	}
+
+	vs, err := decodeAMFBatch(c.amfCodec, bytes.NewReader(body), amf.AMF0)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "amf decode chunk body")
+	}
+	if len(vs) == 0 {
+		return nil
+	}
+
+	cmdStr, _ := vs[0].(string)
+	switch cmdStr {
+	case cmdCreateStream:
+		if err := c.decodeCreateStreamCmdMessage(vs[1:]); err != nil {
+			return err
+		}
+		return c.respCreateStreamCmdMessage(cs, c.createStream())
+	case cmdPlay, cmdPlay2:
+		return c.playStream(cs, cmdStr, vs[1:])
+	case cmdCloseStream:
+		c.stopStream(cs.MsgStreamID)
+	case cmdDeleteStream: // transactionID, null, streamID
+		if len(vs) > 3 {
+			if id, ok := vs[3].(float64); ok {
+				c.stopStream(uint32(id))
+			}
+		}
+	default:
+		c.logger.WithField("event", "handle stream command").Tracef("ignore command '%s' while publishing", cmdStr)
+	}
+
+	return nil
+}
+
+// readWhilePlaying reads a player conn while its playing cycle writes, until the read fails or the player
+// closes or deletes the played message stream. readChunkStream handles the protocol and user control
+// messages on the way: SetBufferLength, Acknowledgement, PingRequest. Other commands are ignored.
+func (c *Conn) readWhilePlaying(streamID uint32) error {
+	for {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			return err
+		}
+
+		body := cs.ChunkBody
+		closed := false
+		if isCommandMessage(cs.MsgTypeID) {
+			closed = c.closesStream(cs, streamID)
+		}
+		c.putBody(cs, body)
+		if closed {
+			return errPlayerClosedStream
+		}
+	}
+}
+
+// closesStream reports a closeStream on streamID, or a deleteStream of it
+func (c *Conn) closesStream(cs *ChunkStream, streamID uint32) bool {
+	body := cs.ChunkBody
+	if cs.MsgTypeID == MsgAMF3CommandMessage && len(body) > 0 {
+		body = body[1:]
+	}
+	vs, err := decodeAMFBatch(c.amfCodec, bytes.NewReader(body), amf.AMF0)
+	if err != nil && err != io.EOF || len(vs) == 0 {
+		return false
+	}
+
+	switch cmdStr, _ := vs[0].(string); cmdStr {
+	case cmdCloseStream:
+		return cs.MsgStreamID == streamID
+	case cmdDeleteStream: // transactionID, null, streamID
+		if len(vs) > 3 {
+			id, _ := vs[3].(float64)
+			return uint32(id) == streamID
+		}
+	default:
+		c.logger.WithField("event", "read while playing").Tracef("ignore command '%s' while playing", cmdStr)
+	}
+	return false
+}
+
+// playStream plays a stream on message stream cs.MsgStreamID, next to the one published
+func (c *Conn) playStream(cs *ChunkStream, cmdStr string, vs []interface{}) error {
+	// decoders fill the conn fields of the published stream, keep them
+	streamName, playStart, playLen := c.streamName, c.playStart, c.playLen
+	defer func() { c.streamName, c.playStart, c.playLen = streamName, playStart, playLen }()
+
+	decode := c.decodePlayCmdMessage
+	if cmdStr == cmdPlay2 {
+		decode = c.decodePlay2CmdMessage
+	}
+	if err := decode(vs); err != nil {
+		return err
+	}
+
+	if id, ok := c.streamIDOf(streamRolePublish); ok && id == cs.MsgStreamID {
+		return c.writeStatusMessage(cs, "error", "NetStream.Play.Failed", "Stream id is publishing.")
+	}
+
+	streamKey := genStreamKey(c.vhost, c.appKey(), c.streamName)
+	logger := c.logger.WithFields(logrus.Fields{"event": "play", "streamKey": streamKey, "streamID": cs.MsgStreamID, "remote": c.RemoteAddr().String()})
+
+	val, ok := c.ssMgr.streamMap.Load(streamKey)
+	if !ok {
+		logger.Error("stream not exists")
+		return c.writeStatusMessage(cs, "error", "NetStream.Play.StreamNotFound", "Stream not found.")
+	}
+	ss := val.(*streamSource)
+	if c.rejectGracePlay(ss) || c.playStart == playStartLiveOnly && ss.getPublisher() == nil {
+		logger.Info("publisher reconnecting")
+		return c.writeStatusMessage(cs, "error", "NetStream.Play.StreamNotFound", "Stream not found.")
+	}
+
+	c.stopStream(cs.MsgStreamID) // play again on a message stream switches stream
+
+	sub := newSubscriber(c, 1024) //TODO: avQueueSize use config's value
+	sub.streamID = cs.MsgStreamID
+	sub.quit = make(chan struct{})
+	sub.closeConn = func() error { // idle, a closed source or shutdown stop the message stream, not the publish
+		c.stopPlayer(sub)
+		return nil
+	}
+	ns := c.setStreamRole(cs.MsgStreamID, streamRolePlay, c.streamName)
+	c.streamsMux.Lock()
+	ns.sub, ns.quit = sub, sub.quit
+	c.streamsMux.Unlock()
+
+	if err := c.respPlayCmdMessage(cs); err != nil {
+		c.stopStream(cs.MsgStreamID)
+		return err
+	}
+	if !ss.addSubscriber(sub) {
+		logger.Error("already subscribe")
+		c.stopStream(cs.MsgStreamID)
+		return c.writeStatusMessage(cs, "error", "NetStream.Play.Failed", "Stream is played on another stream id.")
+	}
+
+	logger.Info("start playing")
+	go func() {
+		defer ss.delPlayer(sub)
+		if err := ss.doPlaying(sub); err != nil {
+			logger.Trace(err)
+		}
+	}()
+
+	return nil
+}
+
+// stopStream stops the in-band player of a message stream, if any
+func (c *Conn) stopStream(streamID uint32) {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	if ns, ok := c.streams[streamID]; ok && ns.sub != nil {
+		ns.stopPlaying()
+	}
+}
+
+// stopPlayer stops the message stream of sub unless it plays another subscriber by now
+func (c *Conn) stopPlayer(sub *subscriber) {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	if ns, ok := c.streams[sub.streamID]; ok && ns.sub == sub {
+		ns.stopPlaying()
+	}
+}
+
+// must hold streamsMux
+func (ns *netStream) stopPlaying() {
+	close(ns.quit)
+	ns.sub, ns.quit = nil, nil
+	ns.role = streamRoleNone
+}
+
+// playsInBand reports an in-band player on the conn, e.g. the echo of its own stream
+func (c *Conn) playsInBand() bool {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	for _, ns := range c.streams {
+		if ns.sub != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * writeAckAsync writes an ACK off the read loop of a conn playing in-band:
+ *   1. the write waits for the player's, which waits for the peer to read, a peer may read only after
+ *      it sent what it has, so the read loop waiting as well could stall both ways.
+ *   2. one ACK in flight at a time, false if one is: the bytes due are kept for the next ACK.
+ */
+func (c *Conn) writeAckAsync(cs *ChunkStream) bool {
+	if !atomic.CompareAndSwapInt32(&c.ackWriting, 0, 1) {
+		return false
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&c.ackWriting, 0)
+		if err := c.writeChunkStream(cs); err != nil {
+			c.logError(c.logger.WithFields(logrus.Fields{"event": "send ACK"}), err)
+		}
+	}()
+	return true
+}
+
+// at most that many read loop writes wait for the writer, see runOffReadLoop
+const maxReadLoopWrites = 64
+
+// readLoopWriter runs the writes of the read loop of a conn playing in-band, one goroutine at a time
+type readLoopWriter struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool // a goroutine is running pending
+	used    bool // went off the read loop once, later writes queue up behind
+}
+
+/*
+ * runOffReadLoop runs fn, a handler of the read loop which writes, e.g. a stream command or PingResponse,
+ * for the reason of writeAckAsync:
+ *   1. while nothing plays in-band fn runs right away on the read loop.
+ *   2. once the conn plays in-band fn runs on a goroutine of its own, after what was queued before;
+ *      from then on every fn queues, so they keep the order they arrived in.
+ *   3. beyond maxReadLoopWrites waiting, fn is dropped: a peer which doesn't read gets fewer answers,
+ *      its publish keeps flowing.
+ */
+func (c *Conn) runOffReadLoop(fn func()) {
+	w := &c.readLoopWrites
+	w.mu.Lock()
+	if !w.used && !c.playsInBand() {
+		w.mu.Unlock()
+		fn()
+		return
+	}
+
+	w.used = true
+	if len(w.pending) >= maxReadLoopWrites {
+		w.mu.Unlock()
+		c.logError(c.logger.WithFields(logrus.Fields{"event": "write off read loop"}), errReadLoopWritesFull)
+		return
+	}
+	w.pending = append(w.pending, fn)
+	if !w.running {
+		w.running = true
+		go c.readLoopWriteCycle()
+	}
+	w.mu.Unlock()
+}
+
+func (c *Conn) readLoopWriteCycle() {
+	w := &c.readLoopWrites
+	for {
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		fn := w.pending[0]
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+
+		fn()
+	}
+}
+
+// closeStreams stops every in-band player, the conn is done
+func (c *Conn) closeStreams() {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+
+	for _, ns := range c.streams {
+		if ns.sub != nil {
+			close(ns.quit)
+			ns.sub, ns.quit = nil, nil
+		}
+	}
+}
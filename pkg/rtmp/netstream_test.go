@@ -0,0 +1,408 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestPublishAndPlayOverOneConn(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+
+	otherConn, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10002")
+	other, err := ssMgr.attachPublisher(newPublisher(otherConn, "example.com/live/other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	pc := newTestPeer(peer)
+	msgs := make(chan *ChunkStream, 64)
+	go func() {
+		defer close(msgs)
+		for {
+			cs, err := pc.readChunkStream(pc.basicHdrBuf)
+			if err != nil {
+				return
+			}
+			msg := *cs
+			msg.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+			msgs <- &msg
+		}
+	}()
+	next := func(typeID RtmpMsgTypeID) *ChunkStream {
+		t.Helper()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					t.Fatal("peer closed")
+				}
+				if msg.MsgTypeID == typeID {
+					return msg
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no message of type %d", typeID)
+			}
+		}
+	}
+	command := func(csid, streamID uint32, args ...interface{}) []byte {
+		return encodeTestMessage(csid, 0, MsgAMF0CommandMessage, streamID, newTestCommandMessage(t, args...).ChunkBody, 128)
+	}
+
+	// publish test on message stream 1
+	var cmds []byte
+	cmds = append(cmds, command(3, 0, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})...)
+	cmds = append(cmds, command(3, 0, "createStream", 2.0, nil)...)
+	cmds = append(cmds, command(8, 1, "publish", 3.0, nil, "test", "live")...)
+	feedPeer(peer, cmds)
+	if err := c.handleCommandMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		t.Fatal(err)
+	}
+	next(MsgAMF0CommandMessage) // connect _result
+	if vs := decodeTestAMF(t, next(MsgAMF0CommandMessage).ChunkBody); len(vs) != 4 || vs[3] != 1.0 {
+		t.Fatalf("got createStream result %v; want stream id 1", vs)
+	}
+	next(MsgAMF0CommandMessage) // NetStream.Publish.Start
+
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "example.com/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10003")
+	go func() { _ = ss.doPublishing() }()
+
+	// play other on message stream 2 of the same conn
+	feedPeer(peer, append(command(3, 0, "createStream", 4.0, nil), command(8, 2, "play", 5.0, nil, "other")...))
+	if vs := decodeTestAMF(t, next(MsgAMF0CommandMessage).ChunkBody); len(vs) != 4 || vs[3] != 2.0 {
+		t.Fatalf("got createStream result %v; want stream id 2", vs)
+	}
+	if begin := next(MsgUserControlMessage); begin.ChunkBody[5] != 2 {
+		t.Fatalf("got StreamBegin % x; want stream id 2", begin.ChunkBody)
+	}
+	if reset := next(MsgAMF0CommandMessage); statusCode(decodeTestAMF(t, reset.ChunkBody)) != "NetStream.Play.Reset" {
+		t.Fatalf("got %v; want NetStream.Play.Reset ahead of NetStream.Play.Start", decodeTestAMF(t, reset.ChunkBody))
+	}
+	if start := next(MsgAMF0CommandMessage); start.MsgStreamID != 2 || statusCode(decodeTestAMF(t, start.ChunkBody)) != "NetStream.Play.Start" {
+		t.Fatalf("got %v on stream %d; want NetStream.Play.Start on 2", decodeTestAMF(t, start.ChunkBody), start.MsgStreamID)
+	}
+	if id, ok := c.streamIDOf(streamRolePlay); !ok || id != 2 {
+		t.Fatalf("got play stream id %d %v; want 2", id, ok)
+	}
+	if id, ok := c.streamIDOf(streamRolePublish); !ok || id != 1 {
+		t.Fatalf("got publish stream id %d %v; want 1", id, ok)
+	}
+
+	subscribers := func() int {
+		other.addSubMux.Lock()
+		defer other.addSubMux.Unlock()
+		return len(other.subscribers)
+	}
+	for i := 0; subscribers() != 1; i++ {
+		if i == 100 {
+			t.Fatal("in-band player not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// media flows both ways at once: other to the peer on stream 2, the peer's publishing to test
+	other.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 40))
+	feedPeer(peer, encodeTestMessage(6, 40, MsgVideoMessage, 1, testVideoKey, 128))
+
+	if video := next(MsgVideoMessage); video.MsgStreamID != 2 {
+		t.Fatalf("got video on stream %d; want 2", video.MsgStreamID)
+	}
+	select {
+	case pkt := <-sub.avPktQueue:
+		if !pkt.IsVideo || pkt.StreamID != 1 {
+			t.Fatalf("got %+v; want video of stream 1", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("published video not dispatched")
+	}
+
+	// deleteStream stops the player, publishing goes on
+	feedPeer(peer, command(3, 0, "deleteStream", 6.0, nil, 2.0))
+	for i := 0; subscribers() != 0; i++ {
+		if i == 100 {
+			t.Fatal("in-band player not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ss.getPublisher() == nil {
+		t.Fatal("publisher detached by deleteStream of the played stream")
+	}
+}
+
+func TestPublishEchoOverOneConn(t *testing.T) {
+	config := newTestConfig()
+	config.WindowAckSize = 4096 // the read loop writes ACKs while the player writes the echo
+	ssMgr := newStreamSourceMgr(config)
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	pc := newTestPeer(peer)
+	msgs := make(chan *ChunkStream, 1024)
+	go func() {
+		defer close(msgs)
+		for {
+			cs, err := pc.readChunkStream(pc.basicHdrBuf)
+			if err != nil {
+				return
+			}
+			msg := *cs
+			msg.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+			msgs <- &msg
+		}
+	}()
+	next := func(typeID RtmpMsgTypeID) *ChunkStream {
+		t.Helper()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					t.Fatal("peer closed")
+				}
+				if msg.MsgTypeID == typeID {
+					return msg
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no message of type %d", typeID)
+			}
+		}
+	}
+	command := func(csid, streamID uint32, args ...interface{}) []byte {
+		return encodeTestMessage(csid, 0, MsgAMF0CommandMessage, streamID, newTestCommandMessage(t, args...).ChunkBody, 128)
+	}
+
+	var cmds []byte
+	cmds = append(cmds, command(3, 0, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})...)
+	cmds = append(cmds, command(3, 0, "createStream", 2.0, nil)...)
+	cmds = append(cmds, command(8, 1, "publish", 3.0, nil, "test", "live")...)
+	feedPeer(peer, cmds)
+	if err := c.handleCommandMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "example.com/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ss.doPublishing() }()
+
+	// play the published stream back on message stream 2
+	feedPeer(peer, append(command(3, 0, "createStream", 4.0, nil), command(8, 2, "play", 5.0, nil, "test")...))
+	for {
+		if start := next(MsgAMF0CommandMessage); statusCode(decodeTestAMF(t, start.ChunkBody)) == "NetStream.Play.Start" {
+			break
+		}
+	}
+	for i := 0; len(ss.Subscribers()) != 1; i++ {
+		if i == 100 {
+			t.Fatal("echo player not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the peer publishes while reading the echo, both directions on one conn
+	frame := append(append([]byte(nil), testVideoInter...), make([]byte, 1024)...)
+	const n = 200
+	go func() {
+		_, _ = peer.Write(encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoKey, 128))
+		for ts := uint32(1); ts < n; ts++ {
+			if _, err := peer.Write(encodeTestMessage(6, ts*40, MsgVideoMessage, 1, frame, 128)); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		video := next(MsgVideoMessage)
+		if video.MsgStreamID != 2 {
+			t.Fatalf("got echo on stream %d; want 2", video.MsgStreamID)
+		}
+		want := frame
+		if i == 0 {
+			want = testVideoKey
+		}
+		if !bytes.Equal(video.ChunkBody, want) {
+			t.Fatalf("echo %d: got %d bytes; want the published frame", i, len(video.ChunkBody))
+		}
+	}
+
+	// the peer stops reading once msgs is full: the echo blocks, reading what it publishes must not,
+	// nor answering pings and commands
+	pause := make(chan struct{})
+	go func() {
+		<-pause
+		for range msgs { // resumes reading at the end
+		}
+	}()
+	ping := NewUserControlMessage(pingRequest, 4)
+	wrote := make(chan error, 1)
+	go func() {
+		for ts := uint32(n); ts < 51*n; ts++ {
+			b := encodeTestMessage(6, ts*40, MsgVideoMessage, 1, frame, 128)
+			if ts%500 == 0 {
+				b = append(b, encodeTestMessage(2, 0, MsgUserControlMessage, 0, ping.ChunkBody, 128)...)
+				b = append(b, command(3, 0, "createStream", float64(ts), nil)...)
+			}
+			if _, err := peer.Write(b); err != nil {
+				wrote <- err
+				return
+			}
+		}
+		wrote <- nil
+	}()
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case err := <-done:
+		t.Fatalf("publishing ended: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing stalled behind the echo to a peer not reading")
+	}
+	close(pause)
+}
+
+func TestIdleInBandPlayerKeepsPublishing(t *testing.T) {
+	config := newTestConfig()
+	config.IdleSubscriberTimeout = 50 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+
+	otherConn, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10002")
+	other, err := ssMgr.attachPublisher(newPublisher(otherConn, "example.com/live/other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer stops reading once pause is closed, until resume is
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	pc := newTestPeer(peer)
+	pause, resume := make(chan struct{}), make(chan struct{})
+	msgs := make(chan *ChunkStream, 64)
+	go func() {
+		for {
+			select {
+			case <-pause:
+				<-resume
+			default:
+			}
+			cs, err := pc.readChunkStream(pc.basicHdrBuf)
+			if err != nil {
+				return
+			}
+			msg := *cs
+			msg.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+			select {
+			case msgs <- &msg:
+			default:
+			}
+		}
+	}()
+	command := func(csid, streamID uint32, args ...interface{}) []byte {
+		return encodeTestMessage(csid, 0, MsgAMF0CommandMessage, streamID, newTestCommandMessage(t, args...).ChunkBody, 128)
+	}
+
+	var cmds []byte
+	cmds = append(cmds, command(3, 0, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})...)
+	cmds = append(cmds, command(3, 0, "createStream", 2.0, nil)...)
+	cmds = append(cmds, command(8, 1, "publish", 3.0, nil, "test", "live")...)
+	feedPeer(peer, cmds)
+	if err := c.handleCommandMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.discoverTcUrl(); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "example.com/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10003")
+	done := make(chan error, 1)
+	go func() { done <- ss.doPublishing() }()
+
+	// play other on message stream 2, then leave its writes blocked
+	feedPeer(peer, append(command(3, 0, "createStream", 4.0, nil), command(8, 2, "play", 5.0, nil, "other")...))
+	for i := 0; len(other.Subscribers()) != 1; i++ {
+		if i == 100 {
+			t.Fatal("in-band player not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(pause)
+	for i := uint32(0); i < 4; i++ {
+		other.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, i*40))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if n := other.disconnectIdle(); n != 1 {
+		t.Fatalf("disconnected %d; want the in-band player", n)
+	}
+	if _, ok := c.streamIDOf(streamRolePlay); ok {
+		t.Fatal("idle in-band player still on its message stream")
+	}
+
+	// the conn goes on publishing
+	feedPeer(peer, encodeTestMessage(6, 40, MsgVideoMessage, 1, testVideoKey, 128))
+	select {
+	case pkt := <-sub.avPktQueue:
+		pkt.Release()
+	case err := <-done:
+		t.Fatalf("publishing ended with the idle player: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("published video not dispatched")
+	}
+
+	// the player's blocked write completes once the peer reads again, then it leaves
+	close(resume)
+	for i := 0; len(other.Subscribers()) != 0; i++ {
+		if i == 100 {
+			t.Fatal("stopped in-band player not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ss.getPublisher() == nil {
+		t.Fatal("publisher detached by the idle player")
+	}
+}
+
+func TestAckAsyncInFlightCarriesBytes(t *testing.T) {
+	config := newTestConfig()
+	config.WindowAckSize = 100
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	c.setStreamRole(2, streamRolePlay, "test").sub = &subscriber{}
+
+	// due while one is in flight: held back, not reset
+	atomic.StoreInt32(&c.ackWriting, 1)
+	c.ack(150)
+	if c.ackSeqNumber != 150 {
+		t.Fatalf("got %d bytes to acknowledge; want 150 kept for the next ACK", c.ackSeqNumber)
+	}
+
+	atomic.StoreInt32(&c.ackWriting, 0)
+	c.ack(10)
+	pc := newTestPeer(peer)
+	cs, err := pc.readChunkStream(pc.basicHdrBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.MsgTypeID != MsgAcknowledgement || binary.BigEndian.Uint32(cs.ChunkBody) != 160 {
+		t.Fatalf("got message type %d body % x; want Acknowledgement of 160", cs.MsgTypeID, cs.ChunkBody)
+	}
+	if c.ackSeqNumber != 0 {
+		t.Fatalf("got %d bytes to acknowledge after the ACK; want 0", c.ackSeqNumber)
+	}
+}
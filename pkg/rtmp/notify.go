@@ -0,0 +1,41 @@
+package rtmp
+
+import (
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// codes of the onStatus data messages to players as the publisher comes and goes
+const (
+	publishNotify   = "NetStream.Play.PublishNotify"
+	unpublishNotify = "NetStream.Play.UnpublishNotify"
+)
+
+/*
+ * players get onStatus on the data channel as the publisher of their stream comes and goes:
+ *   1. UnpublishNotify once the publisher stops, players stay through the reconnect grace period.
+ *   2. PublishNotify once a publisher attaches to the stream source again.
+ *   3. the notify goes ahead of media still queued, the queue may drop media but never a notify.
+ */
+func (ss *streamSource) notifyPlayers(code string) {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	for _, sub := range ss.subList {
+		if sub.notify == nil || sub.isStopped() {
+			continue
+		}
+		select {
+		case sub.notify <- code:
+		default: // a player not writing for two notifies has more to catch up on
+		}
+	}
+}
+
+func (s *subscriber) writeNotify(code string) error {
+	description := "Stream is now published."
+	if code == unpublishNotify {
+		description = "Stream is now unpublished."
+	}
+	event := amf.Object{"level": "status", "code": code, "description": description}
+	return s.rtmpConn.writeDataMessage(s.chunkMsgToSend.Csid, s.eventStreamID(), "onStatus", event)
+}
@@ -0,0 +1,64 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestPublishNotify(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	c, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	pub := newPublisher(c, "_defaultVhost_/live/test")
+	ss, err := ssMgr.attachPublisher(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	pc, peer := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10002")
+	sub := newSubscriber(pc, 16)
+	if !ss.addSubscriber(sub) {
+		t.Fatal("add subscriber failed")
+	}
+	go func() { _ = sub.playingCycle(ss) }()
+
+	notifies := make(chan []interface{}, 2)
+	go func() {
+		tp := newTestPeer(peer)
+		for {
+			cs, err := tp.readChunkStream(tp.basicHdrBuf)
+			if err != nil {
+				return
+			}
+			if cs.MsgTypeID != MSGAMF0DataMessage {
+				continue
+			}
+			vs, _ := decodeAMFBatch(&livegoAMFCodec{}, bytes.NewReader(cs.ChunkBody), amf.AMF0)
+			notifies <- vs
+		}
+	}()
+	next := func() []interface{} {
+		select {
+		case vs := <-notifies:
+			return vs
+		case <-time.After(time.Second):
+			t.Fatal("no data message to the player")
+			return nil
+		}
+	}
+
+	ss.delPublisher()
+	if vs := next(); len(vs) != 2 || vs[0] != "onStatus" || statusCode(vs) != unpublishNotify {
+		t.Fatalf("got %v; want onStatus %s on the data channel", vs, unpublishNotify)
+	}
+
+	if _, err := ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test")); err != nil {
+		t.Fatal(err)
+	}
+	if vs := next(); statusCode(vs) != publishNotify {
+		t.Fatalf("got %v; want onStatus %s on the data channel", vs, publishNotify)
+	}
+}
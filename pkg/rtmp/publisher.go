@@ -2,7 +2,9 @@ package rtmp
 
 import (
 	//"fmt"
+	"io"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"playground/pkg/av"
@@ -10,58 +12,140 @@ import (
 )
 
 type publisher struct {
-	rtmpConn  *Conn
-	streamKey string
+	rtmpConn    *Conn
+	streamKey   string
+	publishType string // live, record or append
 
-	demuxer *flv.Demuxer
-	logger  *logrus.Logger
+	demuxer  *flv.Demuxer
+	amfCodec AMFCodec // of the conn, rewrites onMetaData, see liveMetaData
+	logger   *logrus.Logger
+
+	hasCompositionTime bool // got video with nonzero cts, very likely B-frames
+
+	// Config.RebaseTimeStamps, see rebaseTimeStamp
+	rebase  bool
+	baseSet bool
+	base    uint32 // timestamp of the first media, it goes at 0
+
+	// Config.NonIncreasingTimeStamps, see checkTimeStamp, indexed by tsTrack
+	tsPolicy      TimeStampPolicy
+	lastTimeStamp [2]uint32
+	seenTimeStamp [2]bool
+	tsDisorder    [2]bool // in a run of non-increasing timestamps, logged at its start
+
+	msgSizes msgSizeHistogram // of the media and metadata published, see StreamStats.PublisherMsgSizes
 }
 
 func newPublisher(c *Conn, streamKey string) *publisher {
 	p := &publisher{
-		rtmpConn:  c,
-		streamKey: streamKey,
-		demuxer:   flv.NewDemuxer(),
-		logger:    c.logger,
+		rtmpConn:    c,
+		streamKey:   streamKey,
+		publishType: c.publishType,
+		demuxer:     flv.NewDemuxer(),
+		amfCodec:    c.amfCodec,
+		logger:      c.logger,
+		rebase:      c.config.RebaseTimeStamps,
+		tsPolicy:    c.config.NonIncreasingTimeStamps,
 	}
 
 	return p
 }
 
+// needRecord reports whether the publisher asked to be recorded, "append" keeps the existing file
+func (p *publisher) needRecord() bool {
+	return p.publishType == publishTypeRecord || p.publishType == publishTypeAppend
+}
+
 func (p *publisher) publishingCycle(ss *streamSource) error {
 	// start to recv av data
 loopRecvAVChunkStream:
 	for {
 		cs, err := p.rtmpConn.readChunkStream(p.rtmpConn.basicHdrBuf)
 		if err != nil {
-			p.logger.WithField("event", "recv av chunk stream").Error(err)
+			logger := p.logger.WithFields(logrus.Fields{"event": "recv av chunk stream", "streamKey": p.streamKey})
+			if errors.Cause(err) == io.EOF { // closed between chunks, the publisher stopped
+				logger.Info("publisher closed")
+			} else {
+				logger.Error(err)
+			}
 			return err
 		}
 		//p.logger.WithField("event", "recv av chunk stream").Tracef("data: %s", fmt.Sprintf("%#v", cs))
 
-		avPkt := new(av.Packet)
-		switch cs.MsgTypeID {
-		case MsgAudioMessage:
-			avPkt.IsAudio = true
-		case MsgVideoMessage:
-			avPkt.IsVideo = true
-		case MSGAMF0DataMessage, MsgAMF3DataMessage:
-			avPkt.IsMetaData = true
-		default:
+		avPkt := av.NewPacket() // subscribers and cache retain what they keep
+		if !msgTypeToPacket(cs.MsgTypeID, cs.ChunkBody, avPkt) {
+			avPkt.Release()
+			if cs.MsgTypeID == MsgAMF0CommandMessage || cs.MsgTypeID == MsgAMF3CommandMessage {
+				cmd := *cs // the body goes back to the pool, the command may be handled later
+				cmd.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+				p.rtmpConn.runOffReadLoop(func() {
+					if err := p.rtmpConn.handleStreamCommand(&cmd); err != nil {
+						p.logError(p.logger.WithFields(logrus.Fields{"event": "handle stream command", "streamKey": p.streamKey}), err)
+					}
+				})
+			}
+			p.rtmpConn.putBody(cs, cs.ChunkBody)
 			continue loopRecvAVChunkStream
 		}
 
+		p.rtmpConn.poolBody(avPkt, cs)
 		avPkt.StreamID = cs.MsgStreamID
-		avPkt.Data = cs.ChunkBody
 		avPkt.TimeStamp = cs.TimeStamp
+		p.publishPacket(ss, cs, avPkt)
+	}
+}
+
+// publishPacket demuxes the header of avPkt, dispatches and caches it, then releases it
+func (p *publisher) publishPacket(ss *streamSource, cs *ChunkStream, avPkt *av.Packet) {
+	p.msgSizes.add(uint32(len(avPkt.Data))) // MsgLength, the body is the whole message
+
+	if err := p.demuxer.DemuxHdr(avPkt); err != nil { // flv demux av pkt
+		p.logError(p.logger.WithField("event", "flv Demux Hdr"), err)
+	}
 
-		if err := p.demuxer.DemuxHdr(avPkt); err != nil { // flv demux av pkt
-			p.logger.WithField("event", "flv Demux Hdr").Error(err)
+	if p.rebase {
+		p.rebaseTimeStamp(avPkt)
+	}
+
+	if p.tsPolicy != TimeStampPass && !p.checkTimeStamp(avPkt) {
+		avPkt.Release()
+		return
+	}
+
+	if avPkt.CompositionTime != 0 && !p.hasCompositionTime {
+		p.hasCompositionTime = true
+		p.logger.WithFields(logrus.Fields{"event": "detect composition time", "streamKey": p.streamKey, "cts": avPkt.CompositionTime}).Info("stream may contain B-frames")
+	}
+
+	if avPkt.IsMetaData {
+		avPkt.Data = liveMetaData(p.amfCodec, avPkt.Data)
+	}
+
+	if err := ss.updateStreamInfo(avPkt); err != nil {
+		p.logError(p.logger.WithFields(logrus.Fields{"event": "update stream info", "streamKey": p.streamKey}), err)
+	}
+
+	ss.dispatchAVPacket(cs, avPkt) // dispatch av pkt
+	ss.cacheAVMetaPacket(avPkt)    // cache av meta info and GOP
+	avPkt.Release()
+}
+
+// rebaseTimeStamp moves pkt onto a timeline starting at 0 with the first media of the publish session,
+// sequence headers and metadata ahead of it go at 0, as does anything older than it
+func (p *publisher) rebaseTimeStamp(pkt *av.Packet) {
+	if !p.baseSet {
+		if !(pkt.IsAudio || pkt.IsVideo) || isSeqHeader(pkt) {
+			pkt.TimeStamp = 0
+			return
 		}
+		p.base, p.baseSet = pkt.TimeStamp, true
+	}
 
-		ss.cacheAVMetaPacket(avPkt)    // cache av meta info
-		ss.dispatchAVPacket(cs, avPkt) // dispatch av pkt
+	if int32(pkt.TimeStamp-p.base) < 0 {
+		pkt.TimeStamp = 0
+		return
 	}
+	pkt.TimeStamp -= p.base
 }
 
 /*
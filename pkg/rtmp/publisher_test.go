@@ -0,0 +1,147 @@
+package rtmp
+
+import (
+	"testing"
+
+	"playground/pkg/av"
+)
+
+func TestPublisherRebaseTimeStamps(t *testing.T) {
+	for _, rebase := range []bool{false, true} {
+		config := newTestConfig()
+		config.RebaseTimeStamps = rebase
+		ssMgr := newStreamSourceMgr(config)
+		c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		pub := newPublisher(c, "_defaultVhost_/live/test")
+		ss, err := ssMgr.attachPublisher(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+
+		var tests = []struct {
+			pkt  *av.Packet
+			want uint32 // rebased
+		}{
+			{&av.Packet{IsMetaData: true, Data: newTestMetaData(t), TimeStamp: 90000}, 0},
+			{newTestAVPacket(t, true, testVideoSeq, 90000), 0},
+			{newTestAVPacket(t, false, testAudioSeq, 90000), 0},
+			{newTestAVPacket(t, true, testVideoKey, 90010), 0},  // first media
+			{newTestAVPacket(t, false, testAudioRaw, 90000), 0}, // older than the first media
+			{newTestAVPacket(t, false, testAudioRaw, 90033), 23},
+			{newTestAVPacket(t, true, testVideoInter, 90050), 40},
+		}
+		for i, tt := range tests {
+			ts := tt.pkt.TimeStamp
+			pub.publishPacket(ss, nil, tt.pkt)
+			want := ts
+			if rebase {
+				want = tt.want
+			}
+			if pkt := <-sub.avPktQueue; pkt.TimeStamp != want {
+				t.Fatalf("rebase %v, packet %d: got timestamp %d; want %d", rebase, i, pkt.TimeStamp, want)
+			}
+		}
+	}
+}
+
+func TestPublisherNonIncreasingTimeStamps(t *testing.T) {
+	const dropped = ^uint32(0)
+	var tests = []struct {
+		policy TimeStampPolicy
+		want   []uint32 // per packet below, dropped if rejected
+	}{
+		{TimeStampPass, []uint32{0, 100, 140, 130, 120, 140, 180}},
+		{TimeStampLog, []uint32{0, 100, 140, 130, 120, 140, 180}},
+		{TimeStampClamp, []uint32{0, 100, 140, 130, 140, 140, 180}},
+		{TimeStampReject, []uint32{0, 100, 140, 130, dropped, dropped, 180}},
+	}
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.NonIncreasingTimeStamps = tt.policy
+		ssMgr := newStreamSourceMgr(config)
+		c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		pub := newPublisher(c, "_defaultVhost_/live/test")
+		ss, err := ssMgr.attachPublisher(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+
+		pkts := []*av.Packet{
+			newTestAVPacket(t, true, testVideoSeq, 0),
+			newTestAVPacket(t, true, testVideoKey, 100),
+			newTestAVPacket(t, true, testVideoInter, 140),
+			newTestAVPacket(t, false, testAudioRaw, 130),  // audio lags video, another track
+			newTestAVPacket(t, true, testVideoInter, 120), // backwards
+			newTestAVPacket(t, true, testVideoInter, 140), // duplicate
+			newTestAVPacket(t, true, testVideoInter, 180),
+		}
+		for i, pkt := range pkts {
+			pub.publishPacket(ss, nil, pkt)
+			select {
+			case got := <-sub.avPktQueue:
+				if tt.want[i] == dropped {
+					t.Fatalf("policy %v, packet %d: got timestamp %d; want dropped", tt.policy, i, got.TimeStamp)
+				}
+				if got.TimeStamp != tt.want[i] {
+					t.Fatalf("policy %v, packet %d: got timestamp %d; want %d", tt.policy, i, got.TimeStamp, tt.want[i])
+				}
+				got.Release()
+			default:
+				if tt.want[i] != dropped {
+					t.Fatalf("policy %v, packet %d: dropped; want timestamp %d", tt.policy, i, tt.want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestPublisherReattachContinuesTimeline(t *testing.T) {
+	for _, rebase := range []bool{false, true} {
+		config := newTestConfig()
+		config.RebaseTimeStamps = rebase
+		ssMgr := newStreamSourceMgr(config)
+		c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		pub := newPublisher(c, "_defaultVhost_/live/test")
+		ss, err := ssMgr.attachPublisher(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+
+		var got []uint32
+		publish := func(pub *publisher, pkts ...*av.Packet) {
+			for _, pkt := range pkts {
+				pub.publishPacket(ss, nil, pkt)
+				got = append(got, sub.nextTimeStamp(<-sub.avPktQueue))
+			}
+		}
+		publish(pub,
+			newTestAVPacket(t, true, testVideoSeq, 90000),
+			newTestAVPacket(t, true, testVideoKey, 90000),
+			newTestAVPacket(t, true, testVideoInter, 90400),
+		)
+
+		// the encoder reconnects within the grace period, its clock restarted
+		ss.delPublisher()
+		c, _ = newTestConn(t, ssMgr, config, "127.0.0.1:10003")
+		pub = newPublisher(c, "_defaultVhost_/live/test")
+		if _, err := ssMgr.attachPublisher(pub); err != nil {
+			t.Fatal(err)
+		}
+		publish(pub,
+			newTestAVPacket(t, true, testVideoSeq, 0),
+			newTestAVPacket(t, true, testVideoKey, 0),
+			newTestAVPacket(t, true, testVideoInter, 40),
+			newTestAVPacket(t, true, testVideoInter, 80),
+		)
+
+		want := []uint32{0, 0, 400, 400, 400, 440, 480}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("rebase %v: got timestamps %v; want %v", rebase, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"os"
+	"path/filepath"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRecordDir takes a publish of type record or append without Config.RecordDir, relative to the working dir
+const defaultRecordDir = "record"
+
+func (c *Conn) recordDir() string {
+	if c.config.RecordDir != "" {
+		return c.config.RecordDir
+	}
+	return defaultRecordDir
+}
+
+// recordPath maps app and stream to {dir}/{app}/{stream}.flv, names can't climb out of dir
+func recordPath(dir, app, streamName string) string {
+	rel := filepath.Clean("/" + filepath.Join(app, streamName+".flv"))
+	return filepath.Join(dir, rel)
+}
+
+/*
+ * startRecording records the stream to path through a pseudo subscriber:
+ *   1. packets are written as they come, flv.Recorder keeps the keyframe positions.
+ *   2. stop, or the stream source being deleted, closes the recorder which puts onMetaData with the
+ *      keyframes index in front of the file.
+ * The subscriber blocks the publisher rather than lose data, a record has no gaps.
+ * With appending, publish type "append", an existing file is continued rather than replaced.
+ */
+func (ss *streamSource) startRecording(path string, appending bool, logger *logrus.Logger) (stop func(), err error) {
+	sub := newPseudoSubscriber(subTypeRecord, subTypeRecord, logger, 1024)
+	sub.quit = make(chan struct{})
+	if !ss.addSubscriber(sub) {
+		return nil, errors.New("stream is being recorded")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		ss.delPseudoSubscriber(sub, (*av.Packet).Release)
+		return nil, errors.Wrap(err, "create record dir")
+	}
+	newRecorder := flv.NewRecorder
+	if appending {
+		newRecorder = flv.NewAppendRecorder
+	}
+	rec, err := newRecorder(path)
+	if err != nil {
+		ss.delPseudoSubscriber(sub, (*av.Packet).Release)
+		return nil, errors.Wrap(err, "create record file")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss.recordingCycle(sub, rec, path)
+	}()
+
+	return func() {
+		close(sub.quit)
+		<-done
+	}, nil
+}
+
+func (ss *streamSource) recordingCycle(sub *subscriber, rec *flv.Recorder, path string) {
+	logger := sub.logger.WithFields(logrus.Fields{"event": "record", "streamKey": ss.streamKey, "path": path})
+
+	var err error
+	write := func(pkt *av.Packet) {
+		if err == nil {
+			err = rec.WritePacket(pkt, sub.nextTimeStamp(pkt))
+		}
+		pkt.Release()
+	}
+	defer func() {
+		sub.stop()
+		ss.delPseudoSubscriber(sub, write) // packets queued before stop are recorded too
+		if err != nil {
+			logger.Error(err)
+		}
+
+		if err := rec.Close(); err != nil {
+			logger.Error(err)
+			return
+		}
+		logger.Info("recorded")
+	}()
+
+	for err == nil {
+		select {
+		case <-sub.quit:
+			return
+		case <-ss.done:
+			return
+		case pkt := <-sub.avPktQueue:
+			write(pkt)
+		}
+	}
+}
+
+// delPseudoSubscriber deletes sub while handling what is left in its queue, see drainWhile
+func (ss *streamSource) delPseudoSubscriber(sub *subscriber, handle func(pkt *av.Packet)) {
+	ss.drainWhile(sub, func() { ss.delSubscriber(sub) }, handle)
+}
+
+// drainWhile runs del while handling what is left in the queue of sub, a dispatch blocked on the full
+// queue of a dropPolicyBlock subscriber holds addSubMux until it gets room
+func (ss *streamSource) drainWhile(sub *subscriber, del func(), handle func(pkt *av.Packet)) {
+	deleted := make(chan struct{})
+	go func() {
+		del()
+		close(deleted)
+	}()
+
+	for {
+		select {
+		case pkt := <-sub.avPktQueue:
+			handle(pkt)
+		case <-deleted:
+			for len(sub.avPktQueue) > 0 { // nothing is queued any more once deleted
+				handle(<-sub.avPktQueue)
+			}
+			return
+		}
+	}
+}
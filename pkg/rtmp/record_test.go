@@ -0,0 +1,120 @@
+package rtmp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestRecordPath(t *testing.T) {
+	var tests = []struct {
+		app, stream, want string
+	}{
+		{"live", "test", "/rec/live/test.flv"},
+		{"live/inst", "test", "/rec/live/inst/test.flv"},
+		{"live", "../../etc/test", "/rec/etc/test.flv"},
+	}
+
+	for _, tt := range tests {
+		if got := recordPath("/rec", tt.app, tt.stream); got != tt.want {
+			t.Fatalf("recordPath(%q, %q): got %s; want %s", tt.app, tt.stream, got, tt.want)
+		}
+	}
+}
+
+func TestStartRecording(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := recordPath(t.TempDir(), "live", "test")
+	stop, err := ss.startRecording(path, false, config.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.startRecording(path, false, config.Logger); err == nil {
+		t.Fatal("recording the stream twice")
+	}
+
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoSeq, 0))
+	for _, ts := range []uint32{0, 1000, 2000} {
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, ts))
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, ts+40))
+	}
+	stop()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("keyframes")) || !bytes.Contains(b, []byte("filepositions")) {
+		t.Fatal("no keyframes index in onMetaData")
+	}
+	vs, err := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(b[24:]), amf.AMF0) // onMetaData is the first tag
+	if len(vs) < 2 {
+		t.Fatalf("got onMetaData %v: %v", vs, err)
+	}
+	if times := vs[1].(amf.Object)["keyframes"].(amf.Object)["times"].(amf.Array); len(times) != 3 {
+		t.Fatalf("got keyframe times %v; want 3", times)
+	}
+	if matches, _ := filepath.Glob(path + "*"); len(matches) != 1 {
+		t.Fatalf("got files %v; want %s only", matches, path)
+	}
+}
+
+func TestPublishRecordWithoutRecordDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	config := newTestConfig() // no RecordDir, publish type record goes to the default
+	ended := make(chan SessionRecord, 1)
+	config.AccessLog = func(record SessionRecord) { ended <- record }
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+	go c.Serve()
+	if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+		t.Fatal("handshake failed")
+	}
+	drainPeer(peer)
+
+	for _, b := range [][]byte{
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"}).ChunkBody, 128),
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 0, newTestCommandMessage(t, "createStream", 2.0, nil).ChunkBody, 128),
+		encodeTestMessage(3, 0, MsgAMF0CommandMessage, 1, newTestCommandMessage(t, "publish", 3.0, nil, "test", "record").ChunkBody, 128),
+		encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoSeq, 128),
+		encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoKey, 128),
+	} {
+		if _, err := peer.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	peer.Close()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("session not ended")
+	}
+
+	b, err := ioutil.ReadFile(recordPath(defaultRecordDir, "live", "test"))
+	if err != nil {
+		t.Fatalf("publish type record not recorded without RecordDir: %v", err)
+	}
+	if !bytes.Contains(b, []byte("keyframes")) {
+		t.Fatal("no keyframes index in onMetaData")
+	}
+}
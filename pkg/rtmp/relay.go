@@ -0,0 +1,218 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRTMPPort = "1935"
+	relayFlashVer   = "FMLE/3.0 (compatible; livego)"
+)
+
+/*
+ * Relay pushes the stream streamKey, e.g. _defaultVhost_/live/test, to upstream, an rtmp url such as
+ * rtmp://origin/live/test, publishing it there as a client:
+ *   1. handshake, connect to the app of upstream, createStream and publish its last path segment.
+ *   2. media goes out pass-through, see newRelaySubscriber, starting with the GOP cache as for a player.
+ *   3. what upstream sends is read meanwhile: ACKs and pings are answered, a read error ends the relay.
+ * It returns once the stream source is closed, errStreamSourceDeleted, or with the upstream error.
+ */
+func (s *Service) Relay(streamKey, upstream string) error {
+	val, ok := s.ssMgr.streamMap.Load(streamKey)
+	if !ok {
+		return errStreamNotFound
+	}
+	ss := val.(*streamSource)
+
+	addr, app, tcUrl, name, err := parseRelayURL(upstream)
+	if err != nil {
+		return err
+	}
+
+	logger := s.config.Logger.WithFields(logrus.Fields{"event": "relay", "streamKey": streamKey, "upstream": upstream})
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	c := Client(nc, s.config)
+	defer c.Close()
+
+	streamID, err := c.publishUpstream(app, tcUrl, name)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	logger.Info("start relaying")
+
+	sub := newRelaySubscriber(c, 1024)
+	sub.streamID = streamID
+	if !ss.addSubscriber(sub) {
+		logger.Error("already subscribe")
+		return errAlreadySubscribed
+	}
+	defer ss.delPlayer(sub)
+
+	var readErr error
+	go func() {
+		readErr = c.readUpstream()
+		close(sub.quit) // stops the playing cycle
+	}()
+
+	err = ss.doPlaying(sub)
+	select {
+	case <-ss.done:
+		err = errStreamSourceDeleted // Close disconnects the relay too, the read may fail first
+	default:
+		select {
+		case <-sub.quit:
+			err = readErr
+		default:
+		}
+	}
+	_ = c.Close()
+	<-sub.quit // readUpstream returned
+	logger.Infof("stop relaying: %v", err)
+	return err
+}
+
+// parseRelayURL splits rtmp://host[:port]/app[/instance]/stream[?query] into the address to dial, the app,
+// the tcUrl to connect with, the query kept on it, and the stream to publish
+func parseRelayURL(upstream string) (addr, app, tcUrl, name string, err error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	if strings.ToLower(u.Scheme) != "rtmp" {
+		return "", "", "", "", errors.Errorf("not rtmp scheme: %s", u.Scheme)
+	}
+
+	idx := strings.LastIndex(u.Path, "/")
+	if idx <= 0 || idx == len(u.Path)-1 {
+		return "", "", "", "", errors.Errorf("no app and stream in path: %s", u.Path)
+	}
+	app, name = u.Path[1:idx], u.Path[idx+1:]
+
+	addr = u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultRTMPPort)
+	}
+	tcUrl = u.Scheme + "://" + u.Host + "/" + app
+	if u.RawQuery != "" {
+		tcUrl += "?" + u.RawQuery
+	}
+	return addr, app, tcUrl, name, nil
+}
+
+/*
+ * publishUpstream runs the client side of a publish, each step waits for the answer of the previous one:
+ *   1. handshake, then SetChunkSize to write media by Config.ChunkSize as the server side does.
+ *   2. connect on transaction 1, createStream on transaction 2, its _result carries the message stream.
+ *   3. publish on that message stream, onStatus NetStream.Publish.Start follows.
+ * It returns the message stream to send media on.
+ */
+func (c *Conn) publishUpstream(app, tcUrl, name string) (uint32, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, errors.Wrap(err, "handshake")
+	}
+
+	chunkSize := uint32(DefaultChunkSize)
+	if c.config.ChunkSize > 0 {
+		chunkSize = c.config.ChunkSize
+	}
+	if err := c.setLocalChunkSize(chunkSize); err != nil {
+		return 0, err
+	}
+
+	connect := amf.Object{"app": app, "type": "nonprivate", "flashVer": relayFlashVer, "tcUrl": tcUrl}
+	if err := c.writeCommandMessage(csidCommand, 0, cmdConnect, 1, connect); err != nil {
+		return 0, errors.Wrap(err, "send connect")
+	}
+	if _, err := c.readResponse(1); err != nil {
+		return 0, errors.Wrap(err, "connect")
+	}
+
+	if err := c.writeCommandMessage(csidCommand, 0, cmdCreateStream, 2, nil); err != nil {
+		return 0, errors.Wrap(err, "send createStream")
+	}
+	vs, err := c.readResponse(2)
+	if err != nil {
+		return 0, errors.Wrap(err, "createStream")
+	}
+	id, ok := vs[len(vs)-1].(float64) // _result, 2, null, stream id
+	if !ok || id <= 0 {
+		return 0, errors.Errorf("createStream: no message stream in %v", vs)
+	}
+	streamID := uint32(id)
+
+	if err := c.writeCommandMessage(csidCommand, streamID, cmdPublish, 0, nil, name, publishTypeLive); err != nil {
+		return 0, errors.Wrap(err, "send publish")
+	}
+	if _, err := c.readResponse(0); err != nil {
+		return 0, errors.Wrap(err, "publish")
+	}
+	return streamID, nil
+}
+
+// readResponse reads up to the _result or _error of transaction id, the onStatus for id 0. Other
+// commands such as onBWDone are skipped, protocol control messages are handled by readChunkStream.
+func (c *Conn) readResponse(id int) ([]interface{}, error) {
+	for {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			return nil, err
+		}
+		if !isCommandMessage(cs.MsgTypeID) {
+			c.putBody(cs, cs.ChunkBody)
+			continue
+		}
+
+		body := cs.ChunkBody
+		if cs.MsgTypeID == MsgAMF3CommandMessage && len(body) > 0 {
+			body = body[1:]
+		}
+		vs, err := decodeAMFBatch(c.amfCodec, bytes.NewReader(body), amf.AMF0)
+		c.putBody(cs, cs.ChunkBody)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(vs) < 2 {
+			continue
+		}
+
+		cmd, _ := vs[0].(string)
+		tid, _ := vs[1].(float64)
+		switch {
+		case cmd == "onStatus" && id == 0:
+		case (cmd == "_result" || cmd == "_error") && int(tid) == id:
+		default:
+			continue
+		}
+
+		info, _ := vs[len(vs)-1].(amf.Object)
+		if cmd == "_error" || info["level"] == "error" {
+			return nil, errors.Wrapf(errUpstreamRejected, "%s %v: %v", cmd, info["code"], info["description"])
+		}
+		return vs, nil
+	}
+}
+
+// readUpstream reads what upstream sends while relaying until the conn fails, the protocol control
+// messages are answered by readChunkStream, commands such as onStatus are dropped
+func (c *Conn) readUpstream() error {
+	for {
+		cs, err := c.readChunkStream(c.basicHdrBuf)
+		if err != nil {
+			return err
+		}
+		c.putBody(cs, cs.ChunkBody)
+	}
+}
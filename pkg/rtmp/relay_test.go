@@ -0,0 +1,100 @@
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseRelayURL(t *testing.T) {
+	var tests = []struct {
+		upstream               string
+		addr, app, tcUrl, name string
+	}{
+		{"rtmp://origin/live/test", "origin:1935", "live", "rtmp://origin/live", "test"},
+		{"rtmp://origin:1936/live/inst/test?token=x", "origin:1936", "live/inst", "rtmp://origin:1936/live/inst?token=x", "test"},
+	}
+	for _, tt := range tests {
+		addr, app, tcUrl, name, err := parseRelayURL(tt.upstream)
+		if err != nil || addr != tt.addr || app != tt.app || tcUrl != tt.tcUrl || name != tt.name {
+			t.Fatalf("%s: got %s %s %s %s %v; want %s %s %s %s", tt.upstream, addr, app, tcUrl, name, err, tt.addr, tt.app, tt.tcUrl, tt.name)
+		}
+	}
+
+	for _, upstream := range []string{"http://origin/live/test", "rtmp://origin/test", "rtmp://origin/live/"} {
+		if _, _, _, _, err := parseRelayURL(upstream); err == nil {
+			t.Fatalf("%s: got no error", upstream)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	const streamKey = "_defaultVhost_/live/test"
+
+	// upstream: the stream source waits for the relay to publish, a monitor sees what it sends
+	upstream := NewService(newTestConfig())
+	upstreamSS := newStreamSource(nil, streamKey, upstream.ssMgr)
+	upstream.ssMgr.streamMap.Store(streamKey, upstreamSS)
+	received := make(chan *av.Packet, 16)
+	upstreamSS.AddMonitor(func(pkt *av.Packet) {
+		received <- &av.Packet{IsVideo: pkt.IsVideo, TimeStamp: pkt.TimeStamp, Data: append([]byte(nil), pkt.Data...)}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- upstream.Serve(l) }()
+
+	origin := NewService(newTestConfig())
+	ss := newStreamSource(nil, streamKey, origin.ssMgr)
+	origin.ssMgr.streamMap.Store(streamKey, ss)
+	relayed := make(chan error, 1)
+	go func() { relayed <- origin.Relay(streamKey, "rtmp://"+l.Addr().String()+"/live/test") }()
+	for i := 0; i < 200 && (len(ss.Subscribers()) == 0 || upstreamSS.getPublisher() == nil); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if subs := ss.Subscribers(); len(subs) != 1 || subs[0].Type != subTypeRelay || upstreamSS.getPublisher() == nil {
+		t.Fatalf("got subscribers %+v, upstream publisher %v; want the relay publishing", subs, upstreamSS.getPublisher())
+	}
+
+	// publisher timestamps far from 0 and a body of several chunks reach upstream untouched
+	pkts := []*av.Packet{
+		newTestAVPacket(t, true, testVideoSeq, 100000),
+		newTestAVPacket(t, true, testVideoKey, 100000),
+		newTestAVPacket(t, true, append(append([]byte(nil), testVideoInter...), bytes.Repeat([]byte{0xab}, 70000)...), 100040),
+	}
+	for _, pkt := range pkts {
+		ss.dispatchAVPacket(nil, pkt)
+	}
+	for i, pkt := range pkts {
+		select {
+		case got := <-received:
+			if got.TimeStamp != pkt.TimeStamp || !bytes.Equal(got.Data, pkt.Data) {
+				t.Fatalf("packet %d: got ts %d %d bytes; want ts %d %d bytes", i, got.TimeStamp, len(got.Data), pkt.TimeStamp, len(pkt.Data))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("packet %d not relayed", i)
+		}
+	}
+
+	ss.Close()
+	select {
+	case err := <-relayed:
+		if errors.Cause(err) != errStreamSourceDeleted {
+			t.Fatalf("got %v; want stream source deleted", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("relay not stopped by Close")
+	}
+	for i := 0; i < 200 && upstreamSS.getPublisher() != nil; i++ { // the relay left, upstream serve returns
+		time.Sleep(5 * time.Millisecond)
+	}
+	_ = upstream.Shutdown()
+	<-served
+}
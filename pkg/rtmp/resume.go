@@ -0,0 +1,79 @@
+package rtmp
+
+import (
+	"time"
+
+	"playground/pkg/av"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resumePoint is where a player of a session left off, kept for Config.SessionResumeWindow
+type resumePoint struct {
+	timeStamp uint32 // publisher timestamp of the last media sent
+	expire    time.Time
+}
+
+func (ss *streamSource) resumeWindow() time.Duration {
+	if ss.ssMgr == nil || ss.ssMgr.config == nil {
+		return 0
+	}
+	return ss.ssMgr.config.SessionResumeWindow
+}
+
+// must hold addSubMux, keeps where sub left off if it plays in a session
+func (ss *streamSource) keepResumeLocked(sub *subscriber) {
+	window := ss.resumeWindow()
+	if window <= 0 || sub.session == "" || !sub.isPlayer() {
+		return
+	}
+	if ss.subscribers[sub.id] != sub { // deleted already
+		return
+	}
+
+	sent, ok := sub.lastSent()
+	if !ok {
+		return // nothing played yet, nothing to resume
+	}
+	ss.resumes[sub.session] = resumePoint{timeStamp: sent, expire: timeNow().Add(window)}
+}
+
+// must hold addSubMux, a player rejoining its session within the window resumes where it left off
+func (ss *streamSource) resumeLocked(sub *subscriber) {
+	if sub.session == "" || len(ss.resumes) == 0 {
+		return
+	}
+
+	now := timeNow()
+	for session, p := range ss.resumes {
+		if now.After(p.expire) {
+			delete(ss.resumes, session)
+		}
+	}
+
+	p, ok := ss.resumes[sub.session]
+	if !ok {
+		return
+	}
+	delete(ss.resumes, sub.session)
+	sub.resumeTimeStamp, sub.resume = p.timeStamp, true
+	sub.logger.WithFields(logrus.Fields{"event": "resume session", "streamKey": ss.streamKey, "session": sub.session, "subscriber": sub.id}).
+		Debugf("resume from %d", p.timeStamp)
+}
+
+// gopAt returns cached media from the last keyframe at or before timeStamp, false if the cache starts
+// after it
+func (c *Cache) gopAt(timeStamp uint32) ([]*av.Packet, bool) {
+	if len(c.keyIdx) == 0 || c.gop[c.keyIdx[0]].TimeStamp > timeStamp {
+		return nil, false
+	}
+
+	start := c.keyIdx[0]
+	for _, i := range c.keyIdx[1:] {
+		if c.gop[i].TimeStamp > timeStamp {
+			break
+		}
+		start = i
+	}
+	return c.gop[start:], true
+}
@@ -0,0 +1,94 @@
+package rtmp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+)
+
+func TestSessionResume(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	config := newTestConfig()
+	config.GOPCacheDuration = 5 * time.Second
+	config.SessionResumeWindow = 10 * time.Second
+	ssMgr := newStreamSourceMgr(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+
+	// 10s of 25fps video, a keyframe every second
+	publish := func(pkt *av.Packet) {
+		ss.dispatchAVPacket(nil, pkt)
+		ss.cacheAVMetaPacket(pkt)
+	}
+	publish(newTestAVPacket(t, true, testVideoSeq, 0))
+	for i := 0; i < 250; i++ {
+		data := testVideoInter
+		if i%25 == 0 {
+			data = testVideoKey
+		}
+		publish(newTestAVPacket(t, true, data, uint32(i*40)))
+	}
+
+	play := func(remote, session string) *subscriber {
+		c, _ := newTestConn(t, ssMgr, config, remote)
+		c.urlValues = url.Values{"session": {session}, "buffer": {"5"}}
+		sub := newSubscriber(c, 1024)
+		ss.addSubscriber(sub)
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, 10000))
+		return sub
+	}
+	leave := func(sub *subscriber, sentUpTo uint32) {
+		for len(sub.avPktQueue) > 0 {
+			pkt := <-sub.avPktQueue
+			if pkt.TimeStamp <= sentUpTo {
+				sub.nextTimeStamp(pkt) // sent
+			}
+		}
+		ss.delSubscriber(sub)
+	}
+	replayFrom := func(sub *subscriber) uint32 {
+		t.Helper()
+		if seq := <-sub.avPktQueue; !isSeqHeader(seq) {
+			t.Fatalf("got %+v first; want video sequence header", seq)
+		}
+		pkt := <-sub.avPktQueue
+		if !pkt.Header.(av.VideoPacketHeader).IsKeyFrame() {
+			t.Fatalf("got replay from %+v; want a keyframe", pkt)
+		}
+		return pkt.TimeStamp
+	}
+	const live = 5000 // buffer=5
+
+	// the player left at 7.5s, it resumes from the keyframe at 7s, not live at 5s
+	leave(play("127.0.0.1:10001", "abc"), 7500)
+	now = now.Add(5 * time.Second)
+	if from := replayFrom(play("127.0.0.1:10002", "abc")); from != 7000 {
+		t.Fatalf("got resume from %d; want 7000", from)
+	}
+
+	// the point was used up, another session or a reconnect after the window plays live
+	if from := replayFrom(play("127.0.0.1:10003", "abc")); from != live {
+		t.Fatalf("got second reconnect from %d; want live %d", from, live)
+	}
+	if from := replayFrom(play("127.0.0.1:10004", "other")); from != live {
+		t.Fatalf("got other session from %d; want live %d", from, live)
+	}
+
+	leave(play("127.0.0.1:10005", "late"), 7500)
+	now = now.Add(11 * time.Second)
+	if from := replayFrom(play("127.0.0.1:10006", "late")); from != live {
+		t.Fatalf("got reconnect after the window from %d; want live %d", from, live)
+	}
+
+	// what was played left the cache, live too
+	old := play("127.0.0.1:10007", "old")
+	old.markSent(newTestAVPacket(t, true, testVideoKey, 1000))
+	ss.delSubscriber(old)
+	if from := replayFrom(play("127.0.0.1:10008", "old")); from != live {
+		t.Fatalf("got resume before the cache from %d; want live %d", from, live)
+	}
+}
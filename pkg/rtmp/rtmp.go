@@ -4,13 +4,27 @@ import (
 	//"log"
 
 	"bufio"
+	"io"
 	"net"
-	"os"
+	"sync/atomic"
+	"time"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/sirupsen/logrus"
 )
 
+// the read buffer must hold the 4 byte extended timestamp peek of a fmt 3 chunk, bufio never goes below 16
+const (
+	connReadBufSize    = 4096
+	minConnReadBufSize = 16
+)
+
+func newConnReader(r io.Reader, size int) *bufio.Reader {
+	if size < minConnReadBufSize {
+		size = minConnReadBufSize
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
 // Server returns a new RTMP server side conncetion
 func Server(conn net.Conn, ssMgr *streamSourceMgr, config *Config) *Conn {
 	c := &Conn{
@@ -21,24 +35,30 @@ func Server(conn net.Conn, ssMgr *streamSourceMgr, config *Config) *Conn {
 	c.handshakeFn = c.serverHandshake
 
 	//TODO: config
-	c.localChunksize = 60000
+	c.localChunksize = DefaultChunkSize
+	if config.ChunkSize > 0 {
+		c.localChunksize = config.ChunkSize
+	}
 	c.remoteChunkSize = 128
+	c.playStart, c.playLen = playStartLive, playLenAll
 	c.localWindowAckSize = 2500000
-	c.remoteWindowAckSize = 250000
+	c.remoteWindowAckSize = defaultWindowAckSize
+	if config.WindowAckSize > 0 {
+		c.remoteWindowAckSize = config.WindowAckSize
+	}
 
 	//c.readWriter = newReadWriter(c, connReadBufSize, connWriteBufSize)
-	c.reader = bufio.NewReader(conn)
+	c.reader = newConnReader(&countingReader{r: conn, n: &c.bytesIn}, connReadBufSize)
 
 	c.chunks = make(map[uint32]*ChunkStream)
-	c.amfDecoder = &amf.Decoder{}
-	c.amfEncoder = &amf.Encoder{}
+	c.amfCodec = newAMFCodec(config)
 
 	c.logger = config.Logger
 
 	return c
 }
 
-// Client returns a new RTMP client side connection
+// Client returns a new RTMP client side connection, it writes by 128 byte chunks until it sends SetChunkSize
 func Client(conn net.Conn, config *Config) *Conn {
 	c := &Conn{
 		conn:     conn,
@@ -46,13 +66,49 @@ func Client(conn net.Conn, config *Config) *Conn {
 		isClient: true,
 	}
 	c.handshakeFn = c.clientHandshake
+
+	c.localChunksize = 128
+	c.remoteChunkSize = 128
+	c.localWindowAckSize = 2500000
+	c.remoteWindowAckSize = defaultWindowAckSize
+	if config.WindowAckSize > 0 {
+		c.remoteWindowAckSize = config.WindowAckSize
+	}
+
+	c.reader = newConnReader(&countingReader{r: conn, n: &c.bytesIn}, connReadBufSize)
+	c.basicHdrBuf = make([]byte, 3)
+
+	c.chunks = make(map[uint32]*ChunkStream)
+	c.amfCodec = newAMFCodec(config)
+
+	c.logger = config.Logger
+
 	return c
 }
 
+// countingReader counts raw bytes read from conn, before chunk parsing
+type countingReader struct {
+	r io.Reader
+	n *int64 // atomic
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// keepAliveConn is implemented by *net.TCPConn
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
 type listener struct {
 	net.Listener
 	config *Config
 	ssMgr  *streamSourceMgr // streamSourceMgr for every listener/server instance
+	server *Service         // nil if not served by Service
 }
 
 func (l *listener) Accept() (net.Conn, error) {
@@ -61,13 +117,25 @@ func (l *listener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	return Server(c, l.ssMgr, l.config), nil
+	if l.config.TCPKeepAlive > 0 {
+		if kc, ok := c.(keepAliveConn); ok {
+			if err := kc.SetKeepAlive(true); err != nil {
+				l.config.Logger.WithFields(logrus.Fields{"event": "SetKeepAlive"}).Error(err)
+			} else if err := kc.SetKeepAlivePeriod(l.config.TCPKeepAlive); err != nil {
+				l.config.Logger.WithFields(logrus.Fields{"event": "SetKeepAlivePeriod"}).Error(err)
+			}
+		}
+	}
+
+	conn := Server(c, l.ssMgr, l.config)
+	conn.server = l.server
+	return conn, nil
 }
 
 func NewListener(inner net.Listener, config *Config) net.Listener {
 	l := new(listener)
 	l.Listener = inner
-	l.ssMgr = newStreamSourceMgr()
+	l.ssMgr = newStreamSourceMgr(config)
 	l.config = config
 	return l
 }
@@ -81,25 +149,5 @@ func Listen(network, laddr string, config *Config) (net.Listener, error) {
 }
 
 func ListenAndServe(network, laddr string, config *Config) error {
-	logger := config.Logger.WithFields(logrus.Fields{
-		"event": "ListenAndServe",
-	})
-
-	l, err := Listen(network, laddr, config)
-	if err != nil {
-		logger.Error(err)
-		return err
-	}
-
-	logger.Tracef("listen at addr: %s, network: %s, pid: %d", l.Addr().String(), l.Addr().Network(), os.Getpid())
-
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			config.Logger.WithFields(logrus.Fields{"event": "Accept"}).Error(err)
-			continue
-		}
-
-		go conn.(*Conn).Serve()
-	}
+	return NewService(config).ListenAndServe(network, laddr)
 }
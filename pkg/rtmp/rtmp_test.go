@@ -0,0 +1,257 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/sirupsen/logrus"
+)
+
+type testAddr string
+
+func (a testAddr) Network() string { return "tcp" }
+func (a testAddr) String() string  { return string(a) }
+
+// testNetConn wraps one end of net.Pipe with distinct addresses, subscribers are keyed by remote addr
+type testNetConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *testNetConn) LocalAddr() net.Addr  { return c.local }
+func (c *testNetConn) RemoteAddr() net.Addr { return c.remote }
+
+func newTestConfig() *Config {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return &Config{Logger: logger}
+}
+
+// newTestConn returns a server side Conn and the peer end of the pipe
+func newTestConn(t testing.TB, ssMgr *streamSourceMgr, config *Config, remote string) (*Conn, net.Conn) {
+	t.Helper()
+
+	local, peer := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+
+	nc := &testNetConn{Conn: local, local: testAddr("127.0.0.1:1935"), remote: testAddr(remote)}
+	c := Server(nc, ssMgr, config)
+	c.basicHdrBuf = make([]byte, 3)
+
+	return c, peer
+}
+
+// newTestSubscriber returns a subscriber whose queue is drained by the test itself
+func newTestSubscriber(t *testing.T, ss *streamSource, remote string) *subscriber {
+	t.Helper()
+
+	c, _ := newTestConn(t, ss.ssMgr, newTestConfig(), remote)
+	sub := newSubscriber(c, 1024)
+	if !ss.addSubscriber(sub) {
+		t.Fatalf("add subscriber %s failed", remote)
+	}
+
+	return sub
+}
+
+type keepAliveTestConn struct {
+	net.Conn
+	keepAlive bool
+	period    time.Duration
+}
+
+func (c *keepAliveTestConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *keepAliveTestConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+// stubListener hands out the queued conns, then the queued error
+type stubListener struct {
+	conns []net.Conn
+	err   error
+}
+
+func (l *stubListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		return nil, l.err
+	}
+	c := l.conns[0]
+	l.conns = l.conns[1:]
+	return c, nil
+}
+
+func (l *stubListener) Close() error   { return nil }
+func (l *stubListener) Addr() net.Addr { return testAddr("127.0.0.1:1935") }
+
+func TestListenerTCPKeepAlive(t *testing.T) {
+	var tests = []struct {
+		name      string
+		keepAlive time.Duration
+		expectOn  bool
+	}{
+		{"enabled", 15 * time.Second, true},
+		{"disabled", 0, false},
+	}
+
+	for _, tt := range tests {
+		kc := &keepAliveTestConn{}
+		config := newTestConfig()
+		config.TCPKeepAlive = tt.keepAlive
+
+		l := NewListener(&stubListener{conns: []net.Conn{kc}}, config)
+		if _, err := l.Accept(); err != nil {
+			t.Fatalf("%s: accept: %v", tt.name, err)
+		}
+
+		if kc.keepAlive != tt.expectOn || kc.period != tt.keepAlive {
+			t.Fatalf("%s: got keepalive %v period %v; want %v %v", tt.name, kc.keepAlive, kc.period, tt.expectOn, tt.keepAlive)
+		}
+	}
+}
+
+// encodeTestMessage encodes one message as a fmt 0 chunk followed by fmt 3 continuations, csid must < 64
+func encodeTestMessage(csid, timeStamp uint32, typeID RtmpMsgTypeID, streamID uint32, body []byte, chunkSize int) []byte {
+	var b []byte
+	for i := 0; i == 0 || i < len(body); i += chunkSize {
+		if i == 0 {
+			b = append(b, byte(csid))
+			b = append(b, byte(timeStamp>>16), byte(timeStamp>>8), byte(timeStamp))
+			b = append(b, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+			b = append(b, byte(typeID))
+			b = append(b, byte(streamID), byte(streamID>>8), byte(streamID>>16), byte(streamID>>24))
+		} else {
+			b = append(b, 3<<6|byte(csid))
+		}
+
+		end := i + chunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+		b = append(b, body[i:end]...)
+	}
+
+	return b
+}
+
+// feedPeer writes b from the peer end of the pipe without blocking the test
+func feedPeer(peer net.Conn, b []byte) {
+	go func() {
+		_, _ = peer.Write(b)
+	}()
+}
+
+// drainPeer discards everything the server writes to the peer
+func drainPeer(peer net.Conn) {
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, peer)
+	}()
+}
+
+// newTestCommandMessage returns a received AMF0 command message chunk stream
+func newTestCommandMessage(t *testing.T, args ...interface{}) *ChunkStream {
+	t.Helper()
+
+	buffer := bytes.NewBuffer(nil)
+	for _, v := range args {
+		if _, err := (&amf.Encoder{}).Encode(buffer, v, amf.AMF0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cs := newChunkStream()
+	cs = cs.setBasicHeader(0, 3)
+	cs = cs.setMessageHeader(0, uint32(buffer.Len()), MsgAMF0CommandMessage, 1)
+	cs.ChunkBody = buffer.Bytes()
+	return cs
+}
+
+// newTestClient returns a client side Conn over conn ready to read and write chunks, without handshake
+func newTestClient(conn net.Conn, config *Config) *Conn {
+	return Client(conn, config)
+}
+
+// newTestPeer returns a client side Conn over the peer end, used to parse what server writes
+func newTestPeer(peer net.Conn) *Conn {
+	pc := newTestClient(peer, newTestConfig())
+	pc.remoteChunkSize = 60000 // server writes with its local chunk size even before SetChunkSize
+	return pc
+}
+
+// readTestCommand reads messages from peer until a command message arrives and returns its AMF values,
+// safe to call from other goroutines
+func readTestCommand(t *testing.T, pc *Conn) []interface{} {
+	t.Helper()
+
+	for {
+		cs, err := pc.readChunkStream(pc.basicHdrBuf)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if cs.MsgTypeID != MsgAMF0CommandMessage {
+			continue
+		}
+
+		vs, err := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(cs.ChunkBody), amf.AMF0)
+		if err != nil && err != io.EOF {
+			t.Error(err)
+		}
+		return vs
+	}
+}
+
+// statusCode returns the code of onStatus/_result/_error event object, the last AMF value
+func statusCode(vs []interface{}) string {
+	if len(vs) == 0 {
+		return ""
+	}
+	if event, ok := vs[len(vs)-1].(amf.Object); ok {
+		code, _ := event["code"].(string)
+		return code
+	}
+	return ""
+}
+
+// readTestMessages reads n messages from peer, chunk streams are copied since Conn reuses them per csid
+func readTestMessages(t *testing.T, pc *Conn, n int) []*ChunkStream {
+	t.Helper()
+
+	var msgs []*ChunkStream
+	for i := 0; i < n; i++ {
+		cs, err := pc.readChunkStream(pc.basicHdrBuf)
+		if err != nil {
+			t.Error(err)
+			return msgs
+		}
+
+		msg := *cs
+		msg.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+		msgs = append(msgs, &msg)
+	}
+	return msgs
+}
+
+// decodeTestAMF decodes all AMF0 values of a command or data message body
+func decodeTestAMF(t *testing.T, body []byte) []interface{} {
+	t.Helper()
+
+	vs, err := (&amf.Decoder{}).DecodeBatch(bytes.NewReader(body), amf.AMF0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return vs
+}
@@ -0,0 +1,126 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Service serves RTMP connections, all listeners of one Service share the same stream source manager
+type Service struct {
+	config *Config
+	ssMgr  *streamSourceMgr
+
+	draining int32 // atomic, 1: reject new connect/publish/play
+	serving  int32 // atomic, number of listeners in Serve
+
+	listeners sync.Map // net.Listener in Serve -> struct{}, closed by Shutdown
+	conns     sync.Map // *Conn being served -> struct{}, closed by Shutdown
+}
+
+func NewService(config *Config) *Service {
+	if config.LogLevel != "" {
+		if level, err := logrus.ParseLevel(config.LogLevel); err == nil { // Validate reports it
+			base := config.Logger
+			if base == nil { // as streamSourceMgr.logger
+				base = logrus.StandardLogger()
+			}
+			owned := *config // the caller's Logger may be shared, the level is the server's
+			owned.Logger = levelLogger(base, level)
+			config = &owned
+		}
+	}
+	return &Service{
+		config: config,
+		ssMgr:  newStreamSourceMgr(config),
+	}
+}
+
+func (s *Service) ListenAndServe(network, laddr string) error {
+	logger := s.config.Logger.WithFields(logrus.Fields{
+		"event": "ListenAndServe",
+	})
+
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	logger.Tracef("listen at addr: %s, network: %s, pid: %d", l.Addr().String(), l.Addr().Network(), os.Getpid())
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on inner and serves each one in a new goroutine. Temporary accept errors
+// (e.g. EMFILE) are retried with backoff, a permanent one (e.g. listener closed) is returned.
+// Accepting is throttled by config.AcceptRateLimit.
+func (s *Service) Serve(inner net.Listener) error {
+	l := &listener{
+		Listener: inner,
+		config:   s.config,
+		ssMgr:    s.ssMgr,
+		server:   s,
+	}
+
+	s.listeners.Store(inner, struct{}{})
+	defer s.listeners.Delete(inner)
+	atomic.AddInt32(&s.serving, 1)
+	defer atomic.AddInt32(&s.serving, -1)
+
+	var limiter *rate.Limiter
+	if s.config.AcceptRateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(s.config.AcceptRateLimit), s.config.AcceptRateLimit)
+	}
+
+	var delay time.Duration
+	for {
+		if limiter != nil {
+			_ = limiter.Wait(context.Background())
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			logger := s.config.Logger.WithFields(logrus.Fields{"event": "Accept"})
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				logger.Errorf("%v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			logger.Error(err)
+			return err // permanent, e.g. listener closed
+		}
+		delay = 0
+
+		go s.serveConn(conn.(*Conn))
+	}
+}
+
+func (s *Service) serveConn(c *Conn) {
+	s.conns.Store(c, struct{}{})
+	defer s.conns.Delete(c)
+	c.Serve()
+}
+
+// Drain stops accepting new connect, publish and play commands, they are rejected with a retriable
+// status so clients may try another server. Streams already publishing or playing keep flowing.
+func (s *Service) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.config.Logger.WithFields(logrus.Fields{"event": "Drain"}).Info("server is draining")
+}
+
+func (s *Service) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
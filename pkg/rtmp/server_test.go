@@ -0,0 +1,211 @@
+package rtmp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+)
+
+func TestServerDrain(t *testing.T) {
+	server := NewService(newTestConfig())
+
+	// existing stream publishing before drain
+	pubConn, pubPeer := newTestConn(t, server.ssMgr, server.config, "127.0.0.1:10001")
+	pubConn.server = server
+	ss := newStreamSource(newPublisher(pubConn, "_defaultVhost_/live/test"), "_defaultVhost_/live/test", server.ssMgr)
+	server.ssMgr.streamMap.Store(ss.streamKey, ss)
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+	go func() { _ = ss.doPublishing() }()
+
+	server.Drain()
+	if !server.IsDraining() {
+		t.Fatal("server should be draining")
+	}
+
+	// new publish is rejected
+	newConn, newPeer := newTestConn(t, server.ssMgr, server.config, "127.0.0.1:10003")
+	newConn.server = server
+	cmdResp := make(chan []interface{}, 1)
+	go func() { cmdResp <- readTestCommand(t, newTestPeer(newPeer)) }()
+
+	err := newConn.decodeCommandMessage(newTestCommandMessage(t, "publish", 5.0, nil, "other", "live"))
+	if errors.Cause(err) != errServerDraining {
+		t.Fatalf("got err %v; want %v", err, errServerDraining)
+	}
+	if code := statusCode(<-cmdResp); code != "NetStream.Publish.Rejected" {
+		t.Fatalf("got status '%s'; want NetStream.Publish.Rejected", code)
+	}
+
+	// existing publish keeps flowing
+	feedPeer(pubPeer, encodeTestMessage(6, 40, MsgVideoMessage, 1, testVideoKey, 128))
+	select {
+	case pkt := <-sub.avPktQueue:
+		if !pkt.IsVideo || pkt.TimeStamp != 40 {
+			t.Fatalf("got %+v; want video at 40", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("existing stream stopped flowing while draining")
+	}
+}
+
+func TestServerDrainRejectConnect(t *testing.T) {
+	server := NewService(newTestConfig())
+	server.Drain()
+
+	c, peer := newTestConn(t, server.ssMgr, server.config, "127.0.0.1:10001")
+	c.server = server
+	cmdResp := make(chan []interface{}, 1)
+	go func() { cmdResp <- readTestCommand(t, newTestPeer(peer)) }()
+
+	connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://127.0.0.1/live"})
+	if err := c.decodeCommandMessage(connect); errors.Cause(err) != errServerDraining {
+		t.Fatalf("got err %v; want %v", err, errServerDraining)
+	}
+
+	vs := <-cmdResp
+	if len(vs) == 0 || vs[0] != "_error" || statusCode(vs) != "NetConnection.Connect.Rejected" {
+		t.Fatalf("got %v; want _error NetConnection.Connect.Rejected", vs)
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "accept: too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// countListener counts Accept calls, always failing with err
+type countListener struct {
+	stubListener
+	accepts int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&l.accepts, 1)
+	return l.stubListener.Accept()
+}
+
+func TestServeBackoffOnTemporaryError(t *testing.T) {
+	server := NewService(newTestConfig())
+	l := &countListener{stubListener: stubListener{err: tempError{}}}
+	go func() { _ = server.Serve(l) }()
+
+	// backoff 5ms, 10ms, 20ms, 40ms, 80ms... only a handful of retries fit in 100ms
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&l.accepts); n > 10 {
+		t.Fatalf("got %d accepts in 100ms; want accept loop backing off", n)
+	}
+}
+
+func TestServeReturnOnPermanentError(t *testing.T) {
+	server := NewService(newTestConfig())
+	permErr := errors.New("accept: use of closed network connection")
+	l := &countListener{stubListener: stubListener{err: permErr}}
+
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(l) }()
+
+	select {
+	case err := <-done:
+		if err != permErr {
+			t.Fatalf("got err %v; want %v", err, permErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve kept looping on permanent accept error")
+	}
+	if n := atomic.LoadInt32(&l.accepts); n != 1 {
+		t.Fatalf("got %d accepts; want 1", n)
+	}
+	if server.IsReady() {
+		t.Fatal("server should not be ready after Serve returned")
+	}
+
+	// a closed real listener
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- server.Serve(nl) }()
+	_ = nl.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("got nil err; want accept error of closed listener")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve kept looping on closed listener")
+	}
+}
+
+func TestConnectionSoftLimit(t *testing.T) {
+	config := newTestConfig()
+	config.SoftMaxConnections = 2
+	config.MaxConnections = 3
+	server := NewService(config)
+	streamKey := "_defaultVhost_/live/test"
+
+	pubConn, pubPeer := newTestConn(t, server.ssMgr, config, "127.0.0.1:10001")
+	ss, err := server.ssMgr.attachPublisher(newPublisher(pubConn, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10002")
+	go func() { _ = ss.doPublishing() }()
+
+	if n := server.ssMgr.ConnectionCount(); n != 2 {
+		t.Fatalf("got %d connections; want 2", n)
+	}
+
+	// soft limit reached, new play is rejected with a retriable status
+	c, peer := newTestConn(t, server.ssMgr, config, "127.0.0.1:10003")
+	cmdResp := make(chan []interface{}, 1)
+	go func() { cmdResp <- readTestCommand(t, newTestPeer(peer)) }()
+
+	err = c.decodeCommandMessage(newTestCommandMessage(t, "play", 4.0, nil, "test"))
+	if errors.Cause(err) != errServerBusy {
+		t.Fatalf("got err %v; want %v", err, errServerBusy)
+	}
+	if code := statusCode(<-cmdResp); code != "NetStream.Play.Failed" {
+		t.Fatalf("got status '%s'; want NetStream.Play.Failed", code)
+	}
+
+	// connect is still accepted below the hard limit
+	c, peer = newTestConn(t, server.ssMgr, config, "127.0.0.1:10004")
+	drainPeer(peer)
+	connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://127.0.0.1/live"})
+	if err := c.decodeCommandMessage(connect); err != nil {
+		t.Fatalf("connect below hard limit: %v", err)
+	}
+
+	// existing stream keeps flowing
+	feedPeer(pubPeer, encodeTestMessage(6, 40, MsgVideoMessage, 1, testVideoKey, 128))
+	select {
+	case pkt := <-sub.avPktQueue:
+		if !pkt.IsVideo || pkt.TimeStamp != 40 {
+			t.Fatalf("got %+v; want video at 40", pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("existing stream stopped flowing above soft limit")
+	}
+
+	// hard limit reached, connect is rejected
+	newTestSubscriber(t, ss, "127.0.0.1:10005")
+	c, peer = newTestConn(t, server.ssMgr, config, "127.0.0.1:10006")
+	go func() { cmdResp <- readTestCommand(t, newTestPeer(peer)) }()
+	if err := c.decodeCommandMessage(connect); errors.Cause(err) != errServerBusy {
+		t.Fatalf("got err %v; want %v", err, errServerBusy)
+	}
+	if vs := <-cmdResp; len(vs) == 0 || vs[0] != "_error" || statusCode(vs) != "NetConnection.Connect.Rejected" {
+		t.Fatalf("got %v; want _error NetConnection.Connect.Rejected", vs)
+	}
+	// the count follows players and the publisher leaving
+	ss.delSubscriber(sub)
+	ss.delPublisher()
+	if n := server.ssMgr.ConnectionCount(); n != 1 {
+		t.Fatalf("got %d connections; want 1, the player left", n)
+	}
+}
@@ -0,0 +1,90 @@
+package rtmp
+
+import (
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultShutdownTimeout = 10 * time.Second
+	shutdownPollInterval   = 10 * time.Millisecond
+)
+
+/*
+ * Shutdown stops the server gracefully, bounded by Config.ShutdownTimeout:
+ *   1. it drains and closes the listeners, Serve returns their accept error.
+ *   2. publishers are disconnected, players keep sending what is queued to them.
+ *   3. once every player flushed its queue, or at the deadline, the stream sources and all
+ *      connections left are closed. A player stalled by a slow client is closed with media queued.
+ * It returns ErrShutdownTimeout if the deadline forced the close.
+ */
+func (s *Service) Shutdown() error {
+	s.Drain()
+	logger := s.config.Logger.WithFields(logrus.Fields{"event": "Shutdown"})
+
+	s.listeners.Range(func(key, _ interface{}) bool {
+		if err := key.(net.Listener).Close(); err != nil {
+			logger.Error(err)
+		}
+		return true
+	})
+
+	s.ssMgr.streamMap.Range(func(_, val interface{}) bool {
+		if pub := val.(*streamSource).getPublisher(); pub != nil && pub.rtmpConn != nil {
+			_ = pub.rtmpConn.Close()
+		}
+		return true
+	})
+
+	var err error
+	timeout := s.shutdownTimeout()
+	deadline := time.Now().Add(timeout)
+	for !s.playersFlushed() {
+		if !time.Now().Before(deadline) {
+			logger.Warnf("players not flushed within %v, force close", timeout)
+			err = ErrShutdownTimeout
+			break
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+
+	s.ssMgr.streamMap.Range(func(_, val interface{}) bool {
+		val.(*streamSource).Close()
+		return true
+	})
+	n := 0
+	s.conns.Range(func(key, _ interface{}) bool {
+		_ = key.(*Conn).Close()
+		n++
+		return true
+	})
+	logger.Infof("closed %d connections", n)
+	return err
+}
+
+func (s *Service) shutdownTimeout() time.Duration {
+	if s.config.ShutdownTimeout > 0 {
+		return s.config.ShutdownTimeout
+	}
+	return defaultShutdownTimeout
+}
+
+// playersFlushed reports no player with media queued or being written
+func (s *Service) playersFlushed() bool {
+	flushed := true
+	s.ssMgr.streamMap.Range(func(_, val interface{}) bool {
+		ss := val.(*streamSource)
+		ss.addSubMux.Lock()
+		for _, sub := range ss.subList {
+			if sub.closeConn != nil && !sub.isStopped() && sub.pending() {
+				flushed = false
+				break
+			}
+		}
+		ss.addSubMux.Unlock()
+		return flushed
+	})
+	return flushed
+}
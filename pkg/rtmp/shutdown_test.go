@@ -0,0 +1,84 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerShutdownTimeout(t *testing.T) {
+	config := newTestConfig()
+	config.ShutdownTimeout = 100 * time.Millisecond
+	server := NewService(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", server.ssMgr)
+	server.ssMgr.streamMap.Store(ss.streamKey, ss)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(inner) }()
+	for !server.IsReady() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// stalled never reads its socket, its queue never flushes
+	stalled := newTestSubscriber(t, ss, "127.0.0.1:10001")
+	done := make(chan error, 1)
+	go func() { done <- ss.doPlaying(stalled) }()
+	for i := 0; i < 3; i++ {
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, uint32(i*40)))
+	}
+
+	start := time.Now()
+	if err := server.Shutdown(); err != ErrShutdownTimeout {
+		t.Fatalf("got err %v; want %v", err, ErrShutdownTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v; want about %v", elapsed, config.ShutdownTimeout)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("playing cycle of the stalled player returned no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stalled player still playing after shutdown")
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("Serve still accepting after shutdown")
+	}
+	if !server.IsDraining() {
+		t.Fatal("server should be draining after shutdown")
+	}
+}
+
+func TestServerShutdownFlushed(t *testing.T) {
+	config := newTestConfig()
+	config.ShutdownTimeout = time.Minute
+	server := NewService(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", server.ssMgr)
+	server.ssMgr.streamMap.Store(ss.streamKey, ss)
+
+	c, peer := newTestConn(t, server.ssMgr, config, "127.0.0.1:10001")
+	drainPeer(peer)
+	sub := newSubscriber(c, 1024)
+	ss.addSubscriber(sub)
+	go func() { _ = ss.doPlaying(sub) }()
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 0))
+
+	start := time.Now()
+	if err := server.Shutdown(); err != nil {
+		t.Fatalf("got err %v; want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown of a flushed player took %v", elapsed)
+	}
+	if _, ok := server.ssMgr.streamMap.Load(ss.streamKey); ok {
+		t.Fatal("stream source left after shutdown")
+	}
+}
@@ -0,0 +1,121 @@
+package rtmp
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of all streams of a server
+type Stats struct {
+	Connections int // publishers and players
+	Streams     []StreamStats
+}
+
+type StreamStats struct {
+	StreamInfo
+	PublisherTimings ConnTimings // zero without publisher
+	PublisherMemory  int64       // bytes, see Conn.MemoryUsage
+	SubscriberStats  []SubscriberStats
+
+	PublisherMsgSizes []MsgSizeBucket // message lengths of the media and metadata published, to pick Config.ChunkSize,
+	// a message up to the chunk size goes in one chunk, nil without publisher
+}
+
+type SubscriberStats struct {
+	ID      string
+	Type    string        // play, wsplay, relay, record, dash or flvsink
+	AVDrift time.Duration // audio - video timestamp of the last sent media
+	Idle    bool          // a player without write progress for Config.IdleSubscriberTimeout, see Service.DisconnectIdleSubscribers
+	Timings ConnTimings   // of the rtmp connection, zero for websocket players and internal consumers
+	Memory  int64         // bytes of the rtmp connection, see Conn.MemoryUsage
+	Unacked uint32        // bytes sent beyond the last Acknowledgement of the rtmp peer, 0 if it never acknowledged
+}
+
+// SubscriberInfo details one subscriber for debugging slow clients
+type SubscriberInfo struct {
+	ID            string
+	Type          string
+	RemoteAddr    string // empty for internal consumers
+	Session       string // tcUrl parameter session of a player
+	QueueDepth    int    // packets queued, not sent yet
+	QueueSize     int
+	DroppedAudio  uint64 // by queue depth or latency budget
+	DroppedVideo  uint64
+	LastTimeStamp uint32 // publisher timestamp of the last media sent
+	Sent          bool   // false before any media was sent, LastTimeStamp is 0
+}
+
+// Subscribers lists the subscribers in join order
+func (ss *streamSource) Subscribers() []SubscriberInfo {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	infos := make([]SubscriberInfo, 0, len(ss.subList))
+	for _, sub := range ss.subList {
+		info := SubscriberInfo{
+			ID:           sub.id,
+			Type:         sub.subType,
+			Session:      sub.session,
+			QueueDepth:   len(sub.avPktQueue),
+			QueueSize:    sub.avPktQueueSize,
+			DroppedAudio: atomic.LoadUint64(&sub.droppedAudio),
+			DroppedVideo: atomic.LoadUint64(&sub.droppedVideo),
+		}
+		if sub.rtmpConn != nil {
+			info.RemoteAddr = sub.rtmpConn.RemoteAddr().String()
+		}
+		info.LastTimeStamp, info.Sent = sub.lastSent()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (s *Service) Stats() Stats {
+	return s.ssMgr.Stats()
+}
+
+func (mgr *streamSourceMgr) Stats() Stats {
+	var stats Stats
+	mgr.streamMap.Range(func(_, val interface{}) bool {
+		stats.Streams = append(stats.Streams, val.(*streamSource).Stats())
+		return true
+	})
+	sort.Slice(stats.Streams, func(i, j int) bool { return stats.Streams[i].StreamKey < stats.Streams[j].StreamKey })
+
+	stats.Connections = mgr.ConnectionCount()
+
+	return stats
+}
+
+func (ss *streamSource) Stats() StreamStats {
+	stats := StreamStats{StreamInfo: ss.StreamInfo()}
+	if pub := ss.getPublisher(); pub != nil {
+		stats.PublisherMsgSizes = pub.msgSizes.buckets()
+		if pub.rtmpConn != nil {
+			stats.PublisherTimings = pub.rtmpConn.Timings()
+			stats.PublisherMemory = pub.rtmpConn.MemoryUsage()
+		}
+	}
+	timeout := ss.idleTimeout()
+
+	ss.addSubMux.Lock()
+	for _, sub := range ss.subscribers {
+		st := SubscriberStats{
+			ID:      sub.id,
+			Type:    sub.subType,
+			AVDrift: sub.AVDrift(),
+			Idle:    sub.isIdle(timeout),
+		}
+		if sub.rtmpConn != nil {
+			st.Timings = sub.rtmpConn.Timings()
+			st.Memory = sub.rtmpConn.MemoryUsage()
+			st.Unacked = sub.rtmpConn.unacked()
+		}
+		stats.SubscriberStats = append(stats.SubscriberStats, st)
+	}
+	ss.addSubMux.Unlock()
+
+	sort.Slice(stats.SubscriberStats, func(i, j int) bool { return stats.SubscriberStats[i].ID < stats.SubscriberStats[j].ID })
+	return stats
+}
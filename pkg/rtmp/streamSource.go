@@ -2,40 +2,103 @@ package rtmp
 
 import (
 	"playground/pkg/av"
+	"playground/pkg/dash"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 type streamSource struct {
 	stopPublish chan bool
+	done        chan struct{} // closed when deleted from streamSourceMgr, stops subscribers and monitors
 	publisher   *publisher
+	pubMux      sync.Mutex  // guard publisher, delTimer, delGen and deleted
+	delTimer    *time.Timer // pending deletion after publisher left
+	delGen      uint64      // bumped on every (re)schedule or cancel of delTimer
+	deleted     bool        // removed from streamSourceMgr, never attach publisher again
 
 	subscribers     map[string]*subscriber
+	subList         []*subscriber // subscribers in join order, dispatch iterates it instead of the map
 	subscriberCount int
-	addSubMux       sync.Mutex
+	monitors        map[string]*subscriber // internal consumers of AddMonitor, not counted as subscribers
+	addSubMux       sync.Mutex             // guard subscribers, subscriberCount, monitors and subscribers of shards
+	shards          []*dispatchShard       // dispatch workers with Config.DispatchShards, nil: dispatch on the publisher goroutine
+	shardWG         sync.WaitGroup         // shards busy with the packet being dispatched
+	resumes         map[string]resumePoint // by session, guarded by addSubMux
+
+	keyFrameRequestAt time.Time // last request to the publisher, guarded by addSubMux
+
+	players   int           // subscribers which are players, guarded by addSubMux
+	idleSince time.Time     // no player since, zero while any, guarded by addSubMux
+	subJoined chan struct{} // signalled when a player joins, wakes an ingest sleeping while idle
 
 	streamKey string
 	sessionID string
 	ssMgr     *streamSourceMgr
 	cache     *Cache
+
+	lastTimeStamp   uint32    // timestamp of the last dispatched media packet
+	lastMetaRefresh time.Time // last dispatch of onMetaData, by publisher or Config.MetaDataRefreshInterval
+
+	dash  *dash.Packager // set on creation with Config.DASH
+	thumb *thumbnailer   // set on creation with Config.ThumbnailDecoder
+
+	infoMux      sync.Mutex // guard info, bytesIn, publishStart, audioReady and videoReady
+	info         StreamInfo // codec info, filled by the publishing cycle
+	bytesIn      int64
+	publishStart time.Time
+	audioReady   bool // got a decodable track, see StreamInfo.AudioOnly
+	videoReady   bool
 }
 
 func newStreamSource(pub *publisher, streamKey string, ssMgr *streamSourceMgr) *streamSource {
 	ss := &streamSource{
 		stopPublish: make(chan bool, 1),
+		done:        make(chan struct{}),
 		publisher:   pub,
 		subscribers: make(map[string]*subscriber),
+		monitors:    make(map[string]*subscriber),
+		resumes:     make(map[string]resumePoint),
+		idleSince:   timeNow(),
+		subJoined:   make(chan struct{}, 1),
 		streamKey:   streamKey,
-		sessionID:   genUuid(),
+		sessionID:   ssMgr.genSessionID(),
 		ssMgr:       ssMgr,
 		cache:       NewCache(),
 	}
+	ss.resetStreamInfo(pub)
+	if pub != nil {
+		ssMgr.addConnections(1)
+	}
+
+	if ssMgr != nil && ssMgr.config != nil {
+		ss.cache.gopDuration = ssMgr.config.GOPCacheDuration
+		ss.cache.keyFrameOnly = ssMgr.config.KeyFrameOnlyCache
+		if n := ssMgr.config.DispatchShards; n > 1 {
+			ss.startShards(n)
+		}
+		if ssMgr.config.DASH {
+			ss.startDASH(ssMgr.config)
+		}
+		if ssMgr.config.ThumbnailDecoder != nil {
+			ss.startThumbnail(ssMgr.config)
+		}
+	}
 
 	return ss
 }
 
+// doPublishing runs the publishing cycle of the attached publisher, Serve calls it right after
+// attachPublisher and detaches with delPublisher only once it returns
 func (ss *streamSource) doPublishing() error {
-	err := ss.publisher.publishingCycle(ss)
+	pub := ss.getPublisher()
+	if pub == nil { // detached or never attached
+		return errNoPublisher
+	}
+
+	err := pub.publishingCycle(ss)
 	return err
 }
 
@@ -44,37 +107,167 @@ func (ss *streamSource) doPlaying(sub *subscriber) error {
 	return err
 }
 
-func (ss *streamSource) setPublisher(pub *publisher) *streamSource {
+// trySetPublisher attaches pub if nobody is publishing, cancelling the pending deletion of grace period
+func (ss *streamSource) trySetPublisher(pub *publisher) error {
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+
+	if ss.deleted {
+		return errStreamSourceDeleted
+	}
+	if ss.publisher != nil {
+		return errStreamBusy
+	}
+
+	if ss.delTimer != nil { // publisher reattach within grace period
+		ss.delTimer.Stop()
+		ss.delTimer = nil
+	}
+	ss.delGen++
+
+	ss.setPublisherLocked(pub)
+	ss.resetStreamInfo(pub)
+	return nil
+}
+
+// must hold pubMux, counts the publisher in streamSourceMgr.ConnectionCount while attached
+func (ss *streamSource) setPublisherLocked(pub *publisher) {
+	if ss.publisher == nil && pub != nil {
+		ss.ssMgr.addConnections(1)
+	} else if ss.publisher != nil && pub == nil {
+		ss.ssMgr.addConnections(-1)
+	}
 	ss.publisher = pub
-	return ss
+}
+
+// reanchorSubscribers has the subscribers continue their timeline over a publisher attaching again
+func (ss *streamSource) reanchorSubscribers() {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	for _, sub := range ss.subList {
+		atomic.StoreInt32(&sub.republished, 1)
+	}
+}
+
+func (ss *streamSource) getPublisher() *publisher {
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+
+	return ss.publisher
 }
 
 func (ss *streamSource) delPublisher() {
-	ss.publisher = nil
-
-	time.AfterFunc(time.Minute, func() {
-		val, ok := ss.ssMgr.streamMap.Load(ss.streamKey)
-		if ok {
-			ssCache := val.(*streamSource)
-			if ssCache.publisher == nil {
-				ss.ssMgr.streamMap.Delete(ss.streamKey)
-				ss.stopPublish <- true
-			}
-		}
+	defer ss.notifyPlayers(unpublishNotify) // once pubMux is released
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+
+	ss.setPublisherLocked(nil)
+	if ss.deleted { // closed, nothing to wait for
+		return
+	}
+	if ss.delTimer != nil {
+		ss.delTimer.Stop()
+	}
+
+	ss.delGen++
+	gen := ss.delGen
+	ss.delTimer = time.AfterFunc(ss.ssMgr.publishReconnectGrace(), func() {
+		ss.onReconnectGraceExpired(gen)
 	})
 }
 
-func (ss *streamSource) addSubscriber(sub *subscriber) bool {
+// onReconnectGraceExpired deletes the stream source unless a publisher reattached. A timer which
+// already fired can't be stopped, so the check and the deletion are done under pubMux, a racing
+// trySetPublisher either wins before it or sees deleted and creates a new stream source.
+func (ss *streamSource) onReconnectGraceExpired(gen uint64) {
+	ss.pubMux.Lock()
+	defer ss.pubMux.Unlock()
+
+	if ss.delGen != gen || ss.publisher != nil || ss.deleted { // reattached, rescheduled or closed
+		return
+	}
+
+	ss.delTimer = nil
+	ss.deleteLocked()
+}
+
+// must hold pubMux, marks deleted and removes ss from streamSourceMgr unless replaced already
+func (ss *streamSource) deleteLocked() {
+	ss.deleted = true
+	close(ss.done)
+	if val, ok := ss.ssMgr.streamMap.Load(ss.streamKey); ok && val.(*streamSource) == ss {
+		ss.ssMgr.streamMap.Delete(ss.streamKey)
+	}
+
+	select {
+	case ss.stopPublish <- true:
+	default:
+	}
+}
+
+/*
+ * Close destroys the stream at once rather than after the reconnect grace period, e.g. an admin kick:
+ *   1. ss is deleted from streamSourceMgr, a new publish of the key creates a new stream source.
+ *   2. the publisher and player connections are closed, their cycles fail and detach as usual,
+ *      internal consumers stop on done.
+ *   3. the cache is cleared, a player still joining gets nothing stale.
+ * Calling it again, or after the grace period deleted ss, does nothing.
+ */
+func (ss *streamSource) Close() {
+	ss.pubMux.Lock()
+	if ss.deleted {
+		ss.pubMux.Unlock()
+		return
+	}
+	if ss.delTimer != nil {
+		ss.delTimer.Stop()
+		ss.delTimer = nil
+	}
+	ss.delGen++
+	pub := ss.publisher
+	ss.deleteLocked()
+	ss.pubMux.Unlock()
+
 	ss.addSubMux.Lock()
-	defer ss.addSubMux.Unlock()
+	subs := append([]*subscriber(nil), ss.subList...)
+	ss.cache.reset()
+	ss.addSubMux.Unlock()
+
+	logger := ss.ssMgr.logger().WithFields(logrus.Fields{"event": "close stream source", "streamKey": ss.streamKey})
+	if pub != nil && pub.rtmpConn != nil {
+		if err := pub.rtmpConn.Close(); err != nil {
+			logger.Error(err)
+		}
+	}
+	for _, sub := range subs { // unlocked, a close may wait for a writer
+		if sub.closeConn == nil {
+			continue
+		}
+		if err := sub.closeConn(); err != nil {
+			logger.WithField("subscriber", sub.id).Error(err)
+		}
+	}
+	logger.Infof("closed with %d subscribers", len(subs))
+}
 
-	if _, ok := ss.subscribers[sub.rtmpConn.RemoteAddr().String()]; ok { //exists
+func (ss *streamSource) addSubscriber(sub *subscriber) bool {
+	ss.addSubMux.Lock()
+	if _, ok := ss.subscribers[sub.id]; ok { //exists
+		ss.addSubMux.Unlock()
 		return false
 	}
 
-	ss.subscribers[sub.rtmpConn.RemoteAddr().String()] = sub
+	ss.putSubscriberLocked(sub)
 	ss.subscriberCount++
+	ss.addShardLocked(sub)
+	ss.resumeLocked(sub)
+	requestKeyFrame := ss.keyFrameRequestDueLocked()
+	ss.addSubMux.Unlock()
 
+	if requestKeyFrame {
+		ss.requestKeyFrame()
+	}
 	return true
 }
 
@@ -82,11 +275,70 @@ func (ss *streamSource) delSubscriber(sub *subscriber) bool {
 	ss.addSubMux.Lock()
 	defer ss.addSubMux.Unlock()
 
-	delete(ss.subscribers, sub.rtmpConn.RemoteAddr().String())
+	ss.keepResumeLocked(sub)
+	ss.removeSubscriberLocked(sub.id)
+	ss.delShardLocked(sub)
 	return true
 }
 
+// delPlayer deletes sub once its playing cycle returned, the packets left in its queue are released and
+// no longer count against the memory of its conn, which may go on publishing or playing other streams
+func (ss *streamSource) delPlayer(sub *subscriber) {
+	ss.drainWhile(sub, func() { ss.delSubscriber(sub) }, func(pkt *av.Packet) {
+		sub.dequeueMemory(pkt)
+		pkt.Release()
+	})
+}
+
+// must hold addSubMux, the map and subList change together
+func (ss *streamSource) putSubscriberLocked(sub *subscriber) {
+	ss.subscribers[sub.id] = sub
+	ss.subList = append(ss.subList, sub)
+	if !sub.isPlayer() {
+		return
+	}
+
+	ss.players++
+	ss.ssMgr.addConnections(1)
+	ss.idleSince = time.Time{}
+	select {
+	case ss.subJoined <- struct{}{}:
+	default:
+	}
+}
+
+// must hold addSubMux, subList keeps the join order of the rest
+func (ss *streamSource) removeSubscriberLocked(id string) {
+	removed, ok := ss.subscribers[id]
+	if !ok {
+		return
+	}
+
+	delete(ss.subscribers, id)
+	for i, sub := range ss.subList {
+		if sub.id == id {
+			copy(ss.subList[i:], ss.subList[i+1:])
+			ss.subList[len(ss.subList)-1] = nil // no reference kept to the deleted one
+			ss.subList = ss.subList[:len(ss.subList)-1]
+			break
+		}
+	}
+	if !removed.isPlayer() {
+		return
+	}
+
+	ss.players--
+	ss.ssMgr.addConnections(-1)
+	if ss.players == 0 {
+		ss.idleSince = timeNow()
+	}
+}
+
+// cacheAVMetaPacket after dispatching pkt, a subscriber joining now gets pkt from the cache only
 func (ss *streamSource) cacheAVMetaPacket(pkt *av.Packet) {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
 	ss.cache.Write(pkt)
 }
 
@@ -94,22 +346,261 @@ func (ss *streamSource) dispatchAVPacket(cs *ChunkStream, pkt *av.Packet) {
 	ss.addSubMux.Lock()
 	defer ss.addSubMux.Unlock() //TODO: lock big
 
-	for _, sub := range ss.subscribers {
-		if sub.stopped {
-			continue
+	if pkt.IsAudio || pkt.IsVideo {
+		ss.lastTimeStamp = pkt.TimeStamp
+	}
+
+	ss.dispatchLocked(pkt)
+
+	if pkt.IsMetaData {
+		ss.lastMetaRefresh = timeNow()
+	} else {
+		ss.refreshMetaDataLocked()
+	}
+}
+
+// refreshMetaDataLocked resends the cached onMetaData every Config.MetaDataRefreshInterval, some players
+// re-read resolution from it in long sessions. Driven by media, nothing is sent while the stream is idle.
+func (ss *streamSource) refreshMetaDataLocked() {
+	if ss.ssMgr == nil || ss.ssMgr.config == nil || ss.ssMgr.config.MetaDataRefreshInterval <= 0 {
+		return
+	}
+	meta := ss.cache.metaData
+	if !meta.full || meta.pkt == nil {
+		return
+	}
+
+	now := timeNow()
+	if now.Sub(ss.lastMetaRefresh) < ss.ssMgr.config.MetaDataRefreshInterval {
+		return
+	}
+	ss.lastMetaRefresh = now
+
+	pkt := meta.pkt.Copy()
+	pkt.TimeStamp = ss.lastTimeStamp
+	ss.dispatchLocked(pkt)
+}
+
+// InjectMetadata dispatch an AMF data packet(onMetaData, onCuePoint, scte35 marker...) to all subscribers,
+// stamped with the timestamp of the last dispatched media packet. It shares the lock with the publishing
+// cycle, so the packet is ordered right after the media already dispatched.
+func (ss *streamSource) InjectMetadata(pkt *av.Packet) {
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+
+	pkt.IsMetaData = true
+	pkt.IsAudio = false
+	pkt.IsVideo = false
+	pkt.TimeStamp = ss.lastTimeStamp
+
+	ss.dispatchLocked(pkt)
+}
+
+// must hold addSubMux
+func (ss *streamSource) dispatchLocked(pkt *av.Packet) {
+	if len(ss.shards) > 0 {
+		ss.dispatchShardsLocked(pkt)
+	} else {
+		for _, sub := range ss.subList {
+			if sub.isStopped() {
+				continue
+			}
+
+			sub.sendCachePacket(ss.cache)
+			sub.writeAVPacket(pkt) // write channel actually
 		}
+	}
 
-		sub.sendCachePacket(ss.cache)
-		sub.writeAVPacket(pkt) // write channel actually
+	for _, mon := range ss.monitors {
+		mon.sendCachePacket(ss.cache)
+		mon.writeAVPacket(pkt)
+	}
+}
+
+/*
+ * AddMonitor registers fn as an internal consumer, e.g. thumbnailing, which sees every packet
+ * dispatched from now on, starting with the cached metadata and sequence headers. It blocks the
+ * publisher rather than dropping, so fn must keep up. Monitors live outside the subscriber map:
+ * they don't count as subscribers or connections. fn runs on its own goroutine until cancel or
+ * the stream source is deleted; cancel must not be called from fn.
+ */
+func (ss *streamSource) AddMonitor(fn func(*av.Packet)) (cancel func()) {
+	mon := newPseudoSubscriber(subTypeMonitor, genUuid(), ss.ssMgr.logger(), 1024)
+
+	ss.addSubMux.Lock()
+	ss.monitors[mon.id] = mon
+	ss.addSubMux.Unlock()
+
+	removed := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-removed:
+				return
+			case <-ss.done:
+				mon.stop()
+				ss.drainWhile(mon, func() {
+					ss.addSubMux.Lock()
+					delete(ss.monitors, mon.id)
+					ss.addSubMux.Unlock()
+				}, (*av.Packet).Release)
+				return
+			case pkt := <-mon.avPktQueue:
+				if !mon.isStopped() {
+					fn(pkt)
+				}
+				pkt.Release()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mon.stop() // keep draining without fn, dispatch may be blocked on the queue holding addSubMux
+			ss.addSubMux.Lock()
+			delete(ss.monitors, mon.id)
+			ss.addSubMux.Unlock()
+			close(removed)
+			<-exited
+		})
 	}
 }
 
 type streamSourceMgr struct {
-	streamMap sync.Map //<StreamKey, StreamSource>
+	streamMap   sync.Map //<StreamKey, StreamSource>
+	config      *Config
+	connections int64 // atomic, publishers attached and players subscribed, see ConnectionCount
+
+	banMux sync.Mutex
+	bans   map[string]bool // stream keys not allowed to publish
 }
 
-func newStreamSourceMgr() *streamSourceMgr {
-	mgr := &streamSourceMgr{}
+func newStreamSourceMgr(config *Config) *streamSourceMgr {
+	mgr := &streamSourceMgr{
+		config: config,
+		bans:   make(map[string]bool),
+	}
 
 	return mgr
 }
+
+// attachPublisher attaches pub to the stream source of its stream key, creates one if not exists
+func (mgr *streamSourceMgr) attachPublisher(pub *publisher) (*streamSource, error) {
+	if mgr.IsBanned(pub.streamKey) {
+		return nil, errStreamBanned
+	}
+
+	for {
+		if val, ok := mgr.streamMap.Load(pub.streamKey); ok {
+			ss := val.(*streamSource)
+			err := ss.trySetPublisher(pub)
+			if err == errStreamSourceDeleted { // lost the race with grace expiry, look up again
+				continue
+			}
+			if err == nil {
+				ss.reanchorSubscribers()
+				ss.notifyPlayers(publishNotify)
+			}
+			return ss, err
+		}
+
+		ss := newStreamSource(pub, pub.streamKey, mgr)
+		if _, loaded := mgr.streamMap.LoadOrStore(pub.streamKey, ss); !loaded {
+			return ss, nil
+		}
+
+		// another publisher stored the key first, stop the workers ss already started
+		ss.pubMux.Lock()
+		ss.setPublisherLocked(nil)
+		ss.deleteLocked()
+		ss.pubMux.Unlock()
+	}
+}
+
+func (mgr *streamSourceMgr) genSessionID() string {
+	if mgr != nil && mgr.config != nil && mgr.config.SessionIDFunc != nil {
+		return mgr.config.SessionIDFunc()
+	}
+	return genUuid()
+}
+
+func (mgr *streamSourceMgr) logger() *logrus.Logger {
+	if mgr != nil && mgr.config != nil && mgr.config.Logger != nil {
+		return mgr.config.Logger
+	}
+	return logrus.StandardLogger()
+}
+
+func (mgr *streamSourceMgr) trackDetectTimeout() time.Duration {
+	if mgr != nil && mgr.config != nil && mgr.config.TrackDetectTimeout > 0 {
+		return mgr.config.TrackDetectTimeout
+	}
+	return defaultTrackDetectTimeout
+}
+
+func (mgr *streamSourceMgr) publishReconnectGrace() time.Duration {
+	if mgr.config != nil && mgr.config.PublishReconnectGrace > 0 {
+		return mgr.config.PublishReconnectGrace
+	}
+	return defaultPublishReconnectGrace
+}
+
+// ConnectionCount counts publishers and players, pseudo subscribers of record or packaging are not
+// connections. It's kept as they come and go, connect and play check it without walking the streams.
+func (mgr *streamSourceMgr) ConnectionCount() int {
+	return int(atomic.LoadInt64(&mgr.connections))
+}
+
+func (mgr *streamSourceMgr) addConnections(n int64) {
+	if mgr != nil {
+		atomic.AddInt64(&mgr.connections, n)
+	}
+}
+
+// IsLive reports whether the stream exists and is publishing, false during the reconnect grace period
+func (mgr *streamSourceMgr) IsLive(streamKey string) bool {
+	val, ok := mgr.streamMap.Load(streamKey)
+	if !ok {
+		return false
+	}
+
+	return val.(*streamSource).getPublisher() != nil
+}
+
+// Ban disconnects the publisher of streamKey and rejects publishing it until Unban, players are left
+// to the reconnect grace period
+func (mgr *streamSourceMgr) Ban(streamKey string) {
+	mgr.banMux.Lock()
+	mgr.bans[streamKey] = true
+	mgr.banMux.Unlock()
+
+	if val, ok := mgr.streamMap.Load(streamKey); ok {
+		if pub := val.(*streamSource).getPublisher(); pub != nil && pub.rtmpConn != nil {
+			_ = pub.rtmpConn.Close()
+		}
+	}
+}
+
+func (mgr *streamSourceMgr) Unban(streamKey string) {
+	mgr.banMux.Lock()
+	defer mgr.banMux.Unlock()
+
+	delete(mgr.bans, streamKey)
+}
+
+func (mgr *streamSourceMgr) IsBanned(streamKey string) bool {
+	mgr.banMux.Lock()
+	defer mgr.banMux.Unlock()
+
+	return mgr.bans[streamKey]
+}
+
+func (mgr *streamSourceMgr) hasBans() bool {
+	mgr.banMux.Lock()
+	defer mgr.banMux.Unlock()
+
+	return len(mgr.bans) > 0
+}
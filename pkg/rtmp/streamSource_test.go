@@ -0,0 +1,692 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/dash"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestInjectMetadata(t *testing.T) {
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(newTestConfig()))
+	sub1 := newTestSubscriber(t, ss, "127.0.0.1:10001")
+	sub2 := newTestSubscriber(t, ss, "127.0.0.1:10002")
+
+	ss.dispatchAVPacket(nil, &av.Packet{IsVideo: true, TimeStamp: 40})
+	ss.dispatchAVPacket(nil, &av.Packet{IsAudio: true, TimeStamp: 46})
+	ss.InjectMetadata(&av.Packet{Data: []byte("cue")})
+	ss.dispatchAVPacket(nil, &av.Packet{IsVideo: true, TimeStamp: 80})
+
+	for _, sub := range []*subscriber{sub1, sub2} {
+		if len(sub.avPktQueue) != 4 {
+			t.Fatalf("got %d queued packets; want 4", len(sub.avPktQueue))
+		}
+
+		<-sub.avPktQueue
+		<-sub.avPktQueue
+
+		cue := <-sub.avPktQueue
+		if !cue.IsMetaData || string(cue.Data) != "cue" {
+			t.Fatalf("got %+v at position 3; want injected cue", cue)
+		}
+		if cue.TimeStamp != 46 {
+			t.Fatalf("got cue timestamp %d; want 46", cue.TimeStamp)
+		}
+
+		if pkt := <-sub.avPktQueue; !pkt.IsVideo || pkt.TimeStamp != 80 {
+			t.Fatalf("got %+v after cue; want video at 80", pkt)
+		}
+	}
+}
+
+func TestStalledSubscriberNotBlockPublisher(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	pubConn, pubPeer := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	ss := newStreamSource(newPublisher(pubConn, "_defaultVhost_/live/test"), "_defaultVhost_/live/test", ssMgr)
+	go func() { _ = ss.doPublishing() }()
+
+	// stalled: playing cycle blocks on socket write since nobody reads its peer
+	stalledConn, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10002")
+	stalled := newSubscriber(stalledConn, 1024)
+	ss.addSubscriber(stalled)
+	go func() { _ = ss.doPlaying(stalled) }()
+
+	const total = 5000
+	var msgs []byte
+	for i := 0; i < total; i++ {
+		data := testVideoInter
+		if i%50 == 0 {
+			data = testVideoKey
+		}
+		msgs = append(msgs, encodeTestMessage(6, uint32(i*40), MsgVideoMessage, 1, data, 128)...)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = pubPeer.Write(msgs) // returns only after publisher read everything
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher read loop blocked by stalled subscriber")
+	}
+
+	if n := len(stalled.avPktQueue); n > stalled.avPktQueueSize {
+		t.Fatalf("got stalled queue len %d; want <= %d", n, stalled.avPktQueueSize)
+	}
+}
+
+func TestStreamSourceMgrIsLive(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	streamKey := "_defaultVhost_/live/test"
+	if ssMgr.IsLive(streamKey) {
+		t.Fatal("stream not exists should not be live")
+	}
+
+	c, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	ss := newStreamSource(newPublisher(c, streamKey), streamKey, ssMgr)
+	ssMgr.streamMap.Store(streamKey, ss)
+	if !ssMgr.IsLive(streamKey) {
+		t.Fatal("publishing stream should be live")
+	}
+
+	ss.delPublisher() // stream source lingers in grace period
+	if _, ok := ssMgr.streamMap.Load(streamKey); !ok {
+		t.Fatal("stream source should linger during grace period")
+	}
+	if ssMgr.IsLive(streamKey) {
+		t.Fatal("stream in grace period should not be live")
+	}
+
+	if err := ss.trySetPublisher(newPublisher(c, streamKey)); err != nil { // publisher reconnect
+		t.Fatal(err)
+	}
+	if !ssMgr.IsLive(streamKey) {
+		t.Fatal("republished stream should be live")
+	}
+}
+
+func TestPublishReconnectGrace(t *testing.T) {
+	config := newTestConfig()
+	config.PublishReconnectGrace = 50 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+	streamKey := "_defaultVhost_/live/test"
+
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	ss := newStreamSource(newPublisher(c, streamKey), streamKey, ssMgr)
+	ssMgr.streamMap.Store(streamKey, ss)
+
+	// reattach within grace cancels deletion
+	ss.delPublisher()
+	time.Sleep(20 * time.Millisecond)
+	if err := ss.trySetPublisher(newPublisher(c, streamKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.trySetPublisher(newPublisher(c, streamKey)); err != errStreamBusy {
+		t.Fatalf("got err %v; want %v", err, errStreamBusy)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := ssMgr.streamMap.Load(streamKey); !ok {
+		t.Fatal("reattached stream source should not be deleted")
+	}
+
+	// expiry deletes
+	ss.delPublisher()
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := ssMgr.streamMap.Load(streamKey); ok {
+		t.Fatal("stream source should be deleted after grace period")
+	}
+}
+
+func TestPlayDuringReconnectGrace(t *testing.T) {
+	var tests = []struct {
+		wait    bool // Config.PlayWaitsForReconnect
+		wantErr error
+		code    string
+	}{
+		{false, errStreamReconnecting, "NetStream.Play.StreamNotFound"},
+		{true, nil, "NetStream.Play.Reset"},
+	}
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.PublishReconnectGrace = time.Minute
+		config.PlayWaitsForReconnect = tt.wait
+		ssMgr := newStreamSourceMgr(config)
+		pubConn, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		ss, err := ssMgr.attachPublisher(newPublisher(pubConn, "_defaultVhost_/live/test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.delPublisher() // stream source lingers in grace period
+
+		c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10002")
+		c.appName, c.tcUrl = "live", "rtmp://127.0.0.1/live"
+		cmdResp := make(chan []interface{}, 1)
+		go func() {
+			cmdResp <- readTestCommand(t, newTestPeer(peer))
+			_, _ = io.Copy(ioutil.Discard, peer)
+		}()
+
+		err = c.decodeCommandMessage(newTestCommandMessage(t, "play", 4.0, nil, "test"))
+		if errors.Cause(err) != tt.wantErr {
+			t.Fatalf("wait %v: got err %v; want %v", tt.wait, err, tt.wantErr)
+		}
+		if code := statusCode(<-cmdResp); code != tt.code {
+			t.Fatalf("wait %v: got status '%s'; want %s", tt.wait, code, tt.code)
+		}
+	}
+}
+
+// run with -race, reattach right at the grace boundary must never lose the reattached publisher
+func TestPublishReattachAtGraceBoundary(t *testing.T) {
+	config := newTestConfig()
+	config.PublishReconnectGrace = 5 * time.Millisecond
+	ssMgr := newStreamSourceMgr(config)
+	streamKey := "_defaultVhost_/live/test"
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+
+	ss, err := ssMgr.attachPublisher(newPublisher(c, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		ss.delPublisher()
+		time.Sleep(config.PublishReconnectGrace - time.Millisecond + time.Duration(i%3)*time.Millisecond)
+
+		pub := newPublisher(c, streamKey)
+		if ss, err = ssMgr.attachPublisher(pub); err != nil {
+			t.Fatalf("round %d: %v", i, err)
+		}
+
+		time.Sleep(2 * config.PublishReconnectGrace)
+		val, ok := ssMgr.streamMap.Load(streamKey)
+		if !ok || val.(*streamSource) != ss {
+			t.Fatalf("round %d: reattached stream source deleted", i)
+		}
+		if ss.getPublisher() != pub {
+			t.Fatalf("round %d: reattached publisher lost", i)
+		}
+	}
+}
+
+func TestSessionIDFunc(t *testing.T) {
+	config := newTestConfig()
+	n := 0
+	config.SessionIDFunc = func() string {
+		n++
+		return fmt.Sprintf("session-%d", n)
+	}
+	ssMgr := newStreamSourceMgr(config)
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+
+	for i, key := range []string{"_defaultVhost_/live/a", "_defaultVhost_/live/b"} {
+		ss, err := ssMgr.attachPublisher(newPublisher(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("session-%d", i+1); ss.sessionID != want || ss.StreamInfo().SessionID != want {
+			t.Fatalf("got session id %s; want %s", ss.sessionID, want)
+		}
+	}
+
+	// default generator
+	ss := newStreamSource(nil, "_defaultVhost_/live/c", newStreamSourceMgr(newTestConfig()))
+	if _, err := uuid.FromString(ss.sessionID); err != nil {
+		t.Fatalf("got session id %s; want uuid: %v", ss.sessionID, err)
+	}
+}
+
+func TestAddMonitor(t *testing.T) {
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(newTestConfig()))
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10001")
+	count := ss.subscriberCount
+
+	got := make(chan *av.Packet, 16)
+	cancel := ss.AddMonitor(func(pkt *av.Packet) { got <- pkt }) // slow: blocks once got is full
+	if ss.subscriberCount != count || len(ss.subscribers) != 1 {
+		t.Fatalf("got %d subscribers, count %d; want monitor not counted", len(ss.subscribers), ss.subscriberCount)
+	}
+
+	const total = 2000 // beyond the monitor queue, never dropped
+	go func() {
+		for i := 0; i < total; i++ {
+			ss.dispatchAVPacket(nil, &av.Packet{IsVideo: true, TimeStamp: uint32(i * 40)})
+			<-sub.avPktQueue
+		}
+	}()
+	for i := 0; i < total; i++ {
+		select {
+		case pkt := <-got:
+			if pkt.TimeStamp != uint32(i*40) {
+				t.Fatalf("got timestamp %d at %d; want %d", pkt.TimeStamp, i, i*40)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("monitor got %d packets; want %d", i, total)
+		}
+	}
+
+	cancel()
+	cancel() // idempotent
+	ss.dispatchAVPacket(nil, &av.Packet{IsVideo: true, TimeStamp: total * 40})
+	select {
+	case pkt := <-got:
+		t.Fatalf("got %+v after cancel; want none", pkt)
+	default:
+	}
+	if len(ss.monitors) != 0 {
+		t.Fatalf("got %d monitors after cancel; want 0", len(ss.monitors))
+	}
+}
+
+func TestStreamInfoClientIdentity(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	c, peer := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	drainPeer(peer)
+
+	connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{
+		"app": "live", "flashVer": "FMLE/3.0 (compatible; FMSc/1.0)", "tcUrl": "rtmp://127.0.0.1/live",
+	})
+	if err := c.decodeCommandMessage(connect); err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := ss.StreamInfo()
+	if info.FlashVer != "FMLE/3.0 (compatible; FMSc/1.0)" || info.TcUrl != "rtmp://127.0.0.1/live" {
+		t.Fatalf("got flashVer '%s' tcUrl '%s'; want the connect command's", info.FlashVer, info.TcUrl)
+	}
+
+	// another client reconnects within grace period
+	ss.delPublisher()
+	c2, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10002")
+	c2.flashVer = "LNX 9,0,124,2"
+	if err := ss.trySetPublisher(newPublisher(c2, "_defaultVhost_/live/test")); err != nil {
+		t.Fatal(err)
+	}
+	if info := ss.StreamInfo(); info.FlashVer != "LNX 9,0,124,2" || info.TcUrl != "" {
+		t.Fatalf("got flashVer '%s' tcUrl '%s'; want the new publisher's", info.FlashVer, info.TcUrl)
+	}
+}
+
+func TestBanStream(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	streamKey := "example.com/live/test"
+
+	pubConn, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	ss, err := ssMgr.attachPublisher(newPublisher(pubConn, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := make(chan error, 1)
+	go func() { published <- ss.doPublishing() }()
+
+	ssMgr.Ban(streamKey)
+	select {
+	case <-published:
+		ss.delPublisher()
+	case <-time.After(time.Second):
+		t.Fatal("banned publisher not disconnected")
+	}
+
+	// publish attempts of the banned key are rejected, connect and the command phase before publish go on
+	publish := func(remote string) ([]interface{}, error) {
+		c, peer := newTestConn(t, ssMgr, newTestConfig(), remote)
+		pc := newTestPeer(peer)
+		cmdResp := make(chan []interface{}, 1)
+		go func() {
+			readTestCommand(t, pc) // connect _result
+			cmdResp <- readTestCommand(t, pc)
+		}()
+
+		connect := newTestCommandMessage(t, "connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"})
+		if err := c.decodeCommandMessage(connect); err != nil {
+			t.Fatal(err)
+		}
+		err := c.decodeCommandMessage(newTestCommandMessage(t, "publish", 5.0, nil, "test", "live"))
+		return <-cmdResp, err
+	}
+
+	vs, err := publish("127.0.0.1:10002")
+	if err != errStreamBanned || statusCode(vs) != "NetStream.Publish.BadName" {
+		t.Fatalf("got err %v status '%s'; want %v NetStream.Publish.BadName", err, statusCode(vs), errStreamBanned)
+	}
+	if _, err := ssMgr.attachPublisher(newPublisher(pubConn, streamKey)); err != errStreamBanned {
+		t.Fatalf("got attach err %v; want %v", err, errStreamBanned)
+	}
+
+	ssMgr.Unban(streamKey)
+	vs, err = publish("127.0.0.1:10003")
+	if err != nil || statusCode(vs) != "NetStream.Publish.Start" {
+		t.Fatalf("got err %v status '%s'; want NetStream.Publish.Start after unban", err, statusCode(vs))
+	}
+	if _, err := ssMgr.attachPublisher(newPublisher(pubConn, streamKey)); err != nil {
+		t.Fatalf("got attach err %v after unban; want nil", err)
+	}
+}
+
+func TestMetaDataRefresh(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(1600000000, 0)
+	timeNow = func() time.Time { return now }
+
+	config := newTestConfig()
+	config.MetaDataRefreshInterval = time.Second
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(config))
+	sub := newTestSubscriber(t, ss, "127.0.0.1:10001")
+
+	publish := func(pkt *av.Packet) {
+		ss.dispatchAVPacket(nil, pkt)
+		ss.cacheAVMetaPacket(pkt)
+	}
+	publish(&av.Packet{IsMetaData: true, Data: []byte("onMetaData")})
+	for i := 0; i < 75; i++ { // 3s of 25fps video
+		publish(newTestAVPacket(t, true, testVideoInter, uint32(i*40)))
+		now = now.Add(40 * time.Millisecond)
+	}
+
+	var refreshes []uint32
+	for len(sub.avPktQueue) > 0 {
+		if pkt := <-sub.avPktQueue; pkt.IsMetaData {
+			refreshes = append(refreshes, pkt.TimeStamp)
+		}
+	}
+	// sent by publisher, then refreshed stamped with the last media timestamp
+	if want := []uint32{0, 1000, 2000}; fmt.Sprint(refreshes) != fmt.Sprint(want) {
+		t.Fatalf("got onMetaData at %v; want %v", refreshes, want)
+	}
+}
+
+func TestDoPublishingWithoutPublisher(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+	if err := ss.doPublishing(); err != errNoPublisher {
+		t.Fatalf("got err %v before attach; want %v", err, errNoPublisher)
+	}
+
+	c, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	if err := ss.trySetPublisher(newPublisher(c, "_defaultVhost_/live/test")); err != nil {
+		t.Fatal(err)
+	}
+	ss.delPublisher()
+	if err := ss.doPublishing(); err != errNoPublisher {
+		t.Fatalf("got err %v after delPublisher; want %v", err, errNoPublisher)
+	}
+}
+
+func TestDispatchShards(t *testing.T) {
+	config := newTestConfig()
+	config.DispatchShards = 4
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(config))
+	defer close(ss.done)
+
+	var subs []*subscriber
+	for i := 0; i < 40; i++ {
+		sub := newPseudoSubscriber(subTypeRecord, fmt.Sprintf("record-%d", i), config.Logger, 256)
+		if !ss.addSubscriber(sub) {
+			t.Fatal("add subscriber failed")
+		}
+		subs = append(subs, sub)
+	}
+	for i, sh := range ss.shards {
+		if len(sh.subs) != 10 {
+			t.Fatalf("shard %d got %d subscribers; want 10", i, len(sh.subs))
+		}
+	}
+
+	ss.delSubscriber(subs[39])
+	n := 0
+	for _, sh := range ss.shards {
+		n += len(sh.subs)
+	}
+	if n != 39 || subs[39].shard != nil {
+		t.Fatalf("got %d subscribers on shards after delete; want 39", n)
+	}
+	subs = subs[:39]
+
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 0))
+	for ts := uint32(40); ts < 4000; ts += 40 {
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, ts))
+	}
+
+	for _, sub := range subs {
+		if n := len(sub.avPktQueue); n != 100 {
+			t.Fatalf("%s got %d packets; want 100", sub.id, n)
+		}
+		for want := uint32(0); want < 4000; want += 40 {
+			if pkt := <-sub.avPktQueue; pkt.TimeStamp != want {
+				t.Fatalf("%s got ts %d; want %d in dispatch order", sub.id, pkt.TimeStamp, want)
+			}
+		}
+	}
+}
+
+func BenchmarkDispatchShards(b *testing.B) {
+	for _, shards := range []int{1, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			config := newTestConfig()
+			config.DispatchShards = shards
+			ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(config))
+			defer close(ss.done)
+
+			stop := make(chan struct{})
+			defer close(stop)
+			for i := 0; i < 1000; i++ {
+				sub := newPseudoSubscriber(subTypeWSPlay, fmt.Sprintf("player-%d", i), config.Logger, 1024)
+				sub.policy = dropPolicyDrop
+				ss.addSubscriber(sub)
+				go func() {
+					for {
+						select {
+						case pkt := <-sub.avPktQueue:
+							pkt.Release()
+						case <-stop:
+							return
+						}
+					}
+				}()
+			}
+
+			pkt := &av.Packet{IsVideo: true, Data: testVideoInter}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pkt.TimeStamp = uint32(i)
+				ss.dispatchAVPacket(nil, pkt)
+			}
+		})
+	}
+}
+
+func TestSubscriberListFollowsMap(t *testing.T) {
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(newTestConfig()))
+	var subs []*subscriber
+	for i := 0; i < 5; i++ {
+		subs = append(subs, newTestSubscriber(t, ss, fmt.Sprintf("127.0.0.1:%d", 10001+i)))
+	}
+
+	check := func(want ...*subscriber) {
+		t.Helper()
+		if len(ss.subList) != len(want) || len(ss.subscribers) != len(want) {
+			t.Fatalf("got %d in list %d in map; want %d", len(ss.subList), len(ss.subscribers), len(want))
+		}
+		for i, sub := range want {
+			if ss.subList[i] != sub || ss.subscribers[sub.id] != sub {
+				t.Fatalf("position %d: got %s; want %s in join order and in map", i, ss.subList[i].id, sub.id)
+			}
+		}
+	}
+	check(subs...)
+
+	if ss.addSubscriber(newSubscriber(subs[1].rtmpConn, 1024)) {
+		t.Fatal("added a duplicate id")
+	}
+	check(subs...)
+
+	ss.delSubscriber(subs[1])
+	ss.delSubscriber(subs[4])
+	check(subs[0], subs[2], subs[3])
+
+	ss.delSubscriber(subs[4]) // deleted already
+	check(subs[0], subs[2], subs[3])
+
+	ss.addSubscriber(subs[1]) // rejoins at the end
+	ss.delSubscriber(subs[0])
+	check(subs[2], subs[3], subs[1])
+
+	// dispatch follows the list
+	ss.dispatchAVPacket(nil, &av.Packet{IsVideo: true, TimeStamp: 40})
+	for _, sub := range ss.subList {
+		if len(sub.avPktQueue) != 1 {
+			t.Fatalf("%s: got %d queued packets; want 1", sub.id, len(sub.avPktQueue))
+		}
+	}
+}
+
+func TestStreamSourceClose(t *testing.T) {
+	ssMgr := newStreamSourceMgr(newTestConfig())
+	streamKey := "_defaultVhost_/live/test"
+
+	pubConn, _ := newTestConn(t, ssMgr, newTestConfig(), "127.0.0.1:10001")
+	ss, err := ssMgr.attachPublisher(newPublisher(pubConn, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan string, 3)
+	go func() {
+		_ = ss.doPublishing()
+		ss.delPublisher()
+		exited <- "publisher"
+	}()
+
+	for _, remote := range []string{"127.0.0.1:10002", "127.0.0.1:10003"} {
+		c, peer := newTestConn(t, ssMgr, newTestConfig(), remote)
+		drainPeer(peer)
+		sub := newSubscriber(c, 1024)
+		if !ss.addSubscriber(sub) {
+			t.Fatalf("add subscriber %s failed", remote)
+		}
+		go func() {
+			defer ss.delSubscriber(sub)
+			_ = ss.doPlaying(sub)
+			exited <- sub.id
+		}()
+	}
+
+	seq := newTestAVPacket(t, true, testVideoSeq, 0)
+	ss.dispatchAVPacket(nil, seq)
+	ss.cacheAVMetaPacket(seq)
+
+	ss.Close()
+	ss.Close() // idempotent
+	for i := 0; i < 3; i++ {
+		select {
+		case <-exited:
+		case <-time.After(time.Second):
+			t.Fatalf("%d of 3 goroutines exited after close", i)
+		}
+	}
+
+	if _, ok := ssMgr.streamMap.Load(streamKey); ok {
+		t.Fatal("stream source still in streamMap after close")
+	}
+	ss.addSubMux.Lock()
+	defer ss.addSubMux.Unlock()
+	if len(ss.subscribers) != 0 || len(ss.subList) != 0 || ss.cache.videoSeq.full {
+		t.Fatalf("got %d subscribers cached video sequence header %v; want none", len(ss.subscribers), ss.cache.videoSeq.full)
+	}
+	select {
+	case <-ss.done:
+	default:
+		t.Fatal("done not closed")
+	}
+}
+
+func TestStreamSourceCloseBlockedPseudoSubscriber(t *testing.T) {
+	var tests = []struct {
+		name  string
+		setup func(ss *streamSource) (queue chan *av.Packet, start func()) // start consumes after close
+	}{
+		{"monitor", func(ss *streamSource) (chan *av.Packet, func()) {
+			release := make(chan struct{})
+			ss.AddMonitor(func(*av.Packet) { <-release })
+			ss.addSubMux.Lock()
+			defer ss.addSubMux.Unlock()
+			for _, mon := range ss.monitors {
+				return mon.avPktQueue, func() { close(release) }
+			}
+			return nil, nil
+		}},
+		{"dash", func(ss *streamSource) (chan *av.Packet, func()) {
+			ss.dash = dash.NewPackager(dash.Config{})
+			sub := newPseudoSubscriber(subTypeDASH, subTypeDASH, ss.ssMgr.logger(), 1024)
+			ss.addSubscriber(sub)
+			return sub.avPktQueue, func() { go ss.dashPackagingCycle(sub) }
+		}},
+	}
+	for _, tt := range tests {
+		ssMgr := newStreamSourceMgr(newTestConfig())
+		ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+		ssMgr.streamMap.Store(ss.streamKey, ss)
+		queue, start := tt.setup(ss)
+
+		// the dispatch blocks on the full queue, dropPolicyBlock, holding addSubMux
+		pkts := make([]*av.Packet, cap(queue)+10)
+		for i := range pkts {
+			pkts[i] = newTestAVPacket(t, true, testVideoInter, uint32(i*40))
+		}
+		dispatched := make(chan struct{})
+		go func() {
+			defer close(dispatched)
+			for _, pkt := range pkts {
+				ss.dispatchAVPacket(nil, pkt)
+			}
+		}()
+		for i := 0; len(queue) != cap(queue); i++ {
+			if i == 100 {
+				t.Fatalf("%s: queue not filled", tt.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			ss.Close()
+			close(closed)
+		}()
+		<-ss.done
+		start()
+		for _, ch := range []chan struct{}{closed, dispatched} {
+			select {
+			case <-ch:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: close deadlocked against the dispatch blocked on the queue", tt.name)
+			}
+		}
+
+		for i := 0; ; i++ {
+			ss.addSubMux.Lock()
+			n := len(ss.subscribers) + len(ss.monitors)
+			ss.addSubMux.Unlock()
+			if n == 0 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("%s: pseudo subscriber not deleted after close", tt.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
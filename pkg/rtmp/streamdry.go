@@ -0,0 +1,84 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// newStreamEvent returns a user control message of a stream event, e.g. StreamBegin, with the stream id as data
+func newStreamEvent(eventType, streamID uint32) *ChunkStream {
+	cs := NewUserControlMessage(eventType, 4)
+	binary.BigEndian.PutUint32(cs.ChunkBody[2:], streamID)
+	return cs
+}
+
+/*
+ * dryDetector tracks media reaching a player within playingCycle:
+ *   1. no media for Config.StreamDryTimeout, e.g. the publisher stalls or reconnects, sends StreamDry once,
+ *      so the player knows the stream is quiet rather than the connection broken.
+ *   2. the next media packet is preceded by StreamBegin.
+ */
+type dryDetector struct {
+	timeout time.Duration // 0 disables
+	timer   *time.Timer
+	mediaAt time.Time
+	dry     bool
+}
+
+func newDryDetector(timeout time.Duration) *dryDetector {
+	d := &dryDetector{timeout: timeout, mediaAt: timeNow()}
+	if timeout > 0 {
+		d.timer = time.NewTimer(timeout)
+	}
+	return d
+}
+
+// C fires when the stream may have run dry, nil when disabled or already dry
+func (d *dryDetector) C() <-chan time.Time {
+	if d.timer == nil || d.dry {
+		return nil
+	}
+	return d.timer.C
+}
+
+func (d *dryDetector) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// expired is called once C fired, false rearms the timer for media that came meanwhile
+func (d *dryDetector) expired() bool {
+	if idle := timeNow().Sub(d.mediaAt); idle < d.timeout {
+		d.timer.Reset(d.timeout - idle)
+		return false
+	}
+	d.dry = true
+	return true
+}
+
+// media records a media packet, true if the stream was dry and StreamBegin is due
+func (d *dryDetector) media() bool {
+	d.mediaAt = timeNow()
+	if !d.dry {
+		return false
+	}
+	d.dry = false
+	d.timer.Reset(d.timeout)
+	return true
+}
+
+// eventStreamID is the message stream of the player, the one media goes out on
+func (s *subscriber) eventStreamID() uint32 {
+	if s.streamID != 0 {
+		return s.streamID
+	}
+	if id, ok := s.rtmpConn.streamIDOf(streamRolePlay); ok {
+		return id
+	}
+	return s.chunkMsgToSend.MsgStreamID
+}
+
+func (s *subscriber) writeStreamEvent(eventType uint32) error {
+	return s.rtmpConn.writeChunkStream(newStreamEvent(eventType, s.eventStreamID()))
+}
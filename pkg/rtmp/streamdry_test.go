@@ -0,0 +1,90 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPlayStreamDry(t *testing.T) {
+	config := newTestConfig()
+	config.StreamDryTimeout = 50 * time.Millisecond
+	c, peer := newTestConn(t, newStreamSourceMgr(config), config, "127.0.0.1:10001")
+
+	msgs := make(chan *ChunkStream, 8)
+	go func() {
+		defer close(msgs)
+		pc := newTestPeer(peer)
+		for {
+			cs, err := pc.readChunkStream(pc.basicHdrBuf)
+			if err != nil {
+				return
+			}
+			msg := *cs
+			msg.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+			msgs <- &msg
+		}
+	}()
+	next := func(want string) *ChunkStream {
+		t.Helper()
+		select {
+		case msg := <-msgs:
+			if msg == nil {
+				t.Fatalf("peer closed; want %s", want)
+			}
+			return msg
+		case <-time.After(time.Second):
+			t.Fatalf("timeout; want %s", want)
+		}
+		return nil
+	}
+	wantEvent := func(eventType uint32, name string) {
+		t.Helper()
+		msg := next(name)
+		if msg.MsgTypeID != MsgUserControlMessage || len(msg.ChunkBody) != 6 {
+			t.Fatalf("got message type %d body % x; want %s", msg.MsgTypeID, msg.ChunkBody, name)
+		}
+		if got := uint32(binary.BigEndian.Uint16(msg.ChunkBody)); got != eventType {
+			t.Fatalf("got event %d; want %s", got, name)
+		}
+		if id := binary.BigEndian.Uint32(msg.ChunkBody[2:]); id != 1 {
+			t.Fatalf("%s: got stream id %d; want 1", name, id)
+		}
+	}
+	wantVideo := func() {
+		t.Helper()
+		if msg := next("video"); msg.MsgTypeID != MsgVideoMessage {
+			t.Fatalf("got message type %d; want video", msg.MsgTypeID)
+		}
+	}
+
+	sub := newSubscriber(c, 16)
+	sub.streamID = 1
+	done := make(chan error, 1)
+	go func() { done <- sub.playingCycle(nil) }()
+
+	sub.avPktQueue <- newTestAVPacket(t, true, testVideoKey, 0)
+	wantVideo()
+
+	// starved, one StreamDry however long it lasts
+	start := time.Now()
+	wantEvent(streamDry, "StreamDry")
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("StreamDry after %v; want after the timeout", elapsed)
+	}
+	select {
+	case msg := <-msgs:
+		t.Fatalf("got message type %d while dry; want none", msg.MsgTypeID)
+	case <-time.After(120 * time.Millisecond):
+	}
+
+	// resumed, StreamBegin ahead of the media
+	sub.avPktQueue <- newTestAVPacket(t, true, testVideoKey, 40)
+	wantEvent(streamBegin, "StreamBegin")
+	wantVideo()
+
+	close(sub.avPktQueue)
+	if err := <-done; err == nil {
+		t.Fatal("playing cycle returned nil; want closed")
+	}
+}
@@ -0,0 +1,39 @@
+package rtmp
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// StreamEventType tells what changed in a published stream
+type StreamEventType int
+
+const (
+	ResolutionChange StreamEventType = iota + 1 // a new AVC sequence header of another width or height
+)
+
+func (t StreamEventType) String() string {
+	switch t {
+	case ResolutionChange:
+		return "ResolutionChange"
+	}
+	return "Unknown"
+}
+
+// StreamEvent is passed to Config.OnStreamEvent
+type StreamEvent struct {
+	Type      StreamEventType
+	StreamKey string
+
+	Width, Height         int // after the change
+	PrevWidth, PrevHeight int
+}
+
+// emitStreamEvent logs ev and passes it to Config.OnStreamEvent, called unlocked from the publishing cycle
+func (ss *streamSource) emitStreamEvent(ev StreamEvent) {
+	ss.ssMgr.logger().WithFields(logrus.Fields{"event": "stream event", "streamKey": ss.streamKey, "type": ev.Type}).
+		Infof("%dx%d -> %dx%d", ev.PrevWidth, ev.PrevHeight, ev.Width, ev.Height)
+
+	if ss.ssMgr != nil && ss.ssMgr.config != nil && ss.ssMgr.config.OnStreamEvent != nil {
+		ss.ssMgr.config.OnStreamEvent(ev)
+	}
+}
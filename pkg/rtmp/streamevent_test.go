@@ -0,0 +1,48 @@
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestResolutionChange(t *testing.T) {
+	config := newTestConfig()
+	config.GOPCacheDuration = time.Minute
+	var events []StreamEvent
+	config.OnStreamEvent = func(ev StreamEvent) { events = append(events, ev) }
+	ssMgr := newStreamSourceMgr(config)
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	pub := newPublisher(c, "_defaultVhost_/live/test")
+	ss, err := ssMgr.attachPublisher(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub.publishPacket(ss, nil, newTestAVPacket(t, true, testAVCSeq720p, 0))
+	pub.publishPacket(ss, nil, newTestAVPacket(t, true, testVideoKey, 0))
+	pub.publishPacket(ss, nil, newTestAVPacket(t, true, testAVCSeq720p, 40)) // resent, same header
+	if len(events) != 0 {
+		t.Fatalf("got events %+v; want none before a change", events)
+	}
+	if len(ss.cache.gop) != 1 {
+		t.Fatalf("got %d cached; want the keyframe kept across a resent sequence header", len(ss.cache.gop))
+	}
+
+	pub.publishPacket(ss, nil, newTestAVPacket(t, true, testAVCSeq1080p, 80))
+	if info := ss.StreamInfo(); info.Width != 1920 || info.Height != 1080 {
+		t.Fatalf("got %dx%d; want 1920x1080", info.Width, info.Height)
+	}
+	want := StreamEvent{Type: ResolutionChange, StreamKey: ss.streamKey, Width: 1920, Height: 1080, PrevWidth: 1280, PrevHeight: 720}
+	if len(events) != 1 || events[0] != want {
+		t.Fatalf("got events %+v; want %+v", events, want)
+	}
+
+	// new players get the current sequence header and no frame of the old resolution
+	if seq := ss.cache.videoSeq.pkt; seq == nil || !bytes.Equal(seq.Data, testAVCSeq1080p) {
+		t.Fatal("cached sequence header not replaced by the new one")
+	}
+	if len(ss.cache.gop) != 0 {
+		t.Fatalf("got %d cached of the old resolution; want none", len(ss.cache.gop))
+	}
+}
@@ -0,0 +1,142 @@
+package rtmp
+
+import (
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+)
+
+// StreamInfo is a snapshot of a stream source, codec info comes from the sequence headers
+type StreamInfo struct {
+	StreamKey   string
+	SessionID   string
+	Publishing  bool
+	Subscribers int
+
+	// client identity of the publisher from its connect command, e.g. FMLE/3.0 (compatible; obs-studio/27.0.1)
+	FlashVer string
+	TcUrl    string
+
+	HasVideo     bool
+	VideoCodecID uint8 // flv codec id, 7: AVC
+	Width        int
+	Height       int
+
+	HasAudio    bool
+	SoundFormat uint8 // flv sound format, 10: AAC
+
+	// a track without a sequence header (or a packet, for codecs without one) within
+	// Config.TrackDetectTimeout of publish start is considered absent
+	AudioOnly bool
+	VideoOnly bool
+
+	Bitrate int64 // bits per second, averaged since publish start
+}
+
+// updateStreamInfo is called from the publishing cycle for every packet
+func (ss *streamSource) updateStreamInfo(pkt *av.Packet) error {
+	ss.infoMux.Lock()
+	ev, err := ss.updateStreamInfoLocked(pkt)
+	ss.infoMux.Unlock()
+
+	if ev != nil {
+		ss.emitStreamEvent(*ev)
+	}
+	return err
+}
+
+// must hold infoMux, returns the event of a change to emit once unlocked
+func (ss *streamSource) updateStreamInfoLocked(pkt *av.Packet) (*StreamEvent, error) {
+	ss.bytesIn += int64(len(pkt.Data))
+
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if !ok {
+			return nil, nil
+		}
+		ss.info.HasVideo = true
+		ss.info.VideoCodecID = vh.CodecID()
+		if vh.CodecID() != av.VIDEO_H264 || vh.IsSeq() {
+			ss.videoReady = true
+		}
+		if vh.IsSeq() && vh.CodecID() == av.VIDEO_H264 {
+			cfg, err := flv.ParseAVCSequenceHeader(pkt.Data)
+			if err != nil {
+				return nil, err
+			}
+			prevWidth, prevHeight := ss.info.Width, ss.info.Height
+			ss.info.Width, ss.info.Height = cfg.Width, cfg.Height
+			if prevWidth != 0 && (prevWidth != cfg.Width || prevHeight != cfg.Height) { // not the first one
+				return &StreamEvent{
+					Type:       ResolutionChange,
+					StreamKey:  ss.streamKey,
+					Width:      cfg.Width,
+					Height:     cfg.Height,
+					PrevWidth:  prevWidth,
+					PrevHeight: prevHeight,
+				}, nil
+			}
+		}
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		if !ok {
+			return nil, nil
+		}
+		ss.info.HasAudio = true
+		ss.info.SoundFormat = ah.SoundFormat()
+		if ah.SoundFormat() != av.SOUND_AAC || ah.AACPacketType() == av.AAC_SEQHDR {
+			ss.audioReady = true
+		}
+	}
+
+	return nil, nil
+}
+
+// resetStreamInfo is called when a publisher attaches, pub may be nil
+func (ss *streamSource) resetStreamInfo(pub *publisher) {
+	ss.infoMux.Lock()
+	defer ss.infoMux.Unlock()
+
+	ss.info = StreamInfo{}
+	if pub != nil && pub.rtmpConn != nil {
+		ss.info.FlashVer = pub.rtmpConn.flashVer
+		ss.info.TcUrl = pub.rtmpConn.tcUrl
+	}
+	ss.bytesIn = 0
+	ss.publishStart = timeNow()
+	ss.audioReady, ss.videoReady = false, false
+}
+
+func (ss *streamSource) StreamInfo() StreamInfo {
+	ss.addSubMux.Lock()
+	subscribers := len(ss.subscribers)
+	ss.addSubMux.Unlock()
+
+	publishing := ss.getPublisher() != nil
+
+	ss.infoMux.Lock()
+	defer ss.infoMux.Unlock()
+
+	info := ss.info
+	info.StreamKey = ss.streamKey
+	info.SessionID = ss.sessionID
+	info.Publishing = publishing
+	info.Subscribers = subscribers
+	elapsed := timeNow().Sub(ss.publishStart)
+	if elapsed >= time.Second {
+		info.Bitrate = ss.bytesIn * 8 * int64(time.Second) / int64(elapsed)
+	}
+	if publishing && elapsed >= ss.ssMgr.trackDetectTimeout() {
+		info.AudioOnly = ss.audioReady && !ss.videoReady
+		info.VideoOnly = ss.videoReady && !ss.audioReady
+	}
+
+	return info
+}
+
+// flvTracks are the FLV header flags, both until a track is known to be absent so players wait for it
+func (info StreamInfo) flvTracks() (hasAudio, hasVideo bool) {
+	return !info.VideoOnly, !info.AudioOnly
+}
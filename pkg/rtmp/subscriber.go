@@ -4,41 +4,165 @@ import (
 	"encoding/binary"
 	"errors"
 	"playground/pkg/av"
+	"sync/atomic"
+	"time"
 
 	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/sirupsen/logrus"
 )
 
+// subscriber type
+const (
+	subTypePlay    = "play"    // rtmp player
+	subTypeWSPlay  = "wsplay"  // pseudo subscriber pushing flv to websocket player
+	subTypeDASH    = "dash"    // pseudo subscriber packaging DASH segments
+	subTypeRelay   = "relay"   // pushing to upstream over a client conn, see Service.Relay
+	subTypeRecord  = "record"  // pseudo subscriber recording to disk
+	subTypeMonitor = "monitor" // pseudo subscriber of AddMonitor, outside the subscriber map
+	subTypeFLVSink = "flvsink" // pseudo subscriber of AttachFLVSink
+)
+
+// what to do with a packet while the subscriber queue is nearly full
+type dropPolicy int
+
+const (
+	dropPolicyDrop  dropPolicy = iota // drop non-key packets, never block the publisher
+	dropPolicyBlock                   // block the publisher until queued, for internal consumers which must not lose data
+)
+
 type subscriber struct {
-	rtmpConn *Conn
+	rtmpConn *Conn  // nil for pseudo subscriber
+	id       string // key in streamSource, remote addr for player
 
-	stopped bool
-	subType string // "gerneral"
+	stopped int32  // atomic, 1: playing cycle exited
+	subType string // play, relay or record
+	policy  dropPolicy
 	logger  *logrus.Logger
 
 	avPktQueue     chan *av.Packet
 	avPktQueueSize int //av packet buffer size
 
+	streamID           uint32        // message stream played on, 0: the one of the publisher
+	passThrough        bool          // relay: publisher timestamps and bodies go out untouched
+	quit               chan struct{} // closed to stop playingCycle, e.g. once the conn of a player fails reading
+	shard              *dispatchShard
 	initCache          bool
-	baseTimeStamp      uint32
+	audioFirst         bool          // cache replay sends the audio sequence header before the video one
+	bufferDepth        time.Duration // media replayed from the GOP cache on join, see Cache.gopFrom and replayDepth
+	clientBuffer       bool          // bufferDepth is a default, the SetBufferLength of the player replaces it
+	session            string        // tcUrl parameter session of a player, see Config.SessionResumeWindow
+	resume             bool          // join replays the GOP cache from resumeTimeStamp, not bufferDepth
+	resumeTimeStamp    uint32
+	baseTimeStampSet   bool
+	baseTimeStamp      uint32 // publisher timestamp of the first media packet sent to this subscriber
+	lastTimeStamp      uint32 // last timestamp sent, any type
 	lastAudioTimeStamp uint32
 	lastVideoTimeStamp uint32
 	chunkMsgToSend     *ChunkStream
+
+	// a publisher attached again, its timeline starts anew, see calcTimeStamp
+	republished     int32  // atomic, 1 until the first sequence header of the new publisher
+	anchorTimeStamp uint32 // subscriber timestamp the next base maps to
+
+	// A/V drift on publisher timestamps, the subscriber timeline is clamped monotonic and would hide it
+	pubAudioTimeStamp uint32 // publisher timestamp of the last audio sent
+	pubVideoTimeStamp uint32
+	sentAudio         bool
+	sentVideo         bool
+	avDrift           int64 // atomic, ms, audio - video
+	driftThreshold    time.Duration
+	driftAlerted      bool
+
+	// latency budget, see withinLatencyBudget
+	latencyBudget time.Duration // 0 disables
+	sentTimeStamp uint32        // atomic, publisher timestamp of the last media sent
+	sentMedia     int32         // atomic, 1: sentTimeStamp is set
+	waitKeyFrame  bool          // dropping video up to the next keyframe, publisher side only
+
+	dryTimeout    time.Duration // StreamDry after no media that long, 0 disables, see dryDetector
+	notify        chan string   // onStatus codes to send on the data channel, nil for internal consumers
+	flushInterval time.Duration // writes are flushed by a ticker, 0: every message
+
+	// write progress, see isIdle
+	closeConn  func() error // disconnects a player, nil for internal consumers
+	writing    int32        // atomic, 1: a send is in progress
+	progressAt int64        // atomic, unix nano of the last completed send or of creation
+
+	// packets dropped by queue depth or latency budget, see streamSource.Subscribers
+	droppedAudio uint64 // atomic
+	droppedVideo uint64 // atomic
+	dropLog      logSampler
 }
 
 func newSubscriber(c *Conn, avQueueSize int) *subscriber {
 	sub := &subscriber{
 		rtmpConn:       c,
-		subType:        "gerneral",
+		id:             c.RemoteAddr().String(),
+		subType:        subTypePlay,
+		policy:         dropPolicyDrop,
 		logger:         c.logger,
 		avPktQueue:     make(chan *av.Packet, avQueueSize),
 		avPktQueueSize: avQueueSize,
 		chunkMsgToSend: new(ChunkStream),
+		driftThreshold: c.config.AVDriftThreshold,
+		latencyBudget:  c.config.LatencyBudget,
+		dryTimeout:     c.config.StreamDryTimeout,
+		flushInterval:  c.config.SubscriberFlushInterval,
+		session:        c.urlValues.Get("session"),
+		dropLog:        logSampler{interval: c.config.LogSampleInterval},
+		audioFirst:     c.config.AudioFirst,
+		notify:         make(chan string, 2),
+		closeConn:      c.Close,
+		progressAt:     timeNow().UnixNano(),
 	}
 
+	depth, pinned := c.playBufferDepth()
+	sub.bufferDepth, sub.clientBuffer = depth, !pinned
+
 	return sub
 }
 
+// newRelaySubscriber returns a pass-through subscriber pushing to upstream over c, a client conn. Packets
+// go out as dispatched with publisher timestamps: no rebasing, no metadata reform, no stream events or
+// notifications a player gets, the upstream is to see the stream, not a player's view of it.
+func newRelaySubscriber(c *Conn, avQueueSize int) *subscriber {
+	sub := newSubscriber(c, avQueueSize)
+	sub.subType = subTypeRelay
+	sub.policy = dropPolicyBlock
+	sub.passThrough = true
+	sub.quit = make(chan struct{})
+	sub.latencyBudget, sub.dryTimeout, sub.notify = 0, 0, nil
+
+	return sub
+}
+
+// newPseudoSubscriber returns a record or dash subscriber without rtmp conn, the owner consumes avPktQueue itself
+func newPseudoSubscriber(subType, id string, logger *logrus.Logger, avQueueSize int) *subscriber {
+	sub := &subscriber{
+		id:             id,
+		subType:        subType,
+		policy:         dropPolicyBlock,
+		logger:         logger,
+		avPktQueue:     make(chan *av.Packet, avQueueSize),
+		avPktQueueSize: avQueueSize,
+		progressAt:     timeNow().UnixNano(),
+	}
+
+	return sub
+}
+
+// replayDepth is bufferDepth, or the buffer length the player announced for its message stream if
+// clientBuffer. Players announce it around play, it's taken on the first dispatch after join.
+func (s *subscriber) replayDepth() time.Duration {
+	if !s.clientBuffer || s.rtmpConn == nil {
+		return s.bufferDepth
+	}
+	if ms := s.rtmpConn.bufferLength(s.streamID); ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return s.bufferDepth
+}
+
 func (s *subscriber) sendCachePacket(cache *Cache) {
 	if s.initCache {
 		return
@@ -49,32 +173,135 @@ func (s *subscriber) sendCachePacket(cache *Cache) {
 		s.writeAVPacket(metaData.pkt)
 	}
 
-	videoSeq := cache.videoSeq
-	if videoSeq.full && videoSeq.pkt != nil {
-		s.writeAVPacket(videoSeq.pkt)
+	seqs := []*SpecialCache{cache.videoSeq, cache.audioSeq}
+	if s.audioFirst {
+		seqs[0], seqs[1] = seqs[1], seqs[0]
+	}
+	for _, seq := range seqs {
+		if seq.full && seq.pkt != nil {
+			s.writeAVPacket(seq.pkt)
+		}
 	}
 
-	audioSeq := cache.audioSeq
-	if audioSeq.full && audioSeq.pkt != nil {
-		s.writeAVPacket(audioSeq.pkt)
+	gop, ok := cache.gopAt(s.resumeTimeStamp)
+	if !s.resume || !ok {
+		gop = cache.gopFrom(s.replayDepth()) // live, what was played left the cache
+	}
+	for _, pkt := range gop {
+		s.writeAVPacket(pkt)
 	}
 
 	s.initCache = true
 }
 
 func (s *subscriber) playingCycle(ss *streamSource) error {
+	dry := newDryDetector(s.dryTimeout)
+	defer dry.stop()
+	var deleted <-chan struct{}
+	if ss != nil {
+		deleted = ss.done // no media ever comes again, see streamSource.Close
+	}
+	var flush <-chan time.Time
+	if s.flushInterval > 0 {
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+		_ = s.rtmpConn.deferFlush(true)
+		defer func() { _ = s.rtmpConn.deferFlush(false) }()
+	}
+
 	for {
-		pkt, ok := <-s.avPktQueue
+		var pkt *av.Packet
+		var ok bool
+		select {
+		case pkt, ok = <-s.avPktQueue:
+			if ok {
+				s.dequeueMemory(pkt)
+			}
+		case <-dry.C():
+			if !dry.expired() {
+				continue
+			}
+			s.logger.WithField("event", "stream dry").Debugf("no media for %v", s.dryTimeout)
+			if err := s.writeStreamEvent(streamDry); err != nil {
+				s.stop()
+				return err
+			}
+			continue
+		case code := <-s.notify:
+			s.beginWrite()
+			err := s.writeNotify(code)
+			s.endWrite()
+			if err != nil {
+				s.stop()
+				return err
+			}
+			continue
+		case <-flush:
+			s.beginWrite()
+			err := s.rtmpConn.flushDeferred()
+			s.endWrite()
+			if err != nil {
+				s.stop()
+				return err
+			}
+			continue
+		case <-s.quit:
+			s.stop()
+			return errors.New("quit")
+		case <-deleted:
+			s.stop()
+			return errStreamSourceDeleted
+		}
 		if !ok {
-			s.stopped = true
+			s.stop()
 			return errors.New("closed")
 		}
+		if err := s.waitPeerAck(deleted); err != nil {
+			pkt.Release()
+			s.stop()
+			return err
+		}
 
-		if err := s.sendAVPacket(pkt); err != nil {
-			s.stopped = true
+		s.beginWrite()
+		var err error
+		if (pkt.IsAudio || pkt.IsVideo) && dry.media() {
+			err = s.writeStreamEvent(streamBegin)
+		}
+		if err == nil {
+			err = s.sendAVPacket(pkt)
+		}
+		if err == nil && (pkt.IsAudio || pkt.IsVideo) {
+			markTime(&s.rtmpConn.timings.firstMedia)
+		}
+		s.endWrite()
+		if s.logger.IsLevelEnabled(logrus.TraceLevel) { // per packet, formatting costs even when not logged
+			s.logger.WithField("event", "SendAVPacket").Tracef("pkt: %+v", pkt)
+		}
+		pkt.Release()
+		if err != nil {
+			s.stop()
 			return err
 		}
-		s.logger.WithField("event", "SendAVPacket").Debugf("pkt: %+v", pkt)
+	}
+}
+
+// waitPeerAck pauses sending while the peer is more than two windows behind acknowledging, it's asked
+// to acknowledge once a window, the window in flight is not acknowledged yet. See Conn.unacked.
+func (s *subscriber) waitPeerAck(deleted <-chan struct{}) error {
+	c := s.rtmpConn
+	for {
+		acked := c.peerAckWaiter() // before the check, an ACK in between closes it
+		if c.unacked() <= 2*c.localWindowAckSize {
+			return nil
+		}
+		select {
+		case <-acked:
+		case <-s.quit:
+			return errors.New("quit")
+		case <-deleted:
+			return errStreamSourceDeleted
+		}
 	}
 }
 
@@ -84,19 +311,15 @@ func (s *subscriber) sendAVPacket(pkt *av.Packet) error {
 	cs.ChunkBody = pkt.Data
 	cs.MsgLength = uint32(len(pkt.Data))
 	cs.MsgStreamID = pkt.StreamID
-	cs.TimeStamp = pkt.TimeStamp + s.getBaseTimeStamp()
-
-	switch {
-	case pkt.IsVideo:
-		cs.MsgTypeID = MsgVideoMessage
-	case pkt.IsAudio:
-		cs.MsgTypeID = MsgAudioMessage
-	case pkt.IsMetaData:
-		cs.MsgTypeID = MSGAMF0DataMessage
+	cs.MsgTypeID = packetToMsgType(pkt)
+	if s.streamID != 0 {
+		cs.MsgStreamID = s.streamID
 	}
-
-	s.recordTimeStamp(cs.MsgTypeID, cs.TimeStamp)
-
+	if s.passThrough {
+		cs.TimeStamp = pkt.TimeStamp
+		return s.rtmpConn.writeChunkStream(cs)
+	}
+	cs.TimeStamp = s.nextTimeStamp(pkt)
 	return s.writeAVChunkStream(cs)
 }
 
@@ -115,45 +338,181 @@ func (s *subscriber) writeAVChunkStream(cs *ChunkStream) error {
 	return s.rtmpConn.writeChunkStream(cs)
 }
 
+// player over rtmp or websocket, which holds a client connection
+func (s *subscriber) isPlayer() bool {
+	return s.subType == subTypePlay || s.subType == subTypeWSPlay
+}
+
+func (s *subscriber) stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+}
+
+func (s *subscriber) isStopped() bool {
+	return atomic.LoadInt32(&s.stopped) == 1
+}
+
+// writeAVPacket is called from the publisher read loop, it must never block on a slow player:
+// the socket write happens in playingCycle, here we only enqueue or drop. Only pseudo subscribers
+// with dropPolicyBlock may hold the publisher back.
+// The queue holds a reference of every packet in it, whoever takes one out releases it.
 func (s *subscriber) writeAVPacket(pkt *av.Packet) {
 	//s.logger.WithField("event", "avpkt enQueue").Infof("data len: %d", len(pkt.Data))
+	pkt.Retain()
+	if s.policy == dropPolicyBlock {
+		s.queueMemory(pkt)
+		s.avPktQueue <- pkt
+		return
+	}
+
+	if s.latencyBudget > 0 && !s.withinLatencyBudget(pkt) {
+		s.countDrop(pkt)
+		pkt.Release()
+		return
+	}
+
 	if len(s.avPktQueue) > s.avPktQueueSize-24 {
 		s.dropAVPacket()
-	} else {
-		s.avPktQueue <- pkt
+	}
+
+	if !s.tryEnqueue(pkt) {
+		s.logDrop("queue full, drop pkt")
+		s.countDrop(pkt)
+		pkt.Release()
+	}
+}
+
+// non-blocking enqueue, publisher dispatch is the only producer
+func (s *subscriber) tryEnqueue(pkt *av.Packet) bool {
+	if !s.queueMemory(pkt) {
+		return false
+	}
+	select {
+	case s.avPktQueue <- pkt:
+		return true
+	default:
+		s.dequeueMemory(pkt)
+		return false
+	}
+}
+
+// non-blocking dequeue, playingCycle may drain the queue concurrently
+func (s *subscriber) tryDequeue() (*av.Packet, bool) {
+	select {
+	case pkt, ok := <-s.avPktQueue:
+		if ok {
+			s.dequeueMemory(pkt)
+		}
+		return pkt, ok
+	default:
+		return nil, false
+	}
+}
+
+// requeue puts a dequeued packet back, releasing it if there is no room anymore
+func (s *subscriber) requeue(pkt *av.Packet) {
+	if !s.tryEnqueue(pkt) {
+		s.countDrop(pkt)
+		pkt.Release()
+	}
+}
+
+// discard drops the packet at the head of the queue
+func (s *subscriber) discard() {
+	if pkt, ok := s.tryDequeue(); ok {
+		s.countDrop(pkt)
+		pkt.Release()
+	}
+}
+
+func (s *subscriber) countDrop(pkt *av.Packet) {
+	switch {
+	case pkt.IsAudio:
+		atomic.AddUint64(&s.droppedAudio, 1)
+	case pkt.IsVideo:
+		atomic.AddUint64(&s.droppedVideo, 1)
 	}
 }
 
 func (s *subscriber) dropAVPacket() {
 	//s.logger.WithField("event", "dropAvPkt").Infof("subscriber: %s", s.rtmpConn.RemoteAddr().String())
 	for i := 0; i < s.avPktQueueSize-84; i++ {
-		pkt, ok := <-s.avPktQueue
+		pkt, ok := s.tryDequeue()
 		if !ok {
-			continue
+			return // drained by playing cycle meanwhile
 		}
 
 		switch {
 		case pkt.IsAudio:
 			if len(s.avPktQueue) > s.avPktQueueSize-2 {
-				s.logger.WithField("event", "dropAvPkt").Infof("drop audio pkt")
-				<-s.avPktQueue
+				s.logDrop("drop audio pkt")
+				s.countDrop(pkt)
+				pkt.Release()
+				s.discard()
 			} else {
-				s.avPktQueue <- pkt //enqueu again
+				s.requeue(pkt) //enqueu again
 			}
 		case pkt.IsVideo:
 			vPkt, ok := pkt.Header.(av.VideoPacketHeader)
 			if ok && (vPkt.IsSeq() || vPkt.IsKeyFrame()) {
-				s.avPktQueue <- pkt
+				s.requeue(pkt)
+			} else {
+				s.countDrop(pkt)
+				pkt.Release()
 			}
 
 			if len(s.avPktQueue) > s.avPktQueueSize-10 {
-				s.logger.WithField("event", "dropAvPkt").Infof("drop audio pkt")
-				<-s.avPktQueue
+				s.logDrop("drop video pkt")
+				s.discard()
 			}
+		default:
+			s.requeue(pkt)
 		}
 	}
 }
 
+/*
+ * calcTimeStamp maps the publisher timeline onto the subscriber timeline:
+ *   1. the first audio/video packet sent fixes baseTimeStamp, so every subscriber starts from 0
+ *      no matter when it joins; cached metadata and sequence headers sent before it go out at 0.
+ *   2. output = pkt.TimeStamp - baseTimeStamp, packets older than the base go out at 0.
+ *   3. output never goes backwards across audio and video, a packet behind the last sent one
+ *      (interleave jitter between tracks) is clamped to the last sent timestamp.
+ *   4. a publisher attaching again, see reanchorSubscribers, may restart its clock: at its first
+ *      sequence header the base is fixed anew by the next media, which goes out at the last sent
+ *      timestamp. Media of the previous publisher still queued ahead of it keeps the old base.
+ */
+func (s *subscriber) calcTimeStamp(pkt *av.Packet) uint32 {
+	if isSeqHeader(pkt) && atomic.CompareAndSwapInt32(&s.republished, 1, 0) {
+		s.baseTimeStampSet = false
+		s.anchorTimeStamp = s.lastTimeStamp
+	}
+	if !s.baseTimeStampSet && (pkt.IsAudio || pkt.IsVideo) && !isSeqHeader(pkt) {
+		s.baseTimeStamp = pkt.TimeStamp - s.anchorTimeStamp
+		s.baseTimeStampSet = true
+	}
+
+	ts := uint32(0)
+	if s.baseTimeStampSet && int32(pkt.TimeStamp-s.baseTimeStamp) > 0 { // the base may wrap once anchored
+		ts = pkt.TimeStamp - s.baseTimeStamp
+	}
+
+	if ts < s.lastTimeStamp {
+		ts = s.lastTimeStamp
+	}
+
+	return ts
+}
+
+// nextTimeStamp maps pkt onto the subscriber timeline and records it as sent
+func (s *subscriber) nextTimeStamp(pkt *av.Packet) uint32 {
+	ts := s.calcTimeStamp(pkt)
+	s.recordTimeStamp(packetToMsgType(pkt), ts)
+	s.updateAVDrift(pkt)
+	s.markSent(pkt)
+
+	return ts
+}
+
 func (s *subscriber) recordTimeStamp(msgTypeID RtmpMsgTypeID, timeStamp uint32) {
 	switch msgTypeID {
 	case MsgVideoMessage:
@@ -162,14 +521,69 @@ func (s *subscriber) recordTimeStamp(msgTypeID RtmpMsgTypeID, timeStamp uint32)
 		s.lastAudioTimeStamp = timeStamp
 	}
 
-	// calcBaseTimeStamp
-	if s.lastAudioTimeStamp > s.lastVideoTimeStamp {
-		s.baseTimeStamp = s.lastAudioTimeStamp
-	} else {
-		s.baseTimeStamp = s.lastVideoTimeStamp
+	s.lastTimeStamp = timeStamp
+}
+
+// updateAVDrift tracks audio - video of the last sent media, alerting once when it exceeds the threshold
+func (s *subscriber) updateAVDrift(pkt *av.Packet) {
+	if isSeqHeader(pkt) {
+		return
+	}
+
+	switch {
+	case pkt.IsAudio:
+		s.pubAudioTimeStamp = pkt.TimeStamp
+		s.sentAudio = true
+	case pkt.IsVideo:
+		s.pubVideoTimeStamp = pkt.TimeStamp
+		s.sentVideo = true
+	default:
+		return
+	}
+	if !s.sentAudio || !s.sentVideo {
+		return
+	}
+
+	drift := int64(s.pubAudioTimeStamp) - int64(s.pubVideoTimeStamp)
+	atomic.StoreInt64(&s.avDrift, drift)
+
+	threshold := s.driftThreshold
+	if threshold <= 0 {
+		threshold = defaultAVDriftThreshold
+	}
+	abs := time.Duration(drift) * time.Millisecond
+	if abs < 0 {
+		abs = -abs
 	}
+
+	// recover below half of the threshold, so interleaving doesn't flap the alert around it
+	alert := abs > threshold || (s.driftAlerted && abs > threshold/2)
+	if alert != s.driftAlerted {
+		s.driftAlerted = alert
+		logger := s.logger.WithFields(logrus.Fields{"event": "av drift", "subscriber": s.id, "drift": drift})
+		if alert {
+			logger.Warnf("audio/video drift exceeds %v", threshold)
+		} else {
+			logger.Info("audio/video drift recovered")
+		}
+	}
+}
+
+// AVDrift is audio - video timestamp of the last sent media
+func (s *subscriber) AVDrift() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.avDrift)) * time.Millisecond
 }
 
-func (s *subscriber) getBaseTimeStamp() uint32 {
-	return s.baseTimeStamp
+// audio or video sequence header
+func isSeqHeader(pkt *av.Packet) bool {
+	switch {
+	case pkt.IsVideo:
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		return ok && vh.IsSeq()
+	case pkt.IsAudio:
+		ah, ok := pkt.Header.(av.AudioPacketHeader)
+		return ok && ah.SoundFormat() == av.SOUND_AAC && ah.AACPacketType() == av.AAC_SEQHDR
+	}
+
+	return false
 }
@@ -0,0 +1,606 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"playground/pkg/av"
+	"playground/pkg/flv"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+// newTestAVPacket returns a demuxed av packet, data is a minimal flv audio/video tag body
+func newTestAVPacket(t *testing.T, isVideo bool, data []byte, timeStamp uint32) *av.Packet {
+	t.Helper()
+
+	pkt := &av.Packet{IsVideo: isVideo, IsAudio: !isVideo, Data: data, TimeStamp: timeStamp}
+	if err := flv.NewDemuxer().DemuxHdr(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+var (
+	testVideoSeq   = []byte{0x17, 0x00, 0x00, 0x00, 0x00}
+	testVideoKey   = []byte{0x17, 0x01, 0x00, 0x00, 0x00}
+	testVideoInter = []byte{0x27, 0x01, 0x00, 0x00, 0x00}
+	testAudioSeq   = []byte{0xaf, 0x00, 0x12, 0x10}
+	testAudioRaw   = []byte{0xaf, 0x01, 0x21}
+)
+
+func TestSubscriberTimeStampMonotonic(t *testing.T) {
+	c, _ := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	sub := newSubscriber(c, 1024)
+
+	// late join: cached seq headers carry ts 0, live packets start at 100000 with A/V jitter
+	pkts := []*av.Packet{
+		newTestAVPacket(t, true, testVideoSeq, 0),
+		newTestAVPacket(t, false, testAudioSeq, 0),
+		newTestAVPacket(t, true, testVideoKey, 100000),
+		newTestAVPacket(t, false, testAudioRaw, 99980),
+		newTestAVPacket(t, false, testAudioRaw, 100003),
+		newTestAVPacket(t, true, testVideoInter, 100040),
+		newTestAVPacket(t, false, testAudioRaw, 100026),
+		newTestAVPacket(t, false, testAudioRaw, 100049),
+		newTestAVPacket(t, true, testVideoInter, 100080),
+	}
+	expected := []uint32{0, 0, 0, 0, 3, 40, 40, 49, 80}
+
+	for i, pkt := range pkts {
+		ts := sub.calcTimeStamp(pkt)
+		if ts != expected[i] {
+			t.Fatalf("pkt %d: got ts %d; want %d", i, ts, expected[i])
+		}
+
+		typeID := MsgAudioMessage
+		if pkt.IsVideo {
+			typeID = MsgVideoMessage
+		}
+		sub.recordTimeStamp(typeID, ts)
+	}
+
+	if sub.lastVideoTimeStamp != 80 || sub.lastAudioTimeStamp != 49 {
+		t.Fatalf("got last video %d audio %d; want 80 49", sub.lastVideoTimeStamp, sub.lastAudioTimeStamp)
+	}
+}
+
+func TestSubscriberDropPolicy(t *testing.T) {
+	c, _ := newTestConn(t, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+	play := newSubscriber(c, 128)
+	record := newPseudoSubscriber(subTypeRecord, "record", newTestConfig().Logger, 128)
+	relay := newPseudoSubscriber(subTypeRelay, "relay", newTestConfig().Logger, 128)
+
+	if play.subType != subTypePlay || play.policy != dropPolicyDrop {
+		t.Fatalf("got play subscriber %s policy %d; want %s %d", play.subType, play.policy, subTypePlay, dropPolicyDrop)
+	}
+	if record.policy != dropPolicyBlock || relay.policy != dropPolicyBlock {
+		t.Fatalf("got record policy %d relay policy %d; want %d", record.policy, relay.policy, dropPolicyBlock)
+	}
+
+	const total = 1000
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		for pkt := range record.avPktQueue {
+			if pkt.TimeStamp != uint32(n) {
+				t.Errorf("record got ts %d; want %d", pkt.TimeStamp, n)
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	for i := 0; i < total; i++ {
+		pkt := newTestAVPacket(t, true, testVideoInter, uint32(i))
+		record.writeAVPacket(pkt)
+		play.writeAVPacket(pkt) // nobody consumes, must drop instead of blocking
+	}
+	close(record.avPktQueue)
+
+	if n := <-received; n != total {
+		t.Fatalf("record subscriber got %d packets; want %d", n, total)
+	}
+	if n := len(play.avPktQueue); n >= total {
+		t.Fatalf("play subscriber queued %d packets; want drops", n)
+	}
+}
+
+func TestSubscriberAVDrift(t *testing.T) {
+	var log bytes.Buffer
+	config := newTestConfig()
+	config.Logger.SetOutput(&log)
+	ssMgr := newStreamSourceMgr(config)
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	drainPeer(peer)
+
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+	ssMgr.streamMap.Store(ss.streamKey, ss)
+	sub := newSubscriber(c, 1024)
+	ss.addSubscriber(sub)
+
+	// audio runs ahead of video by 20ms more every 40ms
+	for i := uint32(0); i <= 40; i++ {
+		if err := sub.sendAVPacket(newTestAVPacket(t, true, testVideoInter, 1000+i*40)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.sendAVPacket(newTestAVPacket(t, false, testAudioRaw, 1000+i*60)); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := time.Duration(i*20) * time.Millisecond; sub.AVDrift() != want {
+			t.Fatalf("step %d: got drift %v; want %v", i, sub.AVDrift(), want)
+		}
+	}
+
+	stats := ssMgr.Stats()
+	if len(stats.Streams) != 1 || len(stats.Streams[0].SubscriberStats) != 1 {
+		t.Fatalf("got stats %+v; want one stream with one subscriber", stats)
+	}
+	if drift := stats.Streams[0].SubscriberStats[0].AVDrift; drift != 800*time.Millisecond {
+		t.Fatalf("got stats drift %v; want 800ms", drift)
+	}
+
+	if n := strings.Count(log.String(), "drift exceeds"); n != 1 {
+		t.Fatalf("got %d drift alerts; want 1 once crossing 500ms", n)
+	}
+}
+
+func TestStreamSourceSubscribers(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+
+	c, peer := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	drainPeer(peer)
+	fast := newSubscriber(c, 1024)
+	ss.addSubscriber(fast)
+	if err := fast.sendAVPacket(newTestAVPacket(t, true, testVideoKey, 2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ = newTestConn(t, ssMgr, config, "127.0.0.1:10002")
+	c.urlValues = url.Values{"session": {"abc"}}
+	slow := newSubscriber(c, 4) // full after 4 packets, the rest is dropped
+	ss.addSubscriber(slow)
+
+	for i := uint32(1); i <= 6; i++ {
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, 2000+i*40))
+	}
+
+	want := []SubscriberInfo{
+		{ID: "127.0.0.1:10001", Type: subTypePlay, RemoteAddr: "127.0.0.1:10001", QueueDepth: 6, QueueSize: 1024, LastTimeStamp: 2000, Sent: true},
+		{ID: "127.0.0.1:10002", Type: subTypePlay, RemoteAddr: "127.0.0.1:10002", Session: "abc", QueueDepth: 4, QueueSize: 4, DroppedVideo: 2},
+	}
+	got := ss.Subscribers()
+	if len(got) != len(want) {
+		t.Fatalf("got %d subscribers; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("subscriber %d: got %+v; want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSubscriberPlayBufferDepth(t *testing.T) {
+	config := newTestConfig()
+	config.GOPCacheDuration = 5 * time.Second
+	config.PlayBufferDepth = 2 * time.Second
+	ssMgr := newStreamSourceMgr(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+
+	// 10s of 25fps video, a keyframe every second
+	publish := func(pkt *av.Packet) {
+		ss.dispatchAVPacket(nil, pkt)
+		ss.cacheAVMetaPacket(pkt)
+	}
+	publish(newTestAVPacket(t, true, testVideoSeq, 0))
+	for i := 0; i < 250; i++ {
+		data := testVideoInter
+		if i%25 == 0 {
+			data = testVideoKey
+		}
+		publish(newTestAVPacket(t, true, data, uint32(i*40)))
+	}
+	if first := ss.cache.gop[0].TimeStamp; first != 4000 {
+		t.Fatalf("got GOP cache from %d; want 4000, 5s before the last frame at 9960", first)
+	}
+
+	var tests = []struct {
+		buffer    string  // tcUrl parameter
+		playLen   float64 // len of play
+		announced uint32  // SetBufferLength of the player in ms, 0: none
+		from      uint32  // first replayed timestamp
+	}{
+		{"", -1, 0, 8000}, // Config.PlayBufferDepth
+		{"1", -1, 0, 9000},
+		{"0", -1, 0, 9000}, // last GOP only
+		{"4.5", -1, 0, 6000},
+		{"4.5", 3000, 0, 7000}, // capped by len
+		{"", 0, 0, 9000},
+		{"", -1, 3000, 7000}, // the player's buffer replaces the default
+		{"1", -1, 3000, 9000},
+	}
+	for _, tt := range tests {
+		c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		c.playLen = tt.playLen
+		c.urlValues = url.Values{}
+		if tt.buffer != "" {
+			c.urlValues.Set("buffer", tt.buffer)
+		}
+		sub := newSubscriber(c, 1024)
+		if tt.announced > 0 { // after play, taken on the replay
+			c.bufferLengths = map[uint32]uint32{0: tt.announced}
+		}
+		ss.addSubscriber(sub)
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, 10000))
+		ss.delSubscriber(sub)
+
+		if seq := <-sub.avPktQueue; !isSeqHeader(seq) {
+			t.Fatalf("buffer %q: got %+v first; want video sequence header", tt.buffer, seq)
+		}
+		want := int(9960-tt.from)/40 + 1 + 1 // replay + live packet
+		if n := len(sub.avPktQueue); n != want {
+			t.Fatalf("buffer %q: got %d packets after sequence header; want %d", tt.buffer, n, want)
+		}
+		if pkt := <-sub.avPktQueue; pkt.TimeStamp != tt.from || !pkt.Header.(av.VideoPacketHeader).IsKeyFrame() {
+			t.Fatalf("buffer %q: got replay from %+v; want keyframe at %d", tt.buffer, pkt, tt.from)
+		}
+	}
+}
+
+func TestSubscriberAudioFirst(t *testing.T) {
+	for _, audioFirst := range []bool{false, true} {
+		config := newTestConfig()
+		config.GOPCacheDuration = 5 * time.Second
+		config.AudioFirst = audioFirst
+		ssMgr := newStreamSourceMgr(config)
+		ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+		for _, pkt := range []*av.Packet{
+			newTestAVPacket(t, true, testVideoSeq, 0),
+			newTestAVPacket(t, false, testAudioSeq, 0),
+			newTestAVPacket(t, true, testVideoKey, 0),
+			newTestAVPacket(t, false, testAudioRaw, 20),
+		} {
+			ss.cacheAVMetaPacket(pkt)
+		}
+
+		c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+		sub := newSubscriber(c, 1024)
+		ss.addSubscriber(sub)
+		ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, 40))
+
+		want := [][]byte{testVideoSeq, testAudioSeq, testVideoKey, testAudioRaw, testVideoInter}
+		if audioFirst {
+			want[0], want[1] = testAudioSeq, testVideoSeq
+		}
+		for i, data := range want {
+			if pkt := <-sub.avPktQueue; !bytes.Equal(pkt.Data, data) {
+				t.Fatalf("audio first %v: got %x at %d; want %x", audioFirst, pkt.Data, i, data)
+			}
+		}
+	}
+}
+
+func TestKeyFrameOnlyCache(t *testing.T) {
+	config := newTestConfig()
+	config.KeyFrameOnlyCache = true
+	ssMgr := newStreamSourceMgr(config)
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", ssMgr)
+	for _, pkt := range []*av.Packet{
+		newTestAVPacket(t, true, testVideoSeq, 0),
+		newTestAVPacket(t, false, testAudioSeq, 0),
+		newTestAVPacket(t, true, testVideoKey, 0),
+		newTestAVPacket(t, true, testVideoInter, 40),
+		newTestAVPacket(t, false, testAudioRaw, 60),
+		newTestAVPacket(t, true, testVideoKey, 1000),
+		newTestAVPacket(t, true, testVideoInter, 1040),
+		newTestAVPacket(t, false, testAudioRaw, 1060),
+	} {
+		ss.cacheAVMetaPacket(pkt)
+	}
+	if len(ss.cache.gop) != 1 || ss.cache.gop[0].TimeStamp != 1000 {
+		t.Fatalf("got %d packets cached; want the keyframe at 1000 only", len(ss.cache.gop))
+	}
+
+	c, _ := newTestConn(t, ssMgr, config, "127.0.0.1:10001")
+	sub := newSubscriber(c, 1024)
+	ss.addSubscriber(sub)
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoInter, 1080))
+
+	want := []struct {
+		data      []byte
+		timeStamp uint32
+	}{
+		{testVideoSeq, 0},
+		{testAudioSeq, 0},
+		{testVideoKey, 1000},
+		{testVideoInter, 1080},
+	}
+	for i, w := range want {
+		if pkt := <-sub.avPktQueue; !bytes.Equal(pkt.Data, w.data) || pkt.TimeStamp != w.timeStamp {
+			t.Fatalf("got %x at %d in position %d; want %x at %d", pkt.Data, pkt.TimeStamp, i, w.data, w.timeStamp)
+		}
+	}
+}
+
+// newTestMetaData returns an onMetaData data message body as sent by publisher, with @setDataFrame
+func newTestMetaData(t testing.TB) []byte {
+	t.Helper()
+
+	buffer := bytes.NewBuffer(nil)
+	for _, v := range []interface{}{"@setDataFrame", "onMetaData", amf.Object{"width": 1280.0, "height": 720.0}} {
+		if _, err := (&amf.Encoder{}).Encode(buffer, v, amf.AMF0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func TestSubscriberWaitsForPeerAck(t *testing.T) {
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", newStreamSourceMgr(newTestConfig()))
+	c, peer := newTestConn(t, ss.ssMgr, newTestConfig(), "127.0.0.1:10001")
+	drainPeer(peer)
+	c.localWindowAckSize = 1000 // the peer acknowledges every 1000 bytes, sends pause 2000 ahead
+
+	sub := newSubscriber(c, 16)
+	ss.addSubscriber(sub)
+	done := make(chan error, 1)
+	go func() { done <- sub.playingCycle(ss) }()
+	defer func() {
+		close(ss.done)
+		<-done
+	}()
+
+	bytesOut := func() int64 { return atomic.LoadInt64(&c.bytesOut) }
+	waitSent := func(than int64) int64 {
+		t.Helper()
+		for i := 0; i < 100 && bytesOut() <= than; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if n := bytesOut(); n > than {
+			return n
+		}
+		t.Fatalf("nothing sent beyond %d bytes", than)
+		return 0
+	}
+	ack := func(seq uint32) {
+		t.Helper()
+		body := make([]byte, 4)
+		binary.BigEndian.PutUint32(body, seq)
+		feedPeer(peer, encodeTestMessage(2, 0, MsgAcknowledgement, 0, body, 128))
+		if _, err := c.readChunkStream(c.basicHdrBuf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := append(append([]byte(nil), testVideoKey...), make([]byte, 3000)...)
+
+	// a peer which never acknowledged is not waited for
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, data, 0))
+	sent := waitSent(0)
+
+	ack(1)
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, data, 40))
+	time.Sleep(50 * time.Millisecond)
+	if n := bytesOut(); n != sent {
+		t.Fatalf("sent %d bytes; want %d, paused 3000 bytes ahead of the peer", n, sent)
+	}
+	if st := ss.Stats().SubscriberStats[0]; st.Unacked != uint32(sent-1) {
+		t.Fatalf("got %d bytes unacked in stats; want %d", st.Unacked, sent-1)
+	}
+
+	ack(uint32(sent))
+	waitSent(sent)
+}
+
+func TestRelayChunkSizes(t *testing.T) {
+	originConfig := newTestConfig()
+	originMgr := newStreamSourceMgr(originConfig)
+	upstreamConfig := newTestConfig()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	relay := newTestClient(local, originConfig)
+	upstream := Server(&testNetConn{Conn: remote, local: testAddr("127.0.0.1:1935"), remote: testAddr("127.0.0.1:10001")}, newStreamSourceMgr(upstreamConfig), upstreamConfig)
+	upstream.basicHdrBuf = make([]byte, 3)
+
+	// media bodies of several chunks, re-chunked by the relay conn intact, metadata not reformed
+	pkts := []*av.Packet{{IsMetaData: true, Data: newTestMetaData(t), TimeStamp: 99960, StreamID: 1}}
+	for i := 0; i < 4; i++ {
+		data := append([]byte{0x27, 0x01, 0x00, 0x00, 0x00}, bytes.Repeat([]byte{byte(i)}, 5000+i*777)...)
+		pkts = append(pkts, &av.Packet{IsVideo: true, Data: data, TimeStamp: uint32(100000 + i*40), StreamID: 1})
+	}
+	received := make(chan []*ChunkStream, 1)
+	go func() {
+		var msgs []*ChunkStream
+		for len(msgs) < len(pkts) {
+			cs, err := upstream.readChunkStream(upstream.basicHdrBuf)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			if cs.MsgTypeID == MsgVideoMessage || cs.MsgTypeID == MSGAMF0DataMessage {
+				msg := *cs
+				msg.ChunkBody = append([]byte(nil), cs.ChunkBody...)
+				msgs = append(msgs, &msg)
+			}
+		}
+		received <- msgs
+	}()
+
+	ss := newStreamSource(nil, "_defaultVhost_/live/test", originMgr)
+	defer close(ss.done)
+	sub := newRelaySubscriber(relay, 1024)
+	ss.addSubscriber(sub)
+	go func() { _ = sub.playingCycle(ss) }()
+	for _, pkt := range pkts {
+		ss.dispatchAVPacket(nil, pkt)
+	}
+
+	msgs := <-received
+	if len(msgs) != len(pkts) {
+		t.Fatalf("got %d messages upstream; want %d", len(msgs), len(pkts))
+	}
+	for i, msg := range msgs {
+		if ts := pkts[i].TimeStamp; msg.TimeStamp != ts || !bytes.Equal(msg.ChunkBody, pkts[i].Data) {
+			t.Fatalf("message %d: got ts %d %d bytes; want publisher's ts %d %d bytes intact", i, msg.TimeStamp, len(msg.ChunkBody), ts, len(pkts[i].Data))
+		}
+	}
+}
+
+func BenchmarkSubscriberSendAVPacket(b *testing.B) {
+	for _, bb := range []struct {
+		name   string
+		newSub func(c *Conn) *subscriber
+	}{
+		{"remux", func(c *Conn) *subscriber { return newSubscriber(c, 1024) }},
+		{"passthrough", func(c *Conn) *subscriber { return newRelaySubscriber(c, 1024) }},
+	} {
+		// video frames, and metadata such as onCuePoint or a refreshed onMetaData a remux re-encodes
+		for _, pkt := range []*av.Packet{{IsVideo: true, Data: testVideoInter}, {IsMetaData: true, Data: newTestMetaData(b)}} {
+			kind := "video"
+			if pkt.IsMetaData {
+				kind = "metadata"
+			}
+			b.Run(bb.name+"/"+kind, func(b *testing.B) {
+				c, peer := newTestConn(b, newStreamSourceMgr(newTestConfig()), newTestConfig(), "127.0.0.1:10001")
+				drainPeer(peer)
+				sub := bb.newSub(c)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					pkt.TimeStamp = uint32(i * 40)
+					if err := sub.sendAVPacket(pkt); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testWriteLog is a conn taking every write at once and recording when it came, one write per flush
+type testWriteLog struct {
+	testNetConn
+
+	mu     sync.Mutex
+	writes []time.Time
+}
+
+func newTestWriteLog(t testing.TB, config *Config) (*Conn, *testWriteLog) {
+	local, peer := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+
+	wl := &testWriteLog{testNetConn: testNetConn{Conn: local, local: testAddr("127.0.0.1:1935"), remote: testAddr("127.0.0.1:10001")}}
+	return Server(wl, newStreamSourceMgr(config), config), wl
+}
+
+func (wl *testWriteLog) Write(b []byte) (int, error) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	wl.writes = append(wl.writes, time.Now())
+	return len(b), nil
+}
+
+func (wl *testWriteLog) log() []time.Time {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return append([]time.Time(nil), wl.writes...)
+}
+
+func TestSubscriberFlushInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, 20 * time.Millisecond} {
+		config := newTestConfig()
+		config.SubscriberFlushInterval = interval
+		c, wl := newTestWriteLog(t, config)
+		sub := newSubscriber(c, 1024)
+		done := make(chan error, 1)
+		go func() { done <- sub.playingCycle(nil) }()
+
+		const n = 100 // one every 2ms
+		for i := 0; i < n; i++ {
+			sub.avPktQueue <- newTestAVPacket(t, true, testVideoInter, uint32(i*2))
+			time.Sleep(2 * time.Millisecond)
+		}
+		close(sub.avPktQueue)
+		<-done
+
+		writes := wl.log()
+		if interval == 0 {
+			if len(writes) != n {
+				t.Fatalf("got %d writes; want one for each of %d messages", len(writes), n)
+			}
+			continue
+		}
+
+		if len(writes) > n/4 {
+			t.Fatalf("got %d writes of %d messages; want about one every %v", len(writes), n, interval)
+		}
+		for i := 1; i < len(writes)-1; i++ { // the last one flushes on exit
+			if gap := writes[i].Sub(writes[i-1]); gap < interval/2 {
+				t.Fatalf("write %d after %v; want flushes %v apart", i, gap, interval)
+			}
+		}
+	}
+}
+
+// BenchmarkSubscriberFlushInterval writes over loopback TCP, where a flush is one write or writev syscall
+func BenchmarkSubscriberFlushInterval(b *testing.B) {
+	for _, bb := range []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"every message", 0},
+		{"20ms", 20 * time.Millisecond},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				peer, err := ln.Accept()
+				if err == nil {
+					drainPeer(peer)
+				}
+			}()
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer nc.Close()
+
+			config := newTestConfig()
+			config.SubscriberFlushInterval = bb.interval
+			sub := newSubscriber(Server(nc, newStreamSourceMgr(config), config), 1024)
+			done := make(chan error, 1)
+			go func() { done <- sub.playingCycle(nil) }()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sub.avPktQueue <- &av.Packet{IsVideo: true, Data: testVideoInter, TimeStamp: uint32(i * 40)}
+			}
+			close(sub.avPktQueue)
+			if err := <-done; err != nil && err.Error() != "closed" {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package rtmp
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sync"
+	"time"
+
+	"playground/pkg/av"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultThumbnailInterval = 5 * time.Second
+
+// ThumbnailDecoder decodes a video keyframe, seqHeader and keyFrame are FLV video tag bodies: the AVC
+// sequence header and the keyframe
+type ThumbnailDecoder func(seqHeader, keyFrame []byte) (image.Image, error)
+
+// thumbnailer keeps the latest keyframe of a stream, it's decoded on request at most once an interval
+type thumbnailer struct {
+	decode   ThumbnailDecoder
+	interval time.Duration
+
+	mu        sync.Mutex
+	seqHeader []byte
+	keyFrame  []byte // copied, packets are pooled
+	fresh     bool   // keyFrame is newer than jpeg
+	decoding  bool   // a request is decoding keyFrame, unlocked
+	jpeg      []byte
+	encodedAt time.Time
+}
+
+// startThumbnail keeps keyframes through a monitor, which lives as long as the stream source
+func (ss *streamSource) startThumbnail(config *Config) {
+	th := &thumbnailer{decode: config.ThumbnailDecoder, interval: config.ThumbnailInterval}
+	if th.interval <= 0 {
+		th.interval = defaultThumbnailInterval
+	}
+	ss.thumb = th
+
+	ss.AddMonitor(func(pkt *av.Packet) {
+		vh, ok := pkt.Header.(av.VideoPacketHeader)
+		if !pkt.IsVideo || !ok || !vh.IsKeyFrame() {
+			return
+		}
+
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		if vh.IsSeq() {
+			th.seqHeader = append(th.seqHeader[:0], pkt.Data...)
+			return
+		}
+		th.keyFrame = append(th.keyFrame[:0], pkt.Data...)
+		th.fresh = true
+	})
+}
+
+// image returns the JPEG of the latest keyframe, nil before any keyframe. The decode runs unlocked, the
+// keyframe monitor on the publisher goroutine never waits for it; requests meanwhile get the previous JPEG.
+func (th *thumbnailer) image() ([]byte, error) {
+	th.mu.Lock()
+	if th.decoding || !th.fresh || (th.jpeg != nil && timeNow().Sub(th.encodedAt) < th.interval) {
+		defer th.mu.Unlock()
+		return th.jpeg, nil
+	}
+
+	th.fresh = false // a keyframe failing to decode isn't tried again
+	th.decoding = true
+	seqHeader := append([]byte(nil), th.seqHeader...)
+	keyFrame := append([]byte(nil), th.keyFrame...) // the monitor reuses the buffers
+	th.mu.Unlock()
+
+	b, err := th.encode(seqHeader, keyFrame)
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.decoding = false
+	if err != nil {
+		return nil, err
+	}
+	th.jpeg, th.encodedAt = b, timeNow()
+	return th.jpeg, nil
+}
+
+func (th *thumbnailer) encode(seqHeader, keyFrame []byte) ([]byte, error) {
+	img, err := th.decode(seqHeader, keyFrame)
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(b, img, nil); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// ThumbnailHandler serves the latest keyframe of a stream as JPEG, e.g. http://host/live/test.jpg?vhost=...,
+// mount it with http.StripPrefix("/thumb", ...) for /thumb/{app}/{stream}.jpg. Without
+// Config.ThumbnailDecoder, or before the first keyframe, it answers 503.
+func (s *Service) ThumbnailHandler() http.Handler {
+	return http.HandlerFunc(s.serveThumbnail)
+}
+
+func (s *Service) serveThumbnail(w http.ResponseWriter, r *http.Request) {
+	streamKey, ok := parseHTTPStreamKey(r, ".jpg")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	val, ok := s.ssMgr.streamMap.Load(streamKey)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	th := val.(*streamSource).thumb
+	if th == nil {
+		http.Error(w, "no thumbnail decoder", http.StatusServiceUnavailable)
+		return
+	}
+
+	b, err := th.image()
+	if err != nil {
+		s.config.Logger.WithFields(logrus.Fields{"event": "thumbnail", "streamKey": streamKey}).Error(err)
+		http.Error(w, "decode keyframe failed", http.StatusInternalServerError)
+		return
+	}
+	if b == nil {
+		http.Error(w, "no keyframe yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(b)
+}
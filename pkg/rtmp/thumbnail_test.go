@@ -0,0 +1,137 @@
+package rtmp
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThumbnailHandler(t *testing.T) {
+	decoded := 0
+	config := newTestConfig()
+	config.ThumbnailDecoder = func(seqHeader, keyFrame []byte) (image.Image, error) {
+		if !bytes.Equal(seqHeader, testVideoSeq) || !bytes.Equal(keyFrame, testVideoKey) {
+			t.Errorf("got sequence header % x keyframe % x", seqHeader, keyFrame)
+		}
+		decoded++
+		return image.NewGray(image.Rect(0, 0, 16, 9)), nil
+	}
+	server := NewService(config)
+
+	c, _ := newTestConn(t, server.ssMgr, config, "127.0.0.1:10001")
+	ss, err := server.ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ThumbnailHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1"+path, nil))
+		return w
+	}
+	if w := get("/live/test.jpg"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d before a keyframe; want 503", w.Code)
+	}
+	if w := get("/live/other.jpg"); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d for an unknown stream; want 404", w.Code)
+	}
+
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoSeq, 0))
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 0))
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 100; i++ { // the monitor is asynchronous
+		if w = get("/live/test.jpg"); w.Code == http.StatusOK {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("got %d %s; want a JPEG", w.Code, w.Header().Get("Content-Type"))
+	}
+	if img, err := jpeg.Decode(w.Body); err != nil || img.Bounds().Dx() != 16 {
+		t.Fatalf("got image %v: %v", img, err)
+	}
+
+	// throttled, a newer keyframe within the interval serves the same thumbnail
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 40))
+	get("/live/test.jpg")
+	if decoded != 1 {
+		t.Fatalf("decoded %d times; want 1 within the interval", decoded)
+	}
+}
+
+func TestThumbnailHandlerNoDecoder(t *testing.T) {
+	config := newTestConfig()
+	server := NewService(config)
+	c, _ := newTestConn(t, server.ssMgr, config, "127.0.0.1:10001")
+	if _, err := server.ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.ThumbnailHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1/live/test.jpg", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d; want 503 without decoder", w.Code)
+	}
+}
+
+func (th *thumbnailer) hasKeyFrame() bool {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+
+	return th.fresh || th.jpeg != nil
+}
+
+func TestThumbnailDecodeNotBlockingIngest(t *testing.T) {
+	decoding, release := make(chan struct{}), make(chan struct{})
+	config := newTestConfig()
+	config.ThumbnailDecoder = func(seqHeader, keyFrame []byte) (image.Image, error) {
+		close(decoding)
+		<-release
+		return image.NewGray(image.Rect(0, 0, 16, 9)), nil
+	}
+	server := NewService(config)
+	c, _ := newTestConn(t, server.ssMgr, config, "127.0.0.1:10001")
+	ss, err := server.ssMgr.attachPublisher(newPublisher(c, "_defaultVhost_/live/test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoSeq, 0))
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 0))
+	for i := 0; i < 100 && !ss.thumb.hasKeyFrame(); i++ { // the monitor is asynchronous
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	served := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		server.ThumbnailHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1/live/test.jpg", nil))
+		served <- w.Code
+	}()
+	<-decoding
+
+	// keyframes keep flowing through the monitor while the decode is in flight
+	dispatched := make(chan struct{})
+	go func() {
+		for i := uint32(1); i <= 2000; i++ { // beyond the monitor queue
+			ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, i*40))
+		}
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ingest blocked by a thumbnail decode")
+	}
+
+	close(release)
+	if code := <-served; code != http.StatusOK {
+		t.Fatalf("got %d; want 200", code)
+	}
+}
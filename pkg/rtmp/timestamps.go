@@ -0,0 +1,73 @@
+package rtmp
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"playground/pkg/av"
+)
+
+// TimeStampPolicy tells what the publisher does with media not later than the previous one of its track
+type TimeStampPolicy int
+
+const (
+	TimeStampPass   TimeStampPolicy = iota // pass as is, not checked
+	TimeStampLog                           // pass as is, logged
+	TimeStampClamp                         // raised to the previous timestamp of the track, logged
+	TimeStampReject                        // dropped, logged
+)
+
+func (p TimeStampPolicy) String() string {
+	switch p {
+	case TimeStampPass:
+		return "Pass"
+	case TimeStampLog:
+		return "Log"
+	case TimeStampClamp:
+		return "Clamp"
+	case TimeStampReject:
+		return "Reject"
+	}
+	return "Unknown"
+}
+
+// tsTrack indexes the per track timestamp state of the publisher
+func tsTrack(pkt *av.Packet) int {
+	if pkt.IsVideo {
+		return 1
+	}
+	return 0
+}
+
+/*
+ * checkTimeStamp applies Config.NonIncreasingTimeStamps to pkt, false if it is to be dropped:
+ *   1. audio and video are checked apart, one may lag the other in an interleaved stream.
+ *   2. metadata and sequence headers aren't checked, nor do they move the previous timestamp.
+ *   3. a run of non-increasing timestamps, e.g. a looped source starting over, is logged once.
+ */
+func (p *publisher) checkTimeStamp(pkt *av.Packet) bool {
+	if (!pkt.IsAudio && !pkt.IsVideo) || isSeqHeader(pkt) {
+		return true
+	}
+
+	track := tsTrack(pkt)
+	last, seen := p.lastTimeStamp[track], p.seenTimeStamp[track]
+	if !seen || int32(pkt.TimeStamp-last) > 0 { // survives the 32 bit wrap
+		p.lastTimeStamp[track], p.seenTimeStamp[track] = pkt.TimeStamp, true
+		p.tsDisorder[track] = false
+		return true
+	}
+
+	if !p.tsDisorder[track] {
+		p.tsDisorder[track] = true
+		p.logger.WithFields(logrus.Fields{"event": "non-increasing timestamp", "streamKey": p.streamKey,
+			"video": pkt.IsVideo, "timeStamp": pkt.TimeStamp, "last": last, "policy": p.tsPolicy}).Warn("timestamp not after the previous one")
+	}
+
+	switch p.tsPolicy {
+	case TimeStampClamp:
+		pkt.TimeStamp = last
+	case TimeStampReject:
+		return false
+	}
+	return true
+}
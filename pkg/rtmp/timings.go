@@ -0,0 +1,45 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnTimings are QoE timings of a connection, a duration is 0 until its end happened
+type ConnTimings struct {
+	Handshake        time.Duration // start of the handshake to its completion
+	ConnectToPublish time.Duration // connect command to NetStream.Publish.Start
+	ConnectToMedia   time.Duration // connect command to the first media of a player written
+}
+
+// connTimings keeps unix nanos, written on the conn goroutine or the playing cycle, read by Stats
+type connTimings struct {
+	handshakeStart int64 // atomic
+	handshakeEnd   int64 // atomic
+	connect        int64 // atomic
+	publish        int64 // atomic
+	firstMedia     int64 // atomic
+}
+
+// markTime records now in t once, later calls keep the first
+func markTime(t *int64) {
+	atomic.CompareAndSwapInt64(t, 0, time.Now().UnixNano())
+}
+
+func elapsed(start, end *int64) time.Duration {
+	s, e := atomic.LoadInt64(start), atomic.LoadInt64(end)
+	if s == 0 || e == 0 {
+		return 0
+	}
+	return time.Duration(e - s)
+}
+
+// Timings returns the timings measured this far
+func (c *Conn) Timings() ConnTimings {
+	ct := &c.timings
+	return ConnTimings{
+		Handshake:        elapsed(&ct.handshakeStart, &ct.handshakeEnd),
+		ConnectToPublish: elapsed(&ct.connect, &ct.publish),
+		ConnectToMedia:   elapsed(&ct.connect, &ct.firstMedia),
+	}
+}
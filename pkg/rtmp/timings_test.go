@@ -0,0 +1,96 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gwuhaolin/livego/protocol/amf"
+)
+
+func TestConnTimings(t *testing.T) {
+	config := newTestConfig()
+	ssMgr := newStreamSourceMgr(config)
+	const pause = 20 * time.Millisecond
+
+	// serve runs a scripted client: handshake, connect, a pause, then the rest of cmds
+	serve := func(remote string, cmds ...[]interface{}) net.Conn {
+		c, peer := newTestConn(t, ssMgr, config, remote)
+		served := make(chan struct{})
+		go func() {
+			c.Serve()
+			close(served)
+		}()
+		t.Cleanup(func() { // a player waits on its stream, not on its conn
+			c.Close()
+			ssMgr.streamMap.Range(func(_, val interface{}) bool {
+				val.(*streamSource).Close()
+				return true
+			})
+			<-served // nothing may touch timeNow after the test
+		})
+		if s0s1s2 := <-simpleHandshakePeer(peer, 3); s0s1s2 == nil {
+			t.Fatal("handshake failed")
+		}
+		drainPeer(peer)
+
+		for i, args := range cmds {
+			if i == 1 {
+				time.Sleep(pause)
+			}
+			streamID := uint32(0)
+			if args[0] == "publish" || args[0] == "play" {
+				streamID = 1
+			}
+			if _, err := peer.Write(encodeTestMessage(3, 0, MsgAMF0CommandMessage, streamID, newTestCommandMessage(t, args...).ChunkBody, 128)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return peer
+	}
+	connect := []interface{}{"connect", 1.0, amf.Object{"app": "live", "tcUrl": "rtmp://example.com/live"}}
+
+	pubPeer := serve("127.0.0.1:10001", connect, []interface{}{"createStream", 2.0, nil}, []interface{}{"publish", 3.0, nil, "test", "live"})
+	waitStats := func(ok func(Stats) bool) Stats {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if stats := ssMgr.Stats(); ok(stats) {
+				return stats
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("timings not populated")
+		return Stats{}
+	}
+	stats := waitStats(func(st Stats) bool { return len(st.Streams) == 1 && st.Streams[0].PublisherTimings.ConnectToPublish > 0 })
+	pub := stats.Streams[0].PublisherTimings
+	if pub.Handshake <= 0 || pub.ConnectToPublish < pause || pub.ConnectToMedia != 0 {
+		t.Fatalf("got publisher %+v; want handshake, publish at least %v after connect, no media", pub, pause)
+	}
+
+	serve("127.0.0.1:10002", connect, []interface{}{"createStream", 2.0, nil}, []interface{}{"play", 3.0, nil, "test"})
+	waitStats(func(st Stats) bool { return len(st.Streams[0].SubscriberStats) == 1 })
+	time.Sleep(pause)
+	if _, err := pubPeer.Write(encodeTestMessage(6, 0, MsgVideoMessage, 1, testVideoKey, 128)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats = waitStats(func(st Stats) bool {
+		subs := st.Streams[0].SubscriberStats
+		return len(subs) == 1 && subs[0].Timings.ConnectToMedia > 0
+	})
+	player := stats.Streams[0].SubscriberStats[0].Timings
+	if player.Handshake <= 0 || player.ConnectToMedia < 2*pause || player.ConnectToPublish != 0 {
+		t.Fatalf("got player %+v; want handshake, first media at least %v after connect, no publish", player, 2*pause)
+	}
+
+	// first occurrences are kept, later media doesn't move them
+	if _, err := pubPeer.Write(encodeTestMessage(6, 40, MsgVideoMessage, 1, testVideoKey, 128)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(pause)
+	stats = ssMgr.Stats()
+	if got := stats.Streams[0].SubscriberStats[0].Timings; got != player || stats.Streams[0].PublisherTimings != pub {
+		t.Fatalf("got player %+v publisher %+v; want %+v %+v unchanged", got, stats.Streams[0].PublisherTimings, player, pub)
+	}
+}
@@ -0,0 +1,141 @@
+package rtmp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"playground/internal/websocket"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second // a stalled player fails its writes, the FLV sink doesn't wait on it
+)
+
+// WebSocketFLVHandler serves live streams as FLV over websocket for players like flv.js,
+// e.g. ws://host/live/test.flv?vhost=..., each FLV tag is sent as one binary frame
+func (s *Service) WebSocketFLVHandler() http.Handler {
+	return http.HandlerFunc(s.serveWebSocketFLV)
+}
+
+func (s *Service) serveWebSocketFLV(w http.ResponseWriter, r *http.Request) {
+	logger := s.config.Logger.WithFields(logrus.Fields{"event": "serveWebSocketFLV", "remote": r.RemoteAddr})
+
+	if s.IsDraining() {
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	streamKey, ok := parseFLVStreamKey(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	val, ok := s.ssMgr.streamMap.Load(streamKey)
+	if !ok {
+		logger.WithField("streamKey", streamKey).Error("stream not exists")
+		http.NotFound(w, r)
+		return
+	}
+	ss := val.(*streamSource)
+
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	defer ws.Close()
+	ws.SetWriteTimeout(wsWriteTimeout)
+
+	// a player, never hold the publisher back
+	sub := newPseudoSubscriber(subTypeWSPlay, r.RemoteAddr, s.config.Logger, 1024) //TODO: avQueueSize use config's value
+	sub.policy = dropPolicyDrop
+	sub.latencyBudget = s.config.LatencyBudget
+	sub.session = r.URL.Query().Get("session")
+	sub.closeConn = ws.Close
+	fs, err := ss.newFLVSink(ws, sub)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	defer fs.close()
+
+	if err := s.wsPlayingCycle(ws, fs); err != nil {
+		logger.Trace(err)
+	}
+}
+
+// wsPlayingCycle pushes queued packets until the client closes or a write fails
+func (s *Service) wsPlayingCycle(ws *websocket.Conn, fs *flvSink) error {
+	closed := make(chan error, 1)
+	go func() { // answers ping, detects client close
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-closed:
+			return err
+		case <-ticker.C:
+			if err := ws.WriteMessage(websocket.OpPing, nil); err != nil {
+				return err
+			}
+		case pkt := <-fs.sub.avPktQueue:
+			if err := fs.write(pkt); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseFLVStreamKey maps /{app}/{stream}.flv to stream key
+func parseFLVStreamKey(r *http.Request) (string, bool) {
+	return parseHTTPStreamKey(r, ".flv")
+}
+
+// parseHTTPStreamKey maps /{app}/{stream}{ext} to stream key
+func parseHTTPStreamKey(r *http.Request, ext string) (string, bool) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasSuffix(path, ext) {
+		return "", false
+	}
+	path = strings.TrimSuffix(path, ext)
+
+	idx := strings.LastIndex(path, "/")
+	if idx <= 0 || idx == len(path)-1 {
+		return "", false
+	}
+	return genStreamKey(httpVhost(r), path[:idx], path[idx+1:]), true
+}
+
+// httpVhost takes vhost from the vhost parameter, or the request host unless it's an ip, like tcUrl of rtmp
+func httpVhost(r *http.Request) string {
+	vhost := r.URL.Query().Get("vhost")
+	if vhost == "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			vhost = host
+		}
+	}
+	if vhost == "" {
+		vhost = defaultVhost
+	}
+
+	return vhost
+}
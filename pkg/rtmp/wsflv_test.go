@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"playground/internal/websocket"
+	"playground/pkg/av"
+)
+
+// dialTestWS completes the opening handshake to url path on srv
+func dialTestWS(t *testing.T, srv *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + conn.RemoteAddr().String() + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if accept := resp.Header.Get("Sec-Websocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" { // RFC 6455 1.3
+		t.Fatalf("got accept %s; want s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", accept)
+	}
+
+	return conn, br
+}
+
+// readTestWSFrame reads one unmasked server frame, payload < 64KB
+func readTestWSFrame(t *testing.T, conn net.Conn, br *bufio.Reader) (byte, []byte) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(hdr[1] & 0x7f)
+	if length == 126 {
+		var b [2]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(b[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0] & 0x0f, payload
+}
+
+// writeTestWSFrame writes one masked client frame, payload <= 125
+func writeTestWSFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	b := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSocketFLV(t *testing.T) {
+	server := NewService(newTestConfig())
+	streamKey := "_defaultVhost_/live/test"
+	pubConn, _ := newTestConn(t, server.ssMgr, server.config, "127.0.0.1:10001")
+	ss, err := server.ssMgr.attachPublisher(newPublisher(pubConn, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(server.WebSocketFLVHandler())
+	defer srv.Close()
+
+	conn, br := dialTestWS(t, srv, "/live/test.flv")
+	defer conn.Close()
+
+	op, payload := readTestWSFrame(t, conn, br)
+	wantHdr := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	if op != websocket.OpBinary || !bytes.Equal(payload, wantHdr) {
+		t.Fatalf("got frame op %d % x; want binary FLV header % x", op, payload, wantHdr)
+	}
+
+	// ping is answered with pong carrying the same payload
+	writeTestWSFrame(t, conn, websocket.OpPing, []byte("hi"))
+	if op, payload := readTestWSFrame(t, conn, br); op != websocket.OpPong || string(payload) != "hi" {
+		t.Fatalf("got frame op %d %q; want pong \"hi\"", op, payload)
+	}
+
+	// media is pushed as one tag per frame
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, true, testVideoKey, 1000))
+	op, payload = readTestWSFrame(t, conn, br)
+	if op != websocket.OpBinary || payload[0] != av.TagVideo {
+		t.Fatalf("got frame op %d tag type %d; want binary video tag", op, payload[0])
+	}
+	if dataSize := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3]); dataSize != len(testVideoKey) {
+		t.Fatalf("got tag data size %d; want %d", dataSize, len(testVideoKey))
+	}
+	if prev := binary.BigEndian.Uint32(payload[len(payload)-4:]); int(prev) != len(payload)-4 {
+		t.Fatalf("got PreviousTagSize %d; want %d", prev, len(payload)-4)
+	}
+
+	// client close is echoed and the subscriber removed
+	writeTestWSFrame(t, conn, websocket.OpClose, []byte{0x03, 0xe8})
+	if op, _ := readTestWSFrame(t, conn, br); op != websocket.OpClose {
+		t.Fatalf("got frame op %d; want close", op)
+	}
+
+	waitTestWSPlayerGone(t, ss)
+}
+
+// waitTestWSPlayerGone waits for the handler to remove its subscriber, the handler of a hijacked
+// connection outlives httptest.Server.Close
+func waitTestWSPlayerGone(t *testing.T, ss *streamSource) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		ss.addSubMux.Lock()
+		n := len(ss.subscribers)
+		ss.addSubMux.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("subscriber not removed after client close")
+}
+
+func TestParseFLVStreamKey(t *testing.T) {
+	var tests = []struct {
+		url       string
+		host      string
+		streamKey string
+		ok        bool
+	}{
+		{"/live/test.flv", "127.0.0.1:8080", "_defaultVhost_/live/test", true},
+		{"/live/test.flv", "example.com", "example.com/live/test", true},
+		{"/live/test.flv?vhost=foo.com", "127.0.0.1", "foo.com/live/test", true},
+		{"/live/test", "127.0.0.1", "", false},
+		{"/test.flv", "127.0.0.1", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		r.Host = tt.host
+		streamKey, ok := parseFLVStreamKey(r)
+		if ok != tt.ok || streamKey != tt.streamKey {
+			t.Fatalf("%s %s: got %s %v; want %s %v", tt.host, tt.url, streamKey, ok, tt.streamKey, tt.ok)
+		}
+	}
+}
+
+func TestWebSocketFLVAudioOnly(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(1600000000, 0)
+	timeNow = func() time.Time { return now }
+
+	server := NewService(newTestConfig())
+	streamKey := "_defaultVhost_/live/radio"
+	pubConn, _ := newTestConn(t, server.ssMgr, server.config, "127.0.0.1:10001")
+	ss, err := server.ssMgr.attachPublisher(newPublisher(pubConn, streamKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, pkt := range []*av.Packet{newTestAVPacket(t, false, testAudioSeq, 0), newTestAVPacket(t, false, testAudioRaw, 23)} {
+		if err := ss.updateStreamInfo(pkt); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	if info := ss.StreamInfo(); info.AudioOnly || info.VideoOnly {
+		t.Fatalf("got audio only %v video only %v before detect timeout; want undecided", info.AudioOnly, info.VideoOnly)
+	}
+
+	now = now.Add(defaultTrackDetectTimeout)
+	if info := ss.StreamInfo(); !info.AudioOnly || info.VideoOnly || info.HasVideo {
+		t.Fatalf("got %+v; want audio only", info)
+	}
+
+	srv := httptest.NewServer(server.WebSocketFLVHandler())
+	defer srv.Close()
+
+	conn, br := dialTestWS(t, srv, "/live/radio.flv")
+	defer conn.Close()
+
+	op, payload := readTestWSFrame(t, conn, br)
+	wantHdr := []byte{'F', 'L', 'V', 1, 0x04, 0, 0, 0, 9, 0, 0, 0, 0}
+	if op != websocket.OpBinary || !bytes.Equal(payload, wantHdr) {
+		t.Fatalf("got frame op %d % x; want audio only FLV header % x", op, payload, wantHdr)
+	}
+
+	ss.dispatchAVPacket(nil, newTestAVPacket(t, false, testAudioSeq, 0))
+	if op, payload = readTestWSFrame(t, conn, br); op != websocket.OpBinary || payload[0] != av.TagAudio {
+		t.Fatalf("got frame op %d tag type %d; want binary audio tag", op, payload[0])
+	}
+	if prev := binary.BigEndian.Uint32(payload[len(payload)-4:]); int(prev) != len(payload)-4 {
+		t.Fatalf("got PreviousTagSize %d; want %d", prev, len(payload)-4)
+	}
+
+	conn.Close()
+	waitTestWSPlayerGone(t, ss) // before timeNow is restored
+}